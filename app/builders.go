@@ -0,0 +1,293 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Policies for builders that are unknown or disabled in the registry
+const (
+	unknownBuildersReject = "reject" // Reject the bundle
+	unknownBuildersDrop   = "drop"   // Drop the builder from the bundle
+)
+
+// BuilderConfig represents a builder bundles can be addressed to.
+type BuilderConfig struct {
+	Name     string   `json:"name"`              // Canonical name of the builder
+	Aliases  []string `json:"aliases,omitempty"` // Alternative names accepted in the builders field
+	Priority int      `json:"priority"`          // Priority for the builder_priority ordering, higher is more important
+	Enabled  *bool    `json:"enabled,omitempty"` // Whether bundles can be addressed to the builder, defaults to true
+	GRPCURL  string   `json:"grpcUrl,omitempty"` // Optional bundle merger of the builder by gRPC URL or name, used by the builders dispatch mode
+}
+
+func (b *BuilderConfig) isEnabled() bool {
+	return b.Enabled == nil || *b.Enabled
+}
+
+// BuilderRegistryConfig represents the builder registry configuration file.
+type BuilderRegistryConfig struct {
+	UnknownBuilders string          `json:"unknownBuilders"` // Policy for unknown or disabled builders, reject or drop
+	Builders        []BuilderConfig `json:"builders"`        // Known builders
+}
+
+// defaultBuilderRegistryConfig is used if no configuration file is given
+var defaultBuilderRegistryConfig = BuilderRegistryConfig{
+	UnknownBuilders: unknownBuildersDrop,
+	Builders: []BuilderConfig{
+		{Name: "flashbots", Priority: 10},
+		{Name: "Titan", Priority: 20},
+	},
+}
+
+// BuilderRegistry holds the builders bundles can be addressed to.
+type BuilderRegistry struct {
+	builders        map[string]*BuilderConfig // Builders by canonical name
+	index           map[string]string         // Canonical name by lower-case name and alias
+	unknownBuilders string                    // Policy for unknown or disabled builders
+	mu              sync.RWMutex              // A mutex for concurrent access
+}
+
+// loadBuilderRegistry builds the builder registry from a JSON configuration file, or from
+// the default configuration if no file is given
+func loadBuilderRegistry(configPath string) (*BuilderRegistry, error) {
+	config := defaultBuilderRegistryConfig
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read builder config: %v", err)
+		}
+		config = BuilderRegistryConfig{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse builder config: %v", err)
+		}
+	}
+
+	return newBuilderRegistry(config)
+}
+
+func newBuilderRegistry(config BuilderRegistryConfig) (*BuilderRegistry, error) {
+	r := &BuilderRegistry{
+		builders:        make(map[string]*BuilderConfig),
+		index:           make(map[string]string),
+		unknownBuilders: config.UnknownBuilders,
+	}
+
+	switch r.unknownBuilders {
+	case "":
+		r.unknownBuilders = unknownBuildersDrop
+	case unknownBuildersReject, unknownBuildersDrop:
+	default:
+		return nil, fmt.Errorf("invalid unknownBuilders policy %q, expected %s or %s", config.UnknownBuilders, unknownBuildersReject, unknownBuildersDrop)
+	}
+
+	for i := range config.Builders {
+		if err := r.setLocked(config.Builders[i]); err != nil {
+			return nil, fmt.Errorf("builders[%d]: %v", i, err)
+		}
+	}
+
+	return r, nil
+}
+
+// set adds or updates a builder
+func (r *BuilderRegistry) set(builder BuilderConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.setLocked(builder)
+}
+
+func (r *BuilderRegistry) setLocked(builder BuilderConfig) error {
+	builder.Name = strings.TrimSpace(builder.Name)
+	if builder.Name == "" {
+		return fmt.Errorf("builder name is required")
+	}
+
+	// Names and aliases are unique across builders, case-insensitively
+	for _, name := range append([]string{builder.Name}, builder.Aliases...) {
+		if owner, exists := r.index[strings.ToLower(name)]; exists && owner != builder.Name {
+			return fmt.Errorf("name %q is already used by builder %q", name, owner)
+		}
+	}
+
+	r.removeLocked(builder.Name)
+	r.builders[builder.Name] = &builder
+	r.index[strings.ToLower(builder.Name)] = builder.Name
+	for _, alias := range builder.Aliases {
+		r.index[strings.ToLower(alias)] = builder.Name
+	}
+	return nil
+}
+
+// remove deletes a builder and reports whether it existed
+func (r *BuilderRegistry) remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.removeLocked(name)
+}
+
+func (r *BuilderRegistry) removeLocked(name string) bool {
+	builder, exists := r.builders[name]
+	if !exists {
+		return false
+	}
+
+	delete(r.builders, name)
+	for key, owner := range r.index {
+		if owner == builder.Name {
+			delete(r.index, key)
+		}
+	}
+	return true
+}
+
+// list returns copies of the builders ordered by name
+func (r *BuilderRegistry) list() []BuilderConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	builders := make([]BuilderConfig, 0, len(r.builders))
+	for _, builder := range r.builders {
+		builders = append(builders, *builder)
+	}
+	sort.Slice(builders, func(i, j int) bool { return builders[i].Name < builders[j].Name })
+	return builders
+}
+
+// resolve maps the requested builder names and aliases to the canonical names of enabled builders.
+// Unknown or disabled builders are rejected or dropped according to the registry policy, a bundle
+// whose builders were all dropped is rejected, as it would otherwise be sent to every builder.
+func (r *BuilderRegistry) resolve(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var resolved []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		var reason string
+		canonical, exists := r.index[strings.ToLower(strings.TrimSpace(name))]
+		switch {
+		case !exists:
+			reason = fmt.Sprintf("unknown builder %q", name)
+		case !r.builders[canonical].isEnabled():
+			reason = fmt.Sprintf("builder %q is disabled", name)
+		}
+
+		if reason != "" {
+			if r.unknownBuilders == unknownBuildersReject {
+				return nil, fmt.Errorf("%s", reason)
+			}
+			log.Debug().Str("builder", name).Msg("Dropping " + reason)
+			continue
+		}
+
+		if !seen[canonical] {
+			seen[canonical] = true
+			resolved = append(resolved, canonical)
+		}
+	}
+
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("none of the builders %s is available", strings.Join(names, ", "))
+	}
+	return resolved, nil
+}
+
+// priority returns the highest priority of the given builders, zero if none is known
+func (r *BuilderRegistry) priority(builders []string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	priority := 0 // Default to low priority
+	for _, name := range builders {
+		if builder, exists := r.builders[name]; exists {
+			priority = max(priority, builder.Priority)
+		}
+	}
+	return priority
+}
+
+// mergerRoutes returns the bundle mergers of the given builders that have one
+func (r *BuilderRegistry) mergerRoutes(builders []string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var routes []string
+	for _, name := range builders {
+		if builder, exists := r.builders[name]; exists && builder.GRPCURL != "" {
+			routes = append(routes, builder.GRPCURL)
+		}
+	}
+	return routes
+}
+
+// refreshBuilderPriorities recomputes the builder priorities of all pools after the builder registry changed
+func (c *ChainPools) refreshBuilderPriorities() {
+	for _, target := range c.targetList() {
+		target.Pool.refreshBuilderPriorities()
+	}
+}
+
+// handleAdminListBuilders lists the builders of the registry
+func handleAdminListBuilders(registry *BuilderRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		registry.mu.RLock()
+		unknownBuilders := registry.unknownBuilders
+		registry.mu.RUnlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"unknownBuilders": unknownBuilders,
+			"builders":        registry.list(),
+		})
+	}
+}
+
+// handleAdminSetBuilder adds or updates the builder named in the path and re-sorts the pools
+func handleAdminSetBuilder(registry *BuilderRegistry, pools *ChainPools) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var builder BuilderConfig
+		if err := c.ShouldBindJSON(&builder); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		builder.Name = c.Param("name")
+
+		if err := registry.set(builder); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		pools.refreshBuilderPriorities()
+
+		log.Info().Str("builder", builder.Name).Int("priority", builder.Priority).Bool("enabled", builder.isEnabled()).Msg("Builder updated")
+		c.JSON(http.StatusOK, builder)
+	}
+}
+
+// handleAdminDeleteBuilder removes the builder named in the path and re-sorts the pools
+func handleAdminDeleteBuilder(registry *BuilderRegistry, pools *ChainPools) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		if !registry.remove(name) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Builder not found"})
+			return
+		}
+		pools.refreshBuilderPriorities()
+
+		log.Info().Str("builder", name).Msg("Builder removed")
+		c.JSON(http.StatusOK, gin.H{"removed": name})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestBuilderRegistry returns a registry of flashbots, Titan with an alias and a disabled builder
+func newTestBuilderRegistry(t *testing.T, unknownBuilders string) *BuilderRegistry {
+	t.Helper()
+
+	disabled := false
+	registry, err := newBuilderRegistry(BuilderRegistryConfig{
+		UnknownBuilders: unknownBuilders,
+		Builders: []BuilderConfig{
+			{Name: "flashbots", Priority: 10},
+			{Name: "Titan", Aliases: []string{"titanbuilder"}, Priority: 20, GRPCURL: "titan-merger:50051"},
+			{Name: "paused", Priority: 30, Enabled: &disabled},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newBuilderRegistry() error = %v", err)
+	}
+	return registry
+}
+
+func TestBuilderRegistryResolve(t *testing.T) {
+	tests := []struct {
+		name            string
+		unknownBuilders string
+		builders        []string
+		want            string
+		wantErr         bool
+	}{
+		{"no builders", unknownBuildersReject, nil, "[]", false},
+		{"canonical names", unknownBuildersReject, []string{"flashbots", "Titan"}, "[flashbots Titan]", false},
+		{"aliases and case", unknownBuildersReject, []string{"FLASHBOTS", " TitanBuilder"}, "[flashbots Titan]", false},
+		{"duplicates", unknownBuildersReject, []string{"titan", "titanbuilder"}, "[Titan]", false},
+		{"unknown builder rejected", unknownBuildersReject, []string{"flashbots", "beaver"}, "", true},
+		{"disabled builder rejected", unknownBuildersReject, []string{"paused"}, "", true},
+		{"unknown builder dropped", unknownBuildersDrop, []string{"beaver", "flashbots"}, "[flashbots]", false},
+		{"disabled builder dropped", unknownBuildersDrop, []string{"paused", "titan"}, "[Titan]", false},
+		{"all builders dropped", unknownBuildersDrop, []string{"beaver", "paused"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := newTestBuilderRegistry(t, tt.unknownBuilders).resolve(tt.builders)
+			if (err != nil) != tt.wantErr || (!tt.wantErr && fmt.Sprint(resolved) != tt.want) {
+				t.Errorf("resolve() = %v, %v, want %s", resolved, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuilderRegistryPriorityAndRoutes(t *testing.T) {
+	registry := newTestBuilderRegistry(t, unknownBuildersDrop)
+
+	tests := []struct {
+		builders     []string
+		wantPriority int
+		wantRoutes   string
+	}{
+		{nil, 0, "[]"},
+		{[]string{"flashbots"}, 10, "[]"},
+		{[]string{"flashbots", "Titan"}, 20, "[titan-merger:50051]"},
+		{[]string{"unknown"}, 0, "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.builders), func(t *testing.T) {
+			if got := registry.priority(tt.builders); got != tt.wantPriority {
+				t.Errorf("priority() = %d, want %d", got, tt.wantPriority)
+			}
+			if got := fmt.Sprint(registry.mergerRoutes(tt.builders)); got != tt.wantRoutes {
+				t.Errorf("mergerRoutes() = %s, want %s", got, tt.wantRoutes)
+			}
+		})
+	}
+}
+
+func TestLoadBuilderRegistry(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		wantBuilders int
+		wantErr      bool
+	}{
+		{"default", "", 2, false},
+		{"config file", write("builders.json", `{"unknownBuilders":"reject","builders":[{"name":"beaver","priority":5}]}`), 1, false},
+		{"missing file", filepath.Join(dir, "missing.json"), 0, true},
+		{"invalid json", write("invalid.json", `{"builders":`), 0, true},
+		{"invalid policy", write("policy.json", `{"unknownBuilders":"ignore"}`), 0, true},
+		{"missing name", write("name.json", `{"builders":[{"priority":5}]}`), 0, true},
+		{"duplicate alias", write("alias.json", `{"builders":[{"name":"a"},{"name":"b","aliases":["A"]}]}`), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry, err := loadBuilderRegistry(tt.path)
+			if (err != nil) != tt.wantErr || (!tt.wantErr && len(registry.list()) != tt.wantBuilders) {
+				t.Errorf("loadBuilderRegistry() = %v, %v, want %d builders", registry, err, tt.wantBuilders)
+			}
+		})
+	}
+}
+
+func TestAdminBuilders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	registry := newTestBuilderRegistry(t, unknownBuildersDrop)
+	pools, err := newChainPools(ChainConfig{ChainIDs: []uint64{1}}, false, "127.0.0.1:50051", nil, 12*time.Second, func() *TxBundlePool {
+		return newTxBundlePool(orderingPolicies["builder_priority"], PoolLimits{}, conflictKeepHigher, defaultRetryPolicy, newBundleStatusTracker(0, nil), registry.priority)
+	})
+	if err != nil {
+		t.Fatalf("newChainPools() error = %v", err)
+	}
+	pool := pools.pools[1]
+	for i, builder := range []string{"flashbots", "Titan"} {
+		bundle := newTestBundle(uint64(i+1), builder, 10)
+		bundle.Builders = []string{builder}
+		mustAddBundle(t, pool, bundle, false)
+	}
+
+	router := gin.New()
+	router.GET("/builders", handleAdminListBuilders(registry))
+	router.PUT("/builders/:name", handleAdminSetBuilder(registry, pools))
+	router.DELETE("/builders/:name", handleAdminDeleteBuilder(registry, pools))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantFirst  string
+	}{
+		{"raise the priority", http.MethodPut, "/builders/flashbots", `{"priority":30}`, http.StatusOK, "flashbots"},
+		{"add a builder", http.MethodPut, "/builders/beaver", `{"aliases":["beaverbuild"],"priority":5}`, http.StatusOK, "flashbots"},
+		{"alias of another builder", http.MethodPut, "/builders/rsync", `{"aliases":["titanbuilder"]}`, http.StatusBadRequest, "flashbots"},
+		{"invalid body", http.MethodPut, "/builders/rsync", `{"priority":"high"}`, http.StatusBadRequest, "flashbots"},
+		{"remove a builder", http.MethodDelete, "/builders/flashbots", "", http.StatusOK, "Titan"},
+		{"remove an unknown builder", http.MethodDelete, "/builders/flashbots", "", http.StatusNotFound, "Titan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("%s %s returned status %d, want %d", tt.method, tt.path, recorder.Code, tt.wantStatus)
+			}
+
+			// The pool is re-sorted by the new priorities
+			if first := queuedBundles(pool, 1); len(first) != 1 || first[0].ReplacementUUID != tt.wantFirst {
+				t.Errorf("first bundle in dispatch order is %v, want %s", first, tt.wantFirst)
+			}
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/builders", nil))
+	var response struct {
+		UnknownBuilders string          `json:"unknownBuilders"`
+		Builders        []BuilderConfig `json:"builders"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if names := fmt.Sprint(builderNames(response.Builders)); response.UnknownBuilders != unknownBuildersDrop || names != "[Titan beaver paused]" {
+		t.Errorf("GET returned policy %s and builders %s, want drop and [Titan beaver paused]", response.UnknownBuilders, names)
+	}
+}
+
+func builderNames(builders []BuilderConfig) []string {
+	names := make([]string, len(builders))
+	for i, builder := range builders {
+		names[i] = builder.Name
+	}
+	return names
+}
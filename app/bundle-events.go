@@ -0,0 +1,123 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// bundleEventBufferSize is the number of events buffered per subscriber before events are dropped
+const bundleEventBufferSize = 256
+
+// BundleEvent represents a lifecycle event of a bundle pushed to subscribers.
+type BundleEvent struct {
+	ReplacementUUID string      `json:"replacementUuid"`  // UUID of the bundle
+	State           BundleState `json:"state"`            // State entered
+	Status          string      `json:"status,omitempty"` // Optional status text, e.g. from the bundle merger
+	Timestamp       time.Time   `json:"timestamp"`        // Time of the transition
+}
+
+// bundleEventSubscriber receives the bundle events of a single user.
+type bundleEventSubscriber struct {
+	username string           // Owner of the bundles the subscriber is interested in
+	events   chan BundleEvent // Buffered event channel
+}
+
+// BundleEventHub fans out bundle events to the subscribers of the bundle owner.
+type BundleEventHub struct {
+	subscribers map[string]map[*bundleEventSubscriber]struct{} // Subscribers by username
+	mu          sync.RWMutex                                   // A mutex for concurrent access
+}
+
+func newBundleEventHub() *BundleEventHub {
+	return &BundleEventHub{
+		subscribers: make(map[string]map[*bundleEventSubscriber]struct{}),
+	}
+}
+
+func (h *BundleEventHub) subscribe(username string) *bundleEventSubscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &bundleEventSubscriber{
+		username: username,
+		events:   make(chan BundleEvent, bundleEventBufferSize),
+	}
+	if h.subscribers[username] == nil {
+		h.subscribers[username] = make(map[*bundleEventSubscriber]struct{})
+	}
+	h.subscribers[username][sub] = struct{}{}
+
+	log.Debug().Str("username", username).Msg("Bundle event subscriber added")
+	return sub
+}
+
+func (h *BundleEventHub) unsubscribe(sub *bundleEventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers[sub.username], sub)
+	if len(h.subscribers[sub.username]) == 0 {
+		delete(h.subscribers, sub.username)
+	}
+
+	log.Debug().Str("username", sub.username).Msg("Bundle event subscriber removed")
+}
+
+// publish delivers an event to all subscribers of the given user without blocking
+func (h *BundleEventHub) publish(username string, event BundleEvent) {
+	if username == "" {
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers[username] {
+		select {
+		case sub.events <- event:
+		default:
+			log.Warn().Str("username", username).Str("uuid", event.ReplacementUUID).Msg("Bundle event subscriber too slow, dropping event")
+		}
+	}
+}
+
+// handleBundleEventsSSE streams the bundle events of the authenticated user as Server-Sent Events
+func handleBundleEventsSSE(hub *BundleEventHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.GetString("username")
+		sub := hub.subscribe(username)
+		defer hub.unsubscribe(sub)
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Header("Content-Type", "text/event-stream")
+
+		// Send the headers right away, so clients don't wait for the first event
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		// Send a keep-alive comment periodically, so proxies don't close idle streams
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case event := <-sub.events:
+				c.SSEvent("bundleEvent", event)
+				return true
+			case <-keepAlive.C:
+				_, err := w.Write([]byte(": keep-alive\n\n"))
+				return err == nil
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newBundleEventsTestServer serves the handler as the given user
+func newBundleEventsTestServer(t *testing.T, username string, handler gin.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) { c.Set("username", username) }, handler)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// waitForSubscriber waits until the user has a subscriber at the hub
+func waitForSubscriber(t *testing.T, hub *BundleEventHub, username string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		hub.mu.RLock()
+		subscribed := len(hub.subscribers[username]) > 0
+		hub.mu.RUnlock()
+		if subscribed {
+			return
+		}
+	}
+	t.Fatalf("no subscriber of %s", username)
+}
+
+func TestBundleEventHubScopesEventsToTheOwner(t *testing.T) {
+	hub := newBundleEventHub()
+	alice := hub.subscribe("alice")
+	bob := hub.subscribe("bob")
+	defer hub.unsubscribe(bob)
+
+	tracker := newBundleStatusTracker(time.Minute, hub)
+	tracker.setOwner("bundle", "alice")
+	tracker.record("bundle", BundleStateQueued, "")
+	tracker.record("anonymous", BundleStateQueued, "")
+
+	tests := []struct {
+		name string
+		sub  *bundleEventSubscriber
+		want []string
+	}{
+		{"owner", alice, []string{"bundle"}},
+		{"other user", bob, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for len(tt.sub.events) > 0 {
+				got = append(got, (<-tt.sub.events).ReplacementUUID)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("received events of %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Unsubscribed users receive nothing
+	hub.unsubscribe(alice)
+	tracker.record("bundle", BundleStateCancelled, "")
+	if len(alice.events) != 0 {
+		t.Errorf("unsubscribed user received %d events", len(alice.events))
+	}
+
+	// Slow subscribers drop events instead of blocking the pool
+	slow := hub.subscribe("alice")
+	defer hub.unsubscribe(slow)
+	for i := 0; i < bundleEventBufferSize+1; i++ {
+		tracker.record("bundle", BundleStateDispatched, "")
+	}
+	if len(slow.events) != bundleEventBufferSize {
+		t.Errorf("subscriber buffered %d events, want %d", len(slow.events), bundleEventBufferSize)
+	}
+}
+
+func TestBundleEventsSSE(t *testing.T) {
+	hub := newBundleEventHub()
+	server := newBundleEventsTestServer(t, "alice", handleBundleEventsSSE(hub))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	waitForSubscriber(t, hub, "alice")
+	hub.publish("bob", BundleEvent{ReplacementUUID: "other", State: BundleStateQueued})
+	hub.publish("alice", BundleEvent{ReplacementUUID: "bundle", State: BundleStateQueued})
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() && len(lines) < 2 {
+		if scanner.Text() != "" {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	if len(lines) != 2 || lines[0] != "event:bundleEvent" || !strings.Contains(lines[1], `"replacementUuid":"bundle"`) {
+		t.Errorf("SSE stream = %q, want the event of the bundle of alice", lines)
+	}
+}
@@ -0,0 +1,122 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"container/heap"
+)
+
+// bundleHeap is a binary heap of bundles that knows the position of each bundle, so bundles
+// can be removed or re-positioned in O(log n). A bundle can be in several heaps at once, each
+// heap keeps its position in a separate field of the bundle.
+type bundleHeap struct {
+	items []*TxPoolBundle
+	less  func(b1, b2 *TxPoolBundle) bool
+	index func(bundle *TxPoolBundle) *int // Position of the bundle in items, -1 if not in the heap
+}
+
+func newBundleHeap(less func(b1, b2 *TxPoolBundle) bool, index func(bundle *TxPoolBundle) *int) *bundleHeap {
+	return &bundleHeap{less: less, index: index}
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface, use the lower-case methods instead
+
+func (h *bundleHeap) Len() int { return len(h.items) }
+
+func (h *bundleHeap) Less(i, j int) bool { return h.less(h.items[i], h.items[j]) }
+
+func (h *bundleHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	*h.index(h.items[i]) = i
+	*h.index(h.items[j]) = j
+}
+
+func (h *bundleHeap) Push(x any) {
+	bundle := x.(*TxPoolBundle)
+	*h.index(bundle) = len(h.items)
+	h.items = append(h.items, bundle)
+}
+
+func (h *bundleHeap) Pop() any {
+	last := len(h.items) - 1
+	bundle := h.items[last]
+	h.items[last] = nil // Don't keep a reference to the removed bundle
+	h.items = h.items[:last]
+	*h.index(bundle) = -1
+	return bundle
+}
+
+// contains reports whether the bundle is in the heap
+func (h *bundleHeap) contains(bundle *TxPoolBundle) bool {
+	i := *h.index(bundle)
+	return i >= 0 && i < len(h.items) && h.items[i] == bundle
+}
+
+// push adds a bundle to the heap
+func (h *bundleHeap) push(bundle *TxPoolBundle) {
+	heap.Push(h, bundle)
+}
+
+// remove removes a bundle from the heap and reports whether it was in the heap
+func (h *bundleHeap) remove(bundle *TxPoolBundle) bool {
+	if !h.contains(bundle) {
+		return false
+	}
+	heap.Remove(h, *h.index(bundle))
+	return true
+}
+
+// peek returns the first bundle of the heap without removing it
+func (h *bundleHeap) peek() (*TxPoolBundle, bool) {
+	if len(h.items) == 0 {
+		return nil, false
+	}
+	return h.items[0], true
+}
+
+// reorder restores the heap order after the order of many bundles changed, in O(n)
+func (h *bundleHeap) reorder() {
+	heap.Init(h)
+}
+
+// walk visits the bundles in heap order without modifying the heap until visit returns false.
+// Visiting the first k bundles takes O(k log k), as only the frontier of the visited subtree
+// is kept in an auxiliary heap.
+func (h *bundleHeap) walk(visit func(bundle *TxPoolBundle) bool) {
+	if len(h.items) == 0 {
+		return
+	}
+
+	frontier := &heapFrontier{heap: h, positions: []int{0}}
+	for frontier.Len() > 0 {
+		i := heap.Pop(frontier).(int)
+		if !visit(h.items[i]) {
+			return
+		}
+		for child := 2*i + 1; child <= 2*i+2 && child < len(h.items); child++ {
+			heap.Push(frontier, child)
+		}
+	}
+}
+
+// heapFrontier is a heap of positions in a bundle heap, ordered like the bundles at these positions
+type heapFrontier struct {
+	heap      *bundleHeap
+	positions []int
+}
+
+func (f *heapFrontier) Len() int { return len(f.positions) }
+
+func (f *heapFrontier) Less(i, j int) bool { return f.heap.Less(f.positions[i], f.positions[j]) }
+
+func (f *heapFrontier) Swap(i, j int) {
+	f.positions[i], f.positions[j] = f.positions[j], f.positions[i]
+}
+
+func (f *heapFrontier) Push(x any) { f.positions = append(f.positions, x.(int)) }
+
+func (f *heapFrontier) Pop() any {
+	last := len(f.positions) - 1
+	position := f.positions[last]
+	f.positions = f.positions[:last]
+	return position
+}
@@ -0,0 +1,258 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+)
+
+// BundleState is a lifecycle state of a bundle.
+type BundleState string
+
+// Lifecycle states of a bundle
+const (
+	BundleStateReceived     BundleState = "received"      // Bundle passed validation at ingress
+	BundleStateQueued       BundleState = "queued"        // Bundle was added to the TxBundlePool
+	BundleStateDispatched   BundleState = "dispatched"    // Bundle was sent to the bundle merger
+	BundleStateAccepted     BundleState = "accepted"      // Bundle merger accepted the bundle
+	BundleStateRejected     BundleState = "rejected"      // Bundle merger rejected the bundle
+	BundleStateCancelled    BundleState = "cancelled"     // Bundle was canceled by the user
+	BundleStateReplaced     BundleState = "replaced"      // Bundle was replaced by a bundle with the same UUID
+	BundleStateExpired      BundleState = "expired"       // Bundle expired before it was accepted
+	BundleStateEvicted      BundleState = "evicted"       // Bundle was evicted from the full TxBundlePool
+	BundleStateDisplaced    BundleState = "displaced"     // Bundle was displaced by a conflicting bundle with a higher fee score
+	BundleStateDeadLettered BundleState = "dead_lettered" // Bundle exhausted its retry budget at the bundle merger
+	BundleStateRetargeted   BundleState = "retargeted"    // Bundle missed the cutoff of its target block and targets the next block
+	BundleStateIncluded     BundleState = "included"      // Transactions of the bundle were included in a block of the followed chain head
+)
+
+// maxBundleStatusHistory bounds the history per bundle, as dispatches can repeat
+const maxBundleStatusHistory = 64
+
+// BundleStatusEvent represents a single lifecycle transition of a bundle.
+type BundleStatusEvent struct {
+	State     BundleState `json:"state"`            // State entered
+	Timestamp time.Time   `json:"timestamp"`        // Time of the transition
+	Status    string      `json:"status,omitempty"` // Optional status text, e.g. from the bundle merger
+}
+
+// TargetResponse represents the latest answer of a bundle merger for a bundle.
+type TargetResponse struct {
+	Accepted  bool      `json:"accepted"`         // Whether the bundle merger accepted the bundle
+	Status    string    `json:"status,omitempty"` // Status text of the bundle merger
+	Responses int       `json:"responses"`        // Number of answers of the bundle merger
+	UpdatedAt time.Time `json:"updatedAt"`        // Time of the latest answer
+}
+
+// BundleStatus represents the lifecycle of a bundle identified by its replacement UUID.
+type BundleStatus struct {
+	ReplacementUUID string                     `json:"replacementUuid"`     // UUID of the bundle
+	State           BundleState                `json:"state"`               // Current state
+	Status          string                     `json:"status,omitempty"`    // Latest status text
+	UpdatedAt       time.Time                  `json:"updatedAt"`           // Time of the latest transition
+	RemovedAt       *time.Time                 `json:"removedAt,omitempty"` // Time the bundle left the pool
+	History         []BundleStatusEvent        `json:"history"`             // Transitions, oldest first
+	Targets         map[string]*TargetResponse `json:"targets,omitempty"`   // Answers by bundle merger name
+	username        string                     // Owner of the bundle, used to scope bundle events
+}
+
+// BundleStatusTracker records the lifecycle of bundles and retains it for a while after they left the pool.
+type BundleStatusTracker struct {
+	statuses  map[string]*BundleStatus // Lifecycle by replacement UUID
+	retention time.Duration            // How long to keep a status after the bundle left the pool
+	events    *BundleEventHub          // Optional hub the transitions are published to
+	mu        sync.RWMutex             // A mutex for concurrent access
+}
+
+func newBundleStatusTracker(retention time.Duration, events *BundleEventHub) *BundleStatusTracker {
+	return &BundleStatusTracker{
+		statuses:  make(map[string]*BundleStatus),
+		retention: retention,
+		events:    events,
+	}
+}
+
+// setOwner assigns the user that submitted the bundle with the given UUID. A retained status of
+// another user is replaced, so the new owner doesn't see the lifecycle of the previous bundle.
+func (t *BundleStatusTracker) setOwner(uuid string, username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status, exists := t.statuses[uuid]
+	if !exists || status.username != username {
+		status = &BundleStatus{ReplacementUUID: uuid}
+		t.statuses[uuid] = status
+	}
+	status.username = username
+}
+
+// record appends a lifecycle transition for the bundle with the given UUID
+func (t *BundleStatusTracker) record(uuid string, state BundleState, statusText string) {
+	t.recordAt(uuid, state, statusText, time.Now())
+}
+
+// recordAt appends a lifecycle transition that happened at the given time
+func (t *BundleStatusTracker) recordAt(uuid string, state BundleState, statusText string, at time.Time) {
+	username := t.appendTransition(uuid, state, statusText, at)
+
+	if t.events != nil {
+		t.events.publish(username, BundleEvent{
+			ReplacementUUID: uuid,
+			State:           state,
+			Status:          statusText,
+			Timestamp:       at,
+		})
+	}
+}
+
+// appendTransition updates the lifecycle of a bundle and returns the owner of the bundle
+func (t *BundleStatusTracker) appendTransition(uuid string, state BundleState, statusText string, at time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status, exists := t.statuses[uuid]
+	if !exists {
+		status = &BundleStatus{ReplacementUUID: uuid}
+		t.statuses[uuid] = status
+	}
+
+	// A bundle re-entering the pool, e.g. after a replacement, is tracked again
+	if state == BundleStateReceived || state == BundleStateQueued {
+		status.RemovedAt = nil
+	}
+	// The answers of the bundle mergers belong to the previous version or target block of the bundle
+	if state == BundleStateReceived || state == BundleStateRetargeted {
+		status.Targets = nil
+	}
+
+	status.State = state
+	status.Status = statusText
+	status.UpdatedAt = at
+	status.History = append(status.History, BundleStatusEvent{State: state, Timestamp: at, Status: statusText})
+	if len(status.History) > maxBundleStatusHistory {
+		status.History = status.History[len(status.History)-maxBundleStatusHistory:]
+	}
+
+	return status.username
+}
+
+// recordTargetResponse records the answer of a bundle merger for the bundle with the given UUID
+func (t *BundleStatusTracker) recordTargetResponse(uuid string, target string, accepted bool, statusText string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status, exists := t.statuses[uuid]
+	if !exists {
+		return
+	}
+	if status.Targets == nil {
+		status.Targets = make(map[string]*TargetResponse)
+	}
+
+	response, exists := status.Targets[target]
+	if !exists {
+		response = &TargetResponse{}
+		status.Targets[target] = response
+	}
+	response.Accepted = accepted
+	response.Status = statusText
+	response.Responses++
+	response.UpdatedAt = at
+}
+
+// markRemoved starts the retention period of a bundle that left the pool
+func (t *BundleStatusTracker) markRemoved(uuid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if status, exists := t.statuses[uuid]; exists && status.RemovedAt == nil {
+		now := time.Now()
+		status.RemovedAt = &now
+	}
+}
+
+// get returns a copy of the lifecycle of the bundle with the given UUID
+func (t *BundleStatusTracker) get(uuid string) (BundleStatus, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	status, exists := t.statuses[uuid]
+	if !exists {
+		return BundleStatus{}, false
+	}
+
+	statusCopy := *status
+	statusCopy.History = append([]BundleStatusEvent(nil), status.History...)
+	if status.Targets != nil {
+		statusCopy.Targets = make(map[string]*TargetResponse, len(status.Targets))
+		for target, response := range status.Targets {
+			responseCopy := *response
+			statusCopy.Targets[target] = &responseCopy
+		}
+	}
+	return statusCopy, true
+}
+
+func (t *BundleStatusTracker) cleanupExpiredStatuses() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for uuid, status := range t.statuses {
+		if status.RemovedAt != nil && now.Sub(*status.RemovedAt) > t.retention {
+			delete(t.statuses, uuid)
+		}
+	}
+}
+
+func (t *BundleStatusTracker) startCleanupJob(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			t.cleanupExpiredStatuses()
+		}
+	}()
+}
+
+// GetBundleStatusParams represents parameters for querying the status of a bundle.
+type GetBundleStatusParams struct {
+	ReplacementUUID string `json:"replacementUuid"` // UUID of the bundle to query
+}
+
+// registerBundleStatusMethods registers the bundle status JSON-RPC methods of the sequencer
+func registerBundleStatusMethods(registry *RPCRegistry, statusTracker *BundleStatusTracker) {
+	registry.register("prof_getBundleStatus", handleProfGetBundleStatus(statusTracker))
+}
+
+// Handle prof_getBundleStatus requests
+func handleProfGetBundleStatus(statusTracker *BundleStatusTracker) RPCMethod {
+	return func(ctx context.Context, rawParams json.RawMessage) (interface{}, error) {
+		tracer := otel.Tracer("prof-sequencer")
+		_, span := tracer.Start(ctx, "handleGetBundleStatusRequest")
+		defer span.End()
+
+		var params []GetBundleStatusParams
+		if err := decodeParams(rawParams, &params); err != nil {
+			return nil, err
+		}
+		if len(params) != 1 || params[0].ReplacementUUID == "" {
+			return nil, newRPCError(rpcErrInvalidParams, "Expected exactly one replacementUuid", nil)
+		}
+
+		// Users only see the statuses of their own bundles
+		status, exists := statusTracker.get(params[0].ReplacementUUID)
+		if !exists || status.username != usernameFromContext(ctx) {
+			log.Debug().Str("uuid", params[0].ReplacementUUID).Msg("Bundle status not found")
+			return nil, newRPCError(rpcErrServer, "Bundle not found", params[0].ReplacementUUID)
+		}
+
+		return status, nil
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// assertBundleStates checks the lifecycle history of the bundle with the given UUID
+func assertBundleStates(t *testing.T, tracker *BundleStatusTracker, uuid string, want ...BundleState) {
+	t.Helper()
+
+	status, exists := tracker.get(uuid)
+	if !exists {
+		t.Fatalf("no status for bundle %s", uuid)
+	}
+	if len(status.History) != len(want) {
+		t.Fatalf("bundle %s has %d transitions, want %d", uuid, len(status.History), len(want))
+	}
+	for i, state := range want {
+		if status.History[i].State != state {
+			t.Errorf("transition %d of bundle %s is %s, want %s", i, uuid, status.History[i].State, state)
+		}
+	}
+	if status.State != want[len(want)-1] {
+		t.Errorf("bundle %s has state %s, want %s", uuid, status.State, want[len(want)-1])
+	}
+}
+
+func TestBundleStatusLifecycle(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+	tracker := pool.statusTracker
+
+	mustAddBundle(t, pool, newTestBundle(1, "bundle", 10), false)
+	assertBundleStates(t, tracker, "bundle", BundleStateReceived, BundleStateQueued)
+
+	tracker.record("bundle", BundleStateDispatched, "merger")
+	tracker.recordTargetResponse("bundle", "merger", false, "too late", time.Now())
+	tracker.record("bundle", BundleStateRejected, "too late")
+	status, _ := tracker.get("bundle")
+	if response := status.Targets["merger"]; response == nil || response.Accepted || response.Status != "too late" || response.Responses != 1 {
+		t.Errorf("target response = %+v, want the rejection of the merger", response)
+	}
+
+	// A replacement starts a new version of the bundle, the answers of the bundle mergers are dropped
+	mustAddBundle(t, pool, newTestBundle(2, "bundle", 11), true)
+	assertBundleStates(t, tracker, "bundle", BundleStateReceived, BundleStateQueued, BundleStateDispatched, BundleStateRejected, BundleStateReplaced, BundleStateReceived, BundleStateQueued)
+	if status, _ := tracker.get("bundle"); status.Targets != nil {
+		t.Errorf("replaced bundle kept the target responses %v", status.Targets)
+	}
+
+	if err := pool.cancelBundleByUUID("bundle", ""); err != nil {
+		t.Fatalf("cancelBundleByUUID() error = %v", err)
+	}
+	pool.cleanupMarkedBundles()
+	status, _ = tracker.get("bundle")
+	if status.State != BundleStateCancelled || status.RemovedAt == nil {
+		t.Errorf("bundle has state %s and removal time %v, want cancelled and removed", status.State, status.RemovedAt)
+	}
+
+	// Returned statuses are copies
+	status.History[0].State = BundleStateExpired
+	if status, _ := tracker.get("bundle"); status.History[0].State != BundleStateReceived {
+		t.Errorf("get() returned the history of the tracker instead of a copy")
+	}
+}
+
+func TestBundleStatusHistoryIsBounded(t *testing.T) {
+	tracker := newBundleStatusTracker(0, nil)
+	for i := 0; i < maxBundleStatusHistory+10; i++ {
+		tracker.record("bundle", BundleStateDispatched, "")
+	}
+	tracker.record("bundle", BundleStateAccepted, "")
+
+	status, _ := tracker.get("bundle")
+	if len(status.History) != maxBundleStatusHistory || status.History[len(status.History)-1].State != BundleStateAccepted {
+		t.Errorf("history has %d transitions ending with %s, want the latest %d", len(status.History), status.History[len(status.History)-1].State, maxBundleStatusHistory)
+	}
+}
+
+func TestBundleStatusRetention(t *testing.T) {
+	tracker := newBundleStatusTracker(time.Minute, nil)
+	tracker.record("removed", BundleStateExpired, "")
+	tracker.record("retained", BundleStateExpired, "")
+	tracker.record("pooled", BundleStateQueued, "")
+	tracker.markRemoved("removed")
+	tracker.markRemoved("retained")
+
+	// Move the removal of a bundle before the retention period
+	removedAt := time.Now().Add(-2 * time.Minute)
+	tracker.statuses["removed"].RemovedAt = &removedAt
+
+	tracker.cleanupExpiredStatuses()
+	for uuid, want := range map[string]bool{"removed": false, "retained": true, "pooled": true} {
+		if _, exists := tracker.get(uuid); exists != want {
+			t.Errorf("status of bundle %s retained = %v, want %v", uuid, exists, want)
+		}
+	}
+
+	// A bundle re-entering the pool is retained again
+	tracker.record("retained", BundleStateQueued, "")
+	if status, _ := tracker.get("retained"); status.RemovedAt != nil {
+		t.Errorf("re-queued bundle kept its removal time")
+	}
+}
+
+func TestGetBundleStatus(t *testing.T) {
+	tracker := newBundleStatusTracker(time.Minute, nil)
+	tracker.setOwner("bundle", "alice")
+	tracker.record("bundle", BundleStateQueued, "")
+
+	registry := newRPCRegistry()
+	registerBundleStatusMethods(registry, tracker)
+
+	tests := []struct {
+		name      string
+		username  string
+		params    string
+		wantState BundleState
+		wantError string
+	}{
+		{"owner", "alice", `[{"replacementUuid":"bundle"}]`, BundleStateQueued, ""},
+		{"other user", "bob", `[{"replacementUuid":"bundle"}]`, "", `{"code":-32000,"message":"Bundle not found","data":"bundle"}`},
+		{"unknown bundle", "alice", `[{"replacementUuid":"missing"}]`, "", `{"code":-32000,"message":"Bundle not found","data":"missing"}`},
+		{"missing UUID", "alice", `[{}]`, "", `{"code":-32602,"message":"Expected exactly one replacementUuid"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response struct {
+				Result *BundleStatus   `json:"result"`
+				Error  json.RawMessage `json:"error"`
+			}
+			ctx := context.WithValue(context.Background(), usernameContextKey, tt.username)
+			body := `{"jsonrpc":"2.0","id":1,"method":"prof_getBundleStatus","params":` + tt.params + `}`
+			if err := json.Unmarshal([]byte(marshalRPC(t, processRPCPayload(ctx, registry, []byte(body)))), &response); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			if tt.wantError != "" {
+				if string(response.Error) != tt.wantError {
+					t.Errorf("prof_getBundleStatus error = %s, want %s", response.Error, tt.wantError)
+				}
+				return
+			}
+			if response.Result == nil || response.Result.ReplacementUUID != "bundle" || response.Result.State != tt.wantState {
+				t.Errorf("prof_getBundleStatus = %+v, want state %s", response.Result, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestBundleStatusOwnerChange(t *testing.T) {
+	hub := newBundleEventHub()
+	tracker := newBundleStatusTracker(time.Minute, hub)
+	tracker.setOwner("bundle", "alice")
+	tracker.record("bundle", BundleStateQueued, "")
+	tracker.record("bundle", BundleStateCancelled, "")
+
+	// A bundle of the same owner keeps its lifecycle
+	tracker.setOwner("bundle", "alice")
+	assertBundleStates(t, tracker, "bundle", BundleStateQueued, BundleStateCancelled)
+
+	// A bundle of another user under the retained UUID starts a new lifecycle
+	sub := hub.subscribe("alice")
+	defer hub.unsubscribe(sub)
+	tracker.setOwner("bundle", "bob")
+	tracker.record("bundle", BundleStateQueued, "")
+	assertBundleStates(t, tracker, "bundle", BundleStateQueued)
+	if status, _ := tracker.get("bundle"); status.username != "bob" {
+		t.Errorf("bundle is owned by %q, want bob", status.username)
+	}
+	select {
+	case event := <-sub.events:
+		t.Errorf("previous owner received the event %+v", event)
+	default:
+	}
+}
@@ -5,20 +5,47 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rlp"
 	pbBundleMerger "github.com/prof-project/prof-grpc/go/profpb"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
-// connectToGRPCServer connects to a gRPC server with optional TLS.
-func connectToGRPCServer(grpcURL string, useTLS bool) (*grpc.ClientConn, error) {
+// maxSendBackoff bounds the delay before the next send after failed sends
+const maxSendBackoff = 30 * time.Second
+
+// Define Prometheus metrics
+var (
+	sendErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bundle_merger_send_errors_total",
+			Help: "Total number of failed sends to a bundle merger by gRPC URL and status code",
+		},
+		[]string{"grpc_url", "code"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(sendErrorsCounter)
+}
+
+// connectToGRPCServer connects to a gRPC server, using TLS unless tlsConfig is nil.
+func connectToGRPCServer(grpcURL string, tlsConfig *tls.Config) (*grpc.ClientConn, error) {
 	log.Info().Str("grpc_url", grpcURL).Msg("Attempting to connect to gRPC server")
 
 	// Define custom backoff settings for reconnection attempts
@@ -30,11 +57,7 @@ func connectToGRPCServer(grpcURL string, useTLS bool) (*grpc.ClientConn, error)
 
 	var opts []grpc.DialOption
 
-	if useTLS {
-		// Create a tls.Config with InsecureSkipVerify set to true
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: true,
-		}
+	if tlsConfig != nil {
 		creds := credentials.NewTLS(tlsConfig)
 		opts = append(opts, grpc.WithTransportCredentials(creds))
 	} else {
@@ -56,23 +79,6 @@ func connectToGRPCServer(grpcURL string, useTLS bool) (*grpc.ClientConn, error)
 	return conn, nil
 }
 
-func processBundleCollectionResponse(txPool *TxBundlePool, res *pbBundleMerger.BundlesResponse) error {
-	// Process each bundle's response
-	for _, bundleRes := range res.BundleResponses {
-		if bundleRes.Success {
-			err := txPool.cancelBundleByUUID(bundleRes.ReplacementUuid)
-			if err != nil {
-				return err
-			}
-			log.Info().Str("uuid", bundleRes.ReplacementUuid).Str("status", bundleRes.Status).Msg("Bundle processed successfully")
-		} else {
-			log.Error().Str("uuid", bundleRes.ReplacementUuid).Str("status", bundleRes.Status).Msg("Bundle processing failed")
-		}
-	}
-
-	return nil
-}
-
 func serializeTransactions(transactions []*types.Transaction) []*pbBundleMerger.BundleTransaction {
 	var serialized []*pbBundleMerger.BundleTransaction
 	for _, tx := range transactions {
@@ -89,10 +95,17 @@ func serializeTransactions(transactions []*types.Transaction) []*pbBundleMerger.
 func convertToGRPCBundles(bundles []*TxPoolBundle) []*pbBundleMerger.Bundle {
 	var grpcBundles []*pbBundleMerger.Bundle
 	for _, bundle := range bundles {
+		// ToDo: accept refunds, refund recipients and privacy hints in mev_sendBundle once the Bundle message can carry them
+		// A bundle with a block range is dispatched for the upcoming block, the Bundle message has a single block
+		blockNumber := bundle.BlockNumber
+		if bundle.MaxBlockNumber != "" && bundle.dispatchBlock > 0 {
+			blockNumber = hexutil.EncodeUint64(bundle.dispatchBlock)
+		}
+
 		grpcBundles = append(grpcBundles, &pbBundleMerger.Bundle{
 			Transactions:      serializeTransactions(bundle.Txs),
 			ReplacementUuid:   bundle.ReplacementUUID,
-			BlockNumber:       bundle.BlockNumber,
+			BlockNumber:       blockNumber,
 			MinTimestamp:      bundle.MinTimestamp,
 			MaxTimestamp:      bundle.MaxTimestamp,
 			RevertingTxHashes: bundle.RevertingTxHashes,
@@ -102,59 +115,294 @@ func convertToGRPCBundles(bundles []*TxPoolBundle) []*pbBundleMerger.Bundle {
 	return grpcBundles
 }
 
-func sendBundles(client pbBundleMerger.BundleServiceClient, txPool *TxBundlePool, bundleLimit int) {
+// bundleSender dispatches the bundles of a pool to the bundle mergers serving its chains, according to
+// the dispatch mode. Failed sends back off per bundle merger, bundles that can't reach any bundle
+// merger stay in the pool, which keeps accepting bundles meanwhile.
+type bundleSender struct {
+	txPool      *TxBundlePool                    // Pool the bundles are leased from
+	mergers     []*mergerTarget                  // Bundle mergers serving the chains of the pool, by descending weight
+	mode        string                           // Dispatch mode, see the dispatch constants
+	routes      func(builders []string) []string // Bundle mergers of the given builders by gRPC URL or name, used by the builders mode
+	bundleLimit int                              // Maximum number of bundles per send
+	credits     map[*mergerTarget]int            // Smooth weighted round-robin state of the builders mode
+}
+
+// mergerBatch is the part of a dispatch sent to a single bundle merger.
+type mergerBatch struct {
+	merger  *mergerTarget
+	bundles []*TxPoolBundle
+}
+
+// isRetryableCode reports whether a failed send points to an unavailable or overloaded bundle merger
+// and may succeed when repeated. Bundles of other codes are nacked.
+func isRetryableCode(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// isRefusalCode reports whether a failed send points to a request the bundle merger refuses for its
+// content. Other codes point to a fault of the bundle merger and count toward its circuit breaker.
+func isRefusalCode(code codes.Code) bool {
+	switch code {
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendBackoff returns the delay before the next send after the given number of consecutive failures,
+// doubled by every failure up to maxSendBackoff, with jitter over its upper half
+func sendBackoff(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 1; i < failures && delay < maxSendBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxSendBackoff)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// sendBundles leases the eligible bundles, sends them to their bundle mergers and settles them in the
+// pool. It returns the number of bundles sent.
+func (s *bundleSender) sendBundles(now time.Time) int {
+	ready := make(map[*mergerTarget]bool)
+	anyReady := false
+	for _, merger := range s.mergers {
+		ready[merger] = merger.ready(now)
+		anyReady = anyReady || ready[merger]
+	}
+	if !anyReady {
+		return 0 // Every bundle merger is backing off or its circuit is open
+	}
+
+	// Lease a batch of bundles ready for processing, they aren't dispatched again until they are nacked
+	bundles := s.txPool.leaseBundles(s.bundleLimit, now)
+	if len(bundles) == 0 {
+		return 0 // No bundles to process, skip this iteration
+	}
+
+	batches, required, deliveries := s.plan(bundles, ready)
+	var sent []*TxPoolBundle
+	seen := make(bundleSet)
+	for _, batch := range batches {
+		for _, bundle := range batch.bundles {
+			if _, exists := seen[bundle]; !exists {
+				seen[bundle] = struct{}{}
+				sent = append(sent, bundle)
+			}
+		}
+	}
+	s.txPool.observeDispatch(sent, now)
+
+	// Send the batches in parallel, the pool settles the bundles once every bundle merger answered
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, batch := range batches {
+		wg.Add(1)
+		go func(batch mergerBatch) {
+			defer wg.Done()
+			batchDeliveries := s.send(batch, now)
+
+			mu.Lock()
+			deliveries = append(deliveries, batchDeliveries...)
+			mu.Unlock()
+		}(batch)
+	}
+	wg.Wait()
+
+	s.txPool.settleDeliveries(deliveries, required, now)
+	return len(sent)
+}
+
+// plan assigns the leased bundles to the bundle mergers. It returns the batches of the ready bundle
+// mergers, the bundle mergers that have to accept each bundle and failed deliveries for the required
+// bundle mergers that aren't ready, which release the bundle unless another bundle merger answers.
+func (s *bundleSender) plan(bundles []*TxPoolBundle, ready map[*mergerTarget]bool) ([]mergerBatch, map[*TxPoolBundle][]string, []delivery) {
+	required := make(map[*TxPoolBundle][]string)
+	byMerger := make(map[*mergerTarget][]*TxPoolBundle)
+	var deferred []delivery
+
+	for _, bundle := range bundles {
+		serving := mergersFor(s.mergers, []uint64{bundle.ChainID})
+		if len(serving) == 0 {
+			log.Error().Str("uuid", bundle.ReplacementUUID).Uint64("chain_id", bundle.ChainID).Msg("No bundle merger serves the chain of the bundle")
+			deferred = append(deferred, delivery{bundle: bundle, outcome: deliveryFailed})
+			continue
+		}
+
+		var targets []*mergerTarget
+		switch s.mode {
+		case dispatchFanout:
+			targets = serving
+		case dispatchBuilders:
+			targets = s.routed(bundle, serving)
+			if len(targets) == 0 {
+				targets = s.pickWeighted(serving, ready)
+			}
+		default:
+			targets = s.pickFirstReady(serving, ready)
+		}
+
+		for _, merger := range targets {
+			name := merger.config.Name
+			required[bundle] = append(required[bundle], name)
+			switch {
+			case bundle.acceptedBy[name]:
+			case ready[merger]:
+				byMerger[merger] = append(byMerger[merger], bundle)
+			default:
+				deferred = append(deferred, delivery{bundle: bundle, merger: name, outcome: deliveryFailed})
+			}
+		}
+	}
+
+	var batches []mergerBatch
+	for _, merger := range s.mergers {
+		if len(byMerger[merger]) > 0 {
+			batches = append(batches, mergerBatch{merger: merger, bundles: byMerger[merger]})
+		}
+	}
+	return batches, required, deferred
+}
+
+// pickFirstReady returns the ready bundle merger with the highest weight, or the one with the
+// highest weight if none is ready
+func (s *bundleSender) pickFirstReady(serving []*mergerTarget, ready map[*mergerTarget]bool) []*mergerTarget {
+	for _, merger := range serving {
+		if ready[merger] {
+			return []*mergerTarget{merger}
+		}
+	}
+	return serving[:1]
+}
+
+// routed returns the bundle mergers of the builders of a bundle
+func (s *bundleSender) routed(bundle *TxPoolBundle, serving []*mergerTarget) []*mergerTarget {
+	if s.routes == nil || len(bundle.Builders) == 0 {
+		return nil
+	}
+
+	var targets []*mergerTarget
+	for _, route := range s.routes(bundle.Builders) {
+		for _, merger := range serving {
+			if (merger.config.GRPCURL == route || merger.config.Name == route) && !slices.Contains(targets, merger) {
+				targets = append(targets, merger)
+			}
+		}
+	}
+	return targets
+}
+
+// pickWeighted picks one of the ready bundle mergers by smooth weighted round-robin, so each receives
+// a share of the bundles proportional to its weight, or the one with the highest weight if none is ready
+func (s *bundleSender) pickWeighted(serving []*mergerTarget, ready map[*mergerTarget]bool) []*mergerTarget {
+	if s.credits == nil {
+		s.credits = make(map[*mergerTarget]int)
+	}
+
+	var picked *mergerTarget
+	total := 0
+	for _, merger := range serving {
+		if !ready[merger] {
+			continue
+		}
+		total += merger.config.Weight
+		s.credits[merger] += merger.config.Weight
+		if picked == nil || s.credits[merger] > s.credits[picked] {
+			picked = merger
+		}
+	}
+	if picked == nil {
+		return serving[:1]
+	}
+	s.credits[picked] -= total
+	return []*mergerTarget{picked}
+}
+
+// send dispatches a batch to its bundle merger and returns the outcome per bundle
+func (s *bundleSender) send(batch mergerBatch, now time.Time) []delivery {
+	merger := batch.merger
+	deliveries := func(outcome string, status string) []delivery {
+		result := make([]delivery, 0, len(batch.bundles))
+		for _, bundle := range batch.bundles {
+			result = append(result, delivery{bundle: bundle, merger: merger.config.Name, outcome: outcome, status: status})
+		}
+		return result
+	}
+	if !merger.allow(now) {
+		return deliveries(deliveryFailed, "")
+	}
+
 	// Create a context with a timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Retrieve a batch of bundles ready for processing
-	bundles := txPool.getBundlesForProcessing(bundleLimit, false)
-	if len(bundles) == 0 {
-		return // No bundles to process, skip this iteration
+	req := &pbBundleMerger.BundlesRequest{
+		Bundles: convertToGRPCBundles(batch.bundles),
 	}
 
-	req := &pbBundleMerger.BundlesRequest{
-		Bundles: convertToGRPCBundles(bundles),
+	for _, bundle := range batch.bundles {
+		s.txPool.statusTracker.record(bundle.ReplacementUUID, BundleStateDispatched, merger.config.Name)
 	}
 
 	// Send the request and receive the response
-	resp, err := client.SendBundleCollections(ctx, req)
+	resp, err := merger.client.SendBundleCollections(ctx, req)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to send bundles")
+		code := status.Code(err)
+		sendErrorsCounter.WithLabelValues(merger.config.GRPCURL, code.String()).Inc()
+
+		// Bundles of a retryable failure are released without counting the attempt and the bundle merger
+		// backs off. Other bundles are nacked, a fault of the bundle merger also counts as its failure,
+		// while a refused request leaves its health unchanged.
+		if isRetryableCode(code) {
+			delay := merger.failed(err, now)
+			log.Error().Err(err).Str("merger", merger.config.Name).Str("code", code.String()).Dur("backoff", delay).Int("bundles", len(batch.bundles)).Msg("Failed to send bundles")
+			return deliveries(deliveryFailed, err.Error())
+		}
+		if isRefusalCode(code) {
+			merger.refused()
+			log.Error().Err(err).Str("merger", merger.config.Name).Str("code", code.String()).Int("bundles", len(batch.bundles)).Msg("Bundle merger refused the bundles")
+			return deliveries(deliveryRejected, "bundle merger refused the request: "+code.String())
+		}
+		delay := merger.failed(err, now)
+		log.Error().Err(err).Str("merger", merger.config.Name).Str("code", code.String()).Dur("backoff", delay).Int("bundles", len(batch.bundles)).Msg("Bundle merger failed the bundles")
+		return deliveries(deliveryRejected, "bundle merger failed the request: "+code.String())
 	}
+	merger.succeeded()
 
-	// Process the response
+	// Bundles the response doesn't mention stay leased until their lease expires
+	byUUID := make(map[string]*TxPoolBundle, len(batch.bundles))
+	for _, bundle := range batch.bundles {
+		byUUID[bundle.ReplacementUUID] = bundle
+	}
+	var result []delivery
 	for i, bundleResp := range resp.BundleResponses {
 		log.Info().
 			Int("index", i+1).
+			Str("merger", merger.config.Name).
 			Str("uuid", bundleResp.ReplacementUuid).
 			Str("status", bundleResp.Status).
 			Bool("success", bundleResp.Success).
 			Msg("Bundle response received")
-	}
 
-	err = processBundleCollectionResponse(txPool, resp)
-	if err != nil {
-		log.Error().Err(err).Msg("Error processing responses")
-	}
-
-	log.Info().Int("bundles_sent", len(bundles)).Msg("Bundles sent via gRPC")
-}
-
-func startPeriodicBundleSender(txPool *TxBundlePool, interval time.Duration, bundleLimit int, grpcURL string, useTLS bool) {
-	// Attempt to connect to the gRPC server
-	conn, err := connectToGRPCServer(grpcURL, useTLS)
-	if err != nil {
-		log.Fatal().Err(err).Str("grpc_url", grpcURL).Msg("Failed to connect to gRPC server")
+		bundle, exists := byUUID[bundleResp.ReplacementUuid]
+		if !exists {
+			log.Error().Str("merger", merger.config.Name).Str("uuid", bundleResp.ReplacementUuid).Msg("Response for a bundle that wasn't sent")
+			continue
+		}
+		outcome := deliveryRejected
+		if bundleResp.Success {
+			outcome = deliveryAccepted
+		}
+		result = append(result, delivery{bundle: bundle, merger: merger.config.Name, outcome: outcome, status: bundleResp.Status})
 	}
-	defer conn.Close()
 
-	client := pbBundleMerger.NewBundleServiceClient(conn)
-
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		sendBundles(client, txPool, bundleLimit)
-	}
+	log.Info().Str("merger", merger.config.Name).Int("bundles_sent", len(batch.bundles)).Msg("Bundles sent via gRPC")
+	return result
 }
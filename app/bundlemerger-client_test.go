@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	pbBundleMerger "github.com/prof-project/prof-grpc/go/profpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeMergerClient answers sends with the queued errors, then accepts all bundles unless it rejects them
+type fakeMergerClient struct {
+	pbBundleMerger.BundleServiceClient
+	errs    []error
+	rejects bool
+	calls   int
+	uuids   []string
+	blocks  []string
+}
+
+func (c *fakeMergerClient) SendBundleCollections(ctx context.Context, in *pbBundleMerger.BundlesRequest, opts ...grpc.CallOption) (*pbBundleMerger.BundlesResponse, error) {
+	c.calls++
+	for _, bundle := range in.Bundles {
+		c.uuids = append(c.uuids, bundle.ReplacementUuid)
+		c.blocks = append(c.blocks, bundle.BlockNumber)
+	}
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+
+	resp := &pbBundleMerger.BundlesResponse{}
+	for _, bundle := range in.Bundles {
+		if c.rejects {
+			resp.BundleResponses = append(resp.BundleResponses, &pbBundleMerger.BundleResponse{ReplacementUuid: bundle.ReplacementUuid, Success: false, Status: "simulation failed"})
+			continue
+		}
+		resp.BundleResponses = append(resp.BundleResponses, &pbBundleMerger.BundleResponse{ReplacementUuid: bundle.ReplacementUuid, Success: true, Status: "included"})
+	}
+	return resp, nil
+}
+
+func newTestMerger(name string, weight int, client *fakeMergerClient) *mergerTarget {
+	return &mergerTarget{
+		config:   MergerConfig{Name: name, GRPCURL: name + ":50051", Weight: weight},
+		client:   client,
+		breaker:  newCircuitBreaker(name+":50051", BreakerConfig{Threshold: 2, Cooldown: time.Minute}),
+		interval: time.Second,
+	}
+}
+
+func newTestSender(client *fakeMergerClient, pool *TxBundlePool) *bundleSender {
+	return &bundleSender{
+		txPool:      pool,
+		mergers:     []*mergerTarget{newTestMerger("merger", 1, client)},
+		mode:        dispatchFailover,
+		bundleLimit: 10,
+	}
+}
+
+func TestSendBackoff(t *testing.T) {
+	for failures, upper := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 10: maxSendBackoff} {
+		if delay := sendBackoff(time.Second, failures); delay < upper/2 || delay > upper {
+			t.Errorf("sendBackoff(%d) = %v, want between %v and %v", failures, delay, upper/2, upper)
+		}
+	}
+}
+
+func TestSenderOpensCircuitOnRetryableErrors(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	client := &fakeMergerClient{errs: []error{unavailable, unavailable, unavailable}}
+	pool := newTestPool(orderingPolicies["block_number"])
+	sender := newTestSender(client, pool)
+	mustAddBundle(t, pool, newTestBundle(1, "bundle", 10), false)
+	now := time.Now()
+
+	// Retryable failures release the bundles without counting the attempt and back off
+	sender.sendBundles(now)
+	if bundle, _ := pool.getBundleByUUID("bundle"); bundle.attempts != 0 || !bundle.leasedUntil.IsZero() {
+		t.Fatalf("bundle has %d attempts and lease %v after a retryable failure, want released", bundle.attempts, bundle.leasedUntil)
+	}
+	sender.sendBundles(now.Add(500 * time.Millisecond))
+	if client.calls != 1 {
+		t.Fatalf("got %d sends during the backoff, want 1", client.calls)
+	}
+
+	// The threshold opens the circuit, no bundles are sent until the cooldown elapsed
+	sender.sendBundles(now.Add(2 * time.Second))
+	if view := sender.mergers[0].breaker.view(); view.State != circuitOpen {
+		t.Fatalf("circuit is %s after %d failures, want open", view.State, view.ConsecutiveFailures)
+	}
+	sender.sendBundles(now.Add(30 * time.Second))
+	if client.calls != 2 {
+		t.Fatalf("got %d sends while the circuit is open, want 2", client.calls)
+	}
+
+	// A failed trial re-opens the circuit, a successful one closes it
+	sender.sendBundles(now.Add(2*time.Minute + 5*time.Second))
+	if view := sender.mergers[0].breaker.view(); view.State != circuitOpen || client.calls != 3 {
+		t.Fatalf("circuit is %s after %d sends, want open after a failed trial", view.State, client.calls)
+	}
+	sender.sendBundles(now.Add(4 * time.Minute))
+	if view := sender.mergers[0].breaker.view(); view.State != circuitClosed {
+		t.Fatalf("circuit is %s after a successful trial, want closed", view.State)
+	}
+	assertPending(t, pool, map[string]bool{"bundle": false})
+}
+
+func TestIsRefusalCode(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		want bool
+	}{
+		{codes.InvalidArgument, true},
+		{codes.FailedPrecondition, true},
+		{codes.Internal, false},
+		{codes.Unknown, false},
+		{codes.Unimplemented, false},
+		{codes.Aborted, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code.String(), func(t *testing.T) {
+			if got := isRefusalCode(tt.code); got != tt.want {
+				t.Errorf("isRefusalCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsRetryableCode(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		want bool
+	}{
+		{codes.Unavailable, true},
+		{codes.DeadlineExceeded, true},
+		{codes.ResourceExhausted, true},
+		{codes.InvalidArgument, false},
+		{codes.Aborted, false},
+		{codes.Canceled, false},
+		{codes.Internal, false},
+		{codes.Unknown, false},
+		{codes.Unimplemented, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code.String(), func(t *testing.T) {
+			if got := isRetryableCode(tt.code); got != tt.want {
+				t.Errorf("isRetryableCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSenderNacksRefusedRequests(t *testing.T) {
+	for _, code := range []codes.Code{codes.InvalidArgument, codes.FailedPrecondition} {
+		t.Run(code.String(), func(t *testing.T) {
+			client := &fakeMergerClient{errs: []error{status.Error(code, "refused")}}
+			pool := newTestPool(orderingPolicies["block_number"])
+			sender := newTestSender(client, pool)
+			mustAddBundle(t, pool, newTestBundle(1, "bundle", 10), false)
+			now := time.Now()
+
+			sender.sendBundles(now)
+			bundle, _ := pool.getBundleByUUID("bundle")
+			if bundle.attempts != 1 || bundle.retryAt.IsZero() {
+				t.Errorf("bundle has %d attempts and retry time %v, want nacked", bundle.attempts, bundle.retryAt)
+			}
+			if status, _ := pool.statusTracker.get("bundle"); status.State != BundleStateRejected {
+				t.Errorf("bundle has state %s, want %s", status.State, BundleStateRejected)
+			}
+
+			// The bundle merger refused the request, it neither backs off nor counts a failure
+			merger := sender.mergers[0]
+			if view := merger.breaker.view(); view.ConsecutiveFailures != 0 || merger.failures != 0 || !merger.allow(now) {
+				t.Errorf("bundle merger has %d breaker and %d send failures, want none", view.ConsecutiveFailures, merger.failures)
+			}
+		})
+	}
+}
+
+func TestSenderCountsMergerFaults(t *testing.T) {
+	for _, code := range []codes.Code{codes.Internal, codes.Unknown, codes.Unimplemented, codes.Aborted} {
+		t.Run(code.String(), func(t *testing.T) {
+			fault := status.Error(code, "fault")
+			client := &fakeMergerClient{errs: []error{fault, fault}}
+			pool := newTestPool(orderingPolicies["block_number"])
+			sender := newTestSender(client, pool)
+			mustAddBundle(t, pool, newTestBundle(1, "bundle", 10), false)
+			now := time.Now()
+
+			// The bundles are nacked and the bundle merger backs off
+			sender.sendBundles(now)
+			bundle, _ := pool.getBundleByUUID("bundle")
+			if bundle.attempts != 1 || bundle.retryAt.IsZero() {
+				t.Errorf("bundle has %d attempts and retry time %v, want nacked", bundle.attempts, bundle.retryAt)
+			}
+			merger := sender.mergers[0]
+			if view := merger.breaker.view(); view.ConsecutiveFailures != 1 || merger.failures != 1 || merger.allow(now) {
+				t.Errorf("bundle merger has %d breaker and %d send failures, want 1 and a backoff", view.ConsecutiveFailures, merger.failures)
+			}
+
+			// Repeated faults open the circuit
+			sender.sendBundles(now.Add(5 * time.Second))
+			if view := merger.breaker.view(); view.State != circuitOpen {
+				t.Errorf("circuit is %s after %d faults, want open", view.State, view.ConsecutiveFailures)
+			}
+		})
+	}
+}
+
+func TestSenderClosesCircuitOnRefusedTrial(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	client := &fakeMergerClient{errs: []error{unavailable, unavailable, status.Error(codes.InvalidArgument, "refused")}}
+	pool := newTestPool(orderingPolicies["block_number"])
+	sender := newTestSender(client, pool)
+	mustAddBundle(t, pool, newTestBundle(1, "bundle", 10), false)
+	now := time.Now()
+
+	sender.sendBundles(now)
+	sender.sendBundles(now.Add(5 * time.Second))
+	if view := sender.mergers[0].breaker.view(); view.State != circuitOpen {
+		t.Fatalf("circuit is %s, want open", view.State)
+	}
+
+	// The bundle merger answered the trial, so the circuit doesn't stay half-open
+	sender.sendBundles(now.Add(2 * time.Minute))
+	if view := sender.mergers[0].breaker.view(); view.State != circuitClosed || client.calls != 3 {
+		t.Errorf("circuit is %s after %d sends, want closed after a refused trial", view.State, client.calls)
+	}
+}
+
+func TestSenderDispatchesRangedBundlesPerBlock(t *testing.T) {
+	client := &fakeMergerClient{}
+	pool := newTestPool(orderingPolicies["block_number"])
+	next := NextBlock{Number: 10}
+	pool.nextBlock = func(uint64) NextBlock { return next }
+	sender := newTestSender(client, pool)
+
+	ranged := newTestBundle(1, "ranged", 0)
+	ranged.BlockNumber, ranged.MaxBlockNumber = "", "0xc"
+	mustAddBundle(t, pool, ranged, false)
+	now := time.Now()
+
+	// An accepted bundle stays pooled for the later blocks of its range, but isn't dispatched twice for a block
+	sender.sendBundles(now)
+	sender.sendBundles(now)
+	assertPending(t, pool, map[string]bool{"ranged": true})
+
+	next = NextBlock{Number: 11}
+	sender.sendBundles(now)
+	if client.calls != 2 || client.blocks[0] != "0xa" || client.blocks[1] != "0xb" {
+		t.Fatalf("got %d sends for blocks %v, want 2 for 0xa and 0xb", client.calls, client.blocks)
+	}
+
+	// The bundle leaves the pool once it's included, bundles sharing its transaction can't be included anymore
+	shared := newTestBundle(2, "shared", 12)
+	shared.Txs = []*types.Transaction{ranged.Txs[0], shared.Txs[0]}
+	shared.Username = "bob"
+	mustAddBundle(t, pool, shared, false)
+	if included := pool.markIncludedBundles(1, &ChainHead{Number: 11, TxHashes: []common.Hash{ranged.Txs[0].Hash()}}); included != 2 {
+		t.Fatalf("markIncludedBundles() = %d, want 2", included)
+	}
+	assertPending(t, pool, map[string]bool{"ranged": false, "shared": false})
+	for uuid, want := range map[string]BundleState{"ranged": BundleStateIncluded, "shared": BundleStateExpired} {
+		if status, _ := pool.statusTracker.get(uuid); status.State != want {
+			t.Errorf("bundle %s has state %s, want %s", uuid, status.State, want)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Define Prometheus metrics
+var (
+	routedBundlesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "routed_bundles_total",
+			Help: "Total number of bundles added to the pool by chain ID",
+		},
+		[]string{"chain_id"},
+	)
+	pooledBundlesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pooled_bundles",
+			Help: "Number of bundles in the pool by chain ID",
+		},
+		[]string{"chain_id"},
+	)
+	expiredBundlesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expired_bundles_total",
+			Help: "Total number of bundles expired in the pool by chain ID",
+		},
+		[]string{"chain_id"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(routedBundlesCounter)
+	profSequencerRegisterer.MustRegister(pooledBundlesGauge)
+	profSequencerRegisterer.MustRegister(expiredBundlesCounter)
+}
+
+// ChainConfig represents the chains served by the sequencer.
+type ChainConfig struct {
+	ChainIDs         []uint64 // Accepted chain IDs, the first one is the primary chain
+	AllowUnprotected bool     // Accept legacy transactions without replay protection, routed to the primary chain
+}
+
+// parseChainIDs parses a comma-separated list of chain IDs
+func parseChainIDs(value string) ([]uint64, error) {
+	var chainIDs []uint64
+	seen := make(map[uint64]bool)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		chainID, err := strconv.ParseUint(field, 0, 64)
+		if err != nil || chainID == 0 {
+			return nil, fmt.Errorf("invalid chain ID %q", field)
+		}
+		if !seen[chainID] {
+			seen[chainID] = true
+			chainIDs = append(chainIDs, chainID)
+		}
+	}
+	if len(chainIDs) == 0 {
+		return nil, fmt.Errorf("at least one chain ID is required")
+	}
+	return chainIDs, nil
+}
+
+// parseChainURLs parses a comma-separated list of chainID=URL pairs
+func parseChainURLs(value string) (map[uint64]string, error) {
+	targets := make(map[uint64]string)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		chain, url, found := strings.Cut(field, "=")
+		if !found || url == "" {
+			return nil, fmt.Errorf("invalid chain URL %q, expected chainID=URL", field)
+		}
+		chainID, err := strconv.ParseUint(chain, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chain ID %q", chain)
+		}
+		targets[chainID] = url
+	}
+	return targets, nil
+}
+
+// primaryChainID returns the chain ID transactions without replay protection are routed to
+func (c ChainConfig) primaryChainID() uint64 {
+	return c.ChainIDs[0]
+}
+
+// accepts reports whether the given chain ID is served
+func (c ChainConfig) accepts(chainID uint64) bool {
+	for _, id := range c.ChainIDs {
+		if id == chainID {
+			return true
+		}
+	}
+	return false
+}
+
+// txChainID returns the chain ID the transaction is sequenced for, or a *TxValidationError
+// if the transaction targets a chain that isn't served
+func (c ChainConfig) txChainID(tx *types.Transaction) (uint64, error) {
+	if !tx.Protected() {
+		if !c.AllowUnprotected {
+			return 0, &TxValidationError{Rule: ruleChainID, Reason: rejectReasonWrongChainID, Message: "transaction is not replay protected"}
+		}
+		return c.primaryChainID(), nil
+	}
+
+	chainID := tx.ChainId()
+	if !chainID.IsUint64() || !c.accepts(chainID.Uint64()) {
+		return 0, &TxValidationError{Rule: ruleChainID, Reason: rejectReasonWrongChainID, Message: fmt.Sprintf("unsupported chain ID %s", chainID)}
+	}
+	return chainID.Uint64(), nil
+}
+
+// ChainPools routes bundles to the TxBundlePool of their chain. Unless every chain runs its
+// own pool, all chains share a single pool.
+type ChainPools struct {
+	chains  ChainConfig              // Chains served by the sequencer
+	pools   map[uint64]*TxBundlePool // Pool by chain ID
+	targets map[uint64]string        // gRPC URL of the bundle merger by chain ID, unless a merger config is given
+	mergers []MergerConfig           // Bundle mergers the bundles are dispatched to
+
+	followers map[uint64]*HeadFollower // Optional head follower by chain ID
+	blockTime time.Duration            // Expected time between blocks
+
+	uuids uuidLocks // Locks of the replacement UUIDs being added, so a UUID can't be pooled on two chains at once
+}
+
+// uuidLocks serializes the adds of bundles with the same replacement UUID, adds of other UUIDs
+// run concurrently. A lock is dropped once no add holds or waits for it.
+type uuidLocks struct {
+	locks map[string]*uuidLock // Lock by replacement UUID
+	mu    sync.Mutex           // A mutex for the locks
+}
+
+type uuidLock struct {
+	mu   sync.Mutex // A mutex for the adds of the UUID
+	refs int        // Number of adds holding or waiting for the lock
+}
+
+func (l *uuidLocks) lock(uuid string) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*uuidLock)
+	}
+	lock, exists := l.locks[uuid]
+	if !exists {
+		lock = &uuidLock{}
+		l.locks[uuid] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.mu.Lock()
+}
+
+func (l *uuidLocks) unlock(uuid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock := l.locks[uuid]
+	lock.mu.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, uuid)
+	}
+}
+
+// newChainPools creates the pools for the given chains using newPool, either one per chain or
+// one shared by all chains. Bundles are dispatched to the bundle merger of their chain, or
+// to defaultTarget if no target is configured for the chain.
+func newChainPools(chains ChainConfig, perChain bool, defaultTarget string, targets map[uint64]string, blockTime time.Duration, newPool func() *TxBundlePool) (*ChainPools, error) {
+	c := &ChainPools{
+		chains:    chains,
+		pools:     make(map[uint64]*TxBundlePool),
+		targets:   make(map[uint64]string),
+		followers: make(map[uint64]*HeadFollower),
+		blockTime: blockTime,
+	}
+
+	for chainID := range targets {
+		if !chains.accepts(chainID) {
+			return nil, fmt.Errorf("bundle merger target configured for unsupported chain ID %d", chainID)
+		}
+		if !perChain {
+			return nil, fmt.Errorf("bundle merger targets by chain require per-chain pools")
+		}
+	}
+
+	var shared *TxBundlePool
+	for _, chainID := range chains.ChainIDs {
+		if perChain {
+			c.pools[chainID] = newPool()
+			c.pools[chainID].nextBlock = c.nextBlock
+		} else {
+			if shared == nil {
+				shared = newPool()
+				shared.nextBlock = c.nextBlock
+			}
+			c.pools[chainID] = shared
+		}
+
+		c.targets[chainID] = defaultTarget
+		if target, exists := targets[chainID]; exists {
+			c.targets[chainID] = target
+		}
+
+		routedBundlesCounter.WithLabelValues(chainLabel(chainID))
+		pooledBundlesGauge.WithLabelValues(chainLabel(chainID))
+		expiredBundlesCounter.WithLabelValues(chainLabel(chainID))
+		evictedBundlesCounter.WithLabelValues(chainLabel(chainID))
+	}
+
+	return c, nil
+}
+
+func chainLabel(chainID uint64) string {
+	return strconv.FormatUint(chainID, 10)
+}
+
+// ChainPoolTarget is a distinct pool together with the chains it serves.
+type ChainPoolTarget struct {
+	ChainIDs []uint64      // Chains sequenced by the pool
+	Pool     *TxBundlePool // Pool of the chains
+}
+
+// targetList returns the distinct pools ordered by their first chain ID
+func (c *ChainPools) targetList() []ChainPoolTarget {
+	byPool := make(map[*TxBundlePool]int)
+	var targets []ChainPoolTarget
+	for _, chainID := range c.chains.ChainIDs {
+		pool := c.pools[chainID]
+		if i, exists := byPool[pool]; exists {
+			targets[i].ChainIDs = append(targets[i].ChainIDs, chainID)
+			continue
+		}
+		byPool[pool] = len(targets)
+		targets = append(targets, ChainPoolTarget{ChainIDs: []uint64{chainID}, Pool: pool})
+	}
+	return targets
+}
+
+// bundleChainID returns the chain all transactions of a bundle belong to. Transactions without
+// replay protection are valid on every chain and follow the other transactions of the bundle.
+func (c *ChainPools) bundleChainID(txs []*types.Transaction) (uint64, error) {
+	var bundleChainID uint64
+	for _, tx := range txs {
+		if !tx.Protected() {
+			continue
+		}
+		chainID, err := c.chains.txChainID(tx)
+		if err != nil {
+			return 0, err
+		}
+		if bundleChainID != 0 && bundleChainID != chainID {
+			return 0, fmt.Errorf("bundle mixes transactions of chains %d and %d", bundleChainID, chainID)
+		}
+		bundleChainID = chainID
+	}
+
+	if bundleChainID == 0 {
+		return c.chains.primaryChainID(), nil
+	}
+	return bundleChainID, nil
+}
+
+// addBundle routes a bundle to the pool of its chain and adds it there
+func (c *ChainPools) addBundle(bundle *TxPoolBundle, replace bool) (*TxPoolBundle, error) {
+	chainID, err := c.bundleChainID(bundle.Txs)
+	if err != nil {
+		return nil, err
+	}
+	bundle.ChainID = chainID
+	pool := c.pools[chainID]
+
+	// Replacement UUIDs are unique across chains, the check and the add are atomic for the UUID
+	if bundle.ReplacementUUID != "" {
+		c.uuids.lock(bundle.ReplacementUUID)
+		defer c.uuids.unlock(bundle.ReplacementUUID)
+		for _, target := range c.targetList() {
+			if target.Pool == pool {
+				continue
+			}
+			if existing, exists := target.Pool.getBundleByUUID(bundle.ReplacementUUID); exists {
+				return nil, fmt.Errorf("bundle with UUID %s already exists on chain %d", bundle.ReplacementUUID, existing.ChainID)
+			}
+		}
+	}
+
+	pooledBundle, err := pool.addBundle(bundle, replace)
+	if err != nil {
+		return nil, err
+	}
+	if pooledBundle == bundle {
+		routedBundlesCounter.WithLabelValues(chainLabel(chainID)).Inc()
+	}
+	return pooledBundle, nil
+}
+
+// getBundleByUUID looks up a pooled bundle by UUID on all chains
+func (c *ChainPools) getBundleByUUID(uuid string) (*TxPoolBundle, bool) {
+	for _, target := range c.targetList() {
+		if bundle, exists := target.Pool.getBundleByUUID(uuid); exists {
+			return bundle, true
+		}
+	}
+	return nil, false
+}
+
+// getBundleByHash looks up a pooled bundle of the given user by bundle hash on all chains
+func (c *ChainPools) getBundleByHash(hash common.Hash, username string) (*TxPoolBundle, bool) {
+	for _, target := range c.targetList() {
+		if bundle, exists := target.Pool.getBundleByHash(hash, username); exists {
+			return bundle, true
+		}
+	}
+	return nil, false
+}
+
+// cancelBundleByUUID cancels a bundle of the given user by UUID on whichever chain it is pooled
+func (c *ChainPools) cancelBundleByUUID(uuid string, username string) error {
+	// Any other reason is more specific than the bundle not being found
+	err := fmt.Errorf("%w: %s", errBundleNotFound, uuid)
+	for _, target := range c.targetList() {
+		cancelErr := target.Pool.cancelBundleByUUID(uuid, username)
+		if cancelErr == nil {
+			return nil
+		}
+		if !errors.Is(cancelErr, errBundleNotFound) {
+			err = cancelErr
+		}
+	}
+	return err
+}
+
+// startHeadFollowers follows the heads of the chains with an RPC URL and expires their bundles on every new head
+func (c *ChainPools) startHeadFollowers(ctx context.Context, rpcURLs map[uint64]string, interval time.Duration) error {
+	for chainID := range rpcURLs {
+		if !c.chains.accepts(chainID) {
+			return fmt.Errorf("RPC URL configured for unsupported chain ID %d", chainID)
+		}
+	}
+
+	for _, chainID := range c.chains.ChainIDs {
+		rpcURL, exists := rpcURLs[chainID]
+		if !exists {
+			log.Warn().Uint64("chain_id", chainID).Msg("No RPC URL configured, bundles of the chain only expire by MaxTimestamp")
+			continue
+		}
+
+		follower := newHeadFollower(chainID, rpcURL, interval, func(head ChainHead) {
+			c.onHead(chainID, head)
+		})
+		c.followers[chainID] = follower
+		follower.start(ctx)
+		log.Info().Uint64("chain_id", chainID).Str("rpc_url", rpcURL).Dur("interval", interval).Msg("Following chain head")
+	}
+	return nil
+}
+
+// nextBlock returns the upcoming block of the chain based on its head. Missed blocks are
+// accounted for by not expecting the next block before the current time.
+func (c *ChainPools) nextBlock(chainID uint64) NextBlock {
+	now := uint64(time.Now().Unix())
+
+	follower, exists := c.followers[chainID]
+	if !exists {
+		return NextBlock{Timestamp: now}
+	}
+	head, exists := follower.latest()
+	if !exists {
+		return NextBlock{Timestamp: now}
+	}
+
+	next := NextBlock{Number: head.Number + 1, Timestamp: head.Timestamp + uint64(c.blockTime.Seconds())}
+	if next.Timestamp < now {
+		next.Timestamp = now
+	}
+	return next
+}
+
+// setBaseFee updates the base fee the fee scores of the bundles of a chain are computed against
+func (c *ChainPools) setBaseFee(chainID uint64, baseFee *big.Int) {
+	if pool, exists := c.pools[chainID]; exists {
+		pool.setBaseFee(chainID, baseFee)
+	}
+}
+
+// onHead removes the bundles of the chain included in the given head, expires the bundles that can't
+// be included after it and tracks the base fee of the head
+func (c *ChainPools) onHead(chainID uint64, head ChainHead) {
+	pool, exists := c.pools[chainID]
+	if !exists {
+		return
+	}
+
+	if head.BaseFee != nil {
+		pool.setBaseFee(chainID, head.BaseFee)
+	}
+
+	if included := pool.markIncludedBundles(chainID, &head); included > 0 {
+		log.Info().Uint64("chain_id", chainID).Uint64("block", head.Number).Int("included", included).Msg("Removed bundles included in the chain head")
+	}
+
+	expired := pool.expireBundles(chainID, &head, time.Now())
+	if expired > 0 {
+		log.Info().Uint64("chain_id", chainID).Uint64("block", head.Number).Int("expired", expired).Msg("Expired bundles after new chain head")
+	}
+}
+
+// countBundles returns the number of pooled bundles by chain ID
+func (c *ChainPools) countBundles() map[uint64]int {
+	counts := make(map[uint64]int, len(c.chains.ChainIDs))
+	for _, chainID := range c.chains.ChainIDs {
+		counts[chainID] = 0
+	}
+	for _, target := range c.targetList() {
+		for chainID, count := range target.Pool.countBundles() {
+			counts[chainID] += count
+		}
+	}
+	return counts
+}
+
+// startCleanupJob starts the cleanup jobs of all pools and keeps the pool metrics up to date
+func (c *ChainPools) startCleanupJob(interval time.Duration) {
+	for _, target := range c.targetList() {
+		target.Pool.startCleanupJob(interval)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			for chainID, count := range c.countBundles() {
+				pooledBundlesGauge.WithLabelValues(chainLabel(chainID)).Set(float64(count))
+			}
+		}
+	}()
+}
+
+// ChainView represents the admin view of a chain.
+type ChainView struct {
+	ChainID       uint64   `json:"chainId"`       // Chain ID
+	PooledBundles int      `json:"pooledBundles"` // Number of bundles in the pool of the chain
+	Mergers       []string `json:"mergers"`       // Names of the bundle mergers the bundles of the chain are dispatched to
+	SharedPool    bool     `json:"sharedPool"`    // Whether the pool is shared with other chains
+}
+
+// handleAdminChains lists the chains served by the sequencer with their pools
+func handleAdminChains(pools *ChainPools) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		counts := pools.countBundles()
+
+		var views []ChainView
+		for _, target := range pools.targetList() {
+			for _, chainID := range target.ChainIDs {
+				views = append(views, ChainView{
+					ChainID:       chainID,
+					PooledBundles: counts[chainID],
+					Mergers:       pools.mergerNames(chainID),
+					SharedPool:    len(target.ChainIDs) > 1,
+				})
+			}
+		}
+		sort.Slice(views, func(i, j int) bool { return views[i].ChainID < views[j].ChainID })
+
+		c.JSON(http.StatusOK, gin.H{"chains": views})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// newChainTestTx returns a replay protected transaction of the given chain, unique for the given nonce
+func newChainTestTx(chainID int64, nonce uint64) *types.Transaction {
+	return types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(chainID), Nonce: nonce, Gas: 21000, GasFeeCap: big.NewInt(2), GasTipCap: big.NewInt(1), To: &feeTestRecipient})
+}
+
+// newPerChainTestPools returns pools for chains 1 and 2, each with its own pool
+func newPerChainTestPools(t *testing.T) *ChainPools {
+	t.Helper()
+
+	chains := ChainConfig{ChainIDs: []uint64{1, 2}, AllowUnprotected: true}
+	pools, err := newChainPools(chains, true, "127.0.0.1:50051", map[uint64]string{2: "127.0.0.1:50052"}, 12*time.Second, func() *TxBundlePool {
+		return newTestPool(orderingPolicies["block_number"])
+	})
+	if err != nil {
+		t.Fatalf("newChainPools() error = %v", err)
+	}
+	return pools
+}
+
+func TestParseChainIDs(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"1", "[1]", false},
+		{"1, 0xaa36a7,1", "[1 11155111]", false},
+		{"", "", true},
+		{"1,mainnet", "", true},
+		{"0", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			chainIDs, err := parseChainIDs(tt.value)
+			if (err != nil) != tt.wantErr || (!tt.wantErr && fmt.Sprint(chainIDs) != tt.want) {
+				t.Errorf("parseChainIDs() = %v, %v, want %s", chainIDs, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChainURLs(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "map[]", false},
+		{"1=merger-1:50051, 0x2=merger-2:50051", "map[1:merger-1:50051 2:merger-2:50051]", false},
+		{"1", "", true},
+		{"1=", "", true},
+		{"one=merger:50051", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			targets, err := parseChainURLs(tt.value)
+			if (err != nil) != tt.wantErr || (!tt.wantErr && fmt.Sprint(targets) != tt.want) {
+				t.Errorf("parseChainURLs() = %v, %v, want %s", targets, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBundleChainID(t *testing.T) {
+	pools := newPerChainTestPools(t)
+
+	tests := []struct {
+		name    string
+		txs     []*types.Transaction
+		want    uint64
+		wantErr bool
+	}{
+		{"primary chain", []*types.Transaction{newChainTestTx(1, 0)}, 1, false},
+		{"other chain", []*types.Transaction{newChainTestTx(2, 0)}, 2, false},
+		{"unprotected follows the bundle", []*types.Transaction{newLegacyTx(21000, 1), newChainTestTx(2, 0)}, 2, false},
+		{"only unprotected", []*types.Transaction{newLegacyTx(21000, 1)}, 1, false},
+		{"unsupported chain", []*types.Transaction{newChainTestTx(5, 0)}, 0, true},
+		{"mixed chains", []*types.Transaction{newChainTestTx(1, 0), newChainTestTx(2, 0)}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chainID, err := pools.bundleChainID(tt.txs)
+			if (err != nil) != tt.wantErr || chainID != tt.want {
+				t.Errorf("bundleChainID() = %d, %v, want %d", chainID, err, tt.want)
+			}
+		})
+	}
+
+	// Unless allowed, unprotected transactions are rejected by the chain ID check of the validation, not by the routing
+	pools.chains.AllowUnprotected = false
+	if _, err := pools.bundleChainID([]*types.Transaction{newLegacyTx(21000, 1)}); err != nil {
+		t.Errorf("bundleChainID() error = %v, unprotected transactions are left to the validation", err)
+	}
+	if _, err := pools.chains.txChainID(newLegacyTx(21000, 1)); err == nil {
+		t.Errorf("txChainID() accepted an unprotected transaction")
+	}
+}
+
+func TestChainPoolsRouteByChain(t *testing.T) {
+	pools := newPerChainTestPools(t)
+	if pools.pools[1] == pools.pools[2] {
+		t.Fatalf("chains share a pool, want a pool per chain")
+	}
+	if pools.targets[1] != "127.0.0.1:50051" || pools.targets[2] != "127.0.0.1:50052" {
+		t.Errorf("targets = %v, want the default target for chain 1 and the configured target for chain 2", pools.targets)
+	}
+
+	for i, chainID := range []int64{1, 2, 2} {
+		bundle := &TxPoolBundle{Txs: []*types.Transaction{newChainTestTx(chainID, uint64(i))}, BlockNumber: "0xa", ReplacementUUID: fmt.Sprintf("bundle-%d", i)}
+		if _, err := pools.addBundle(bundle, false); err != nil {
+			t.Fatalf("addBundle() error = %v", err)
+		}
+		if bundle.ChainID != uint64(chainID) {
+			t.Errorf("bundle routed to chain %d, want %d", bundle.ChainID, chainID)
+		}
+	}
+	if counts := pools.countBundles(); counts[1] != 1 || counts[2] != 2 {
+		t.Errorf("countBundles() = %v, want 1 bundle on chain 1 and 2 on chain 2", counts)
+	}
+
+	// Replacement UUIDs are unique across chains
+	duplicate := &TxPoolBundle{Txs: []*types.Transaction{newChainTestTx(2, 10)}, BlockNumber: "0xa", ReplacementUUID: "bundle-0"}
+	if _, err := pools.addBundle(duplicate, true); err == nil {
+		t.Errorf("addBundle() pooled a UUID of chain 1 on chain 2")
+	}
+}
+
+func TestChainPoolsKeepUUIDsUniqueUnderConcurrentAdds(t *testing.T) {
+	pools := newPerChainTestPools(t)
+
+	const rounds = 200
+	for round := 0; round < rounds; round++ {
+		uuid := fmt.Sprintf("bundle-%d", round)
+		// Both adds start at once, each to the pool of another chain
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for _, chainID := range []int64{1, 2} {
+			wg.Add(1)
+			go func(chainID int64) {
+				defer wg.Done()
+				<-start
+				bundle := &TxPoolBundle{Txs: []*types.Transaction{newChainTestTx(chainID, uint64(round))}, BlockNumber: "0xa", ReplacementUUID: uuid}
+				_, _ = pools.addBundle(bundle, false)
+			}(chainID)
+		}
+		close(start)
+		wg.Wait()
+	}
+
+	if counts := pools.countBundles(); counts[1]+counts[2] != rounds {
+		t.Errorf("countBundles() = %v, want %d bundles, one per UUID", counts, rounds)
+	}
+}
+
+func TestChainPoolsAddOtherUUIDsConcurrently(t *testing.T) {
+	pools := newPerChainTestPools(t)
+
+	// An add holding the lock of one UUID doesn't block the add of another UUID
+	pools.uuids.lock("held")
+	defer pools.uuids.unlock("held")
+
+	added := make(chan error, 1)
+	go func() {
+		bundle := &TxPoolBundle{Txs: []*types.Transaction{newChainTestTx(2, 0)}, BlockNumber: "0xa", ReplacementUUID: "other"}
+		_, err := pools.addBundle(bundle, false)
+		added <- err
+	}()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatalf("addBundle() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("addBundle() blocked on the lock of another UUID")
+	}
+	if _, exists := pools.uuids.locks["other"]; exists {
+		t.Errorf("lock of UUID other kept after the add")
+	}
+}
+
+func TestNewChainPoolsRejectsInvalidTargets(t *testing.T) {
+	chains := ChainConfig{ChainIDs: []uint64{1, 2}}
+	newPool := func() *TxBundlePool { return newTestPool(orderingPolicies["block_number"]) }
+
+	if _, err := newChainPools(chains, true, "", map[uint64]string{5: "merger:50051"}, time.Second, newPool); err == nil {
+		t.Errorf("newChainPools() accepted a target of an unsupported chain")
+	}
+	if _, err := newChainPools(chains, false, "", map[uint64]string{2: "merger:50051"}, time.Second, newPool); err == nil {
+		t.Errorf("newChainPools() accepted targets by chain with a shared pool")
+	}
+}
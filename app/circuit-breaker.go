@@ -0,0 +1,219 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"    // Requests pass
+	circuitHalfOpen = "half_open" // A single trial request passes, its outcome closes or re-opens the circuit
+	circuitOpen     = "open"      // Requests are refused until the cooldown elapsed
+)
+
+// circuitStateValues are the values of the circuit state gauge
+var circuitStateValues = map[string]float64{circuitClosed: 0, circuitHalfOpen: 1, circuitOpen: 2}
+
+// Define Prometheus metrics
+var (
+	circuitStateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bundle_merger_circuit_state",
+			Help: "State of the circuit breaker of a bundle merger by gRPC URL, 0 closed, 1 half-open, 2 open",
+		},
+		[]string{"grpc_url"},
+	)
+	circuitOpensCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bundle_merger_circuit_opens_total",
+			Help: "Total number of times the circuit breaker of a bundle merger opened by gRPC URL",
+		},
+		[]string{"grpc_url"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(circuitStateGauge)
+	profSequencerRegisterer.MustRegister(circuitOpensCounter)
+}
+
+// BreakerConfig represents when a circuit breaker opens and for how long.
+type BreakerConfig struct {
+	Threshold int           // Consecutive failures that open the circuit
+	Cooldown  time.Duration // Time the circuit stays open before a trial request
+}
+
+func (c BreakerConfig) validate() error {
+	if c.Threshold < 1 {
+		return fmt.Errorf("threshold must be at least 1")
+	}
+	if c.Cooldown <= 0 {
+		return fmt.Errorf("cooldown must be positive")
+	}
+	return nil
+}
+
+// circuitBreaker stops requests to a bundle merger after repeated failures, so a failing bundle
+// merger isn't hammered while it recovers.
+type circuitBreaker struct {
+	name     string        // gRPC URL of the bundle merger
+	config   BreakerConfig // Threshold and cooldown
+	state    string        // Current state, see the circuit constants
+	failures int           // Consecutive failures
+	openedAt time.Time     // Time the circuit opened
+	lastErr  string        // Latest failure
+	mu       sync.Mutex    // A mutex for concurrent access
+}
+
+// CircuitView represents the state of a circuit breaker in the health check.
+type CircuitView struct {
+	GRPCURL             string     `json:"grpcUrl"`             // gRPC URL of the bundle merger
+	State               string     `json:"state"`               // State of the circuit
+	ConsecutiveFailures int        `json:"consecutiveFailures"` // Failures since the latest success
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`  // Time the circuit opened, if it's not closed
+	LastError           string     `json:"lastError,omitempty"` // Latest failure
+}
+
+func newCircuitBreaker(name string, config BreakerConfig) *circuitBreaker {
+	circuitStateGauge.WithLabelValues(name).Set(circuitStateValues[circuitClosed])
+	return &circuitBreaker{name: name, config: config, state: circuitClosed}
+}
+
+// allow reports whether a request may be sent. After the cooldown an open circuit turns half-open
+// and allows a single trial request, whose outcome has to be reported before the next one passes.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.config.Cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		log.Info().Str("grpc_url", b.name).Msg("Circuit half-open, sending a trial request")
+		return true
+	default:
+		return false
+	}
+}
+
+// ready reports whether allow would let a request pass, without turning an open circuit half-open
+func (b *circuitBreaker) ready(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		return now.Sub(b.openedAt) >= b.config.Cooldown
+	default:
+		return false
+	}
+}
+
+// success closes the circuit
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != circuitClosed {
+		b.setState(circuitClosed)
+		log.Info().Str("grpc_url", b.name).Msg("Circuit closed")
+	}
+}
+
+// answered resolves a trial request that was refused for its content. The server answered, so a
+// half-open circuit closes, the failures of a closed circuit are left as they are.
+func (b *circuitBreaker) answered() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitHalfOpen {
+		b.failures = 0
+		b.setState(circuitClosed)
+		log.Info().Str("grpc_url", b.name).Msg("Circuit closed")
+	}
+}
+
+// failure counts a failed request and opens the circuit once the threshold is reached or the trial request failed
+func (b *circuitBreaker) failure(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastErr = err.Error()
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.config.Threshold) {
+		b.openedAt = now
+		b.setState(circuitOpen)
+		circuitOpensCounter.WithLabelValues(b.name).Inc()
+		log.Warn().Str("grpc_url", b.name).Int("failures", b.failures).Dur("cooldown", b.config.Cooldown).Msg("Circuit opened, pausing dispatch")
+	}
+}
+
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	circuitStateGauge.WithLabelValues(b.name).Set(circuitStateValues[state])
+}
+
+func (b *circuitBreaker) view() CircuitView {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	view := CircuitView{GRPCURL: b.name, State: b.state, ConsecutiveFailures: b.failures, LastError: b.lastErr}
+	if b.state != circuitClosed {
+		openedAt := b.openedAt
+		view.OpenedAt = &openedAt
+	}
+	return view
+}
+
+// CircuitRegistry holds the circuit breakers of the bundle mergers for the health check.
+type CircuitRegistry struct {
+	breakers map[string]*circuitBreaker // Circuit breakers by gRPC URL
+	config   BreakerConfig              // Configuration of new circuit breakers
+	mu       sync.RWMutex               // A mutex for concurrent access
+}
+
+func newCircuitRegistry(config BreakerConfig) *CircuitRegistry {
+	return &CircuitRegistry{breakers: make(map[string]*circuitBreaker), config: config}
+}
+
+// breaker returns the circuit breaker of a bundle merger, targets sharing a bundle merger share its breaker
+func (r *CircuitRegistry) breaker(grpcURL string) *circuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	breaker, exists := r.breakers[grpcURL]
+	if !exists {
+		breaker = newCircuitBreaker(grpcURL, r.config)
+		r.breakers[grpcURL] = breaker
+	}
+	return breaker
+}
+
+// views returns the states of the circuit breakers by gRPC URL
+func (r *CircuitRegistry) views() []CircuitView {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	views := make([]CircuitView, 0, len(r.breakers))
+	for _, breaker := range r.breakers {
+		views = append(views, breaker.view())
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].GRPCURL < views[j].GRPCURL })
+	return views
+}
@@ -0,0 +1,246 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// dispatchIdleInterval bounds the time between two checks of a pool, so bundles that become
+// eligible without an arrival, e.g. after their retry backoff or a new chain head, are picked up
+const dispatchIdleInterval = 250 * time.Millisecond
+
+// Dispatch triggers, the reasons a pool dispatches its eligible bundles
+const (
+	triggerBatchSize    = "batch_size"    // Enough eligible bundles for a full batch
+	triggerMaxLatency   = "max_latency"   // The oldest eligible bundle waited for the max latency
+	triggerSlotDeadline = "slot_deadline" // The upcoming block of a chain is due within the slot deadline, or the dispatch window of the slot clock started
+)
+
+// Define Prometheus metrics
+var (
+	dispatchLatencyHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "bundle_dispatch_latency_seconds",
+			Help:    "Time from the arrival of a bundle to its first dispatch to a bundle merger by chain ID",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 12},
+		},
+		[]string{"chain_id"},
+	)
+	dispatchTriggersCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dispatch_triggers_total",
+			Help: "Total number of dispatches by trigger",
+		},
+		[]string{"trigger"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(dispatchLatencyHistogram)
+	profSequencerRegisterer.MustRegister(dispatchTriggersCounter)
+}
+
+// DispatchTriggers represents when a pool dispatches its eligible bundles, whichever comes first.
+type DispatchTriggers struct {
+	BatchSize    int           // Eligible bundles that trigger a dispatch, also the maximum per dispatch
+	MaxLatency   time.Duration // Longest time the oldest eligible bundle waits for a dispatch since its arrival
+	SlotDeadline time.Duration // Time before the upcoming block, or the cutoff of a slot clock, from which eligible bundles are dispatched right away, 0 disables
+}
+
+var defaultDispatchTriggers = DispatchTriggers{
+	BatchSize:    100,
+	MaxLatency:   200 * time.Millisecond,
+	SlotDeadline: 2 * time.Second,
+}
+
+func (t DispatchTriggers) validate() error {
+	if t.BatchSize < 1 {
+		return fmt.Errorf("batch size must be at least 1")
+	}
+	if t.MaxLatency <= 0 {
+		return fmt.Errorf("max latency must be positive")
+	}
+	if t.SlotDeadline < 0 {
+		return fmt.Errorf("slot deadline must not be negative")
+	}
+	return nil
+}
+
+// dispatchBacklog returns the number of bundles that could be leased now, counted up to limit, and
+// the arrival of the oldest of them. Both are read from the ready bundles, which are kept up to date
+// on every add, lease and settle and catch up with the upcoming block here, so arrivals don't walk
+// the pool.
+func (p *TxBundlePool) dispatchBacklog(limit int, now time.Time) (int, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.refreshReadyLocked(now)
+	oldest, exists := p.arrived.peek()
+	if !exists {
+		return 0, time.Time{}
+	}
+	return min(p.ready.Len(), limit), oldest.ReceivedAt
+}
+
+// observeDispatch records the ingress-to-dispatch latency of the bundles dispatched for the first time
+func (p *TxBundlePool) observeDispatch(bundles []*TxPoolBundle, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, bundle := range bundles {
+		if !bundle.dispatchedAt.IsZero() {
+			continue
+		}
+		bundle.dispatchedAt = now
+		dispatchLatencyHistogram.WithLabelValues(chainLabel(bundle.ChainID)).Observe(now.Sub(bundle.ReceivedAt).Seconds())
+	}
+}
+
+// bundleDispatcher dispatches the bundles of a pool as soon as a trigger fires instead of at fixed
+// intervals. It's woken by arriving bundles and by the deadlines of the triggers.
+type bundleDispatcher struct {
+	sender     *bundleSender                  // Sender the bundles are dispatched by
+	triggers   DispatchTriggers               // When the bundles are dispatched
+	chainIDs   []uint64                       // Chains sequenced by the pool
+	nextBlock  func(chainID uint64) NextBlock // Upcoming block by chain
+	clock      *SlotClock                     // Optional slot clock scheduling the dispatch windows and cutoffs
+	latePolicy string                         // Handling of bundles that missed the cutoff, if a slot clock is set
+}
+
+// slotDeadline returns the earliest time from which the bundles of the pool are dispatched right
+// away, zero if the slot deadline is disabled or no chain head is known
+func (d *bundleDispatcher) slotDeadline() time.Time {
+	if d.triggers.SlotDeadline == 0 || d.nextBlock == nil {
+		return time.Time{}
+	}
+
+	var deadline time.Time
+	for _, chainID := range d.chainIDs {
+		next := d.nextBlock(chainID)
+		if next.Number == 0 {
+			continue // The block time is unknown without a chain head
+		}
+		chainDeadline := time.Unix(int64(next.Timestamp), 0).Add(-d.triggers.SlotDeadline)
+		if deadline.IsZero() || chainDeadline.Before(deadline) {
+			deadline = chainDeadline
+		}
+	}
+	return deadline
+}
+
+// trigger returns the trigger that fires now, if any, and otherwise the time until the next check
+func (d *bundleDispatcher) trigger(now time.Time) (string, time.Duration) {
+	count, oldest := d.sender.txPool.dispatchBacklog(d.triggers.BatchSize, now)
+	var deadline time.Time
+	if d.clock != nil {
+		if d.clock.Window > 0 {
+			deadline = d.clock.position(now).WindowStart
+		}
+	} else {
+		deadline = d.slotDeadline()
+	}
+
+	wait := dispatchIdleInterval
+	if count == 0 {
+		return "", wait
+	}
+
+	switch {
+	case count >= d.triggers.BatchSize:
+		return triggerBatchSize, 0
+	case now.Sub(oldest) >= d.triggers.MaxLatency:
+		return triggerMaxLatency, 0
+	case !deadline.IsZero() && !now.Before(deadline):
+		return triggerSlotDeadline, 0
+	}
+
+	wait = min(wait, oldest.Add(d.triggers.MaxLatency).Sub(now))
+	if !deadline.IsZero() {
+		wait = min(wait, deadline.Sub(now))
+	}
+	return "", wait
+}
+
+// dispatch sends the eligible bundles if a trigger fires and returns the time until the next check
+func (d *bundleDispatcher) dispatch(now time.Time) time.Duration {
+	// After the cutoff the bundle set of the upcoming block is final until the next slot starts
+	if d.clock != nil {
+		if pos := d.clock.position(now); pos.Phase == slotPhaseClosed {
+			d.cutOff(pos)
+			return pos.End.Sub(now)
+		}
+	}
+
+	trigger, wait := d.trigger(now)
+	if trigger == "" {
+		return wait
+	}
+
+	dispatchTriggersCounter.WithLabelValues(trigger).Inc()
+	if sent := d.sender.sendBundles(now); sent == 0 {
+		return dispatchIdleInterval // No bundle merger is ready, wait for their backoff
+	}
+	return 0 // Check right away for the bundles that didn't fit into the batch
+}
+
+// cutOff applies the late bundle policy to the bundles still targeting the upcoming block of a chain
+// that is due at the end of the slot. The block is unknown without a chain head.
+func (d *bundleDispatcher) cutOff(pos SlotPosition) {
+	if d.nextBlock == nil {
+		return
+	}
+	for _, chainID := range d.chainIDs {
+		next := d.nextBlock(chainID)
+		if next.Number == 0 || time.Unix(int64(next.Timestamp), 0).After(pos.End) {
+			continue
+		}
+		d.sender.txPool.cutOffLateBundles(chainID, next.Number, d.latePolicy)
+	}
+}
+
+func (d *bundleDispatcher) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-d.sender.txPool.arrivals:
+		case <-timer.C:
+		}
+
+		wait := d.dispatch(time.Now())
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+func startBundleDispatcher(txPool *TxBundlePool, chainIDs []uint64, nextBlock func(chainID uint64) NextBlock, triggers DispatchTriggers, clock *SlotClock, latePolicy string, mergers []*mergerTarget, mode string, routes func([]string) []string) {
+	dispatcher := &bundleDispatcher{
+		sender: &bundleSender{
+			txPool:      txPool,
+			mergers:     mergers,
+			mode:        mode,
+			routes:      routes,
+			bundleLimit: triggers.BatchSize,
+		},
+		triggers:   triggers,
+		chainIDs:   chainIDs,
+		nextBlock:  nextBlock,
+		clock:      clock,
+		latePolicy: latePolicy,
+	}
+
+	log.Info().Interface("chain_ids", chainIDs).Int("mergers", len(mergers)).Str("mode", mode).Int("batch_size", triggers.BatchSize).Dur("max_latency", triggers.MaxLatency).Dur("slot_deadline", triggers.SlotDeadline).Bool("slot_clock", clock != nil).Msg("Starting bundle dispatcher")
+	dispatcher.run()
+}
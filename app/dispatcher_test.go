@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestDispatcher(pool *TxBundlePool, client *fakeMergerClient, triggers DispatchTriggers, nextBlock func(chainID uint64) NextBlock) *bundleDispatcher {
+	sender := newTestSender(client, pool)
+	sender.bundleLimit = triggers.BatchSize
+	return &bundleDispatcher{sender: sender, triggers: triggers, chainIDs: []uint64{1}, nextBlock: nextBlock}
+}
+
+func TestDispatchTriggers(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	triggers := DispatchTriggers{BatchSize: 2, MaxLatency: 200 * time.Millisecond, SlotDeadline: 2 * time.Second}
+	nextBlockAt := func(timestamp time.Time) func(uint64) NextBlock {
+		return func(uint64) NextBlock { return NextBlock{Number: 11, Timestamp: uint64(timestamp.Unix())} }
+	}
+	fresh := func(nonce uint64, uuid string) *TxPoolBundle {
+		bundle := newTestBundle(nonce, uuid, 11)
+		bundle.ReceivedAt = now
+		return bundle
+	}
+
+	tests := []struct {
+		name        string
+		bundles     []*TxPoolBundle
+		nextBlock   func(uint64) NextBlock
+		wantTrigger string
+		wantWait    time.Duration
+	}{
+		{"empty pool", nil, nextBlockAt(now.Add(12 * time.Second)), "", dispatchIdleInterval},
+		{"fresh bundle", []*TxPoolBundle{fresh(1, "a")}, nextBlockAt(now.Add(12 * time.Second)), "", 200 * time.Millisecond},
+		{"full batch", []*TxPoolBundle{fresh(1, "a"), fresh(2, "b")}, nextBlockAt(now.Add(12 * time.Second)), triggerBatchSize, 0},
+		{"old bundle", []*TxPoolBundle{newTestBundle(1, "a", 11)}, nextBlockAt(now.Add(12 * time.Second)), triggerMaxLatency, 0},
+		{"slot deadline", []*TxPoolBundle{fresh(1, "a")}, nextBlockAt(now.Add(time.Second)), triggerSlotDeadline, 0},
+		{"slot deadline without chain head", []*TxPoolBundle{fresh(1, "a")}, func(uint64) NextBlock { return NextBlock{Timestamp: uint64(now.Unix())} }, "", 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(orderingPolicies["block_number"])
+			pool.nextBlock = tt.nextBlock
+			for _, bundle := range tt.bundles {
+				if tt.name == "old bundle" {
+					bundle.ReceivedAt = now.Add(-time.Second)
+				}
+				mustAddBundle(t, pool, bundle, false)
+			}
+
+			dispatcher := newTestDispatcher(pool, &fakeMergerClient{}, triggers, tt.nextBlock)
+			if trigger, wait := dispatcher.trigger(now); trigger != tt.wantTrigger || wait != tt.wantWait {
+				t.Errorf("trigger() = %q, %v, want %q, %v", trigger, wait, tt.wantTrigger, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestDispatchBacklogFollowsThePool(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+	now := time.Now()
+	next := NextBlock{Number: 10, Timestamp: uint64(now.Unix())}
+	pool.nextBlock = func(uint64) NextBlock { return next }
+	assertBacklog := func(wantCount int, wantOldest time.Time) {
+		t.Helper()
+		if count, oldest := pool.dispatchBacklog(10, now); count != wantCount || !oldest.Equal(wantOldest) {
+			t.Errorf("dispatchBacklog() = %d, %v, want %d, %v", count, oldest, wantCount, wantOldest)
+		}
+	}
+
+	first, second, later := newTestBundle(1, "first", 10), newTestBundle(2, "second", 10), newTestBundle(3, "later", 11)
+	first.ReceivedAt = now.Add(-2 * time.Second)
+	second.ReceivedAt = now.Add(-time.Second)
+	later.ReceivedAt = now.Add(-3 * time.Second)
+	for _, bundle := range []*TxPoolBundle{first, second, later} {
+		mustAddBundle(t, pool, bundle, false)
+	}
+	assertBacklog(2, first.ReceivedAt)
+
+	// Leased bundles leave the backlog until their dispatch failed
+	leased := pool.leaseBundles(1, now)
+	assertBacklog(1, second.ReceivedAt)
+	pool.settleDeliveries([]delivery{{bundle: leased[0], merger: "merger", outcome: deliveryFailed}}, nil, now)
+	assertBacklog(2, first.ReceivedAt)
+
+	// A new head makes the bundle for the next block eligible
+	next = NextBlock{Number: 11, Timestamp: uint64(now.Unix()) + 12}
+	assertBacklog(3, later.ReceivedAt)
+}
+
+func TestDispatchSendsBatchesUntilThePoolIsDrained(t *testing.T) {
+	now := time.Now()
+	client := &fakeMergerClient{}
+	pool := newTestPool(orderingPolicies["block_number"])
+	for i, uuid := range []string{"a", "b", "c"} {
+		mustAddBundle(t, pool, newTestBundle(uint64(i+1), uuid, 10), false)
+	}
+	dispatcher := newTestDispatcher(pool, client, DispatchTriggers{BatchSize: 2, MaxLatency: time.Minute}, nil)
+	last := mustGetBundle(t, pool, "c")
+
+	// A full batch is sent right away and the dispatcher checks again at once
+	if wait := dispatcher.dispatch(now); wait != 0 || client.calls != 1 {
+		t.Fatalf("dispatch() = %v after %d sends, want 0 after 1", wait, client.calls)
+	}
+
+	// The remaining bundle waits for the max latency
+	if wait := dispatcher.dispatch(now); wait <= 0 || client.calls != 1 {
+		t.Fatalf("dispatch() = %v after %d sends, want a wait after 1", wait, client.calls)
+	}
+	later := now.Add(2 * time.Minute)
+	if wait := dispatcher.dispatch(later); wait != 0 || client.calls != 2 {
+		t.Fatalf("dispatch() = %v after %d sends, want 0 after 2", wait, client.calls)
+	}
+	assertPending(t, pool, map[string]bool{"a": false, "b": false, "c": false})
+
+	if !last.dispatchedAt.Equal(later) {
+		t.Errorf("bundle was first dispatched at %v, want %v", last.dispatchedAt, later)
+	}
+}
+
+func TestDispatchWaitsForEligibleBundles(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	next := NextBlock{Number: 10, Timestamp: uint64(now.Unix())}
+	nextBlock := func(uint64) NextBlock { return next }
+
+	client := &fakeMergerClient{}
+	pool := newTestPool(orderingPolicies["block_number"])
+	pool.nextBlock = nextBlock
+	early := newTestBundle(3, "early", 10)
+	early.MinTimestamp = now.Unix() + 5
+	for _, bundle := range []*TxPoolBundle{newTestBundle(1, "due", 10), newTestBundle(2, "later", 12), early} {
+		mustAddBundle(t, pool, bundle, false)
+	}
+	dispatcher := newTestDispatcher(pool, client, DispatchTriggers{BatchSize: 1, MaxLatency: time.Minute}, nextBlock)
+
+	// Bundles for a later block or before their min timestamp stay in the pool
+	tests := []struct {
+		name      string
+		next      NextBlock
+		wantUUIDs string
+	}{
+		{"block 10", NextBlock{Number: 10, Timestamp: uint64(now.Unix())}, "[due]"},
+		{"block 11", NextBlock{Number: 11, Timestamp: uint64(now.Unix()) + 4}, "[]"},
+		{"block 11 after the min timestamp", NextBlock{Number: 11, Timestamp: uint64(now.Unix()) + 5}, "[early]"},
+		{"block 12", NextBlock{Number: 12, Timestamp: uint64(now.Unix()) + 12}, "[later]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next = tt.next
+			calls, sent := client.calls, len(client.uuids)
+			dispatcher.dispatch(now)
+			if got := fmt.Sprint(client.uuids[sent:]); got != tt.wantUUIDs || (got != "[]") != (client.calls > calls) {
+				t.Errorf("dispatch() sent %s in %d sends, want %s", got, client.calls-calls, tt.wantUUIDs)
+			}
+		})
+	}
+}
+
+func TestDispatchFollowsTheSlotClock(t *testing.T) {
+	genesis := time.Unix(time.Now().Unix(), 0).Add(-time.Minute)
+	clock := &SlotClock{Genesis: genesis, SlotDuration: 12 * time.Second, Cutoff: 4 * time.Second, Window: 2 * time.Second}
+	next := NextBlock{Number: 10, Timestamp: uint64(genesis.Add(12 * time.Second).Unix())}
+	nextBlock := func(uint64) NextBlock { return next }
+
+	client := &fakeMergerClient{}
+	pool := newTestPool(orderingPolicies["block_number"])
+	pool.nextBlock = nextBlock
+	dispatcher := newTestDispatcher(pool, client, DispatchTriggers{BatchSize: 10, MaxLatency: time.Minute, SlotDeadline: clock.Window}, nextBlock)
+	dispatcher.clock = clock
+	dispatcher.latePolicy = lateBundleRetarget
+
+	// Eligible bundles are dispatched right away within the dispatch window
+	mustAddBundle(t, pool, newTestBundle(1, "early", 10), false)
+	if trigger, _ := dispatcher.trigger(genesis.Add(5 * time.Second)); trigger != "" {
+		t.Fatalf("trigger() = %q before the dispatch window, want none", trigger)
+	}
+	if trigger, _ := dispatcher.trigger(genesis.Add(6 * time.Second)); trigger != triggerSlotDeadline {
+		t.Fatalf("trigger() = %q within the dispatch window, want %q", trigger, triggerSlotDeadline)
+	}
+	dispatcher.dispatch(genesis.Add(6 * time.Second))
+
+	// After the cutoff the dispatch is held until the next slot and late bundles target the next block
+	mustAddBundle(t, pool, newTestBundle(2, "late", 10), false)
+	if wait := dispatcher.dispatch(genesis.Add(9 * time.Second)); wait != 3*time.Second || client.calls != 1 {
+		t.Fatalf("dispatch() = %v after %d sends, want 3s after 1", wait, client.calls)
+	}
+	if late := mustGetBundle(t, pool, "late"); late.TargetBlock != 11 {
+		t.Fatalf("late bundle targets block %d, want 11", late.TargetBlock)
+	}
+
+	// The late bundle is dispatched for the next block
+	next = NextBlock{Number: 11, Timestamp: uint64(genesis.Add(24 * time.Second).Unix())}
+	if dispatcher.dispatch(genesis.Add(18 * time.Second)); client.calls != 2 || client.uuids[len(client.uuids)-1] != "late" {
+		t.Errorf("got %d sends of %v, want the late bundle in the second send", client.calls, client.uuids)
+	}
+}
@@ -0,0 +1,36 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// bundleFeeScore computes the effective priority fee per gas of a bundle: the total effective
+// tip of its transactions divided by their total gas limit. The effective tip of a transaction is
+// min(GasTipCap, GasFeeCap - baseFee), so legacy and access list transactions tip their gas price
+// minus the base fee. Transactions whose fee cap is below the base fee lower the score. Without a
+// known base fee, the tip caps are used.
+func bundleFeeScore(txs []*types.Transaction, baseFee *big.Int) *big.Int {
+	totalTip := new(big.Int)
+	totalGas := new(big.Int)
+	for _, tx := range txs {
+		gas := new(big.Int).SetUint64(tx.Gas())
+		totalTip.Add(totalTip, new(big.Int).Mul(tx.EffectiveGasTipValue(baseFee), gas))
+		totalGas.Add(totalGas, gas)
+	}
+
+	if totalGas.Sign() == 0 {
+		return totalGas
+	}
+	return totalTip.Quo(totalTip, totalGas)
+}
+
+// feeScoreOf returns the cached fee score of a bundle, zero if it wasn't computed
+func feeScoreOf(bundle *TxPoolBundle) *big.Int {
+	if bundle.FeeScore == nil {
+		return new(big.Int)
+	}
+	return bundle.FeeScore
+}
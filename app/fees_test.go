@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var feeTestRecipient = common.HexToAddress("0x000000000000000000000000000000000000dEaD")
+
+func newLegacyTx(gas uint64, gasPrice int64) *types.Transaction {
+	return types.NewTx(&types.LegacyTx{Gas: gas, GasPrice: big.NewInt(gasPrice), To: &feeTestRecipient})
+}
+
+func newAccessListTx(gas uint64, gasPrice int64) *types.Transaction {
+	return types.NewTx(&types.AccessListTx{ChainID: big.NewInt(1), Gas: gas, GasPrice: big.NewInt(gasPrice), To: &feeTestRecipient})
+}
+
+func newDynamicFeeTx(gas uint64, gasFeeCap, gasTipCap int64) *types.Transaction {
+	return types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1), Gas: gas, GasFeeCap: big.NewInt(gasFeeCap), GasTipCap: big.NewInt(gasTipCap), To: &feeTestRecipient})
+}
+
+func TestBundleFeeScore(t *testing.T) {
+	tests := []struct {
+		name    string
+		txs     []*types.Transaction
+		baseFee *big.Int
+		want    int64
+	}{
+		{
+			name:    "legacy tips gas price minus base fee",
+			txs:     []*types.Transaction{newLegacyTx(21000, 30)},
+			baseFee: big.NewInt(10),
+			want:    20,
+		},
+		{
+			name:    "access list tips gas price minus base fee",
+			txs:     []*types.Transaction{newAccessListTx(21000, 25)},
+			baseFee: big.NewInt(10),
+			want:    15,
+		},
+		{
+			name:    "dynamic fee capped by tip cap",
+			txs:     []*types.Transaction{newDynamicFeeTx(21000, 100, 2)},
+			baseFee: big.NewInt(10),
+			want:    2,
+		},
+		{
+			name:    "dynamic fee capped by fee cap minus base fee",
+			txs:     []*types.Transaction{newDynamicFeeTx(21000, 12, 5)},
+			baseFee: big.NewInt(10),
+			want:    2,
+		},
+		{
+			name:    "fee cap below base fee lowers the score",
+			txs:     []*types.Transaction{newDynamicFeeTx(21000, 8, 5)},
+			baseFee: big.NewInt(10),
+			want:    -2,
+		},
+		{
+			name:    "unknown base fee uses the tip caps",
+			txs:     []*types.Transaction{newLegacyTx(21000, 30), newDynamicFeeTx(21000, 100, 2)},
+			baseFee: nil,
+			want:    16,
+		},
+		{
+			name:    "mixed bundle is weighted by gas",
+			txs:     []*types.Transaction{newLegacyTx(30000, 40), newAccessListTx(60000, 10), newDynamicFeeTx(10000, 100, 19)},
+			baseFee: big.NewInt(10),
+			want:    (30000*30 + 60000*0 + 10000*19) / 100000,
+		},
+		{
+			name: "empty bundle",
+			want: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := bundleFeeScore(tt.txs, tt.baseFee)
+			if got.Cmp(big.NewInt(tt.want)) != 0 {
+				t.Errorf("bundleFeeScore() = %s, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortByFeeScore(t *testing.T) {
+	pool := newTestPool(orderingPolicies["fee"])
+
+	low := &TxPoolBundle{ChainID: 1, Txs: []*types.Transaction{newLegacyTx(21000, 12)}}
+	high := &TxPoolBundle{ChainID: 1, Txs: []*types.Transaction{newDynamicFeeTx(21000, 100, 5)}}
+	capped := &TxPoolBundle{ChainID: 1, Txs: []*types.Transaction{newDynamicFeeTx(21000, 13, 10)}}
+	for _, bundle := range []*TxPoolBundle{low, capped, high} {
+		if _, err := pool.addBundle(bundle, false); err != nil {
+			t.Fatalf("addBundle() error = %v", err)
+		}
+	}
+
+	// With a base fee of 10, the tips are 2, 3 and 5
+	pool.setBaseFee(1, big.NewInt(10))
+	assertBundleOrder(t, queuedBundles(pool, 3), high, capped, low)
+
+	// With a base fee of 0, the tips are 12, 10 and 5
+	pool.setBaseFee(1, big.NewInt(0))
+	assertBundleOrder(t, queuedBundles(pool, 3), low, capped, high)
+}
+
+func assertBundleOrder(t *testing.T, got []*TxPoolBundle, want ...*TxPoolBundle) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d bundles, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("bundle %d has fee score %s, want fee score %s", i, feeScoreOf(got[i]), feeScoreOf(want[i]))
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// headFollowerRequestTimeout bounds a single JSON-RPC request to the node
+const headFollowerRequestTimeout = 5 * time.Second
+
+// Define Prometheus metrics
+var (
+	chainHeadGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "chain_head_block",
+			Help: "Latest block number seen by the head follower by chain ID",
+		},
+		[]string{"chain_id"},
+	)
+	headFollowerErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "head_follower_errors_total",
+			Help: "Total number of failed head polls by chain ID",
+		},
+		[]string{"chain_id"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(chainHeadGauge)
+	profSequencerRegisterer.MustRegister(headFollowerErrorsCounter)
+}
+
+// ChainHead represents the latest block of a chain.
+type ChainHead struct {
+	Number    uint64        `json:"number"`    // Block number
+	Hash      common.Hash   `json:"hash"`      // Block hash
+	Timestamp uint64        `json:"timestamp"` // Block timestamp in seconds
+	BaseFee   *big.Int      `json:"baseFee"`   // Base fee per gas in wei, nil before London
+	SeenAt    time.Time     `json:"seenAt"`    // Time the follower saw the block
+	TxHashes  []common.Hash `json:"-"`         // Hashes of the transactions included in the block
+}
+
+// HeadFollower follows the head of a chain by polling eth_blockNumber and eth_getBlockByNumber
+// on an Ethereum JSON-RPC endpoint.
+type HeadFollower struct {
+	chainID  uint64          // Chain followed
+	rpcURL   string          // HTTP URL of the JSON-RPC endpoint
+	interval time.Duration   // Poll interval
+	client   *http.Client    // HTTP client used for the requests
+	onHead   func(ChainHead) // Called for every new head
+	head     *ChainHead      // Latest head, nil until the first successful poll
+	mu       sync.RWMutex    // A mutex for the head
+}
+
+func newHeadFollower(chainID uint64, rpcURL string, interval time.Duration, onHead func(ChainHead)) *HeadFollower {
+	return &HeadFollower{
+		chainID:  chainID,
+		rpcURL:   rpcURL,
+		interval: interval,
+		client:   &http.Client{Timeout: headFollowerRequestTimeout},
+		onHead:   onHead,
+	}
+}
+
+// latest returns the latest head seen by the follower
+func (f *HeadFollower) latest() (ChainHead, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.head == nil {
+		return ChainHead{}, false
+	}
+	return *f.head, true
+}
+
+// start polls the chain head until the context is canceled
+func (f *HeadFollower) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := f.poll(ctx); err != nil {
+				headFollowerErrorsCounter.WithLabelValues(chainLabel(f.chainID)).Inc()
+				log.Warn().Err(err).Uint64("chain_id", f.chainID).Str("rpc_url", f.rpcURL).Msg("Failed to poll chain head")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// poll fetches the blocks from the latest head up to the latest block of the chain and notifies
+// about each of them in order, so the transactions of blocks produced between two polls are seen as
+// well. A failed fetch is retried by the next poll, starting after the latest block notified about.
+func (f *HeadFollower) poll(ctx context.Context) error {
+	var number hexutil.Uint64
+	if err := f.call(ctx, "eth_blockNumber", []interface{}{}, &number); err != nil {
+		return err
+	}
+
+	// Heads only move forward, reorgs to a lower height are picked up once the chain advances
+	from := uint64(number)
+	if head, exists := f.latest(); exists {
+		if head.Number >= uint64(number) {
+			return nil
+		}
+		from = head.Number + 1
+	}
+
+	for n := from; n <= uint64(number); n++ {
+		head, err := f.fetchBlock(ctx, n)
+		if err != nil {
+			return err
+		}
+
+		f.mu.Lock()
+		f.head = &head
+		f.mu.Unlock()
+
+		chainHeadGauge.WithLabelValues(chainLabel(f.chainID)).Set(float64(head.Number))
+		log.Debug().Uint64("chain_id", f.chainID).Uint64("block", head.Number).Uint64("timestamp", head.Timestamp).Msg("New chain head")
+
+		if f.onHead != nil {
+			f.onHead(head)
+		}
+	}
+	return nil
+}
+
+// fetchBlock fetches a block by number with the hashes of its transactions
+func (f *HeadFollower) fetchBlock(ctx context.Context, number uint64) (ChainHead, error) {
+	var block *struct {
+		Number    hexutil.Uint64 `json:"number"`
+		Hash      common.Hash    `json:"hash"`
+		Timestamp hexutil.Uint64 `json:"timestamp"`
+		BaseFee   *hexutil.Big   `json:"baseFeePerGas"`
+		TxHashes  []common.Hash  `json:"transactions"`
+	}
+	if err := f.call(ctx, "eth_getBlockByNumber", []interface{}{hexutil.Uint64(number), false}, &block); err != nil {
+		return ChainHead{}, err
+	}
+	if block == nil {
+		return ChainHead{}, fmt.Errorf("block %d not found", number)
+	}
+
+	return ChainHead{
+		Number:    uint64(block.Number),
+		Hash:      block.Hash,
+		Timestamp: uint64(block.Timestamp),
+		BaseFee:   (*big.Int)(block.BaseFee),
+		SeenAt:    time.Now(),
+		TxHashes:  block.TxHashes,
+	}, nil
+}
+
+// call performs a JSON-RPC request and decodes the result into result
+func (f *HeadFollower) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(JSONRPCRequest{JSONRPC: "2.0", ID: json.RawMessage("1"), Method: method, Params: rawParams})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.rpcURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %v", method, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected HTTP status %s", method, resp.Status)
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %v", method, err)
+	}
+
+	var rpcResp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *JSONRPCError   `json:"error"`
+	}
+	if err := json.Unmarshal(respBody, &rpcResp); err != nil {
+		return fmt.Errorf("%s: invalid response: %v", method, err)
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("%s: %v", method, rpcResp.Error)
+	}
+	if err := json.Unmarshal(rpcResp.Result, result); err != nil {
+		return fmt.Errorf("%s: invalid result: %v", method, err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// testNode is a local stand-in for the JSON-RPC endpoint of a node
+type testNode struct {
+	number    uint64            // Latest block number
+	timestamp uint64            // Timestamp of the latest block, earlier blocks are 12 seconds apart
+	txHashes  map[uint64]string // JSON arrays of the transaction hashes by block
+	fail      bool              // Answer every request with a JSON-RPC error
+	mu        sync.Mutex
+}
+
+func (n *testNode) setHead(number uint64, timestamp uint64, txHashes string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.txHashes == nil {
+		n.txHashes = make(map[uint64]string)
+	}
+	n.number, n.timestamp, n.txHashes[number] = number, timestamp, txHashes
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var req JSONRPCRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case n.fail:
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"node unavailable"}}`)
+	case req.Method == "eth_blockNumber":
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":"0x%x"}`, n.number)
+	case req.Method == "eth_getBlockByNumber":
+		var params []json.RawMessage
+		var requested hexutil.Uint64
+		if err := json.Unmarshal(req.Params, &params); err != nil || len(params) == 0 || json.Unmarshal(params[0], &requested) != nil {
+			http.Error(w, "invalid params", http.StatusBadRequest)
+			return
+		}
+		number := uint64(requested)
+		if number > n.number {
+			fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":null}`)
+			return
+		}
+		txHashes := n.txHashes[number]
+		if txHashes == "" {
+			txHashes = "[]"
+		}
+		timestamp := n.timestamp - (n.number-number)*12
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":{"number":"0x%x","hash":"0x%064x","timestamp":"0x%x","baseFeePerGas":"0x7","transactions":%s}}`, number, number, timestamp, txHashes)
+	default:
+		http.Error(w, "unknown method", http.StatusNotFound)
+	}
+}
+
+func TestHeadFollowerPoll(t *testing.T) {
+	node := &testNode{}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	var heads []ChainHead
+	follower := newHeadFollower(1, server.URL, time.Second, func(head ChainHead) { heads = append(heads, head) })
+
+	tests := []struct {
+		name      string
+		number    uint64
+		wantHeads int
+		wantHead  uint64
+	}{
+		{"first head", 10, 1, 10},
+		{"same head", 10, 1, 10},
+		{"new head after a skipped block", 12, 3, 12},
+		{"lower head after a reorg", 11, 3, 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node.setHead(tt.number, 1_700_000_000+tt.number*12, "")
+			if err := follower.poll(context.Background()); err != nil {
+				t.Fatalf("poll() error = %v", err)
+			}
+			head, exists := follower.latest()
+			if len(heads) != tt.wantHeads || !exists || head.Number != tt.wantHead {
+				t.Errorf("poll() notified %d heads, latest %d, want %d heads, latest %d", len(heads), head.Number, tt.wantHeads, tt.wantHead)
+			}
+		})
+	}
+
+	if head := heads[0]; head.Timestamp != 1_700_000_120 || head.BaseFee == nil || head.BaseFee.Int64() != 7 {
+		t.Errorf("head = %+v, want the timestamp and base fee of block 10", head)
+	}
+	if skipped := heads[1]; skipped.Number != 11 || skipped.Timestamp != 1_700_000_132 {
+		t.Errorf("head = %+v, want block 11 skipped between two polls", skipped)
+	}
+
+	node.mu.Lock()
+	node.fail = true
+	node.mu.Unlock()
+	if err := follower.poll(context.Background()); err == nil {
+		t.Errorf("poll() ignored a JSON-RPC error of the node")
+	}
+}
+
+func TestChainPoolsExpireBundlesOnHead(t *testing.T) {
+	node := &testNode{}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	pools := newTestChainPools(t)
+	pool := pools.pools[1]
+	included := newTestBundle(1, "included", 11)
+	for _, bundle := range []*TxPoolBundle{newTestBundle(2, "passed", 10), included, newTestBundle(3, "next", 12)} {
+		mustAddBundle(t, pool, bundle, false)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node.setHead(11, uint64(time.Now().Unix()), `["`+included.Txs[0].Hash().Hex()+`"]`)
+	if err := pools.startHeadFollowers(ctx, map[uint64]string{1: server.URL}, time.Hour); err != nil {
+		t.Fatalf("startHeadFollowers() error = %v", err)
+	}
+
+	// The first poll runs right away, bundles are expired last on a new head
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if status, _ := pool.statusTracker.get("passed"); status.State == BundleStateExpired {
+			break
+		}
+	}
+	if next := pools.nextBlock(1); next.Number != 12 {
+		t.Fatalf("nextBlock() = %d, want 12", next.Number)
+	}
+
+	tests := []struct {
+		uuid      string
+		wantState BundleState
+	}{
+		{"passed", BundleStateExpired},
+		{"included", BundleStateIncluded},
+		{"next", BundleStateQueued},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uuid, func(t *testing.T) {
+			if status, _ := pool.statusTracker.get(tt.uuid); status.State != tt.wantState {
+				t.Errorf("bundle has state %s, want %s", status.State, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestChainPoolsMarksBundlesIncludedInSkippedBlocks(t *testing.T) {
+	node := &testNode{}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	pools := newTestChainPools(t)
+	pool := pools.pools[1]
+	ranged := newTestBundle(1, "ranged", 11)
+	ranged.MaxBlockNumber = "0xd"
+	mustAddBundle(t, pool, ranged, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node.setHead(10, uint64(time.Now().Unix()), "")
+	if err := pools.startHeadFollowers(ctx, map[uint64]string{1: server.URL}, time.Hour); err != nil {
+		t.Fatalf("startHeadFollowers() error = %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && pools.nextBlock(1).Number != 11; time.Sleep(10 * time.Millisecond) {
+	}
+
+	// The bundle is included in block 11, which the follower only sees once the head is at 12
+	node.mu.Lock()
+	node.txHashes[11] = `["` + ranged.Txs[0].Hash().Hex() + `"]`
+	node.mu.Unlock()
+	node.setHead(12, uint64(time.Now().Unix()), "")
+	if err := pools.followers[1].poll(ctx); err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+	if status, _ := pool.statusTracker.get("ranged"); status.State != BundleStateIncluded {
+		t.Errorf("bundle has state %s, want %s", status.State, BundleStateIncluded)
+	}
+}
@@ -7,19 +7,28 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// healthHandler is the handler for the health check endpoint
-func healthHandler(c *gin.Context) {
-	// Check the health and return a status code accordingly
-	if isHealthy() {
-		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
-	} else {
-		c.JSON(http.StatusOK, gin.H{"status": "not healthy"})
+// handleHealth is the handler for the health check endpoint. The sequencer is degraded while the
+// circuit of a bundle merger isn't closed, it keeps accepting bundles meanwhile.
+func handleHealth(circuits *CircuitRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		circuitViews := circuits.views()
+
+		// Check the health and return a status code accordingly
+		status := "healthy"
+		if !isHealthy(circuitViews) {
+			status = "degraded"
+		}
+		c.JSON(http.StatusOK, gin.H{"status": status, "bundleMergers": circuitViews})
 	}
 }
 
 // helper functions
-// isHealthy checks the health of the service
-// ToDo: implement a proper health check
-func isHealthy() bool {
+// isHealthy checks the health of the service by the circuits of the bundle mergers
+func isHealthy(circuitViews []CircuitView) bool {
+	for _, view := range circuitViews {
+		if view.State != circuitClosed {
+			return false
+		}
+	}
 	return true
 }
@@ -0,0 +1,275 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Standard JSON-RPC 2.0 error codes
+const (
+	rpcErrParseError     = -32700 // Invalid JSON was received
+	rpcErrInvalidRequest = -32600 // The JSON sent is not a valid request object
+	rpcErrMethodNotFound = -32601 // The method does not exist or is not available
+	rpcErrInvalidParams  = -32602 // Invalid method parameters
+	rpcErrInternal       = -32603 // Internal JSON-RPC error
+	rpcErrServer         = -32000 // Generic implementation-defined server error
+	rpcErrLimitExceeded  = -32005 // Request exceeds a defined limit, e.g. the pool capacity
+)
+
+// JSONRPCRequest represents a single JSON-RPC 2.0 request object.
+type JSONRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`          // JSON-RPC version, must be "2.0"
+	ID      json.RawMessage `json:"id,omitempty"`     // ID of the request, absent for notifications
+	Method  string          `json:"method"`           // Method name used for dispatching
+	Params  json.RawMessage `json:"params,omitempty"` // Raw params, decoded by the method handler
+}
+
+// JSONRPCResponse represents a single JSON-RPC 2.0 response object.
+type JSONRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`          // JSON-RPC version, always "2.0"
+	ID      json.RawMessage `json:"id"`               // ID echoed from the request, null if unknown
+	Result  interface{}     `json:"result,omitempty"` // Result of a successful call
+	Error   *JSONRPCError   `json:"error,omitempty"`  // Error of a failed call
+}
+
+// JSONRPCError represents a JSON-RPC 2.0 error object.
+type JSONRPCError struct {
+	Code    int         `json:"code"`           // Error code
+	Message string      `json:"message"`        // Short error description
+	Data    interface{} `json:"data,omitempty"` // Optional additional error information
+}
+
+func (e *JSONRPCError) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+// newRPCError creates a new JSON-RPC error object
+func newRPCError(code int, message string, data interface{}) *JSONRPCError {
+	return &JSONRPCError{Code: code, Message: message, Data: data}
+}
+
+// RPCMethod is the handler of a single JSON-RPC method. Returned errors of type
+// *JSONRPCError are passed to the caller as is, all other errors are reported as internal errors.
+type RPCMethod func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// RPCRegistry maps JSON-RPC method names to their handlers.
+type RPCRegistry struct {
+	methods map[string]RPCMethod // Registered handlers by method name
+	mu      sync.RWMutex         // A mutex for concurrent access
+}
+
+func newRPCRegistry() *RPCRegistry {
+	return &RPCRegistry{
+		methods: make(map[string]RPCMethod),
+	}
+}
+
+func (r *RPCRegistry) register(method string, handler RPCMethod) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.methods[method]; exists {
+		log.Warn().Str("method", method).Msg("Overriding already registered JSON-RPC method")
+	}
+	r.methods[method] = handler
+}
+
+func (r *RPCRegistry) lookup(method string) (RPCMethod, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handler, exists := r.methods[method]
+	return handler, exists
+}
+
+// contextKey is the type for values stored in a request context
+type contextKey string
+
+const usernameContextKey contextKey = "username"
+
+// usernameFromContext returns the authenticated username stored by the JSON-RPC handler
+func usernameFromContext(ctx context.Context) string {
+	username, _ := ctx.Value(usernameContextKey).(string)
+	return username
+}
+
+// decodeParams decodes the raw params of a request into target, reporting failures as invalid params
+func decodeParams(params json.RawMessage, target interface{}) error {
+	if len(params) == 0 {
+		return newRPCError(rpcErrInvalidParams, "Missing params", nil)
+	}
+	if err := json.Unmarshal(params, target); err != nil {
+		return newRPCError(rpcErrInvalidParams, "Invalid params", err.Error())
+	}
+	return nil
+}
+
+// rpcMethodLookup resolves JSON-RPC method names to their handlers
+type rpcMethodLookup interface {
+	lookup(method string) (RPCMethod, bool)
+}
+
+// pinnedRPCMethod restricts a registry to a single method, other methods are not found
+type pinnedRPCMethod struct {
+	registry *RPCRegistry // Registry the method is looked up in
+	method   string       // The only method served
+}
+
+func (p pinnedRPCMethod) lookup(method string) (RPCMethod, bool) {
+	if method != p.method {
+		return nil, false
+	}
+	return p.registry.lookup(method)
+}
+
+// only returns a lookup serving the given method of the registry only, e.g. for a legacy per-method route
+func (r *RPCRegistry) only(method string) rpcMethodLookup {
+	return pinnedRPCMethod{registry: r, method: method}
+}
+
+// handleJSONRPC serves single and batch JSON-RPC 2.0 requests and dispatches them via the method lookup
+func handleJSONRPC(registry rpcMethodLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Start a new span for the handleJSONRPC function
+		tracer := otel.Tracer("prof-sequencer")
+		ctx, span := tracer.Start(c.Request.Context(), "handleJSONRPC")
+		defer span.End()
+
+		// Make the authenticated user available to the method handlers
+		ctx = context.WithValue(ctx, usernameContextKey, c.GetString("username"))
+
+		// Read the raw request body
+		rawBody, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusOK, errorResponse(nil, newRPCError(rpcErrInternal, "Failed to read request body", err.Error())))
+			return
+		}
+
+		response := processRPCPayload(ctx, registry, rawBody)
+		if response == nil {
+			// Notifications are not answered
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// processRPCPayload handles a raw single or batch request and returns the response to send.
+// It returns nil if nothing needs to be answered, i.e. for notifications.
+func processRPCPayload(ctx context.Context, methods rpcMethodLookup, rawBody []byte) interface{} {
+	rawBody = bytes.TrimSpace(rawBody)
+	if len(rawBody) == 0 || rawBody[0] != '[' {
+		// Single request
+		var raw json.RawMessage
+		if err := json.Unmarshal(rawBody, &raw); err != nil {
+			return errorResponse(nil, newRPCError(rpcErrParseError, "Parse error", err.Error()))
+		}
+
+		if response := dispatchRPC(ctx, methods, raw); response != nil {
+			return response
+		}
+		return nil
+	}
+
+	// Batch request
+	var batch []json.RawMessage
+	if err := json.Unmarshal(rawBody, &batch); err != nil {
+		return errorResponse(nil, newRPCError(rpcErrParseError, "Parse error", err.Error()))
+	}
+	if len(batch) == 0 {
+		return errorResponse(nil, newRPCError(rpcErrInvalidRequest, "Empty batch", nil))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("rpc.batch_size", len(batch)))
+
+	responses := make([]*JSONRPCResponse, 0, len(batch))
+	for _, raw := range batch {
+		if response := dispatchRPC(ctx, methods, raw); response != nil {
+			responses = append(responses, response)
+		}
+	}
+
+	// A batch consisting only of notifications is not answered
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+// dispatchRPC validates a single request object and calls the registered method.
+// It returns nil for notifications, i.e. requests without an id.
+func dispatchRPC(ctx context.Context, methods rpcMethodLookup, raw json.RawMessage) *JSONRPCResponse {
+	var req JSONRPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return errorResponse(nil, newRPCError(rpcErrInvalidRequest, "Invalid request", err.Error()))
+	}
+
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return errorResponse(req.ID, newRPCError(rpcErrInvalidRequest, "Invalid request", "jsonrpc must be \"2.0\" and method must be set"))
+	}
+
+	tracer := otel.Tracer("prof-sequencer")
+	ctx, span := tracer.Start(ctx, "dispatchRPC")
+	span.SetAttributes(attribute.String("rpc.method", req.Method))
+	defer span.End()
+
+	handler, exists := methods.lookup(req.Method)
+	if !exists {
+		log.Warn().Str("method", req.Method).Msg("JSON-RPC method not found")
+		return notificationFilter(req.ID, errorResponse(req.ID, newRPCError(rpcErrMethodNotFound, "Method not found", req.Method)))
+	}
+
+	result, err := handler(ctx, req.Params)
+	if err != nil {
+		var rpcErr *JSONRPCError
+		if !errors.As(err, &rpcErr) {
+			log.Error().Str("method", req.Method).Err(err).Msg("JSON-RPC method failed")
+			rpcErr = newRPCError(rpcErrInternal, "Internal error", err.Error())
+		}
+		return notificationFilter(req.ID, errorResponse(req.ID, rpcErr))
+	}
+
+	// The result member is required on success, even if it is null
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+
+	return notificationFilter(req.ID, &JSONRPCResponse{
+		JSONRPC: "2.0",
+		ID:      req.ID,
+		Result:  result,
+	})
+}
+
+// notificationFilter drops the response of notifications
+func notificationFilter(id json.RawMessage, response *JSONRPCResponse) *JSONRPCResponse {
+	if len(id) == 0 {
+		return nil
+	}
+	return response
+}
+
+// errorResponse creates a response object carrying the given error
+func errorResponse(id json.RawMessage, rpcErr *JSONRPCError) *JSONRPCResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &JSONRPCResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   rpcErr,
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// newTestRPCRegistry returns a registry with an echo method and methods failing with a JSON-RPC and a plain error
+func newTestRPCRegistry() *RPCRegistry {
+	registry := newRPCRegistry()
+	registry.register("test_echo", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var args []string
+		if err := decodeParams(params, &args); err != nil {
+			return nil, err
+		}
+		return args, nil
+	})
+	registry.register("test_rpcError", func(context.Context, json.RawMessage) (interface{}, error) {
+		return nil, newRPCError(rpcErrLimitExceeded, "pool full", nil)
+	})
+	registry.register("test_error", func(context.Context, json.RawMessage) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	return registry
+}
+
+// marshalRPC encodes a response of processRPCPayload as JSON
+func marshalRPC(t *testing.T, response interface{}) string {
+	t.Helper()
+
+	if response == nil {
+		return ""
+	}
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return string(encoded)
+}
+
+func TestProcessRPCPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"single request", `{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["a"]}`, `{"jsonrpc":"2.0","id":1,"result":["a"]}`},
+		{"notification", `{"jsonrpc":"2.0","method":"test_echo","params":["a"]}`, ``},
+		{"parse error", `{"jsonrpc":`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"Parse error","data":"unexpected end of JSON input"}}`},
+		{"wrong version", `{"jsonrpc":"1.0","id":1,"method":"test_echo"}`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"Invalid request","data":"jsonrpc must be \"2.0\" and method must be set"}}`},
+		{"unknown method", `{"jsonrpc":"2.0","id":1,"method":"test_missing"}`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"Method not found","data":"test_missing"}}`},
+		{"missing params", `{"jsonrpc":"2.0","id":1,"method":"test_echo"}`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Missing params"}}`},
+		{"JSON-RPC error", `{"jsonrpc":"2.0","id":"x","method":"test_rpcError"}`, `{"jsonrpc":"2.0","id":"x","error":{"code":-32005,"message":"pool full"}}`},
+		{"internal error", `{"jsonrpc":"2.0","id":1,"method":"test_error"}`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"Internal error","data":"boom"}}`},
+		{"empty batch", `[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Empty batch"}}`},
+		{
+			"batch",
+			`[{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["a"]},{"jsonrpc":"2.0","method":"test_echo","params":["b"]},1]`,
+			`[{"jsonrpc":"2.0","id":1,"result":["a"]},{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid request","data":"json: cannot unmarshal number into Go value of type main.JSONRPCRequest"}}]`,
+		},
+		{"batch of notifications", `[{"jsonrpc":"2.0","method":"test_echo","params":["a"]}]`, ``},
+	}
+	registry := newTestRPCRegistry()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := marshalRPC(t, processRPCPayload(context.Background(), registry, []byte(tt.body))); got != tt.want {
+				t.Errorf("processRPCPayload() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinnedRPCMethodServesItsMethodOnly(t *testing.T) {
+	methods := newTestRPCRegistry().only("test_echo")
+
+	got := marshalRPC(t, processRPCPayload(context.Background(), methods, []byte(`{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["a"]}`)))
+	if want := `{"jsonrpc":"2.0","id":1,"result":["a"]}`; got != want {
+		t.Errorf("processRPCPayload() = %s, want %s", got, want)
+	}
+
+	got = marshalRPC(t, processRPCPayload(context.Background(), methods, []byte(`{"jsonrpc":"2.0","id":1,"method":"test_error"}`)))
+	if want := `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"Method not found","data":"test_error"}}`; got != want {
+		t.Errorf("processRPCPayload() = %s, want %s", got, want)
+	}
+}
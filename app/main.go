@@ -5,6 +5,7 @@ import (
 	"context"
 	"flag"
 	"io"
+	"math/big"
 	"net/http"
 	"os"
 	"os/signal"
@@ -35,6 +36,77 @@ func main() {
 	useTLS := flag.Bool("use-tls", false, "Use TLS for gRPC connection")
 	tracingURL := flag.String("tracing-url", "", "URL for tracing endpoint (leave empty to disable tracing)")
 
+	// Add command-line flags for the TLS of the bundle merger connections
+	tlsCAFile := flag.String("tls-ca-file", "", "PEM bundle of the CAs verifying the bundle merger (leave empty for the system roots)")
+	tlsServerName := flag.String("tls-server-name", "", "Name verified against the certificate of the bundle merger (leave empty for the host of the gRPC URL)")
+	tlsCertFile := flag.String("tls-cert-file", "", "PEM client certificate for mutual TLS with the bundle merger")
+	tlsKeyFile := flag.String("tls-key-file", "", "PEM key of the client certificate")
+	tlsInsecureSkipVerify := flag.Bool("tls-insecure-skip-verify", false, "Skip the verification of the bundle merger certificate, also allows insecureSkipVerify in --mergers-config (insecure)")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", time.Minute, "Interval of the checks for changed certificate files of the bundle merger connections (0 to disable)")
+
+	// Add command-line flag for the retention of bundle statuses
+	statusRetention := flag.Duration("bundle-status-retention", 10*time.Minute, "How long bundle statuses are kept after a bundle left the pool")
+
+	// Add command-line flag for the validation rule configuration
+	validationConfig := flag.String("validation-config", "", "Path to the JSON validation rule configuration (leave empty for the default rules)")
+
+	// Add command-line flags for the chains served by the sequencer
+	chainIDs := flag.String("chain-ids", "1", "Comma-separated list of accepted chain IDs, the first one is the primary chain")
+	allowUnprotected := flag.Bool("allow-unprotected-txs", true, "Accept legacy transactions without replay protection, routed to the primary chain")
+	perChainPools := flag.Bool("per-chain-pools", false, "Run a separate bundle pool and bundle merger target per chain ID")
+	chainGRPCURLs := flag.String("chain-grpc-urls", "", "Comma-separated list of chainID=grpcURL bundle merger targets (requires --per-chain-pools, defaults to --grpc-url)")
+	chainRPCURLs := flag.String("chain-rpc-urls", "", "Comma-separated list of chainID=rpcURL Ethereum JSON-RPC endpoints to follow the chain heads (leave empty to disable)")
+	headPollInterval := flag.Duration("head-poll-interval", 2*time.Second, "Interval of chain head polls")
+	blockTime := flag.Duration("block-time", 12*time.Second, "Expected time between blocks, used to estimate the timestamp of the upcoming block")
+
+	// Add command-line flag for the builder registry configuration
+	buildersConfig := flag.String("builders-config", "", "Path to the JSON builder registry configuration (leave empty for the default builders)")
+
+	// Add command-line flag for the ordering of the pools
+	orderingPolicySpec := flag.String("ordering-policy", defaultOrderingPolicy, "Comma-separated list of bundle ordering policies, each later policy breaks the ties of the earlier ones")
+	baseFeeFlag := flag.String("base-fee", "", "Base fee per gas in wei for the fee ordering until a head follower tracks it (leave empty to order by tip caps)")
+
+	// Add command-line flags for the persistence of the pools
+	poolDataDir := flag.String("pool-data-dir", "", "Directory for the write-ahead log and snapshots of the pools (leave empty to keep the pools in memory only)")
+	poolSnapshotInterval := flag.Duration("pool-snapshot-interval", time.Minute, "Interval of pool snapshots, which compact the write-ahead log")
+	poolWALFsync := flag.Bool("pool-wal-fsync", false, "Sync the write-ahead log to disk after every record instead of on every snapshot")
+
+	// Add command-line flags for the capacity limits of the pools
+	poolMaxBundles := flag.Int("pool-max-bundles", 0, "Maximum number of pending bundles per pool (0 for no limit)")
+	poolMaxBytes := flag.Uint64("pool-max-bytes", 0, "Maximum encoded size in bytes of the transactions of the pending bundles per pool (0 for no limit)")
+	poolMaxBundlesPerUser := flag.Int("pool-max-bundles-per-user", 0, "Maximum number of pending bundles per user and pool (0 for no limit)")
+	poolMaxBytesPerUser := flag.Uint64("pool-max-bytes-per-user", 0, "Maximum encoded size in bytes of the transactions of the pending bundles per user and pool (0 for no limit)")
+	poolMaxBundlesPerBlock := flag.Int("pool-max-bundles-per-block", 0, "Maximum number of pending bundles per target block and pool (0 for no limit)")
+	poolEvictionPolicy := flag.String("pool-eviction-policy", evictionLowestScore, "Bundle evicted if a limit is reached: lowest_score, oldest or none")
+
+	// Add command-line flags for the retries of bundles dispatched to the bundle merger
+	dispatchMaxAttempts := flag.Int("dispatch-max-attempts", defaultRetryPolicy.MaxAttempts, "Dispatches of a bundle to the bundle merger before it's dead-lettered")
+	dispatchLeaseTimeout := flag.Duration("dispatch-lease-timeout", defaultRetryPolicy.LeaseTimeout, "Time a dispatched bundle waits for the answer of the bundle merger before it counts as rejected")
+	dispatchRetryBackoff := flag.Duration("dispatch-retry-backoff", defaultRetryPolicy.Backoff, "Delay before the first retry of a rejected bundle, doubled by every further attempt")
+	dispatchMaxRetryBackoff := flag.Duration("dispatch-max-retry-backoff", defaultRetryPolicy.MaxBackoff, "Upper bound of the delay before the retry of a rejected bundle")
+
+	// Add command-line flag for the bundle merger configuration
+	mergersConfig := flag.String("mergers-config", "", "Path to the JSON bundle merger configuration with the dispatch mode (leave empty for a single bundle merger per chain from --grpc-url and --chain-grpc-urls)")
+
+	// Add command-line flags for the dispatch triggers of the pools
+	dispatchBatchSize := flag.Int("dispatch-batch-size", defaultDispatchTriggers.BatchSize, "Eligible bundles that trigger a dispatch, also the maximum number of bundles per dispatch")
+	dispatchMaxLatency := flag.Duration("dispatch-max-latency", defaultDispatchTriggers.MaxLatency, "Longest time the oldest eligible bundle waits for a dispatch since its arrival")
+	dispatchSlotDeadline := flag.Duration("dispatch-slot-deadline", defaultDispatchTriggers.SlotDeadline, "Time before the upcoming block, or the cutoff of the slot clock, from which eligible bundles are dispatched right away, requires a head follower or a slot clock (0 to disable)")
+
+	// Add command-line flags for the beacon slot clock
+	slotGenesisTime := flag.Int64("slot-genesis-time", 0, "Unix time in seconds of the beacon chain genesis for the slot clock (0 to disable, unless --beacon-url is given)")
+	slotDuration := flag.Duration("slot-duration", 12*time.Second, "Duration of a beacon slot, with --slot-genesis-time")
+	beaconURL := flag.String("beacon-url", "", "HTTP URL of a beacon node API the genesis time and slot duration of the slot clock are read from (leave empty to disable)")
+	slotCutoff := flag.Duration("slot-cutoff", 4*time.Second, "Time before the end of a slot from which the bundle set of the upcoming block is final, with a slot clock")
+	lateBundlePolicy := flag.String("late-bundle-policy", lateBundleRetarget, "Handling of bundles still targeting the upcoming block after the slot cutoff: retarget or drop")
+
+	// Add command-line flags for the circuit breakers of the bundle mergers
+	breakerThreshold := flag.Int("merger-breaker-threshold", 5, "Consecutive failed sends to a bundle merger that open its circuit")
+	breakerCooldown := flag.Duration("merger-breaker-cooldown", 30*time.Second, "Time the circuit of a bundle merger stays open before a trial send")
+
+	// Add command-line flag for bundles conflicting with pending bundles
+	conflictPolicy := flag.String("conflict-policy", conflictKeepHigher, "Handling of bundles of a user sharing a transaction or a sender nonce with pending bundles of the user: reject or keep_higher")
+
 	flag.Parse()
 
 	// Set log level
@@ -81,10 +153,183 @@ func main() {
 	// Log the gRPC URL and useTLS flag being used
 	log.Info().Str("grpc_url", *grpcURL).Bool("use_tls", *useTLS).Msg("gRPC configuration")
 
-	txPool := &TxBundlePool{
-		bundles:    []*TxPoolBundle{},
-		bundleMap:  make(map[string]*TxPoolBundle),
-		customSort: sortByBlockNumber,
+	// Parse the chains served by the sequencer
+	acceptedChainIDs, err := parseChainIDs(*chainIDs)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid chain IDs")
+	}
+	chainTargets, err := parseChainURLs(*chainGRPCURLs)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid chain gRPC URLs")
+	}
+	rpcURLs, err := parseChainURLs(*chainRPCURLs)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid chain RPC URLs")
+	}
+	chains := ChainConfig{ChainIDs: acceptedChainIDs, AllowUnprotected: *allowUnprotected}
+	log.Info().Interface("chain_ids", chains.ChainIDs).Bool("per_chain_pools", *perChainPools).Msg("Chain configuration")
+
+	// Build the transaction validation pipeline
+	validator, err := loadValidationPipeline(*validationConfig, chains)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid validation configuration")
+	}
+
+	// Bundle lifecycle events are pushed to subscribers of the bundle owner
+	bundleEvents := newBundleEventHub()
+	statusTracker := newBundleStatusTracker(*statusRetention, bundleEvents)
+
+	// Load the builder registry
+	builders, err := loadBuilderRegistry(*buildersConfig)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid builder configuration")
+	}
+
+	// Resolve the ordering policy of the pools
+	ordering, err := parseOrderingPolicy(*orderingPolicySpec)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid ordering policy")
+	}
+	log.Info().Str("policy", ordering.Name()).Msg("Ordering policy")
+
+	// Bound the pools by the capacity limits
+	limits := PoolLimits{
+		MaxBundles:         *poolMaxBundles,
+		MaxBytes:           *poolMaxBytes,
+		MaxBundlesPerUser:  *poolMaxBundlesPerUser,
+		MaxBytesPerUser:    *poolMaxBytesPerUser,
+		MaxBundlesPerBlock: *poolMaxBundlesPerBlock,
+		Eviction:           *poolEvictionPolicy,
+	}
+	if err := limits.validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid pool limits")
+	}
+	log.Info().Interface("limits", limits).Msg("Pool limits")
+	if err := validateConflictPolicy(*conflictPolicy); err != nil {
+		log.Fatal().Err(err).Msg("Invalid conflict policy")
+	}
+
+	// Retry bundles the bundle merger rejects within a budget
+	retry := RetryPolicy{
+		MaxAttempts:  *dispatchMaxAttempts,
+		LeaseTimeout: *dispatchLeaseTimeout,
+		Backoff:      *dispatchRetryBackoff,
+		MaxBackoff:   *dispatchMaxRetryBackoff,
+	}
+	if err := retry.validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid dispatch retry policy")
+	}
+
+	// Dispatch the bundles as soon as a trigger fires
+	triggers := DispatchTriggers{
+		BatchSize:    *dispatchBatchSize,
+		MaxLatency:   *dispatchMaxLatency,
+		SlotDeadline: *dispatchSlotDeadline,
+	}
+	if err := triggers.validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid dispatch triggers")
+	}
+
+	// Schedule the dispatch by the beacon slots, if a slot clock is configured
+	var clock *SlotClock
+	if *slotGenesisTime != 0 || *beaconURL != "" {
+		if *slotGenesisTime != 0 && *beaconURL != "" {
+			log.Fatal().Msg("--slot-genesis-time and --beacon-url are mutually exclusive")
+		}
+		clock = &SlotClock{
+			Genesis:      time.Unix(*slotGenesisTime, 0),
+			SlotDuration: *slotDuration,
+			Cutoff:       *slotCutoff,
+			Window:       triggers.SlotDeadline,
+		}
+		if *beaconURL != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), beaconRequestTimeout)
+			clock.Genesis, clock.SlotDuration, err = fetchBeaconSlotClock(ctx, *beaconURL)
+			cancel()
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to read the slot clock from the beacon node")
+			}
+		}
+		if err := clock.validate(); err != nil {
+			log.Fatal().Err(err).Msg("Invalid slot clock")
+		}
+		if err := validateLateBundlePolicy(*lateBundlePolicy); err != nil {
+			log.Fatal().Err(err).Msg("Invalid late bundle policy")
+		}
+		log.Info().Time("genesis", clock.Genesis).Dur("slot_duration", clock.SlotDuration).Dur("cutoff", clock.Cutoff).Dur("window", clock.Window).Str("late_bundle_policy", *lateBundlePolicy).Msg("Slot clock")
+	}
+
+	// Pause the dispatch to failing bundle mergers
+	breakerConfig := BreakerConfig{Threshold: *breakerThreshold, Cooldown: *breakerCooldown}
+	if err := breakerConfig.validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid circuit breaker configuration")
+	}
+	circuits := newCircuitRegistry(breakerConfig)
+
+	// Bundles are routed to the pool of their chain, the pools share the status tracker
+	pools, err := newChainPools(chains, *perChainPools, *grpcURL, chainTargets, *blockTime, func() *TxBundlePool {
+		return newTxBundlePool(ordering, limits, *conflictPolicy, retry, statusTracker, builders.priority)
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid chain pool configuration")
+	}
+
+	// Load the bundle mergers, or use the single bundle merger per chain given by the gRPC URL and TLS flags
+	mergers := pools.legacyMergersConfig(MergerTLSConfig{
+		Enabled:            *useTLS,
+		CAFile:             *tlsCAFile,
+		ServerName:         *tlsServerName,
+		CertFile:           *tlsCertFile,
+		KeyFile:            *tlsKeyFile,
+		InsecureSkipVerify: *tlsInsecureSkipVerify,
+	})
+	if *mergersConfig != "" {
+		if *chainGRPCURLs != "" {
+			log.Fatal().Msg("--mergers-config and --chain-grpc-urls are mutually exclusive")
+		}
+		if *useTLS || *tlsCAFile != "" || *tlsServerName != "" || *tlsCertFile != "" || *tlsKeyFile != "" {
+			log.Fatal().Msg("TLS flags apply to --grpc-url only, configure the TLS of --mergers-config per merger")
+		}
+		mergers, err = loadMergersConfig(*mergersConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid merger configuration")
+		}
+	}
+	if err := mergers.validate(chains, *tlsInsecureSkipVerify); err != nil {
+		log.Fatal().Err(err).Msg("Invalid merger configuration")
+	}
+	pools.setMergers(mergers.Mergers)
+	log.Info().Str("mode", mergers.Mode).Interface("mergers", mergers.Mergers).Msg("Bundle merger configuration")
+
+	// Set the configured base fee, head followers replace it with the tracked base fee
+	if *baseFeeFlag != "" {
+		baseFee, ok := new(big.Int).SetString(*baseFeeFlag, 0)
+		if !ok || baseFee.Sign() < 0 {
+			log.Fatal().Str("base_fee", *baseFeeFlag).Msg("Invalid base fee")
+		}
+		for _, chainID := range chains.ChainIDs {
+			pools.setBaseFee(chainID, baseFee)
+		}
+	}
+
+	// Restore the pools from disk and persist their mutations from now on
+	var poolStore *PoolStore
+	if *poolDataDir != "" {
+		poolStore, err = openPoolStore(*poolDataDir, *poolWALFsync)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open pool store")
+		}
+		bundles, err := poolStore.load()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load pool store")
+		}
+		restored, skipped := pools.restoreBundles(bundles, time.Now())
+		log.Info().Int("restored", restored).Int("skipped", skipped).Msg("Pools restored")
+
+		pools.setStore(poolStore)
+		if err := pools.snapshot(poolStore); err != nil {
+			log.Fatal().Err(err).Msg("Failed to write pool snapshot")
+		}
 	}
 
 	// Set Gin to Release mode
@@ -136,18 +381,52 @@ func main() {
 	// ToDo: define the trusted proxies in production
 	rMain.SetTrustedProxies(nil)
 
+	// Register the JSON-RPC methods served by the sequencer endpoint
+	rpcRegistry := newRPCRegistry()
+	registerSequencerMethods(rpcRegistry, pools, validator, builders)
+	registerPrivateTransactionMethods(rpcRegistry, pools, validator, builders)
+	registerBundleStatusMethods(rpcRegistry, statusTracker)
+	registerMevShareMethods(rpcRegistry, pools, validator, builders)
+
 	// Apply JWT authentication and rate limiting to protected routes
 	protected := rMain.Group("/sequencer", jwtAuthMiddleware([]string{"user"}), rateLimitMiddleware())
 	{
-		protected.POST("/eth_sendBundle", handleEthSendBundle(txPool))
-		protected.POST("/eth_cancelBundle", handleEthCancelBundle(txPool))
+		// Single JSON-RPC endpoint dispatching by method
+		protected.POST("", handleJSONRPC(rpcRegistry))
+
+		// Legacy per-method routes, kept for backwards compatibility and serving their method only
+		protected.POST("/eth_sendBundle", handleJSONRPC(rpcRegistry.only("eth_sendBundle")))
+		protected.POST("/eth_cancelBundle", handleJSONRPC(rpcRegistry.only("eth_cancelBundle")))
+
+		// Real-time bundle events via WebSocket (eth_subscribe) and Server-Sent Events
+		protected.GET("/ws", handleWebSocket(rpcRegistry, bundleEvents))
+		protected.GET("/events", handleBundleEventsSSE(bundleEvents))
+	}
+
+	// Apply JWT authentication with the admin role and rate limiting to admin routes
+	admin := rMain.Group("/sequencer/admin", jwtAuthMiddleware([]string{"admin"}), rateLimitMiddleware())
+	{
+		// Chains served by the sequencer with their pools
+		admin.GET("/chains", handleAdminChains(pools))
+
+		// Ordering policy of the pools, switchable at runtime
+		admin.GET("/ordering-policy", handleAdminGetOrderingPolicy(pools))
+		admin.PUT("/ordering-policy", handleAdminSetOrderingPolicy(pools))
+
+		// Builder registry, modifiable at runtime
+		admin.GET("/builders", handleAdminListBuilders(builders))
+		admin.PUT("/builders/:name", handleAdminSetBuilder(builders, pools))
+		admin.DELETE("/builders/:name", handleAdminDeleteBuilder(builders, pools))
+
+		// Bundles that exhausted their retry budget at the bundle merger
+		admin.GET("/dead-letters", handleAdminDeadLetters(pools))
 	}
 
 	// Apply rate limiting to unprotected routes
 	unprotected := rMain.Group("/sequencer", rateLimitMiddleware())
 	{
 		// Health check endpoint
-		unprotected.GET("/health", healthHandler)
+		unprotected.GET("/health", handleHealth(circuits))
 
 		// JWT login endpoint
 		unprotected.POST("/login", jwtLoginHandler)
@@ -159,11 +438,44 @@ func main() {
 		Handler: rMain,
 	}
 
-	// Start the cleanup job for the pool
-	txPool.startCleanupJob(5 * time.Second)
+	// Start the cleanup job for the pools
+	pools.startCleanupJob(5 * time.Second)
+
+	// Follow the chain heads to expire bundles whose target block passed
+	followCtx, stopFollowing := context.WithCancel(context.Background())
+	defer stopFollowing()
+	if err := pools.startHeadFollowers(followCtx, rpcURLs, *headPollInterval); err != nil {
+		log.Fatal().Err(err).Msg("Invalid head follower configuration")
+	}
+
+	// Snapshot the pools periodically to compact the write-ahead log
+	if poolStore != nil {
+		pools.startSnapshotJob(poolStore, *poolSnapshotInterval)
+	}
+
+	// Start the cleanup job for the bundle statuses
+	statusTracker.startCleanupJob(30 * time.Second)
+
+	// Connect to the bundle mergers, shared by the bundle senders of all pools
+	mergerTargets, closeMergers, err := connectMergers(mergers, 1*time.Second, circuits)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to connect to the bundle mergers")
+	}
+	defer closeMergers()
+	if *tlsReloadInterval > 0 {
+		startTLSReloadJob(mergerTargets, *tlsReloadInterval)
+	}
+
+	// Report the slot and its phase
+	if clock != nil {
+		startSlotClockJob(clock)
+	}
 
-	// Start the periodic bundle sender
-	go startPeriodicBundleSender(txPool, 1*time.Second, 100, *grpcURL, *useTLS)
+	// Start a bundle dispatcher per pool
+	for _, target := range pools.targetList() {
+		serving := mergersFor(mergerTargets, target.ChainIDs)
+		go startBundleDispatcher(target.Pool, target.ChainIDs, pools.nextBlock, triggers, clock, *lateBundlePolicy, serving, mergers.Mode, builders.mergerRoutes)
+	}
 
 	// Listen for signals to gracefully shut down
 	quit := make(chan os.Signal, 1)
@@ -186,5 +498,15 @@ func main() {
 		log.Fatal().Err(err).Msg("HTTP server forced to shutdown")
 	}
 
+	// Leave a compact pool store behind for the next start
+	if poolStore != nil {
+		if err := pools.snapshot(poolStore); err != nil {
+			log.Error().Err(err).Msg("Failed to write pool snapshot")
+		}
+		if err := poolStore.close(); err != nil {
+			log.Error().Err(err).Msg("Failed to close pool store")
+		}
+	}
+
 	log.Info().Msg("Servers exited properly")
 }
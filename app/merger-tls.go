@@ -0,0 +1,217 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Define Prometheus metrics
+var (
+	tlsReloadsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bundle_merger_tls_reloads_total",
+			Help: "Total number of reloads of the TLS certificates of a bundle merger connection by gRPC URL and outcome",
+		},
+		[]string{"grpc_url", "outcome"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(tlsReloadsCounter)
+}
+
+// MergerTLSConfig represents the TLS settings of the connection to a bundle merger.
+type MergerTLSConfig struct {
+	Enabled            bool   `json:"enabled"`                      // Whether the connection uses TLS
+	CAFile             string `json:"caFile,omitempty"`             // PEM bundle of the CAs verifying the bundle merger, the system roots if empty
+	ServerName         string `json:"serverName,omitempty"`         // Name verified against the certificate of the bundle merger, the host of the gRPC URL if empty
+	CertFile           string `json:"certFile,omitempty"`           // PEM client certificate for mutual TLS
+	KeyFile            string `json:"keyFile,omitempty"`            // PEM key of the client certificate
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"` // Skip the verification of the bundle merger, requires --tls-insecure-skip-verify
+}
+
+// validate checks the TLS settings, skipping the verification of the bundle merger has to be allowed explicitly
+func (c MergerTLSConfig) validate(allowInsecure bool) error {
+	if !c.Enabled {
+		if c.CAFile != "" || c.ServerName != "" || c.CertFile != "" || c.KeyFile != "" || c.InsecureSkipVerify {
+			return fmt.Errorf("TLS settings require TLS to be enabled")
+		}
+		return nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("client certificate and key have to be given together")
+	}
+	if c.InsecureSkipVerify {
+		if !allowInsecure {
+			return fmt.Errorf("TLS without verification of the bundle merger requires --tls-insecure-skip-verify")
+		}
+		if c.CAFile != "" || c.ServerName != "" {
+			return fmt.Errorf("CA bundle and server name are unused if the verification is skipped")
+		}
+	}
+	return nil
+}
+
+// tlsReloader holds the CA bundle and client certificate of a bundle merger connection and reloads
+// them when their files change on disk, so certificates can be rotated without a restart. New
+// handshakes use the latest certificates, a failed reload keeps the previous ones.
+type tlsReloader struct {
+	grpcURL  string               // gRPC URL of the bundle merger
+	config   MergerTLSConfig      // TLS settings of the connection
+	roots    *x509.CertPool       // CAs verifying the bundle merger, nil for the system roots
+	cert     *tls.Certificate     // Client certificate, nil without mutual TLS
+	modTimes map[string]time.Time // Modification times of the loaded files by path
+	mu       sync.RWMutex         // A mutex for concurrent access
+}
+
+func newTLSReloader(grpcURL string, config MergerTLSConfig) (*tlsReloader, error) {
+	r := &tlsReloader{grpcURL: grpcURL, config: config}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the paths of the certificate files of the connection
+func (r *tlsReloader) files() []string {
+	var files []string
+	for _, path := range []string{r.config.CAFile, r.config.CertFile, r.config.KeyFile} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// reload loads the certificate files if any of them changed since the last load and reports whether they were reloaded
+func (r *tlsReloader) reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	changed := false
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, fmt.Errorf("failed to stat %s: %v", path, err)
+		}
+		modTimes[path] = info.ModTime()
+
+		r.mu.RLock()
+		loaded, exists := r.modTimes[path]
+		r.mu.RUnlock()
+		changed = changed || !exists || !loaded.Equal(info.ModTime())
+	}
+	if !changed && r.modTimes != nil {
+		return false, nil
+	}
+
+	var roots *x509.CertPool
+	if r.config.CAFile != "" {
+		pem, err := os.ReadFile(r.config.CAFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates found in CA bundle %s", r.config.CAFile)
+		}
+	}
+
+	var cert *tls.Certificate
+	if r.config.CertFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cert = &keyPair
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roots = roots
+	r.cert = cert
+	r.modTimes = modTimes
+	return true, nil
+}
+
+// tlsConfig returns the TLS configuration of the connection. The bundle merger is verified against
+// the CAs loaded at handshake time, so the built-in verification with its fixed roots is replaced.
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		ServerName:           r.config.ServerName,
+		GetClientCertificate: r.clientCertificate,
+		InsecureSkipVerify:   true, // #nosec G402 -- verified by verifyConnection unless skipping was allowed explicitly
+	}
+	if !r.config.InsecureSkipVerify {
+		config.VerifyConnection = r.verifyConnection
+	}
+	return config
+}
+
+// verifyConnection verifies the certificate chain of the bundle merger against the current CAs and the server name
+func (r *tlsReloader) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("bundle merger presented no certificate")
+	}
+
+	r.mu.RLock()
+	roots := r.roots
+	r.mu.RUnlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       state.ServerName,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// clientCertificate returns the current client certificate, an empty one without mutual TLS
+func (r *tlsReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return r.cert, nil
+}
+
+// startTLSReloadJob checks the certificate files of the bundle merger connections for changes periodically
+func startTLSReloadJob(mergers []*mergerTarget, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			for _, merger := range mergers {
+				if merger.tls == nil {
+					continue
+				}
+				reloaded, err := merger.tls.reload()
+				switch {
+				case err != nil:
+					tlsReloadsCounter.WithLabelValues(merger.config.GRPCURL, "failure").Inc()
+					log.Error().Err(err).Str("merger", merger.config.Name).Msg("Failed to reload TLS certificates, keeping the previous ones")
+				case reloaded:
+					tlsReloadsCounter.WithLabelValues(merger.config.GRPCURL, "success").Inc()
+					log.Info().Str("merger", merger.config.Name).Msg("Reloaded TLS certificates")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate is a generated certificate with its key
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCertificate issues a certificate for the name, self-signed if no issuer is given
+func newTestCertificate(t *testing.T, name string, issuer *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	return &testCertificate{cert: cert, key: key}
+}
+
+// write writes the certificate and optionally its key as PEM files with the given modification time
+func (c *testCertificate) write(t *testing.T, certPath, keyPath string, modTime time.Time) {
+	t.Helper()
+
+	writePEM(t, certPath, "CERTIFICATE", c.cert.Raw, modTime)
+	if keyPath != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		if err != nil {
+			t.Fatalf("MarshalECPrivateKey() error = %v", err)
+		}
+		writePEM(t, keyPath, "EC PRIVATE KEY", der, modTime)
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte, modTime time.Time) {
+	t.Helper()
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+}
+
+func TestMergerTLSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  MergerTLSConfig
+		wantErr string
+	}{
+		{"settings without TLS", MergerTLSConfig{CAFile: "ca.pem"}, "require TLS to be enabled"},
+		{"certificate without key", MergerTLSConfig{Enabled: true, CertFile: "client.pem"}, "given together"},
+		{"insecure without the flag", MergerTLSConfig{Enabled: true, InsecureSkipVerify: true}, "requires --tls-insecure-skip-verify"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(false); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := (MergerTLSConfig{Enabled: true, InsecureSkipVerify: true}).validate(true); err != nil {
+		t.Errorf("validate() error = %v with the insecure flag", err)
+	}
+}
+
+func TestTLSReloaderReloadsChangedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	modTime := time.Now().Add(-time.Minute)
+
+	oldCA, newCA := newTestCertificate(t, "old-ca", nil), newTestCertificate(t, "new-ca", nil)
+	oldCA.write(t, caFile, "", modTime)
+	oldClient := newTestCertificate(t, "sequencer", oldCA)
+	oldClient.write(t, certFile, keyFile, modTime)
+
+	reloader, err := newTLSReloader("merger:50051", MergerTLSConfig{Enabled: true, CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("newTLSReloader() error = %v", err)
+	}
+	oldServer := newTestCertificate(t, "merger", oldCA)
+	newServer := newTestCertificate(t, "merger", newCA)
+	verify := func(server *testCertificate, serverName string) error {
+		return reloader.verifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{server.cert}, ServerName: serverName})
+	}
+
+	if err := verify(oldServer, "merger"); err != nil {
+		t.Fatalf("verifyConnection() error = %v for a certificate of the CA", err)
+	}
+	if err := verify(oldServer, "other"); err == nil {
+		t.Fatalf("verifyConnection() accepted a certificate for another name")
+	}
+	if err := verify(newServer, "merger"); err == nil {
+		t.Fatalf("verifyConnection() accepted a certificate of an unknown CA")
+	}
+
+	// Unchanged files aren't reloaded
+	if reloaded, err := reloader.reload(); reloaded || err != nil {
+		t.Fatalf("reload() = %v, %v for unchanged files, want false, nil", reloaded, err)
+	}
+
+	// Rotated certificates are used by new handshakes
+	newCA.write(t, caFile, "", modTime.Add(time.Second))
+	newClient := newTestCertificate(t, "sequencer", newCA)
+	newClient.write(t, certFile, keyFile, modTime.Add(time.Second))
+	if reloaded, err := reloader.reload(); !reloaded || err != nil {
+		t.Fatalf("reload() = %v, %v for changed files, want true, nil", reloaded, err)
+	}
+	if err := verify(newServer, "merger"); err != nil {
+		t.Errorf("verifyConnection() error = %v after the CA was rotated", err)
+	}
+	if err := verify(oldServer, "merger"); err == nil {
+		t.Errorf("verifyConnection() accepted a certificate of the rotated CA")
+	}
+	if cert, _ := reloader.clientCertificate(nil); len(cert.Certificate) == 0 || !bytes.Equal(cert.Certificate[0], newClient.cert.Raw) {
+		t.Errorf("client certificate wasn't rotated")
+	}
+
+	// A broken file keeps the previous certificates
+	writePEM(t, caFile, "CERTIFICATE", []byte("broken"), modTime.Add(2*time.Second))
+	if _, err := reloader.reload(); err == nil {
+		t.Fatalf("reload() accepted a broken CA bundle")
+	}
+	if err := verify(newServer, "merger"); err != nil {
+		t.Errorf("verifyConnection() error = %v after a failed reload", err)
+	}
+}
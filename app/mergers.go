@@ -0,0 +1,273 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pbBundleMerger "github.com/prof-project/prof-grpc/go/profpb"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+// Dispatch modes, how the bundles of a pool are distributed over the bundle mergers serving their chain
+const (
+	dispatchFailover = "failover" // Every bundle goes to the available bundle merger with the highest weight
+	dispatchFanout   = "fanout"   // Every bundle goes to all bundle mergers
+	dispatchBuilders = "builders" // Every bundle goes to the bundle mergers of its builders, other bundles are spread by weight
+)
+
+// MergerConfig represents a bundle merger the bundles are dispatched to.
+type MergerConfig struct {
+	Name     string          `json:"name"`               // Unique name, used in bundle statuses and by the builders mode
+	GRPCURL  string          `json:"grpcUrl"`            // gRPC URL of the bundle merger
+	TLS      MergerTLSConfig `json:"tls"`                // TLS settings of the connection
+	Weight   int             `json:"weight,omitempty"`   // Preference in the failover mode and share of the unrouted bundles in the builders mode, defaults to 1
+	ChainIDs []uint64        `json:"chainIds,omitempty"` // Chains the bundle merger serves, all chains if empty
+}
+
+// MergersConfig represents the bundle merger configuration file.
+type MergersConfig struct {
+	Mode    string         `json:"mode"`    // Dispatch mode, failover, fanout or builders
+	Mergers []MergerConfig `json:"mergers"` // Bundle mergers
+}
+
+// loadMergersConfig reads the bundle merger configuration from a JSON file
+func loadMergersConfig(configPath string) (MergersConfig, error) {
+	var config MergersConfig
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, fmt.Errorf("failed to read merger config: %v", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse merger config: %v", err)
+	}
+	return config, nil
+}
+
+// legacyMergersConfig returns the configuration of the single bundle merger per chain given by
+// --grpc-url and --chain-grpc-urls, chains sharing a gRPC URL share the bundle merger
+func (c *ChainPools) legacyMergersConfig(tlsConfig MergerTLSConfig) MergersConfig {
+	config := MergersConfig{Mode: dispatchFailover}
+	byURL := make(map[string]int)
+	for _, chainID := range c.chains.ChainIDs {
+		grpcURL := c.targets[chainID]
+		if i, exists := byURL[grpcURL]; exists {
+			config.Mergers[i].ChainIDs = append(config.Mergers[i].ChainIDs, chainID)
+			continue
+		}
+		byURL[grpcURL] = len(config.Mergers)
+		config.Mergers = append(config.Mergers, MergerConfig{
+			Name:     grpcURL,
+			GRPCURL:  grpcURL,
+			TLS:      tlsConfig,
+			Weight:   1,
+			ChainIDs: []uint64{chainID},
+		})
+	}
+	return config
+}
+
+// setMergers sets the bundle mergers the bundles are dispatched to
+func (c *ChainPools) setMergers(mergers []MergerConfig) {
+	c.mergers = mergers
+}
+
+// mergerNames returns the names of the bundle mergers serving a chain
+func (c *ChainPools) mergerNames(chainID uint64) []string {
+	names := []string{}
+	for i := range c.mergers {
+		if c.mergers[i].serves(chainID) {
+			names = append(names, c.mergers[i].Name)
+		}
+	}
+	return names
+}
+
+// validate checks the configuration against the served chains and applies the defaults
+func (c *MergersConfig) validate(chains ChainConfig, allowInsecureTLS bool) error {
+	switch c.Mode {
+	case "":
+		c.Mode = dispatchFailover
+	case dispatchFailover, dispatchFanout, dispatchBuilders:
+	default:
+		return fmt.Errorf("invalid dispatch mode %q, expected %s", c.Mode, strings.Join([]string{dispatchFailover, dispatchFanout, dispatchBuilders}, ", "))
+	}
+	if len(c.Mergers) == 0 {
+		return fmt.Errorf("at least one bundle merger is required")
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Mergers {
+		merger := &c.Mergers[i]
+		if merger.Name == "" || merger.GRPCURL == "" {
+			return fmt.Errorf("mergers[%d]: name and grpcUrl are required", i)
+		}
+		if names[merger.Name] {
+			return fmt.Errorf("mergers[%d]: duplicate name %q", i, merger.Name)
+		}
+		names[merger.Name] = true
+		if err := merger.TLS.validate(allowInsecureTLS); err != nil {
+			return fmt.Errorf("mergers[%d]: %v", i, err)
+		}
+
+		switch {
+		case merger.Weight < 0:
+			return fmt.Errorf("mergers[%d]: weight must not be negative", i)
+		case merger.Weight == 0:
+			merger.Weight = 1
+		}
+		for _, chainID := range merger.ChainIDs {
+			if !chains.accepts(chainID) {
+				return fmt.Errorf("mergers[%d]: chain ID %d is not served", i, chainID)
+			}
+		}
+	}
+
+	// Every chain needs a bundle merger, otherwise its bundles would never leave the pool
+	for _, chainID := range chains.ChainIDs {
+		served := false
+		for i := range c.Mergers {
+			served = served || c.Mergers[i].serves(chainID)
+		}
+		if !served {
+			return fmt.Errorf("no bundle merger serves chain ID %d", chainID)
+		}
+	}
+	return nil
+}
+
+// serves reports whether the bundle merger serves the chain
+func (m *MergerConfig) serves(chainID uint64) bool {
+	if len(m.ChainIDs) == 0 {
+		return true
+	}
+	for _, id := range m.ChainIDs {
+		if id == chainID {
+			return true
+		}
+	}
+	return false
+}
+
+// mergerTarget is a connected bundle merger. Failed sends back off with jitter and are counted by
+// its circuit breaker, both shared by the senders of all pools.
+type mergerTarget struct {
+	config   MergerConfig                       // Configuration of the bundle merger
+	client   pbBundleMerger.BundleServiceClient // Client of the bundle merger
+	breaker  *circuitBreaker                    // Circuit breaker of the bundle merger
+	tls      *tlsReloader                       // Certificates of the connection, nil without TLS
+	interval time.Duration                      // Interval of the sends, the base of the backoff
+	failures int                                // Consecutive failed sends
+	nextSend time.Time                          // Earliest time of the next send after a failure
+	mu       sync.Mutex                         // A mutex for concurrent access
+}
+
+// connectMergers connects to the bundle mergers, ordered by descending weight, and returns a
+// function closing the connections
+func connectMergers(config MergersConfig, interval time.Duration, circuits *CircuitRegistry) ([]*mergerTarget, func(), error) {
+	var conns []*grpc.ClientConn
+	closeAll := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+
+	var mergers []*mergerTarget
+	for _, merger := range config.Mergers {
+		var reloader *tlsReloader
+		var tlsConfig *tls.Config
+		if merger.TLS.Enabled {
+			var err error
+			if reloader, err = newTLSReloader(merger.GRPCURL, merger.TLS); err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("merger %s: %v", merger.Name, err)
+			}
+			tlsConfig = reloader.tlsConfig()
+		}
+
+		conn, err := connectToGRPCServer(merger.GRPCURL, tlsConfig)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("merger %s: %v", merger.Name, err)
+		}
+		conns = append(conns, conn)
+		mergers = append(mergers, &mergerTarget{
+			config:   merger,
+			client:   pbBundleMerger.NewBundleServiceClient(conn),
+			breaker:  circuits.breaker(merger.GRPCURL),
+			tls:      reloader,
+			interval: interval,
+		})
+	}
+
+	sort.SliceStable(mergers, func(i, j int) bool { return mergers[i].config.Weight > mergers[j].config.Weight })
+	return mergers, closeAll, nil
+}
+
+// mergersFor returns the bundle mergers serving at least one of the chains, in the given order
+func mergersFor(mergers []*mergerTarget, chainIDs []uint64) []*mergerTarget {
+	var serving []*mergerTarget
+	for _, merger := range mergers {
+		for _, chainID := range chainIDs {
+			if merger.config.serves(chainID) {
+				serving = append(serving, merger)
+				break
+			}
+		}
+	}
+	return serving
+}
+
+// ready reports whether a send would pass the backoff and the circuit breaker, without taking the
+// trial send of a half-open circuit
+func (m *mergerTarget) ready(now time.Time) bool {
+	m.mu.Lock()
+	backingOff := now.Before(m.nextSend)
+	m.mu.Unlock()
+
+	return !backingOff && m.breaker.ready(now)
+}
+
+// allow reports whether a send may be made now, see circuitBreaker.allow
+func (m *mergerTarget) allow(now time.Time) bool {
+	m.mu.Lock()
+	backingOff := now.Before(m.nextSend)
+	m.mu.Unlock()
+
+	return !backingOff && m.breaker.allow(now)
+}
+
+func (m *mergerTarget) succeeded() {
+	m.mu.Lock()
+	m.failures = 0
+	m.mu.Unlock()
+
+	m.breaker.success()
+}
+
+// refused reports a send the bundle merger refused for its content, which leaves the health of the
+// bundle merger unchanged
+func (m *mergerTarget) refused() {
+	m.breaker.answered()
+}
+
+// failed backs off after a failed send and returns the delay before the next send
+func (m *mergerTarget) failed(err error, now time.Time) time.Duration {
+	m.mu.Lock()
+	m.failures++
+	delay := sendBackoff(m.interval, m.failures)
+	m.nextSend = now.Add(delay)
+	failures := m.failures
+	m.mu.Unlock()
+
+	m.breaker.failure(err, now)
+	log.Debug().Str("merger", m.config.Name).Int("failures", failures).Dur("backoff", delay).Msg("Backing off after a failed send")
+	return delay
+}
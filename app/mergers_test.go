@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMergersConfigValidate(t *testing.T) {
+	chains := ChainConfig{ChainIDs: []uint64{1, 10}}
+	tests := []struct {
+		name    string
+		config  MergersConfig
+		wantErr string
+	}{
+		{"duplicate name", MergersConfig{Mergers: []MergerConfig{{Name: "a", GRPCURL: "a:1"}, {Name: "a", GRPCURL: "b:1"}}}, "duplicate name"},
+		{"missing URL", MergersConfig{Mergers: []MergerConfig{{Name: "a"}}}, "grpcUrl are required"},
+		{"unknown mode", MergersConfig{Mode: "random", Mergers: []MergerConfig{{Name: "a", GRPCURL: "a:1"}}}, "invalid dispatch mode"},
+		{"unsupported chain", MergersConfig{Mergers: []MergerConfig{{Name: "a", GRPCURL: "a:1", ChainIDs: []uint64{1, 5}}}}, "chain ID 5 is not served"},
+		{"insecure TLS", MergersConfig{Mergers: []MergerConfig{{Name: "a", GRPCURL: "a:1", TLS: MergerTLSConfig{Enabled: true, InsecureSkipVerify: true}}}}, "requires --tls-insecure-skip-verify"},
+		{"unserved chain", MergersConfig{Mergers: []MergerConfig{{Name: "a", GRPCURL: "a:1", ChainIDs: []uint64{1}}}}, "no bundle merger serves chain ID 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(chains, false); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	config := MergersConfig{Mergers: []MergerConfig{{Name: "a", GRPCURL: "a:1"}}}
+	if err := config.validate(chains, false); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	if config.Mode != dispatchFailover || config.Mergers[0].Weight != 1 {
+		t.Errorf("got mode %s and weight %d, want the defaults", config.Mode, config.Mergers[0].Weight)
+	}
+}
+
+func TestSenderFailsOverToTheNextMerger(t *testing.T) {
+	primary := &fakeMergerClient{errs: []error{status.Error(codes.Unavailable, "connection refused")}}
+	secondary := &fakeMergerClient{}
+	pool := newTestPool(orderingPolicies["block_number"])
+	sender := &bundleSender{
+		txPool:      pool,
+		mergers:     []*mergerTarget{newTestMerger("primary", 2, primary), newTestMerger("secondary", 1, secondary)},
+		mode:        dispatchFailover,
+		bundleLimit: 10,
+	}
+	mustAddBundle(t, pool, newTestBundle(1, "bundle", 10), false)
+	now := time.Now()
+
+	// The secondary takes over while the primary backs off
+	sender.sendBundles(now)
+	sender.sendBundles(now.Add(100 * time.Millisecond))
+	if primary.calls != 1 || secondary.calls != 1 {
+		t.Fatalf("got %d sends to the primary and %d to the secondary, want 1 each", primary.calls, secondary.calls)
+	}
+	assertPending(t, pool, map[string]bool{"bundle": false})
+
+	status, _ := pool.statusTracker.get("bundle")
+	if status.Status != "included" || len(status.Targets) != 1 || !status.Targets["secondary"].Accepted {
+		t.Errorf("bundle has status %q and target responses %v, want accepted by the secondary", status.Status, status.Targets)
+	}
+}
+
+func TestSenderFansOutToAllMergers(t *testing.T) {
+	accepting := &fakeMergerClient{}
+	rejecting := &fakeMergerClient{rejects: true}
+	pool := newTestPool(orderingPolicies["block_number"])
+	sender := &bundleSender{
+		txPool:      pool,
+		mergers:     []*mergerTarget{newTestMerger("a", 1, accepting), newTestMerger("b", 1, rejecting)},
+		mode:        dispatchFanout,
+		bundleLimit: 10,
+	}
+	mustAddBundle(t, pool, newTestBundle(1, "bundle", 10), false)
+	now := time.Now()
+
+	// A rejection by one bundle merger nacks the bundle
+	sender.sendBundles(now)
+	status, _ := pool.statusTracker.get("bundle")
+	if status.State != BundleStateRejected || status.Status != "b: simulation failed" {
+		t.Fatalf("bundle has state %s and status %q, want rejected by b", status.State, status.Status)
+	}
+	assertPending(t, pool, map[string]bool{"bundle": true})
+
+	// The retry only goes to the bundle merger that didn't accept the bundle yet
+	rejecting.rejects = false
+	sender.sendBundles(now.Add(defaultRetryPolicy.Backoff))
+	if accepting.calls != 1 || rejecting.calls != 2 {
+		t.Fatalf("got %d sends to a and %d to b, want 1 and 2", accepting.calls, rejecting.calls)
+	}
+	assertPending(t, pool, map[string]bool{"bundle": false})
+
+	status, _ = pool.statusTracker.get("bundle")
+	if b := status.Targets["b"]; !b.Accepted || b.Responses != 2 {
+		t.Errorf("b has target response %+v, want accepted after 2 responses", b)
+	}
+}
+
+func TestSenderRoutesByBuilders(t *testing.T) {
+	a, b := &fakeMergerClient{}, &fakeMergerClient{}
+	pool := newTestPool(orderingPolicies["block_number"])
+	sender := &bundleSender{
+		txPool:  pool,
+		mergers: []*mergerTarget{newTestMerger("a", 3, a), newTestMerger("b", 1, b)},
+		mode:    dispatchBuilders,
+		routes: func(builders []string) []string {
+			if len(builders) == 1 && builders[0] == "flashbots" {
+				return []string{"b:50051"}
+			}
+			return nil
+		},
+		bundleLimit: 10,
+	}
+
+	routed := newTestBundle(1, "routed", 10)
+	routed.Builders = []string{"flashbots"}
+	mustAddBundle(t, pool, routed, false)
+	for i, uuid := range []string{"u1", "u2", "u3", "u4"} {
+		mustAddBundle(t, pool, newTestBundle(uint64(i+2), uuid, 11), false)
+	}
+
+	// Routed bundles go to the bundle merger of their builder, the others are spread by weight
+	sender.sendBundles(time.Now())
+	if len(a.uuids) != 3 || len(b.uuids) != 2 || b.uuids[0] != "routed" {
+		t.Errorf("a got %v and b got %v, want 3 unrouted bundles for a and the routed one and 1 unrouted bundle for b", a.uuids, b.uuids)
+	}
+	assertPending(t, pool, map[string]bool{"routed": false, "u1": false, "u2": false, "u3": false, "u4": false})
+}
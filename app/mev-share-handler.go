@@ -0,0 +1,376 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	mevBundleVersion       = "v0.1" // Supported version of the mev_sendBundle params
+	mevBundleMaxDepth      = 2      // Max nesting depth of bundles within a bundle body
+	mevBundleMaxBlockRange = 30     // Max number of blocks between inclusion.block and inclusion.maxBlock
+)
+
+// mevShareHints are the privacy hints accepted by mev_sendBundle
+var mevShareHints = map[string]bool{
+	"calldata":          true,
+	"contract_address":  true,
+	"logs":              true,
+	"default_logs":      true,
+	"special_logs":      true,
+	"function_selector": true,
+	"hash":              true,
+	"tx_hash":           true,
+	"full":              true,
+}
+
+// MevSendBundleParams represents parameters for sending a MEV-Share style bundle.
+type MevSendBundleParams struct {
+	Version   string             `json:"version"`            // Version of the params, should be "v0.1"
+	Inclusion MevBundleInclusion `json:"inclusion"`          // Block range the bundle is valid for
+	Body      []MevBundleBody    `json:"body"`               // Ordered transactions, hashes or nested bundles
+	Validity  *MevBundleValidity `json:"validity,omitempty"` // Optional refund requirements
+	Privacy   *MevBundlePrivacy  `json:"privacy,omitempty"`  // Optional privacy settings
+}
+
+// MevBundleInclusion represents the block range a MEV-Share bundle is valid for.
+type MevBundleInclusion struct {
+	Block    string `json:"block"`              // Hex-encoded first block for inclusion
+	MaxBlock string `json:"maxBlock,omitempty"` // Optional hex-encoded last block for inclusion
+}
+
+// MevBundleBody represents a single element of a MEV-Share bundle body.
+// Exactly one of Hash, Tx and Bundle must be set.
+type MevBundleBody struct {
+	Hash      string               `json:"hash,omitempty"`      // Hash of a transaction or bundle already in the pool
+	Tx        string               `json:"tx,omitempty"`        // Signed transaction (hex string)
+	CanRevert bool                 `json:"canRevert,omitempty"` // Whether the transaction is allowed to revert
+	Bundle    *MevSendBundleParams `json:"bundle,omitempty"`    // Nested bundle
+}
+
+// MevBundleValidity represents the refund requirements of a MEV-Share bundle.
+type MevBundleValidity struct {
+	Refund       []MevRefund       `json:"refund,omitempty"`       // Refunds by body element
+	RefundConfig []MevRefundConfig `json:"refundConfig,omitempty"` // Recipients of the refund
+}
+
+// MevRefund represents the share of a body element's value that is refunded.
+type MevRefund struct {
+	BodyIdx int `json:"bodyIdx"` // Index of the body element
+	Percent int `json:"percent"` // Refund in percent
+}
+
+// MevRefundConfig represents a recipient of a refund.
+type MevRefundConfig struct {
+	Address string `json:"address"` // Recipient address
+	Percent int    `json:"percent"` // Share of the refund in percent
+}
+
+// MevBundlePrivacy represents the privacy settings of a MEV-Share bundle.
+type MevBundlePrivacy struct {
+	Hints    []string `json:"hints,omitempty"`    // Data that may be shared about the bundle
+	Builders []string `json:"builders,omitempty"` // Builders the bundle may be sent to
+}
+
+// flattenedMevBundle is a MEV-Share bundle body resolved into an ordered list of transactions.
+type flattenedMevBundle struct {
+	txs               []*types.Transaction // Transactions in execution order
+	senders           []common.Address     // Recovered senders, by index of txs
+	revertingTxHashes []string             // Hashes of the transactions allowed to revert
+	references        bundleSet            // Pooled bundles referenced by hash elements
+	block             uint64               // First block for inclusion
+	maxBlock          uint64               // Last block for inclusion
+}
+
+// registerMevShareMethods registers the MEV-Share JSON-RPC methods of the sequencer
+func registerMevShareMethods(registry *RPCRegistry, pools *ChainPools, validator Validator, builders *BuilderRegistry) {
+	registry.register("mev_sendBundle", handleMevSendBundle(pools, validator, builders))
+}
+
+// Handle mev_sendBundle requests
+func handleMevSendBundle(pools *ChainPools, validator Validator, builders *BuilderRegistry) RPCMethod {
+	return func(ctx context.Context, rawParams json.RawMessage) (interface{}, error) {
+		tracer := otel.Tracer("prof-sequencer")
+		ctx, span := tracer.Start(ctx, "handleMevSendBundleRequest")
+		defer span.End()
+
+		var params []MevSendBundleParams
+		if err := decodeParams(rawParams, &params); err != nil {
+			return nil, err
+		}
+		if len(params) != 1 {
+			return nil, newRPCError(rpcErrInvalidParams, "Expected exactly one bundle", nil)
+		}
+
+		return processMevSendBundle(ctx, pools, validator, builders, params[0])
+	}
+}
+
+func processMevSendBundle(ctx context.Context, pools *ChainPools, validator Validator, builders *BuilderRegistry, params MevSendBundleParams) (interface{}, error) {
+	tracer := otel.Tracer("prof-sequencer")
+	_, span := tracer.Start(ctx, "processMevSendBundle")
+	defer span.End()
+
+	receivedAt := time.Now()
+
+	username := usernameFromContext(ctx)
+	flattened, err := flattenMevBundle(pools, validator, &params, username, "", 0, nil)
+	if err != nil {
+		processedBundlesCounter.WithLabelValues("failed").Inc()
+		log.Warn().Err(err).Msg("Rejecting invalid MEV-Share bundle")
+		return nil, newRPCError(rpcErrInvalidParams, "Invalid bundle", err.Error())
+	}
+
+	if err := validateMevValidity(params.Validity, params.Body); err != nil {
+		processedBundlesCounter.WithLabelValues("failed").Inc()
+		log.Warn().Err(err).Msg("Rejecting MEV-Share bundle with invalid validity")
+		return nil, newRPCError(rpcErrInvalidParams, "Invalid validity", err.Error())
+	}
+
+	// The Bundle message of the bundle mergers can't carry refunds, refund recipients or privacy
+	// hints, so a bundle relying on them is rejected instead of being included without them
+	if params.Validity != nil {
+		for _, refund := range params.Validity.Refund {
+			if refund.Percent > 0 {
+				processedBundlesCounter.WithLabelValues("failed").Inc()
+				return nil, newRPCError(rpcErrInvalidParams, "Unsupported validity", "refunds are not supported by the bundle mergers")
+			}
+		}
+		if len(params.Validity.RefundConfig) > 0 {
+			processedBundlesCounter.WithLabelValues("failed").Inc()
+			return nil, newRPCError(rpcErrInvalidParams, "Unsupported validity", "refund recipients are not supported by the bundle mergers")
+		}
+	}
+
+	var bundleBuilders []string
+	if params.Privacy != nil {
+		for _, hint := range params.Privacy.Hints {
+			if !mevShareHints[hint] {
+				processedBundlesCounter.WithLabelValues("failed").Inc()
+				return nil, newRPCError(rpcErrInvalidParams, "Invalid privacy", fmt.Sprintf("unsupported hint %q", hint))
+			}
+		}
+		if len(params.Privacy.Hints) > 0 {
+			processedBundlesCounter.WithLabelValues("failed").Inc()
+			return nil, newRPCError(rpcErrInvalidParams, "Unsupported privacy", "privacy hints are not supported by the bundle mergers")
+		}
+
+		bundleBuilders, err = builders.resolve(params.Privacy.Builders)
+		if err != nil {
+			processedBundlesCounter.WithLabelValues("failed").Inc()
+			return nil, newRPCError(rpcErrInvalidParams, "Invalid privacy", err.Error())
+		}
+	}
+
+	bundle := TxPoolBundle{
+		Txs:               flattened.txs,
+		Senders:           flattened.senders,
+		BlockNumber:       hexutil.EncodeUint64(flattened.block),
+		MaxBlockNumber:    hexutil.EncodeUint64(flattened.maxBlock),
+		RevertingTxHashes: flattened.revertingTxHashes,
+		Builders:          bundleBuilders,
+		Username:          username,
+		ReceivedAt:        receivedAt,
+		references:        flattened.references,
+	}
+
+	pooledBundle, err := pools.addBundle(&bundle, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to add MEV-Share bundle to pool")
+		processedBundlesCounter.WithLabelValues("failed").Inc()
+		if errors.Is(err, errPoolFull) {
+			return nil, newPoolFullError(err, nil)
+		}
+		return nil, newRPCError(rpcErrServer, "Failed to add bundle to pool", err.Error())
+	}
+
+	processedBundlesCounter.WithLabelValues("success").Inc()
+	log.Info().Str("uuid", pooledBundle.ReplacementUUID).Int("txs", len(pooledBundle.Txs)).Msg("MEV-Share bundle received and added to the pool")
+
+	return map[string]interface{}{
+		"bundleHash":      pooledBundle.BundleHash.Hex(),
+		"replacementUuid": pooledBundle.ReplacementUUID,
+	}, nil
+}
+
+// flattenMevBundle validates a (nested) MEV-Share bundle of the given user and resolves its body into
+// transactions. The path identifies the bundle in error messages, outer is the enclosing bundle of
+// nested bundles.
+func flattenMevBundle(pools *ChainPools, validator Validator, params *MevSendBundleParams, username string, path string, depth int, outer *flattenedMevBundle) (*flattenedMevBundle, error) {
+	if params.Version != "" && params.Version != mevBundleVersion {
+		return nil, fmt.Errorf("%sversion: unsupported version %q, expected %q", path, params.Version, mevBundleVersion)
+	}
+
+	flattened := &flattenedMevBundle{references: make(bundleSet)}
+
+	// Validate the inclusion range
+	block, err := hexutil.DecodeUint64(params.Inclusion.Block)
+	if err != nil || block == 0 {
+		return nil, fmt.Errorf("%sinclusion.block: invalid block number %q", path, params.Inclusion.Block)
+	}
+	flattened.block, flattened.maxBlock = block, block
+	if params.Inclusion.MaxBlock != "" {
+		maxBlock, err := hexutil.DecodeUint64(params.Inclusion.MaxBlock)
+		if err != nil {
+			return nil, fmt.Errorf("%sinclusion.maxBlock: invalid block number %q", path, params.Inclusion.MaxBlock)
+		}
+		if maxBlock < block {
+			return nil, fmt.Errorf("%sinclusion.maxBlock: must not be lower than inclusion.block", path)
+		}
+		if maxBlock-block > mevBundleMaxBlockRange {
+			return nil, fmt.Errorf("%sinclusion.maxBlock: range exceeds %d blocks", path, mevBundleMaxBlockRange)
+		}
+		flattened.maxBlock = maxBlock
+	}
+
+	// Nested bundles must be valid within the range of the enclosing bundle
+	if outer != nil {
+		if flattened.block > outer.block || flattened.maxBlock < outer.maxBlock {
+			return nil, fmt.Errorf("%sinclusion: range must cover the range of the enclosing bundle", path)
+		}
+		if params.Validity != nil || params.Privacy != nil {
+			return nil, fmt.Errorf("%s: validity and privacy are only supported on the top-level bundle", path)
+		}
+		flattened.block, flattened.maxBlock = outer.block, outer.maxBlock
+	}
+
+	if len(params.Body) == 0 {
+		return nil, fmt.Errorf("%sbody: must not be empty", path)
+	}
+
+	hasOwnTx := false
+	for i, element := range params.Body {
+		elementPath := fmt.Sprintf("%sbody[%d]", path, i)
+		set := 0
+		for _, isSet := range []bool{element.Hash != "", element.Tx != "", element.Bundle != nil} {
+			if isSet {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("%s: exactly one of hash, tx and bundle must be set", elementPath)
+		}
+
+		switch {
+		case element.Tx != "":
+			tx, err := decodeTransaction(element.Tx)
+			if err != nil {
+				processedTransactionsCounter.WithLabelValues("failed").Inc()
+				return nil, fmt.Errorf("%s.tx: %v", elementPath, err)
+			}
+			from, err := validator.Validate(tx)
+			if err != nil {
+				processedTransactionsCounter.WithLabelValues("failed").Inc()
+				return nil, fmt.Errorf("%s.tx: invalid transaction %s: %v", elementPath, tx.Hash().Hex(), err)
+			}
+			processedTransactionsCounter.WithLabelValues("success").Inc()
+
+			flattened.txs = append(flattened.txs, tx)
+			flattened.senders = append(flattened.senders, from)
+			if element.CanRevert {
+				flattened.revertingTxHashes = append(flattened.revertingTxHashes, tx.Hash().Hex())
+			}
+			hasOwnTx = true
+
+		case element.Hash != "":
+			if element.CanRevert {
+				return nil, fmt.Errorf("%s.canRevert: only supported for tx elements", elementPath)
+			}
+
+			var hash common.Hash
+			if err := hash.UnmarshalText([]byte(element.Hash)); err != nil {
+				return nil, fmt.Errorf("%s.hash: %v", elementPath, err)
+			}
+
+			// Hashes reference private transactions or bundles the user already pooled, the
+			// pooled bundles of other users are not found
+			referenced, exists := pools.getBundleByUUID(hash.Hex())
+			if !exists {
+				referenced, exists = pools.getBundleByHash(hash, username)
+			}
+			if !exists || referenced.Username != username {
+				return nil, fmt.Errorf("%s.hash: unknown hash %s", elementPath, hash.Hex())
+			}
+			flattened.txs = append(flattened.txs, referenced.Txs...)
+			flattened.senders = append(flattened.senders, referenced.Senders...)
+			flattened.revertingTxHashes = append(flattened.revertingTxHashes, referenced.RevertingTxHashes...)
+			flattened.references[referenced] = struct{}{}
+
+		case element.Bundle != nil:
+			if element.CanRevert {
+				return nil, fmt.Errorf("%s.canRevert: only supported for tx elements", elementPath)
+			}
+			if depth+1 >= mevBundleMaxDepth {
+				return nil, fmt.Errorf("%s.bundle: nesting exceeds max depth of %d", elementPath, mevBundleMaxDepth)
+			}
+
+			nested, err := flattenMevBundle(pools, validator, element.Bundle, username, elementPath+".bundle.", depth+1, flattened)
+			if err != nil {
+				return nil, err
+			}
+			flattened.txs = append(flattened.txs, nested.txs...)
+			flattened.senders = append(flattened.senders, nested.senders...)
+			flattened.revertingTxHashes = append(flattened.revertingTxHashes, nested.revertingTxHashes...)
+			for referenced := range nested.references {
+				flattened.references[referenced] = struct{}{}
+			}
+			hasOwnTx = true
+		}
+	}
+
+	if !hasOwnTx {
+		return nil, fmt.Errorf("%sbody: must contain at least one tx or bundle element", path)
+	}
+
+	return flattened, nil
+}
+
+// validateMevValidity validates the refund requirements of a MEV-Share bundle
+func validateMevValidity(validity *MevBundleValidity, body []MevBundleBody) error {
+	if validity == nil {
+		return nil
+	}
+
+	total := 0
+	for i, refund := range validity.Refund {
+		if refund.BodyIdx < 0 || refund.BodyIdx >= len(body) {
+			return fmt.Errorf("validity.refund[%d].bodyIdx: out of range", i)
+		}
+		if body[refund.BodyIdx].Bundle != nil {
+			return fmt.Errorf("validity.refund[%d].bodyIdx: refunds for nested bundles are not supported", i)
+		}
+		if refund.Percent < 0 || refund.Percent > 100 {
+			return fmt.Errorf("validity.refund[%d].percent: must be between 0 and 100", i)
+		}
+		total += refund.Percent
+	}
+	if total > 100 {
+		return fmt.Errorf("validity.refund: percentages sum up to more than 100")
+	}
+
+	total = 0
+	for i, config := range validity.RefundConfig {
+		if !common.IsHexAddress(config.Address) {
+			return fmt.Errorf("validity.refundConfig[%d].address: invalid address %q", i, config.Address)
+		}
+		if config.Percent < 0 || config.Percent > 100 {
+			return fmt.Errorf("validity.refundConfig[%d].percent: must be between 0 and 100", i)
+		}
+		total += config.Percent
+	}
+	if total > 100 {
+		return fmt.Errorf("validity.refundConfig: percentages sum up to more than 100")
+	}
+
+	return nil
+}
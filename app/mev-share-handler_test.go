@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// newTestTxHex returns a hex-encoded signed transaction of chain 1 and its hash
+func newTestTxHex(t *testing.T, nonce uint64) (string, string) {
+	t.Helper()
+
+	txHex := newSignedTestTx(t, &types.LegacyTx{Nonce: nonce, Gas: 21000, GasPrice: big.NewInt(1), To: &feeTestRecipient})
+	tx, err := decodeTransaction(txHex)
+	if err != nil {
+		t.Fatalf("decodeTransaction() error = %v", err)
+	}
+	return txHex, tx.Hash().Hex()
+}
+
+func TestMevSendBundle(t *testing.T) {
+	registry, pools := newHandlerTestRegistry(t)
+
+	tx, _ := newTestTxHex(t, 1)
+	other, _ := newTestTxHex(t, 2)
+	ownTx, ownHash := newTestTxHex(t, 3)
+	bobTx, bobHash := newTestTxHex(t, 4)
+	backrun, _ := newTestTxHex(t, 5)
+	nested, _ := newTestTxHex(t, 6)
+	nestedBackrun, _ := newTestTxHex(t, 7)
+	unrefunded, _ := newTestTxHex(t, 8)
+	callRPC(t, registry, "alice", "eth_sendRawTransaction", `["`+ownTx+`"]`)
+	callRPC(t, registry, "bob", "eth_sendRawTransaction", `["`+bobTx+`"]`)
+
+	invalidParams := func(message string, data string) string {
+		return `{"code":-32602,"message":"` + message + `","data":"` + data + `"}`
+	}
+	tests := []struct {
+		name      string
+		params    string
+		wantTxs   int
+		wantError string
+	}{
+		{"single tx", `{"version":"v0.1","inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}]}`, 1, ""},
+		{"block range", `{"inclusion":{"block":"0xa","maxBlock":"0xc"},"body":[{"tx":"` + other + `","canRevert":true}],"privacy":{"builders":[]}}`, 1, ""},
+		{"own private transaction", `{"inclusion":{"block":"0xa"},"body":[{"hash":"` + ownHash + `"},{"tx":"` + backrun + `"}]}`, 2, ""},
+		{"nested bundle", `{"inclusion":{"block":"0xb"},"body":[{"bundle":{"inclusion":{"block":"0xb"},"body":[{"tx":"` + nested + `"}]}},{"tx":"` + nestedBackrun + `"}]}`, 2, ""},
+		{"private transaction of another user", `{"inclusion":{"block":"0xa"},"body":[{"hash":"` + bobHash + `"},{"tx":"` + tx + `"}]}`, 0, invalidParams("Invalid bundle", "body[0].hash: unknown hash "+bobHash)},
+		{"unsupported version", `{"version":"v0.2","inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}]}`, 0, invalidParams("Invalid bundle", `version: unsupported version \"v0.2\", expected \"v0.1\"`)},
+		{"missing block", `{"inclusion":{},"body":[{"tx":"` + tx + `"}]}`, 0, invalidParams("Invalid bundle", `inclusion.block: invalid block number \"\"`)},
+		{"max block before block", `{"inclusion":{"block":"0xa","maxBlock":"0x9"},"body":[{"tx":"` + tx + `"}]}`, 0, invalidParams("Invalid bundle", "inclusion.maxBlock: must not be lower than inclusion.block")},
+		{"block range too long", `{"inclusion":{"block":"0xa","maxBlock":"0x64"},"body":[{"tx":"` + tx + `"}]}`, 0, invalidParams("Invalid bundle", "inclusion.maxBlock: range exceeds 30 blocks")},
+		{"empty body", `{"inclusion":{"block":"0xa"},"body":[]}`, 0, invalidParams("Invalid bundle", "body: must not be empty")},
+		{"ambiguous element", `{"inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `","hash":"` + ownHash + `"}]}`, 0, invalidParams("Invalid bundle", "body[0]: exactly one of hash, tx and bundle must be set")},
+		{"only hashes", `{"inclusion":{"block":"0xa"},"body":[{"hash":"` + ownHash + `"}]}`, 0, invalidParams("Invalid bundle", "body: must contain at least one tx or bundle element")},
+		{"nested bundle outside the range", `{"inclusion":{"block":"0xa","maxBlock":"0xb"},"body":[{"bundle":{"inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}]}}]}`, 0, invalidParams("Invalid bundle", "body[0].bundle.inclusion: range must cover the range of the enclosing bundle")},
+		{"nesting too deep", `{"inclusion":{"block":"0xa"},"body":[{"bundle":{"inclusion":{"block":"0xa"},"body":[{"bundle":{"inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}]}}]}}]}`, 0, invalidParams("Invalid bundle", "body[0].bundle.body[0].bundle: nesting exceeds max depth of 2")},
+		{"refunds", `{"inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}],"validity":{"refund":[{"bodyIdx":0,"percent":10}]}}`, 0, invalidParams("Unsupported validity", "refunds are not supported by the bundle mergers")},
+		{"refund out of range", `{"inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}],"validity":{"refund":[{"bodyIdx":1,"percent":10}]}}`, 0, invalidParams("Invalid validity", "validity.refund[0].bodyIdx: out of range")},
+		{"invalid refund recipient", `{"inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}],"validity":{"refundConfig":[{"address":"0x01","percent":100}]}}`, 0, invalidParams("Invalid validity", `validity.refundConfig[0].address: invalid address \"0x01\"`)},
+		{"zero refund", `{"inclusion":{"block":"0xa"},"body":[{"tx":"` + unrefunded + `"}],"validity":{"refund":[{"bodyIdx":0,"percent":0}]}}`, 1, ""},
+		{"refund recipients", `{"inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}],"validity":{"refundConfig":[{"address":"0x0000000000000000000000000000000000000001","percent":100}]}}`, 0, invalidParams("Unsupported validity", "refund recipients are not supported by the bundle mergers")},
+		{"privacy hints", `{"inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}],"privacy":{"hints":["hash","calldata"]}}`, 0, invalidParams("Unsupported privacy", "privacy hints are not supported by the bundle mergers")},
+		{"unsupported privacy hint", `{"inclusion":{"block":"0xa"},"body":[{"tx":"` + tx + `"}],"privacy":{"hints":["everything"]}}`, 0, invalidParams("Invalid privacy", `unsupported hint \"everything\"`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response struct {
+				Result struct {
+					ReplacementUUID string `json:"replacementUuid"`
+				} `json:"result"`
+				Error json.RawMessage `json:"error"`
+			}
+			if err := json.Unmarshal([]byte(callRPC(t, registry, "alice", "mev_sendBundle", `[`+tt.params+`]`)), &response); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			if tt.wantError != "" {
+				if string(response.Error) != tt.wantError {
+					t.Errorf("mev_sendBundle error = %s, want %s", response.Error, tt.wantError)
+				}
+				return
+			}
+			bundle, exists := pools.getBundleByUUID(response.Result.ReplacementUUID)
+			if len(response.Error) > 0 || !exists || len(bundle.Txs) != tt.wantTxs || bundle.Username != "alice" {
+				t.Errorf("mev_sendBundle error = %s, want a pooled bundle of alice with %d transactions", response.Error, tt.wantTxs)
+			}
+		})
+	}
+}
+
+func TestMevSendBundleBackrunsReferencedBundle(t *testing.T) {
+	for _, policy := range []string{conflictReject, conflictKeepHigher} {
+		t.Run(policy, func(t *testing.T) {
+			pool := newConflictTestPool(policy)
+			pools, err := newChainPools(ChainConfig{ChainIDs: []uint64{1}}, false, "127.0.0.1:50051", nil, 12*time.Second, func() *TxBundlePool { return pool })
+			if err != nil {
+				t.Fatalf("newChainPools() error = %v", err)
+			}
+			registry := newHandlerTestRegistryFor(t, pools)
+
+			// The backrun pays the same as the private transaction it references
+			ownTx, ownHash := newTestTxHex(t, 1)
+			backrun, _ := newTestTxHex(t, 2)
+			callRPC(t, registry, "alice", "eth_sendRawTransaction", `["`+ownTx+`"]`)
+
+			var response struct {
+				Result struct {
+					ReplacementUUID string `json:"replacementUuid"`
+				} `json:"result"`
+				Error json.RawMessage `json:"error"`
+			}
+			params := `[{"inclusion":{"block":"0xa"},"body":[{"hash":"` + ownHash + `"},{"tx":"` + backrun + `"}]}]`
+			if err := json.Unmarshal([]byte(callRPC(t, registry, "alice", "mev_sendBundle", params)), &response); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if len(response.Error) > 0 {
+				t.Fatalf("mev_sendBundle error = %s, want the backrun pooled", response.Error)
+			}
+
+			assertPending(t, pool, map[string]bool{ownHash: true, response.Result.ReplacementUUID: true})
+			if bundle, _ := pool.getBundleByUUID(response.Result.ReplacementUUID); len(bundle.Conflicts) != 0 {
+				t.Errorf("got conflicts %+v with the referenced bundle, want none", bundle.Conflicts)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultOrderingPolicy is the ordering of the pool if none is configured
+const defaultOrderingPolicy = "block_number,arrival_time"
+
+// OrderingPolicy orders the bundles of the pool for dispatch.
+type OrderingPolicy interface {
+	Name() string
+	// Compare returns a negative number if b1 is dispatched before b2, a positive number if
+	// b2 is dispatched before b1 and zero if the policy doesn't order them
+	Compare(b1, b2 *TxPoolBundle) int
+}
+
+// lessPolicy is an ordering policy based on a less function
+type lessPolicy struct {
+	name string
+	less func(b1, b2 *TxPoolBundle) bool
+}
+
+func (p *lessPolicy) Name() string { return p.name }
+
+func (p *lessPolicy) Compare(b1, b2 *TxPoolBundle) int {
+	switch {
+	case p.less(b1, b2):
+		return -1
+	case p.less(b2, b1):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// chainedPolicy applies its policies in order, each later policy breaks the ties of the earlier ones
+type chainedPolicy struct {
+	policies []OrderingPolicy
+}
+
+func (p *chainedPolicy) Name() string {
+	names := make([]string, len(p.policies))
+	for i, policy := range p.policies {
+		names[i] = policy.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (p *chainedPolicy) Compare(b1, b2 *TxPoolBundle) int {
+	for _, policy := range p.policies {
+		if result := policy.Compare(b1, b2); result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+// orderingPolicies holds the ordering policies by name
+var orderingPolicies = map[string]OrderingPolicy{
+	"block_number":     &lessPolicy{name: "block_number", less: sortByBlockNumber},
+	"min_timestamp":    &lessPolicy{name: "min_timestamp", less: sortByMinTimestamp},
+	"max_timestamp":    &lessPolicy{name: "max_timestamp", less: sortByMaxTimestamp},
+	"builder_priority": &lessPolicy{name: "builder_priority", less: sortByBuilderPriority},
+	"arrival_time":     &lessPolicy{name: "arrival_time", less: sortByArrivalTime},
+	"fee":              &lessPolicy{name: "fee", less: sortByFeeScore},
+}
+
+// orderingPolicyNames returns the names of the registered ordering policies
+func orderingPolicyNames() []string {
+	names := make([]string, 0, len(orderingPolicies))
+	for name := range orderingPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseOrderingPolicy resolves a comma-separated list of policy names into a policy, each
+// later policy breaks the ties of the earlier ones, e.g. "block_number,arrival_time"
+func parseOrderingPolicy(spec string) (OrderingPolicy, error) {
+	var policies []OrderingPolicy
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		policy, exists := orderingPolicies[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown ordering policy %q, available: %s", name, strings.Join(orderingPolicyNames(), ", "))
+		}
+		policies = append(policies, policy)
+	}
+
+	switch len(policies) {
+	case 0:
+		return nil, fmt.Errorf("empty ordering policy")
+	case 1:
+		return policies[0], nil
+	default:
+		return &chainedPolicy{policies: policies}, nil
+	}
+}
+
+// setOrderingPolicy switches the ordering policy of all pools, each pool is re-sorted atomically
+func (c *ChainPools) setOrderingPolicy(policy OrderingPolicy) {
+	for _, target := range c.targetList() {
+		target.Pool.setOrderingPolicy(policy)
+	}
+	log.Info().Str("policy", policy.Name()).Msg("Ordering policy switched")
+}
+
+// orderingPolicy returns the ordering policy of the pools
+func (c *ChainPools) orderingPolicy() OrderingPolicy {
+	return c.pools[c.chains.primaryChainID()].orderingPolicy()
+}
+
+// SetOrderingPolicyParams represents the request to switch the ordering policy.
+type SetOrderingPolicyParams struct {
+	Policy string `json:"policy" binding:"required"` // Comma-separated list of policy names
+}
+
+// handleAdminGetOrderingPolicy returns the active and the available ordering policies
+func handleAdminGetOrderingPolicy(pools *ChainPools) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"policy":    pools.orderingPolicy().Name(),
+			"available": orderingPolicyNames(),
+		})
+	}
+}
+
+// handleAdminSetOrderingPolicy switches the ordering policy of the pools live
+func handleAdminSetOrderingPolicy(pools *ChainPools) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params SetOrderingPolicyParams
+		if err := c.ShouldBindJSON(&params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		policy, err := parseOrderingPolicy(params.Policy)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		pools.setOrderingPolicy(policy)
+		c.JSON(http.StatusOK, gin.H{"policy": policy.Name()})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseOrderingPolicy(t *testing.T) {
+	tests := []struct {
+		spec     string
+		wantName string
+		wantErr  bool
+	}{
+		{"block_number", "block_number", false},
+		{"block_number, arrival_time,fee", "block_number,arrival_time,fee", false},
+		{",fee,", "fee", false},
+		{"", "", true},
+		{"block_number,gas", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			policy, err := parseOrderingPolicy(tt.spec)
+			if (err != nil) != tt.wantErr || (!tt.wantErr && policy.Name() != tt.wantName) {
+				t.Errorf("parseOrderingPolicy() = %v, %v, want %s", policy, err, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestOrderingPolicyCompare(t *testing.T) {
+	now := time.Now()
+	bundle := func(block uint64, receivedAt time.Time, feeScore int64, builderPriority int) *TxPoolBundle {
+		return &TxPoolBundle{TargetBlock: block, ReceivedAt: receivedAt, FeeScore: big.NewInt(feeScore), BuilderPriority: builderPriority}
+	}
+	early, late := bundle(10, now, 5, 10), bundle(10, now.Add(time.Second), 7, 20)
+	nextBlock := bundle(11, now.Add(-time.Second), 9, 0)
+
+	tests := []struct {
+		spec   string
+		b1, b2 *TxPoolBundle
+		want   int
+	}{
+		{"block_number", early, nextBlock, -1},
+		{"block_number", early, late, 0},
+		{"block_number,arrival_time", late, early, 1},
+		{"block_number,fee", early, late, 1},
+		{"block_number,builder_priority", late, early, -1},
+		{"arrival_time,block_number", nextBlock, early, -1},
+		{"fee,arrival_time", nextBlock, late, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			policy, err := parseOrderingPolicy(tt.spec)
+			if err != nil {
+				t.Fatalf("parseOrderingPolicy() error = %v", err)
+			}
+			if got := policy.Compare(tt.b1, tt.b2); got != tt.want {
+				t.Errorf("Compare() = %d, want %d", got, tt.want)
+			}
+			if got := policy.Compare(tt.b2, tt.b1); got != -tt.want {
+				t.Errorf("Compare() of the swapped bundles = %d, want %d", got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminOrderingPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	pools := newTestChainPools(t)
+	router := gin.New()
+	router.GET("/ordering-policy", handleAdminGetOrderingPolicy(pools))
+	router.PUT("/ordering-policy", handleAdminSetOrderingPolicy(pools))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantPolicy string
+	}{
+		{"switch", `{"policy":"fee,arrival_time"}`, http.StatusOK, "fee,arrival_time"},
+		{"unknown policy", `{"policy":"gas"}`, http.StatusBadRequest, "fee,arrival_time"},
+		{"missing policy", `{}`, http.StatusBadRequest, "fee,arrival_time"},
+		{"switch back", `{"policy":"block_number"}`, http.StatusOK, "block_number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/ordering-policy", strings.NewReader(tt.body)))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("PUT returned status %d, want %d", recorder.Code, tt.wantStatus)
+			}
+
+			recorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ordering-policy", nil))
+			var response struct {
+				Policy    string   `json:"policy"`
+				Available []string `json:"available"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if response.Policy != tt.wantPolicy || len(response.Available) != len(orderingPolicies) {
+				t.Errorf("GET returned %+v, want policy %s and %d available policies", response, tt.wantPolicy, len(orderingPolicies))
+			}
+			if got := pools.pools[1].orderingPolicy().Name(); got != tt.wantPolicy {
+				t.Errorf("pool is ordered by %s, want %s", got, tt.wantPolicy)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Conflict policies, how a bundle sharing a transaction or a sender nonce with a pending bundle is handled
+const (
+	conflictReject     = "reject"      // The new bundle is refused
+	conflictKeepHigher = "keep_higher" // The bundle with the higher fee score is kept, ties keep the pending bundles
+	conflictTag        = "tag"         // All bundles are forwarded with a shared conflict group, refused until the Bundle message can carry the group
+)
+
+// Kinds of conflicts between two bundles
+const (
+	conflictKindTxHash      = "tx_hash"      // Both bundles contain the same transaction
+	conflictKindSenderNonce = "sender_nonce" // Both bundles contain a transaction of the same sender with the same nonce
+)
+
+// errBundleConflict is returned if a bundle is refused because it conflicts with pending bundles
+var errBundleConflict = errors.New("bundle conflicts with pending bundles")
+
+// Define Prometheus metrics
+var (
+	conflictingBundlesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "conflicting_bundles_total",
+			Help: "Total number of bundles conflicting with pending bundles by outcome",
+		},
+		[]string{"outcome"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(conflictingBundlesCounter)
+}
+
+// validateConflictPolicy checks the name of a conflict policy
+func validateConflictPolicy(policy string) error {
+	switch policy {
+	case conflictReject, conflictKeepHigher:
+		return nil
+	case conflictTag:
+		return fmt.Errorf("conflict policy %q is not supported, the Bundle message of the bundle merger can't carry the conflict group", policy)
+	default:
+		return fmt.Errorf("invalid conflict policy %q, expected %s", policy, strings.Join([]string{conflictReject, conflictKeepHigher}, ", "))
+	}
+}
+
+// senderNonce identifies a nonce of a sender on a chain
+type senderNonce struct {
+	chainID uint64
+	sender  common.Address
+	nonce   uint64
+}
+
+// BundleConflict represents a transaction of a new bundle that conflicts with a pending bundle.
+type BundleConflict struct {
+	Kind            string `json:"kind"`             // Kind of the conflict, tx_hash or sender_nonce
+	TxHash          string `json:"txHash"`           // Hash of the conflicting transaction of the new bundle
+	Sender          string `json:"sender,omitempty"` // Sender of the conflicting transaction, if recovered
+	Nonce           uint64 `json:"nonce"`            // Nonce of the conflicting transaction
+	BundleHash      string `json:"bundleHash"`       // Hash of the pending bundle
+	ReplacementUUID string `json:"replacementUuid"`  // UUID of the pending bundle
+}
+
+// ConflictError reports the conflicts of a bundle that was refused by the conflict policy.
+type ConflictError struct {
+	Conflicts []BundleConflict
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: %d conflicting transactions, first with bundle %s", errBundleConflict, len(e.Conflicts), e.Conflicts[0].BundleHash)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return errBundleConflict
+}
+
+// senderNonceOf returns the sender nonce of the transaction at index i of the bundle, if its sender is known
+func (b *TxPoolBundle) senderNonceOf(i int) (senderNonce, bool) {
+	if i >= len(b.Senders) {
+		return senderNonce{}, false
+	}
+	return senderNonce{chainID: b.ChainID, sender: b.Senders[i], nonce: b.Txs[i].Nonce()}, true
+}
+
+// sharesBlockWith reports whether the block ranges of two bundles overlap. A bundle without a target
+// block can be included in any block.
+func (b *TxPoolBundle) sharesBlockWith(other *TxPoolBundle) bool {
+	first, last := b.blockRange()
+	otherFirst, otherLast := other.blockRange()
+	if first == 0 || otherFirst == 0 {
+		return true
+	}
+	return first <= otherLast && otherFirst <= last
+}
+
+// canConflictWith reports whether a pending bundle sharing a transaction or a sender nonce with the
+// bundle is a conflict. Only bundles of the same user conflict, so a user can neither refuse nor
+// displace the bundles of other users, nor learn that they exist.
+func (b *TxPoolBundle) canConflictWith(pending, replaced *TxPoolBundle) bool {
+	if _, referenced := b.references[pending]; referenced || pending == replaced || pending.Username != b.Username {
+		return false
+	}
+	return b.sharesBlockWith(pending)
+}
+
+// conflictsLocked returns the pending bundles of the same user the bundle conflicts with in insertion
+// order, and the conflicts by transaction. The bundle it replaces is no conflict, nor are bundles for
+// other blocks, as the same transactions are commonly submitted for several blocks, and the bundles
+// it references by hash, which it shares its transactions with by design.
+func (p *TxBundlePool) conflictsLocked(bundle, replaced *TxPoolBundle) ([]*TxPoolBundle, []BundleConflict) {
+	var conflicting []*TxPoolBundle
+	var conflicts []BundleConflict
+	seen := make(bundleSet)
+
+	for i, tx := range bundle.Txs {
+		report := func(kind string, pending []*TxPoolBundle) {
+			// Map iteration is random, report in insertion order of the pending bundles
+			slices.SortFunc(pending, func(b1, b2 *TxPoolBundle) int { return cmp.Compare(b1.seq, b2.seq) })
+			for _, b := range pending {
+				conflict := BundleConflict{
+					Kind:            kind,
+					TxHash:          tx.Hash().Hex(),
+					Nonce:           tx.Nonce(),
+					BundleHash:      b.BundleHash.Hex(),
+					ReplacementUUID: b.ReplacementUUID,
+				}
+				if i < len(bundle.Senders) {
+					conflict.Sender = bundle.Senders[i].Hex()
+				}
+				conflicts = append(conflicts, conflict)
+
+				if _, exists := seen[b]; !exists {
+					seen[b] = struct{}{}
+					conflicting = append(conflicting, b)
+				}
+			}
+		}
+
+		var sameTx, sameNonce []*TxPoolBundle
+		for pending := range p.txHashMap[tx.Hash()] {
+			if bundle.canConflictWith(pending, replaced) {
+				sameTx = append(sameTx, pending)
+			}
+		}
+		if key, ok := bundle.senderNonceOf(i); ok {
+			for pending := range p.nonceMap[key] {
+				// The same transaction implies the same sender nonce, so it's reported once
+				if _, exists := p.txHashMap[tx.Hash()][pending]; !exists && bundle.canConflictWith(pending, replaced) {
+					sameNonce = append(sameNonce, pending)
+				}
+			}
+		}
+		report(conflictKindTxHash, sameTx)
+		report(conflictKindSenderNonce, sameNonce)
+	}
+
+	slices.SortFunc(conflicting, func(b1, b2 *TxPoolBundle) int { return cmp.Compare(b1.seq, b2.seq) })
+	return conflicting, conflicts
+}
+
+// resolveConflictsLocked applies the conflict policy to a bundle conflicting with pending bundles and
+// returns the pending bundles it displaces. A ConflictError is returned if the bundle is refused.
+func (p *TxBundlePool) resolveConflictsLocked(bundle *TxPoolBundle, conflicting []*TxPoolBundle) ([]*TxPoolBundle, error) {
+	if len(conflicting) == 0 {
+		return nil, nil
+	}
+
+	switch p.conflictPolicy {
+	case conflictKeepHigher:
+		// The bundle has to score higher than every bundle it conflicts with
+		for _, pending := range conflicting {
+			if feeScoreOf(bundle).Cmp(feeScoreOf(pending)) <= 0 {
+				conflictingBundlesCounter.WithLabelValues("rejected").Inc()
+				return nil, &ConflictError{Conflicts: bundle.Conflicts}
+			}
+		}
+		return conflicting, nil
+	default:
+		conflictingBundlesCounter.WithLabelValues("rejected").Inc()
+		return nil, &ConflictError{Conflicts: bundle.Conflicts}
+	}
+}
+
+// displaceLocked marks a bundle displaced by a conflicting bundle with a higher fee score for deletion
+func (p *TxBundlePool) displaceLocked(bundle *TxPoolBundle, by *TxPoolBundle) {
+	if !p.markLocked(bundle, poolOpDisplace) {
+		return
+	}
+
+	p.statusTracker.record(bundle.ReplacementUUID, BundleStateDisplaced, "conflicts with bundle "+by.BundleHash.Hex())
+	conflictingBundlesCounter.WithLabelValues("displaced").Inc()
+	log.Info().Str("uuid", bundle.ReplacementUUID).Str("by", by.ReplacementUUID).Msg("Bundle displaced by a conflicting bundle")
+}
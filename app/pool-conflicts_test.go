@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var conflictTestSender = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+func newConflictTestPool(policy string) *TxBundlePool {
+	return newTxBundlePool(orderingPolicies["block_number"], PoolLimits{}, policy, defaultRetryPolicy, newBundleStatusTracker(0, nil), nil)
+}
+
+// newNonceTestBundle returns a bundle with a single transaction of the test sender, transactions
+// with the same nonce and a different gas price differ but conflict by sender nonce
+func newNonceTestBundle(nonce uint64, gasPrice int64, uuid, username string) *TxPoolBundle {
+	tx := types.NewTx(&types.LegacyTx{Nonce: nonce, Gas: 21000, GasPrice: big.NewInt(gasPrice), To: &feeTestRecipient})
+	return &TxPoolBundle{
+		Txs:             []*types.Transaction{tx},
+		Senders:         []common.Address{conflictTestSender},
+		BlockNumber:     hexutil.EncodeUint64(10),
+		ReplacementUUID: uuid,
+		Username:        username,
+		ChainID:         1,
+	}
+}
+
+func assertConflictError(t *testing.T, err error, kind string) *ConflictError {
+	t.Helper()
+
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) || !errors.Is(err, errBundleConflict) {
+		t.Fatalf("addBundle() error = %v, want a conflict error", err)
+	}
+	if got := conflictErr.Conflicts[0].Kind; got != kind {
+		t.Errorf("conflict kind = %s, want %s", got, kind)
+	}
+	return conflictErr
+}
+
+func TestValidateConflictPolicy(t *testing.T) {
+	for policy, valid := range map[string]bool{conflictReject: true, conflictKeepHigher: true, conflictTag: false, "unknown": false} {
+		if err := validateConflictPolicy(policy); (err == nil) != valid {
+			t.Errorf("validateConflictPolicy(%q) error = %v, want valid %v", policy, err, valid)
+		}
+	}
+}
+
+func TestConflictReject(t *testing.T) {
+	pool := newConflictTestPool(conflictReject)
+	mustAddBundle(t, pool, newNonceTestBundle(1, 10, "pending", "alice"), false)
+
+	// Bundles of other users don't conflict, nor do they reveal the pending bundle
+	otherUser := newNonceTestBundle(1, 10, "other-user", "bob")
+	otherUser.MaxBlockNumber = hexutil.EncodeUint64(12)
+	mustAddBundle(t, pool, otherUser, false)
+	if len(otherUser.Conflicts) != 0 {
+		t.Errorf("got conflicts %+v with a bundle of another user, want none", otherUser.Conflicts)
+	}
+
+	// The same transaction in another bundle whose block range covers the pending bundle
+	sameTx := newNonceTestBundle(1, 10, "same-tx", "alice")
+	sameTx.MaxBlockNumber = hexutil.EncodeUint64(11)
+	_, err := pool.addBundle(sameTx, false)
+	conflictErr := assertConflictError(t, err, conflictKindTxHash)
+	if conflictErr.Conflicts[0].ReplacementUUID != "pending" {
+		t.Errorf("conflict UUID = %q, want the UUID of the pending bundle", conflictErr.Conflicts[0].ReplacementUUID)
+	}
+
+	// Another transaction of the same sender with the same nonce
+	_, err = pool.addBundle(newNonceTestBundle(1, 20, "same-nonce", "alice"), false)
+	assertConflictError(t, err, conflictKindSenderNonce)
+
+	// Bundles for other blocks don't conflict, the same transactions are submitted for several blocks
+	nextBlock := newNonceTestBundle(1, 10, "next-block", "alice")
+	nextBlock.BlockNumber = hexutil.EncodeUint64(11)
+	mustAddBundle(t, pool, nextBlock, false)
+	if len(nextBlock.Conflicts) != 0 {
+		t.Errorf("got conflicts %+v for a bundle of another block, want none", nextBlock.Conflicts)
+	}
+
+	// A bundle doesn't conflict with the bundle it replaces
+	mustAddBundle(t, pool, newNonceTestBundle(1, 20, "pending", "alice"), true)
+
+	// Bundles leaving the pool leave the conflict index
+	if err := pool.cancelBundleByUUID("pending", "alice"); err != nil {
+		t.Fatalf("cancelBundleByUUID() error = %v", err)
+	}
+	mustAddBundle(t, pool, newNonceTestBundle(1, 30, "after-cancel", "alice"), false)
+}
+
+func TestConflictKeepHigher(t *testing.T) {
+	pool := newConflictTestPool(conflictKeepHigher)
+	mustAddBundle(t, pool, newNonceTestBundle(1, 10, "pending", "alice"), false)
+
+	// Ties keep the pending bundle
+	tie := newNonceTestBundle(1, 10, "tie", "alice")
+	tie.MaxBlockNumber = hexutil.EncodeUint64(11)
+	_, err := pool.addBundle(tie, false)
+	assertConflictError(t, err, conflictKindTxHash)
+
+	// A higher fee score displaces the pending bundle, a bundle of another user can't
+	mustAddBundle(t, pool, newNonceTestBundle(1, 30, "other-user", "bob"), false)
+	assertPending(t, pool, map[string]bool{"pending": true, "other-user": true})
+	higher := newNonceTestBundle(1, 20, "higher", "alice")
+	mustAddBundle(t, pool, higher, false)
+	if len(higher.Conflicts) != 1 || higher.Conflicts[0].Kind != conflictKindSenderNonce {
+		t.Errorf("got conflicts %+v, want a single sender nonce conflict", higher.Conflicts)
+	}
+	assertPending(t, pool, map[string]bool{"pending": false, "higher": true, "other-user": true})
+	if status, _ := pool.statusTracker.get("pending"); status.State != BundleStateDisplaced {
+		t.Errorf("displaced bundle has state %s, want %s", status.State, BundleStateDisplaced)
+	}
+}
@@ -0,0 +1,438 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// maxDeadLetters bounds the dead-letter set of a pool, the oldest entries are dropped first
+const maxDeadLetters = 1000
+
+// Outcomes of the dispatch of a bundle to a bundle merger
+const (
+	deliveryAccepted = "accepted" // The bundle merger accepted the bundle
+	deliveryRejected = "rejected" // The bundle merger rejected the bundle or refused the request
+	deliveryFailed   = "failed"   // The bundle didn't reach the bundle merger
+)
+
+// statusLeaseExpired is the status of a dispatch the bundle merger didn't answer within the lease
+const statusLeaseExpired = "lease expired"
+
+// Define Prometheus metrics
+var (
+	nackedBundlesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nacked_bundles_total",
+			Help: "Total number of dispatches rejected by the bundle merger or not answered within the lease by chain ID",
+		},
+		[]string{"chain_id"},
+	)
+	deadLetteredBundlesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dead_lettered_bundles_total",
+			Help: "Total number of bundles that exhausted their retry budget by chain ID",
+		},
+		[]string{"chain_id"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(nackedBundlesCounter)
+	profSequencerRegisterer.MustRegister(deadLetteredBundlesCounter)
+}
+
+// RetryPolicy represents the retry budget of bundles dispatched to the bundle merger.
+type RetryPolicy struct {
+	MaxAttempts  int           // Dispatches of a bundle before it's dead-lettered
+	LeaseTimeout time.Duration // Time a dispatched bundle waits for the answer of the bundle merger
+	Backoff      time.Duration // Delay before the first retry, doubled by every further attempt
+	MaxBackoff   time.Duration // Upper bound of the delay before a retry
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	LeaseTimeout: 10 * time.Second,
+	Backoff:      time.Second,
+	MaxBackoff:   30 * time.Second,
+}
+
+func (r RetryPolicy) validate() error {
+	if r.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1")
+	}
+	if r.LeaseTimeout <= 0 {
+		return fmt.Errorf("lease timeout must be positive")
+	}
+	if r.Backoff < 0 || r.MaxBackoff < r.Backoff {
+		return fmt.Errorf("backoff must not be negative or exceed the max backoff")
+	}
+	return nil
+}
+
+// backoff returns the delay before the next dispatch of a bundle dispatched the given number of times
+func (r RetryPolicy) backoff(attempts int) time.Duration {
+	delay := r.Backoff
+	for i := 1; i < attempts && delay < r.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, r.MaxBackoff)
+}
+
+// DeadLetter represents a bundle that exhausted its retry budget.
+type DeadLetter struct {
+	ReplacementUUID string    `json:"replacementUuid"` // UUID of the bundle
+	BundleHash      string    `json:"bundleHash"`      // Hash of the bundle
+	ChainID         uint64    `json:"chainId"`         // Chain the bundle was sequenced for
+	Username        string    `json:"username"`        // User that submitted the bundle
+	Attempts        int       `json:"attempts"`        // Dispatches to the bundle merger
+	LastStatus      string    `json:"lastStatus"`      // Status of the latest answer of the bundle merger
+	DeadLetteredAt  time.Time `json:"deadLetteredAt"`  // Time the retry budget was exhausted
+}
+
+// waitingBundles represents the pending bundles of a chain that wait for a later upcoming block.
+type waitingBundles struct {
+	next       NextBlock   // Upcoming block the bundles of the chain were scheduled against
+	blocks     *bundleHeap // Bundles waiting for a later block number, earliest first
+	timestamps *bundleHeap // Bundles waiting for a later block timestamp by their MinTimestamp, earliest first
+}
+
+// waitingOf returns the waiting bundles of a chain
+func (p *TxBundlePool) waitingOf(chainID uint64) *waitingBundles {
+	waiting, exists := p.waiting[chainID]
+	if !exists {
+		waiting = &waitingBundles{
+			blocks:     newBundleHeap(sortByEligibleFrom, func(bundle *TxPoolBundle) *int { return &bundle.waitIndex }),
+			timestamps: newBundleHeap(sortByMinTimestamp, func(bundle *TxPoolBundle) *int { return &bundle.waitIndex }),
+		}
+		p.waiting[chainID] = waiting
+	}
+	return waiting
+}
+
+// scheduleLocked adds a pending bundle that isn't leased to the ready bundles, or to the bundles
+// waiting for the first condition it doesn't meet yet against the upcoming block of its chain
+func (p *TxBundlePool) scheduleLocked(bundle *TxPoolBundle, now time.Time) {
+	p.unscheduleLocked(bundle)
+
+	waiting := p.waitingOf(bundle.ChainID)
+	switch {
+	case bundle.retryAt.After(now):
+		p.retrying.push(bundle)
+	case waiting.next.Number > 0 && bundle.eligibleFrom() > waiting.next.Number:
+		waiting.blocks.push(bundle)
+	case bundle.MinTimestamp > 0 && uint64(bundle.MinTimestamp) > waiting.next.Timestamp:
+		waiting.timestamps.push(bundle)
+	default:
+		p.ready.push(bundle)
+		p.arrived.push(bundle)
+	}
+}
+
+// unscheduleLocked removes a bundle from the ready and the waiting bundles
+func (p *TxBundlePool) unscheduleLocked(bundle *TxPoolBundle) {
+	p.ready.remove(bundle)
+	p.arrived.remove(bundle)
+	p.retrying.remove(bundle)
+	if waiting, exists := p.waiting[bundle.ChainID]; exists {
+		waiting.blocks.remove(bundle)
+		waiting.timestamps.remove(bundle)
+	}
+}
+
+// refreshReadyLocked moves the waiting bundles whose upcoming block or retry time came to the ready
+// bundles, in O(log n) per moved bundle
+func (p *TxBundlePool) refreshReadyLocked(now time.Time) {
+	for chainID := range p.waiting {
+		p.syncChainLocked(chainID, now)
+	}
+	for {
+		bundle, exists := p.retrying.peek()
+		if !exists || bundle.retryAt.After(now) {
+			break
+		}
+		p.scheduleLocked(bundle, now)
+	}
+}
+
+// syncChainLocked schedules the bundles of a chain against its current upcoming block. Without a
+// head follower, only the MinTimestamp is checked against the given time.
+func (p *TxBundlePool) syncChainLocked(chainID uint64, now time.Time) {
+	next := NextBlock{Timestamp: uint64(now.Unix())}
+	if p.nextBlock != nil {
+		next = p.nextBlock(chainID)
+	}
+	waiting := p.waitingOf(chainID)
+	previous := waiting.next
+	waiting.next = next
+
+	// A chain head that became known or went back, e.g. after a reorg, can make ready bundles wait
+	// again. This is rare, so the ready bundles of the chain are scanned.
+	if next.Number > 0 && (previous.Number == 0 || next.Number < previous.Number) {
+		var rescheduled []*TxPoolBundle
+		for _, bundle := range p.ready.items {
+			if bundle.ChainID == chainID {
+				rescheduled = append(rescheduled, bundle)
+			}
+		}
+		for _, bundle := range rescheduled {
+			p.scheduleLocked(bundle, now)
+		}
+	}
+
+	for {
+		bundle, exists := waiting.blocks.peek()
+		if !exists || (next.Number > 0 && bundle.eligibleFrom() > next.Number) {
+			break
+		}
+		p.scheduleLocked(bundle, now)
+	}
+	for {
+		bundle, exists := waiting.timestamps.peek()
+		if !exists || uint64(bundle.MinTimestamp) > next.Timestamp {
+			break
+		}
+		p.scheduleLocked(bundle, now)
+	}
+}
+
+// leaseBundles returns up to limit bundles in dispatch order that are eligible for the upcoming block
+// of their chain and leases them to the caller. Leased bundles aren't returned again until they are
+// nacked or their lease expires, which counts as a nack. Nacked bundles wait for their backoff. Only
+// the ready bundles are walked, so leasing k bundles takes O(k log n) however many bundles wait.
+func (p *TxBundlePool) leaseBundles(limit int, now time.Time) []*TxPoolBundle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reclaimExpiredLeasesLocked(now)
+	p.refreshReadyLocked(now)
+
+	var selectedBundles, waitingBundles []*TxPoolBundle
+	p.ready.walk(func(bundle *TxPoolBundle) bool {
+		// The expected timestamp of the upcoming block can go back, a bundle scheduled before waits again
+		if !bundle.isEligible(p.waiting[bundle.ChainID].next) {
+			waitingBundles = append(waitingBundles, bundle)
+			return true
+		}
+
+		selectedBundles = append(selectedBundles, bundle)
+		return len(selectedBundles) < limit
+	})
+	for _, bundle := range waitingBundles {
+		p.scheduleLocked(bundle, now)
+	}
+
+	for _, bundle := range selectedBundles {
+		p.unscheduleLocked(bundle)
+		bundle.attempts++
+		bundle.leasedUntil = now.Add(p.retry.LeaseTimeout)
+		bundle.dispatchBlock = p.waiting[bundle.ChainID].next.Number
+		p.leased[bundle] = struct{}{}
+	}
+	return selectedBundles
+}
+
+// reclaimExpiredLeasesLocked nacks the leased bundles whose lease expired. It runs ahead of the walk
+// of leaseBundles, which stops at its limit and would leave the expired leases behind it unanswered.
+func (p *TxBundlePool) reclaimExpiredLeasesLocked(now time.Time) {
+	var expiredLeases []*TxPoolBundle
+	for bundle := range p.leased {
+		if !bundle.leasedUntil.After(now) {
+			expiredLeases = append(expiredLeases, bundle)
+		}
+	}
+	// Map iteration is random, nack the bundles in insertion order
+	slices.SortFunc(expiredLeases, func(b1, b2 *TxPoolBundle) int { return cmp.Compare(b1.seq, b2.seq) })
+
+	for _, bundle := range expiredLeases {
+		p.nackLocked(bundle, statusLeaseExpired, now)
+	}
+}
+
+// delivery is the outcome of the dispatch of a leased bundle to a bundle merger.
+type delivery struct {
+	bundle  *TxPoolBundle // Dispatched bundle
+	merger  string        // Name of the bundle merger
+	outcome string        // Outcome of the dispatch, see the delivery constants
+	status  string        // Status text of the bundle merger or the failure
+}
+
+// settleDeliveries acks, nacks or releases leased bundles by the outcomes of their dispatch. A bundle
+// is acked once each of its required bundle mergers accepted it, in this or an earlier dispatch, and
+// nacked if one of them rejected it. An acked bundle whose block range extends past the block it was
+// dispatched for stays pooled and is dispatched again for the next block, until it's included or
+// expires. A bundle that didn't reach a bundle merger is released without counting the attempt.
+// Bundles without an outcome stay leased until they are answered or their lease expires. Bundles
+// that were acked, nacked, cancelled or replaced meanwhile are skipped.
+func (p *TxBundlePool) settleDeliveries(deliveries []delivery, required map[*TxPoolBundle][]string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var bundles []*TxPoolBundle
+	byBundle := make(map[*TxPoolBundle][]delivery)
+	for _, d := range deliveries {
+		if _, exists := byBundle[d.bundle]; !exists {
+			bundles = append(bundles, d.bundle)
+		}
+		byBundle[d.bundle] = append(byBundle[d.bundle], d)
+	}
+	// A bundle its bundle mergers accepted in earlier dispatches has no outcome but is settled nonetheless
+	for bundle := range required {
+		if _, exists := byBundle[bundle]; !exists {
+			bundles = append(bundles, bundle)
+		}
+	}
+
+	for _, bundle := range bundles {
+		if bundle.leasedUntil.IsZero() || !p.queue.contains(bundle) {
+			continue
+		}
+
+		// Statuses name their bundle merger unless the bundle is dispatched to a single one
+		named := len(required[bundle]) > 1
+		var accepted, rejected []string
+		failed := false
+		for _, d := range byBundle[bundle] {
+			switch d.outcome {
+			case deliveryAccepted:
+				if bundle.acceptedBy == nil {
+					bundle.acceptedBy = make(map[string]bool)
+				}
+				bundle.acceptedBy[d.merger] = true
+				accepted = append(accepted, deliveryStatus(d, named))
+				p.statusTracker.recordTargetResponse(bundle.ReplacementUUID, d.merger, true, d.status, now)
+			case deliveryRejected:
+				rejected = append(rejected, deliveryStatus(d, named))
+				p.statusTracker.recordTargetResponse(bundle.ReplacementUUID, d.merger, false, d.status, now)
+			default:
+				failed = true
+			}
+		}
+
+		acceptedByAll := len(required[bundle]) > 0
+		for _, merger := range required[bundle] {
+			acceptedByAll = acceptedByAll && bundle.acceptedBy[merger]
+		}
+
+		switch {
+		case len(rejected) > 0:
+			status := strings.Join(rejected, "; ")
+			p.statusTracker.record(bundle.ReplacementUUID, BundleStateRejected, status)
+			p.nackLocked(bundle, status, now)
+		case acceptedByAll:
+			p.statusTracker.record(bundle.ReplacementUUID, BundleStateAccepted, strings.Join(accepted, "; "))
+			p.unleaseLocked(bundle)
+			if _, last := bundle.blockRange(); bundle.dispatchBlock == 0 || last <= bundle.dispatchBlock {
+				p.markLocked(bundle, poolOpMark)
+				continue
+			}
+			// The retry budget and the bundle mergers' answers apply to a single block
+			bundle.acceptedFor = bundle.dispatchBlock
+			bundle.acceptedBy = nil
+			bundle.attempts = 0
+			p.scheduleLocked(bundle, now)
+		case failed:
+			p.unleaseLocked(bundle)
+			bundle.attempts--
+			p.scheduleLocked(bundle, now)
+		}
+	}
+}
+
+func deliveryStatus(d delivery, named bool) string {
+	if named {
+		return d.merger + ": " + d.status
+	}
+	return d.status
+}
+
+// unleaseLocked ends the lease of a bundle
+func (p *TxBundlePool) unleaseLocked(bundle *TxPoolBundle) {
+	bundle.leasedUntil = time.Time{}
+	delete(p.leased, bundle)
+}
+
+func (p *TxBundlePool) nackLocked(bundle *TxPoolBundle, status string, now time.Time) {
+	p.unleaseLocked(bundle)
+	bundle.lastStatus = status
+	nackedBundlesCounter.WithLabelValues(chainLabel(bundle.ChainID)).Inc()
+
+	if bundle.attempts >= p.retry.MaxAttempts {
+		p.deadLetterLocked(bundle, now)
+		return
+	}
+
+	delay := p.retry.backoff(bundle.attempts)
+	bundle.retryAt = now.Add(delay)
+	p.scheduleLocked(bundle, now)
+	log.Info().Str("uuid", bundle.ReplacementUUID).Int("attempts", bundle.attempts).Dur("backoff", delay).Str("status", status).Msg("Bundle nacked, retrying after backoff")
+}
+
+// deadLetterLocked marks a bundle that exhausted its retry budget for deletion and keeps it in the dead-letter set
+func (p *TxBundlePool) deadLetterLocked(bundle *TxPoolBundle, now time.Time) {
+	if !p.markLocked(bundle, poolOpDeadLetter) {
+		return
+	}
+
+	// A resubmitted bundle can be dead-lettered again, only its latest entry is kept
+	for i, deadLetter := range p.deadLetters {
+		if deadLetter.ReplacementUUID == bundle.ReplacementUUID {
+			p.deadLetters = append(p.deadLetters[:i], p.deadLetters[i+1:]...)
+			break
+		}
+	}
+	if len(p.deadLetters) >= maxDeadLetters {
+		p.deadLetters = p.deadLetters[1:]
+	}
+	p.deadLetters = append(p.deadLetters, DeadLetter{
+		ReplacementUUID: bundle.ReplacementUUID,
+		BundleHash:      bundle.BundleHash.Hex(),
+		ChainID:         bundle.ChainID,
+		Username:        bundle.Username,
+		Attempts:        bundle.attempts,
+		LastStatus:      bundle.lastStatus,
+		DeadLetteredAt:  now,
+	})
+
+	p.statusTracker.record(bundle.ReplacementUUID, BundleStateDeadLettered, bundle.lastStatus)
+	deadLetteredBundlesCounter.WithLabelValues(chainLabel(bundle.ChainID)).Inc()
+	log.Warn().Str("uuid", bundle.ReplacementUUID).Int("attempts", bundle.attempts).Str("status", bundle.lastStatus).Msg("Bundle exhausted its retry budget, dead-lettered")
+}
+
+// deadLetterList returns the dead-letter set of the pool, oldest first
+func (p *TxBundlePool) deadLetterList() []DeadLetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return append([]DeadLetter(nil), p.deadLetters...)
+}
+
+// deadLetters returns the dead-letter sets of all pools, oldest first
+func (c *ChainPools) deadLetters() []DeadLetter {
+	deadLetters := []DeadLetter{}
+	for _, target := range c.targetList() {
+		deadLetters = append(deadLetters, target.Pool.deadLetterList()...)
+	}
+	sort.SliceStable(deadLetters, func(i, j int) bool {
+		return deadLetters[i].DeadLetteredAt.Before(deadLetters[j].DeadLetteredAt)
+	})
+	return deadLetters
+}
+
+// handleAdminDeadLetters lists the bundles that exhausted their retry budget
+func handleAdminDeadLetters(pools *ChainPools) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"deadLetters": pools.deadLetters()})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newLeaseTestPool(retry RetryPolicy) *TxBundlePool {
+	return newTxBundlePool(orderingPolicies["block_number"], PoolLimits{}, conflictKeepHigher, retry, newBundleStatusTracker(0, nil), nil)
+}
+
+func assertLeased(t *testing.T, pool *TxBundlePool, now time.Time, uuids ...string) {
+	t.Helper()
+
+	bundles := pool.leaseBundles(10, now)
+	if len(bundles) != len(uuids) {
+		t.Fatalf("leased %d bundles, want %d", len(bundles), len(uuids))
+	}
+	for i, uuid := range uuids {
+		if bundles[i].ReplacementUUID != uuid {
+			t.Errorf("leased bundle %d has UUID %s, want %s", i, bundles[i].ReplacementUUID, uuid)
+		}
+	}
+}
+
+// settleBundle settles the dispatch of a leased bundle to a single bundle merger
+func settleBundle(t *testing.T, pool *TxBundlePool, bundle *TxPoolBundle, outcome string, status string, now time.Time) {
+	t.Helper()
+
+	required := map[*TxPoolBundle][]string{bundle: {"merger"}}
+	pool.settleDeliveries([]delivery{{bundle: bundle, merger: "merger", outcome: outcome, status: status}}, required, now)
+}
+
+func mustGetBundle(t *testing.T, pool *TxBundlePool, uuid string) *TxPoolBundle {
+	t.Helper()
+
+	bundle, exists := pool.getBundleByUUID(uuid)
+	if !exists {
+		t.Fatalf("bundle %s not found", uuid)
+	}
+	return bundle
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	retry := RetryPolicy{MaxAttempts: 10, LeaseTimeout: time.Second, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 9: 5 * time.Second} {
+		if got := retry.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestLeaseAckAndNack(t *testing.T) {
+	retry := RetryPolicy{MaxAttempts: 3, LeaseTimeout: 10 * time.Second, Backoff: time.Second, MaxBackoff: time.Minute}
+	pool := newLeaseTestPool(retry)
+	now := time.Now()
+	mustAddBundle(t, pool, newTestBundle(1, "accepted", 10), false)
+	mustAddBundle(t, pool, newTestBundle(2, "rejected", 10), false)
+
+	// Leased bundles aren't leased again
+	assertLeased(t, pool, now, "accepted", "rejected")
+	assertLeased(t, pool, now)
+
+	accepted, rejected := mustGetBundle(t, pool, "accepted"), mustGetBundle(t, pool, "rejected")
+	settleBundle(t, pool, accepted, deliveryAccepted, "included", now)
+	settleBundle(t, pool, rejected, deliveryRejected, "simulation failed", now)
+	assertPending(t, pool, map[string]bool{"accepted": false, "rejected": true})
+
+	// Nacked bundles wait for their backoff, doubled by every attempt
+	assertLeased(t, pool, now.Add(999*time.Millisecond))
+	assertLeased(t, pool, now.Add(time.Second), "rejected")
+	settleBundle(t, pool, rejected, deliveryRejected, "simulation failed", now.Add(time.Second))
+	assertLeased(t, pool, now.Add(2*time.Second))
+	assertLeased(t, pool, now.Add(3*time.Second), "rejected")
+
+	// An expired lease counts as a nack, exhausting the retry budget
+	if got := pool.leaseBundles(10, now.Add(13*time.Second)); len(got) != 0 {
+		t.Fatalf("leased %d bundles after the budget was exhausted, want 0", len(got))
+	}
+	assertPending(t, pool, map[string]bool{"rejected": false})
+	if status, _ := pool.statusTracker.get("rejected"); status.State != BundleStateDeadLettered {
+		t.Errorf("bundle has state %s, want %s", status.State, BundleStateDeadLettered)
+	}
+
+	deadLetters := pool.deadLetterList()
+	if len(deadLetters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(deadLetters))
+	}
+	if deadLetters[0].ReplacementUUID != "rejected" || deadLetters[0].Attempts != 3 || deadLetters[0].LastStatus != statusLeaseExpired {
+		t.Errorf("got dead letter %+v, want bundle rejected after 3 attempts with status %q", deadLetters[0], statusLeaseExpired)
+	}
+}
+
+func TestLeaseWaitsForTheUpcomingBlock(t *testing.T) {
+	pool := newLeaseTestPool(defaultRetryPolicy)
+	now := time.Now()
+	next := NextBlock{Number: 10, Timestamp: uint64(now.Unix())}
+	pool.nextBlock = func(uint64) NextBlock { return next }
+
+	minTimestamp := newTestBundle(1, "min-timestamp", 10)
+	minTimestamp.MinTimestamp = now.Unix() + 12
+	mustAddBundle(t, pool, minTimestamp, false)
+	mustAddBundle(t, pool, newTestBundle(2, "block-10", 10), false)
+	mustAddBundle(t, pool, newTestBundle(3, "block-11", 11), false)
+
+	// Bundles for later blocks wait outside of the ready bundles
+	assertLeased(t, pool, now, "block-10")
+	if ready := pool.ready.Len(); ready != 0 {
+		t.Errorf("%d ready bundles, want 0", ready)
+	}
+
+	next = NextBlock{Number: 11, Timestamp: uint64(now.Unix()) + 12}
+	assertLeased(t, pool, now, "min-timestamp", "block-11")
+
+	// A bundle scheduled for block 11 waits again once the head goes back
+	mustAddBundle(t, pool, newTestBundle(4, "reorged", 11), false)
+	next = NextBlock{Number: 10, Timestamp: uint64(now.Unix())}
+	assertLeased(t, pool, now)
+	next = NextBlock{Number: 11, Timestamp: uint64(now.Unix()) + 12}
+	assertLeased(t, pool, now, "reorged")
+}
+
+func TestLeaseReclaimsExpiredLeasesBeyondTheLimit(t *testing.T) {
+	retry := RetryPolicy{MaxAttempts: 1, LeaseTimeout: 10 * time.Second, Backoff: time.Second, MaxBackoff: time.Minute}
+	pool := newLeaseTestPool(retry)
+	now := time.Now()
+	mustAddBundle(t, pool, newTestBundle(1, "a", 10), false)
+	mustAddBundle(t, pool, newTestBundle(2, "b", 10), false)
+	assertLeased(t, pool, now, "a", "b")
+
+	// A bundle ahead of the expired leases fills the limit, the expired leases are nacked nonetheless
+	mustAddBundle(t, pool, newTestBundle(3, "first", 9), false)
+	if leased := pool.leaseBundles(1, now.Add(10*time.Second)); len(leased) != 1 || leased[0].ReplacementUUID != "first" {
+		t.Fatalf("leased %v, want the first bundle", leased)
+	}
+	assertPending(t, pool, map[string]bool{"a": false, "b": false, "first": true})
+	if deadLetters := pool.deadLetterList(); len(deadLetters) != 2 || deadLetters[0].ReplacementUUID != "a" || deadLetters[0].LastStatus != statusLeaseExpired {
+		t.Errorf("got dead letters %+v, want a and b after their leases expired", deadLetters)
+	}
+	if len(pool.leased) != 1 {
+		t.Errorf("pool tracks %d leases, want 1", len(pool.leased))
+	}
+}
+
+func TestLeaseIgnoresAnswersForReplacedBundles(t *testing.T) {
+	pool := newLeaseTestPool(defaultRetryPolicy)
+	now := time.Now()
+	mustAddBundle(t, pool, newTestBundle(1, "bundle", 10), false)
+	assertLeased(t, pool, now, "bundle")
+	replaced := mustGetBundle(t, pool, "bundle")
+
+	// The replacement wasn't dispatched, the answer belongs to the replaced bundle
+	mustAddBundle(t, pool, newTestBundle(2, "bundle", 10), true)
+	settleBundle(t, pool, replaced, deliveryAccepted, "included", now)
+	assertPending(t, pool, map[string]bool{"bundle": true})
+	assertLeased(t, pool, now, "bundle")
+}
+
+func TestSettleWaitsForEveryRequiredMerger(t *testing.T) {
+	pool := newLeaseTestPool(defaultRetryPolicy)
+	now := time.Now()
+	mustAddBundle(t, pool, newTestBundle(1, "bundle", 10), false)
+	assertLeased(t, pool, now, "bundle")
+	bundle := mustGetBundle(t, pool, "bundle")
+	required := map[*TxPoolBundle][]string{bundle: {"primary", "secondary"}}
+
+	// An acceptance by one bundle merger is kept while the other one is retried
+	pool.settleDeliveries([]delivery{
+		{bundle: bundle, merger: "primary", outcome: deliveryAccepted, status: "included"},
+		{bundle: bundle, merger: "secondary", outcome: deliveryFailed},
+	}, required, now)
+	if bundle.attempts != 0 || !bundle.leasedUntil.IsZero() || !bundle.acceptedBy["primary"] {
+		t.Fatalf("bundle has %d attempts, lease %v and acceptances %v, want released and accepted by primary", bundle.attempts, bundle.leasedUntil, bundle.acceptedBy)
+	}
+
+	assertLeased(t, pool, now, "bundle")
+	pool.settleDeliveries([]delivery{{bundle: bundle, merger: "secondary", outcome: deliveryAccepted, status: "included"}}, required, now)
+	assertPending(t, pool, map[string]bool{"bundle": false})
+
+	status, _ := pool.statusTracker.get("bundle")
+	if status.State != BundleStateAccepted || status.Status != "secondary: included" {
+		t.Errorf("bundle has state %s and status %q, want %s with the status of secondary", status.State, status.Status, BundleStateAccepted)
+	}
+	if len(status.Targets) != 2 || !status.Targets["primary"].Accepted || !status.Targets["secondary"].Accepted {
+		t.Errorf("bundle has target responses %v, want accepted by primary and secondary", status.Targets)
+	}
+}
@@ -0,0 +1,315 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Eviction policies, which pending bundle makes room for a new bundle if the pool is full
+const (
+	evictionLowestScore = "lowest_score" // The bundle with the lowest fee score, if the new bundle scores higher
+	evictionOldest      = "oldest"       // The bundle that arrived first
+	evictionNone        = "none"         // No bundle, the new bundle is refused
+)
+
+// errPoolFull is returned if a bundle can't be admitted because of the capacity limits of the pool
+var errPoolFull = errors.New("pool full")
+
+// Define Prometheus metrics
+var (
+	evictedBundlesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evicted_bundles_total",
+			Help: "Total number of bundles evicted from the pool to make room for new bundles by chain ID",
+		},
+		[]string{"chain_id"},
+	)
+	poolFullCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pool_full_total",
+			Help: "Total number of bundles refused because of the capacity limits by limit",
+		},
+		[]string{"limit"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(evictedBundlesCounter)
+	profSequencerRegisterer.MustRegister(poolFullCounter)
+}
+
+// PoolLimits represents the capacity limits of a pool, zero disables a limit.
+type PoolLimits struct {
+	MaxBundles         int    // Maximum number of pending bundles
+	MaxBytes           uint64 // Maximum encoded size of the transactions of the pending bundles
+	MaxBundlesPerUser  int    // Maximum number of pending bundles of a user
+	MaxBytesPerUser    uint64 // Maximum encoded size of the transactions of the pending bundles of a user
+	MaxBundlesPerBlock int    // Maximum number of pending bundles targeting the same block of a chain
+	Eviction           string // Eviction policy if a limit is reached
+}
+
+func (l PoolLimits) validate() error {
+	if l.MaxBundles < 0 || l.MaxBundlesPerUser < 0 || l.MaxBundlesPerBlock < 0 {
+		return fmt.Errorf("bundle limits must not be negative")
+	}
+	switch l.Eviction {
+	case evictionLowestScore, evictionOldest, evictionNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid eviction policy %q, expected %s", l.Eviction, strings.Join([]string{evictionLowestScore, evictionOldest, evictionNone}, ", "))
+	}
+}
+
+func (l PoolLimits) limitsPool() bool  { return l.MaxBundles > 0 || l.MaxBytes > 0 }
+func (l PoolLimits) limitsUsers() bool { return l.MaxBundlesPerUser > 0 || l.MaxBytesPerUser > 0 }
+
+// evictionScope holds the pending bundles a limit applies to, in eviction order
+type evictionScope struct {
+	bundles *bundleHeap
+	bytes   uint64 // Encoded size of the transactions of the bundles
+}
+
+func (s *evictionScope) add(bundle *TxPoolBundle) {
+	s.bundles.push(bundle)
+	s.bytes += bundle.Size
+}
+
+func (s *evictionScope) remove(bundle *TxPoolBundle) {
+	if s.bundles.remove(bundle) {
+		s.bytes -= bundle.Size
+	}
+}
+
+// poolLimit is a limit checked when a bundle is admitted
+type poolLimit struct {
+	name       string                     // Name of the limit, used in errors and metrics
+	scope      *evictionScope             // Pending bundles the limit applies to, nil if there are none yet
+	contains   func(b *TxPoolBundle) bool // Whether a bundle belongs to the scope
+	maxBundles int                        // Maximum number of bundles, zero for no limit
+	maxBytes   uint64                     // Maximum encoded size, zero for no limit
+}
+
+// evictionOrder returns the order in which the eviction policy evicts pending bundles
+func evictionOrder(policy string) func(b1, b2 *TxPoolBundle) bool {
+	return func(b1, b2 *TxPoolBundle) bool {
+		if policy == evictionLowestScore {
+			if result := feeScoreOf(b1).Cmp(feeScoreOf(b2)); result != 0 {
+				return result < 0
+			}
+		}
+		if !b1.ReceivedAt.Equal(b2.ReceivedAt) {
+			return b1.ReceivedAt.Before(b2.ReceivedAt)
+		}
+		return b1.seq < b2.seq
+	}
+}
+
+// evicts reports whether the eviction policy lets the new bundle take the place of the pending bundle
+func (l PoolLimits) evicts(bundle, pending *TxPoolBundle) bool {
+	switch l.Eviction {
+	case evictionLowestScore:
+		return feeScoreOf(pending).Cmp(feeScoreOf(bundle)) < 0
+	case evictionOldest:
+		return true
+	default:
+		return false
+	}
+}
+
+// newEvictionScope creates an empty eviction scope whose bundles keep their position in the given field
+func (p *TxBundlePool) newEvictionScope(index func(bundle *TxPoolBundle) *int) *evictionScope {
+	return &evictionScope{bundles: newBundleHeap(evictionOrder(p.limits.Eviction), index)}
+}
+
+// trackLocked adds a pending bundle to the eviction scopes of the enabled limits
+func (p *TxBundlePool) trackLocked(bundle *TxPoolBundle) {
+	if p.limits.limitsPool() {
+		p.evictAll.add(bundle)
+	}
+	if p.limits.limitsUsers() {
+		scope, exists := p.evictByUser[bundle.Username]
+		if !exists {
+			scope = p.newEvictionScope(func(bundle *TxPoolBundle) *int { return &bundle.userEvictionIndex })
+			p.evictByUser[bundle.Username] = scope
+		}
+		scope.add(bundle)
+	}
+	if p.limits.MaxBundlesPerBlock > 0 {
+		key := blockKey{chainID: bundle.ChainID, block: bundle.TargetBlock}
+		scope, exists := p.evictByBlock[key]
+		if !exists {
+			scope = p.newEvictionScope(func(bundle *TxPoolBundle) *int { return &bundle.blockEvictionIndex })
+			p.evictByBlock[key] = scope
+		}
+		scope.add(bundle)
+	}
+}
+
+// untrackLocked removes a bundle from the eviction scopes, empty scopes are dropped
+func (p *TxBundlePool) untrackLocked(bundle *TxPoolBundle) {
+	if p.limits.limitsPool() {
+		p.evictAll.remove(bundle)
+	}
+	if scope, exists := p.evictByUser[bundle.Username]; exists {
+		scope.remove(bundle)
+		if scope.bundles.Len() == 0 {
+			delete(p.evictByUser, bundle.Username)
+		}
+	}
+	key := blockKey{chainID: bundle.ChainID, block: bundle.TargetBlock}
+	if scope, exists := p.evictByBlock[key]; exists {
+		scope.remove(bundle)
+		if scope.bundles.Len() == 0 {
+			delete(p.evictByBlock, key)
+		}
+	}
+}
+
+// reorderEvictionsLocked restores the eviction order after the fee scores changed
+func (p *TxBundlePool) reorderEvictionsLocked() {
+	if p.limits.Eviction != evictionLowestScore {
+		return
+	}
+	if p.limits.limitsPool() {
+		p.evictAll.bundles.reorder()
+	}
+	for _, scope := range p.evictByUser {
+		scope.bundles.reorder()
+	}
+	for _, scope := range p.evictByBlock {
+		scope.bundles.reorder()
+	}
+}
+
+// limitsOf returns the limits that apply to the bundle, the narrowest first, so evictions
+// hit the target block and the user of the bundle before other users
+func (p *TxBundlePool) limitsOf(bundle *TxPoolBundle) []poolLimit {
+	var limits []poolLimit
+	if p.limits.MaxBundlesPerBlock > 0 {
+		key := blockKey{chainID: bundle.ChainID, block: bundle.TargetBlock}
+		limits = append(limits, poolLimit{
+			name:       "block",
+			scope:      p.evictByBlock[key],
+			contains:   func(b *TxPoolBundle) bool { return b.ChainID == key.chainID && b.TargetBlock == key.block },
+			maxBundles: p.limits.MaxBundlesPerBlock,
+		})
+	}
+	if p.limits.limitsUsers() {
+		limits = append(limits, poolLimit{
+			name:       "user",
+			scope:      p.evictByUser[bundle.Username],
+			contains:   func(b *TxPoolBundle) bool { return b.Username == bundle.Username },
+			maxBundles: p.limits.MaxBundlesPerUser,
+			maxBytes:   p.limits.MaxBytesPerUser,
+		})
+	}
+	if p.limits.limitsPool() {
+		limits = append(limits, poolLimit{
+			name:       "pool",
+			scope:      p.evictAll,
+			contains:   func(b *TxPoolBundle) bool { return true },
+			maxBundles: p.limits.MaxBundles,
+			maxBytes:   p.limits.MaxBytes,
+		})
+	}
+	return limits
+}
+
+// admitLocked checks the bundle against the capacity limits and returns the pending bundles
+// that have to be evicted to admit it. The bundles leaving the pool with it, like the bundle it
+// replaces, don't count against the limits. Nothing is evicted if the bundle can't be admitted,
+// errPoolFull is returned instead.
+func (p *TxBundlePool) admitLocked(bundle *TxPoolBundle, leaving []*TxPoolBundle) ([]*TxPoolBundle, error) {
+	removed := make(bundleSet)
+	for _, b := range leaving {
+		if !b.MarkedForDeletion {
+			removed[b] = struct{}{}
+		}
+	}
+
+	var evictions []*TxPoolBundle
+	for _, limit := range p.limitsOf(bundle) {
+		if limit.maxBytes > 0 && bundle.Size > limit.maxBytes {
+			poolFullCounter.WithLabelValues(limit.name).Inc()
+			return nil, fmt.Errorf("%w: bundle of %d bytes exceeds the %s limit of %d bytes", errPoolFull, bundle.Size, limit.name, limit.maxBytes)
+		}
+
+		// Usage of the scope without the bundles that are replaced or evicted already
+		bundles, bytes := 0, uint64(0)
+		if limit.scope != nil {
+			bundles, bytes = limit.scope.bundles.Len(), limit.scope.bytes
+		}
+		for b := range removed {
+			if limit.contains(b) {
+				bundles--
+				bytes -= b.Size
+			}
+		}
+
+		for (limit.maxBundles > 0 && bundles+1 > limit.maxBundles) || (limit.maxBytes > 0 && bytes+bundle.Size > limit.maxBytes) {
+			victim := limit.nextVictim(removed)
+			if victim == nil || !p.limits.evicts(bundle, victim) {
+				poolFullCounter.WithLabelValues(limit.name).Inc()
+				return nil, fmt.Errorf("%w: %s limit of %s reached", errPoolFull, limit.name, limit.describe())
+			}
+			removed[victim] = struct{}{}
+			evictions = append(evictions, victim)
+			bundles--
+			bytes -= victim.Size
+		}
+	}
+	return evictions, nil
+}
+
+// nextVictim returns the first bundle of the scope in eviction order that isn't removed already
+func (l poolLimit) nextVictim(removed bundleSet) *TxPoolBundle {
+	var victim *TxPoolBundle
+	if l.scope == nil {
+		return nil
+	}
+	l.scope.bundles.walk(func(bundle *TxPoolBundle) bool {
+		if _, exists := removed[bundle]; exists {
+			return true
+		}
+		victim = bundle
+		return false
+	})
+	return victim
+}
+
+func (l poolLimit) describe() string {
+	var parts []string
+	if l.maxBundles > 0 {
+		parts = append(parts, fmt.Sprintf("%d bundles", l.maxBundles))
+	}
+	if l.maxBytes > 0 {
+		parts = append(parts, fmt.Sprintf("%d bytes", l.maxBytes))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// evictLocked marks a bundle evicted to make room for a new bundle for deletion
+func (p *TxBundlePool) evictLocked(bundle *TxPoolBundle, by *TxPoolBundle) {
+	if !p.markLocked(bundle, poolOpEvict) {
+		return
+	}
+
+	p.statusTracker.record(bundle.ReplacementUUID, BundleStateEvicted, "pool full")
+	evictedBundlesCounter.WithLabelValues(chainLabel(bundle.ChainID)).Inc()
+	log.Info().Str("uuid", bundle.ReplacementUUID).Str("username", bundle.Username).Str("by", by.ReplacementUUID).Msg("Bundle evicted, pool full")
+}
+
+// newPoolFullError reports a bundle refused because of the capacity limits as JSON-RPC error
+func newPoolFullError(err error, data interface{}) *JSONRPCError {
+	if data == nil {
+		data = err.Error()
+	}
+	return newRPCError(rpcErrLimitExceeded, errPoolFull.Error(), data)
+}
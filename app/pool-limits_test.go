@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func newLimitedTestPool(limits PoolLimits) *TxBundlePool {
+	return newTxBundlePool(orderingPolicies["block_number"], limits, conflictKeepHigher, defaultRetryPolicy, newBundleStatusTracker(0, nil), nil)
+}
+
+// newUserTestBundle returns a bundle of the given user whose fee score is its gas price
+func newUserTestBundle(nonce uint64, uuid, username string, block uint64) *TxPoolBundle {
+	bundle := newTestBundle(nonce, uuid, block)
+	bundle.Username = username
+	return bundle
+}
+
+func assertPoolFull(t *testing.T, pool *TxBundlePool, bundle *TxPoolBundle) {
+	t.Helper()
+
+	if _, err := pool.addBundle(bundle, false); !errors.Is(err, errPoolFull) {
+		t.Fatalf("addBundle() error = %v, want %v", err, errPoolFull)
+	}
+}
+
+func assertPending(t *testing.T, pool *TxBundlePool, pending map[string]bool) {
+	t.Helper()
+
+	for uuid, want := range pending {
+		if _, got := pool.getBundleByUUID(uuid); got != want {
+			t.Errorf("bundle %s pending = %v, want %v", uuid, got, want)
+		}
+	}
+}
+
+func TestPoolLimitEvictsLowestScore(t *testing.T) {
+	pool := newLimitedTestPool(PoolLimits{MaxBundles: 2, Eviction: evictionLowestScore})
+
+	// The fee scores are the nonces modulo 100 plus one
+	mustAddBundle(t, pool, newUserTestBundle(10, "medium", "alice", 10), false)
+	mustAddBundle(t, pool, newUserTestBundle(5, "low", "bob", 10), false)
+
+	// A bundle scoring lower than every pending bundle is refused
+	assertPoolFull(t, pool, newUserTestBundle(1, "lowest", "carol", 10))
+
+	// A bundle scoring higher evicts the lowest scoring bundle
+	mustAddBundle(t, pool, newUserTestBundle(20, "high", "carol", 10), false)
+	assertPending(t, pool, map[string]bool{"medium": true, "low": false, "high": true})
+	if status, _ := pool.statusTracker.get("low"); status.State != BundleStateEvicted {
+		t.Errorf("evicted bundle has state %s, want %s", status.State, BundleStateEvicted)
+	}
+
+	// Replacing a pending bundle doesn't count against the limit
+	mustAddBundle(t, pool, newUserTestBundle(2, "medium", "alice", 11), true)
+	assertPending(t, pool, map[string]bool{"medium": true, "high": true})
+}
+
+func TestPoolLimitPerUser(t *testing.T) {
+	pool := newLimitedTestPool(PoolLimits{MaxBundles: 10, MaxBundlesPerUser: 2, Eviction: evictionOldest})
+
+	mustAddBundle(t, pool, newUserTestBundle(1, "alice-1", "alice", 10), false)
+	mustAddBundle(t, pool, newUserTestBundle(2, "bob-1", "bob", 10), false)
+	mustAddBundle(t, pool, newUserTestBundle(3, "alice-2", "alice", 10), false)
+
+	// A user at the limit evicts their own oldest bundle, not the older bundles of other users
+	mustAddBundle(t, pool, newUserTestBundle(4, "alice-3", "alice", 10), false)
+	assertPending(t, pool, map[string]bool{"alice-1": false, "bob-1": true, "alice-2": true, "alice-3": true})
+}
+
+func TestPoolLimitPerBlock(t *testing.T) {
+	pool := newLimitedTestPool(PoolLimits{MaxBundlesPerBlock: 1, Eviction: evictionNone})
+
+	mustAddBundle(t, pool, newUserTestBundle(1, "block-10", "alice", 10), false)
+	assertPoolFull(t, pool, newUserTestBundle(2, "block-10-again", "bob", 10))
+	mustAddBundle(t, pool, newUserTestBundle(3, "block-11", "bob", 11), false)
+
+	// Bundles leaving the pool free their place
+	if err := pool.cancelBundleByUUID("block-10", "alice"); err != nil {
+		t.Fatalf("cancelBundleByUUID() error = %v", err)
+	}
+	mustAddBundle(t, pool, newUserTestBundle(2, "block-10-again", "bob", 10), false)
+}
+
+func TestPoolLimitBytes(t *testing.T) {
+	bundle := newUserTestBundle(1, "first", "alice", 10)
+	size := bundle.Txs[0].Size()
+	pool := newLimitedTestPool(PoolLimits{MaxBytes: 2 * size, MaxBytesPerUser: size, Eviction: evictionOldest})
+
+	mustAddBundle(t, pool, bundle, false)
+	mustAddBundle(t, pool, newUserTestBundle(2, "second", "bob", 10), false)
+
+	// Evictions for the user limit also make room in the pool
+	mustAddBundle(t, pool, newUserTestBundle(3, "third", "bob", 10), false)
+	assertPending(t, pool, map[string]bool{"first": true, "second": false, "third": true})
+
+	// A bundle larger than a limit is never admitted
+	large := newUserTestBundle(4, "large", "carol", 10)
+	large.Txs = append(large.Txs, newUserTestBundle(5, "", "", 10).Txs...)
+	assertPoolFull(t, pool, large)
+	assertPending(t, pool, map[string]bool{"first": true, "third": true})
+}
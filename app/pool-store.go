@@ -0,0 +1,557 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Operations recorded in the write-ahead log of the pool store
+const (
+	poolOpAdd        = "add"         // A new bundle was pooled
+	poolOpReplace    = "replace"     // A bundle replaced the bundle with the same UUID
+	poolOpCancel     = "cancel"      // A bundle was cancelled by its user
+	poolOpMark       = "mark"        // A bundle was marked for deletion, e.g. after it was accepted by the bundle merger
+	poolOpExpire     = "expire"      // A bundle expired
+	poolOpEvict      = "evict"       // A bundle was evicted to make room for a new bundle
+	poolOpDisplace   = "displace"    // A bundle was displaced by a conflicting bundle with a higher fee score
+	poolOpDeadLetter = "dead_letter" // A bundle exhausted its retry budget
+	poolOpCleanup    = "cleanup"     // A marked bundle was removed from the pool
+)
+
+// Files of the pool store
+const (
+	poolSnapshotFile     = "snapshot.json"
+	poolWALSegmentPrefix = "wal-"
+	poolWALSegmentSuffix = ".log"
+)
+
+// Define Prometheus metrics
+var (
+	poolStoreRecordsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pool_store_records_total",
+			Help: "Total number of pool mutations written to the write-ahead log by operation",
+		},
+		[]string{"op"},
+	)
+	poolStoreErrorsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pool_store_errors_total",
+			Help: "Total number of failed writes to the write-ahead log and snapshots",
+		},
+	)
+	poolStoreSnapshotBundlesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pool_store_snapshot_bundles",
+			Help: "Number of bundles in the latest pool snapshot",
+		},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(poolStoreRecordsCounter)
+	profSequencerRegisterer.MustRegister(poolStoreErrorsCounter)
+	profSequencerRegisterer.MustRegister(poolStoreSnapshotBundlesGauge)
+}
+
+// PersistedBundle represents a pooled bundle on disk. Fields derived from the pool state, like
+// the fee score, are recomputed when the bundle is restored.
+type PersistedBundle struct {
+	Txs               []hexutil.Bytes  `json:"txs"`                         // Binary-encoded transactions
+	Senders           []common.Address `json:"senders"`                     // Recovered senders, by index of Txs
+	BlockNumber       string           `json:"blockNumber"`                 // Hex-encoded block number
+	MaxBlockNumber    string           `json:"maxBlockNumber,omitempty"`    // Optional hex-encoded last block for inclusion
+	MinTimestamp      int64            `json:"minTimestamp,omitempty"`      // Optional minimum timestamp
+	MaxTimestamp      int64            `json:"maxTimestamp,omitempty"`      // Optional maximum timestamp
+	RevertingTxHashes []string         `json:"revertingTxHashes,omitempty"` // Optional list of tx hashes allowed to revert
+	ReplacementUUID   string           `json:"replacementUuid"`             // Replacement UUID
+	Builders          []string         `json:"builders,omitempty"`          // Optional list of canonical builder names
+	ChainID           uint64           `json:"chainId"`                     // Chain the bundle is sequenced for
+	Username          string           `json:"username"`                    // User that submitted the bundle
+	ReceivedAt        time.Time        `json:"receivedAt"`                  // Time the bundle arrived at the sequencer
+	Retargeted        bool             `json:"retargeted,omitempty"`        // Whether the bundle was moved to the next block after missing the cutoff
+}
+
+func persistBundle(bundle *TxPoolBundle) (*PersistedBundle, error) {
+	txs := make([]hexutil.Bytes, len(bundle.Txs))
+	for i, tx := range bundle.Txs {
+		data, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode transaction %d: %v", i, err)
+		}
+		txs[i] = data
+	}
+
+	return &PersistedBundle{
+		Txs:               txs,
+		Senders:           bundle.Senders,
+		BlockNumber:       bundle.BlockNumber,
+		MaxBlockNumber:    bundle.MaxBlockNumber,
+		MinTimestamp:      bundle.MinTimestamp,
+		MaxTimestamp:      bundle.MaxTimestamp,
+		RevertingTxHashes: bundle.RevertingTxHashes,
+		ReplacementUUID:   bundle.ReplacementUUID,
+		Builders:          bundle.Builders,
+		ChainID:           bundle.ChainID,
+		Username:          bundle.Username,
+		ReceivedAt:        bundle.ReceivedAt,
+		Retargeted:        bundle.retargeted,
+	}, nil
+}
+
+func (b *PersistedBundle) bundle() (*TxPoolBundle, error) {
+	txs := make([]*types.Transaction, len(b.Txs))
+	for i, data := range b.Txs {
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("failed to decode transaction %d: %v", i, err)
+		}
+		txs[i] = tx
+	}
+
+	return &TxPoolBundle{
+		Txs:               txs,
+		Senders:           b.Senders,
+		BlockNumber:       b.BlockNumber,
+		MaxBlockNumber:    b.MaxBlockNumber,
+		MinTimestamp:      b.MinTimestamp,
+		MaxTimestamp:      b.MaxTimestamp,
+		RevertingTxHashes: b.RevertingTxHashes,
+		ReplacementUUID:   b.ReplacementUUID,
+		Builders:          b.Builders,
+		ChainID:           b.ChainID,
+		Username:          b.Username,
+		ReceivedAt:        b.ReceivedAt,
+		retargeted:        b.Retargeted,
+	}, nil
+}
+
+// poolRecord represents a pool mutation in the write-ahead log, one JSON object per line.
+type poolRecord struct {
+	Op     string           `json:"op"`               // Operation, see the poolOp constants
+	UUID   string           `json:"uuid"`             // Replacement UUID of the bundle
+	Bundle *PersistedBundle `json:"bundle,omitempty"` // Pooled bundle, for add and replace
+}
+
+// poolSnapshot represents the pending bundles of all pools at the start of a write-ahead log segment.
+type poolSnapshot struct {
+	Segment   uint64             `json:"segment"`   // First write-ahead log segment not covered by the snapshot
+	CreatedAt time.Time          `json:"createdAt"` // Time the snapshot was taken
+	Bundles   []*PersistedBundle `json:"bundles"`   // Pending bundles
+}
+
+// PoolStore persists the mutations of the bundle pools in an append-only write-ahead log, which is
+// compacted by periodic snapshots. The log is split into numbered segments: a snapshot covers all
+// segments before the one it names, these are deleted once the snapshot is written.
+type PoolStore struct {
+	dir     string     // Directory of the snapshot and the log segments
+	fsync   bool       // Sync the log after every record
+	segment uint64     // Number of the segment records are appended to
+	wal     *os.File   // Segment records are appended to, nil until the first record
+	mu      sync.Mutex // A mutex for the log
+
+	snapshotMu sync.Mutex // Serializes snapshots, so an older snapshot never replaces a newer one
+}
+
+// openPoolStore opens the pool store in the given directory, creating it if necessary. Records
+// are appended to a new segment, so a record torn by a crash is never followed by another one.
+func openPoolStore(dir string, fsync bool) (*PoolStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create pool data directory: %v", err)
+	}
+
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &PoolStore{dir: dir, fsync: fsync, segment: 1}
+	if len(segments) > 0 {
+		s.segment = segments[len(segments)-1] + 1
+	}
+	return s, nil
+}
+
+// listWALSegments returns the numbers of the log segments in the directory in ascending order
+func listWALSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pool data directory: %v", err)
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, poolWALSegmentPrefix) || !strings.HasSuffix(name, poolWALSegmentSuffix) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, poolWALSegmentPrefix), poolWALSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (s *PoolStore) segmentPath(segment uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", poolWALSegmentPrefix, segment, poolWALSegmentSuffix))
+}
+
+// load restores the pending bundles from the latest snapshot and the log segments written after it,
+// ordered by arrival time
+func (s *PoolStore) load() ([]*TxPoolBundle, error) {
+	pending := make(map[string]*PersistedBundle)
+
+	var snapshot poolSnapshot
+	data, err := os.ReadFile(filepath.Join(s.dir, poolSnapshotFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to parse pool snapshot: %v", err)
+		}
+		for _, bundle := range snapshot.Bundles {
+			pending[bundle.ReplacementUUID] = bundle
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to read pool snapshot: %v", err)
+	}
+
+	segments, err := listWALSegments(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	replayed := 0
+	for i, segment := range segments {
+		if segment < snapshot.Segment {
+			continue
+		}
+		n, err := replayWALSegment(s.segmentPath(segment), i == len(segments)-1, pending)
+		if err != nil {
+			return nil, err
+		}
+		replayed += n
+	}
+
+	bundles := make([]*TxPoolBundle, 0, len(pending))
+	for _, persisted := range pending {
+		bundle, err := persisted.bundle()
+		if err != nil {
+			return nil, fmt.Errorf("bundle %s: %v", persisted.ReplacementUUID, err)
+		}
+		bundles = append(bundles, bundle)
+	}
+	sort.SliceStable(bundles, func(i, j int) bool { return sortByArrivalTime(bundles[i], bundles[j]) })
+
+	log.Info().Str("dir", s.dir).Int("snapshot_bundles", len(snapshot.Bundles)).Int("replayed_records", replayed).Int("bundles", len(bundles)).Msg("Pool store loaded")
+	return bundles, nil
+}
+
+// replayWALSegment applies the records of a log segment to the pending bundles by UUID. A torn
+// record at the end of the last segment, left by a crash during the write, is skipped.
+func replayWALSegment(path string, last bool, pending map[string]*PersistedBundle) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open write-ahead log: %v", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	replayed := 0
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return replayed, fmt.Errorf("failed to read write-ahead log %s: %v", path, err)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record poolRecord
+			if decodeErr := json.Unmarshal(line, &record); decodeErr != nil {
+				if last && err == io.EOF {
+					log.Warn().Str("path", path).Int("line", lineNumber).Msg("Skipping torn record at the end of the write-ahead log")
+					return replayed, nil
+				}
+				return replayed, fmt.Errorf("invalid record in write-ahead log %s line %d: %v", path, lineNumber, decodeErr)
+			}
+
+			switch record.Op {
+			case poolOpAdd, poolOpReplace:
+				if record.Bundle == nil {
+					return replayed, fmt.Errorf("record without bundle in write-ahead log %s line %d", path, lineNumber)
+				}
+				pending[record.UUID] = record.Bundle
+			default:
+				delete(pending, record.UUID)
+			}
+			replayed++
+		}
+		if err == io.EOF {
+			return replayed, nil
+		}
+	}
+}
+
+// append writes records to the log with a single write
+func (s *PoolStore) append(records ...poolRecord) error {
+	var buf bytes.Buffer
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode pool record: %v", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.write(buf.Bytes()); err != nil {
+		poolStoreErrorsCounter.Inc()
+		return err
+	}
+	for _, record := range records {
+		poolStoreRecordsCounter.WithLabelValues(record.Op).Inc()
+	}
+	return nil
+}
+
+func (s *PoolStore) write(data []byte) error {
+	if s.wal == nil {
+		wal, err := os.OpenFile(s.segmentPath(s.segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return fmt.Errorf("failed to open write-ahead log: %v", err)
+		}
+		s.wal = wal
+	}
+
+	if _, err := s.wal.Write(data); err != nil {
+		return fmt.Errorf("failed to write write-ahead log: %v", err)
+	}
+	if s.fsync {
+		if err := s.wal.Sync(); err != nil {
+			return fmt.Errorf("failed to sync write-ahead log: %v", err)
+		}
+	}
+	return nil
+}
+
+// rotate closes the current log segment and returns the number of the next one, which the
+// following records are appended to
+func (s *PoolStore) rotate() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal != nil {
+		err := s.wal.Sync()
+		if closeErr := s.wal.Close(); err == nil {
+			err = closeErr
+		}
+		s.wal = nil
+		if err != nil {
+			poolStoreErrorsCounter.Inc()
+			return 0, fmt.Errorf("failed to close write-ahead log: %v", err)
+		}
+	}
+	s.segment++
+	return s.segment, nil
+}
+
+// writeSnapshot atomically replaces the snapshot by the given bundles as of the start of the
+// given segment and deletes the segments it covers
+func (s *PoolStore) writeSnapshot(segment uint64, bundles []*TxPoolBundle) error {
+	snapshot := poolSnapshot{Segment: segment, CreatedAt: time.Now(), Bundles: make([]*PersistedBundle, 0, len(bundles))}
+	for _, bundle := range bundles {
+		persisted, err := persistBundle(bundle)
+		if err != nil {
+			return fmt.Errorf("bundle %s: %v", bundle.ReplacementUUID, err)
+		}
+		snapshot.Bundles = append(snapshot.Bundles, persisted)
+	}
+
+	if err := s.writeSnapshotFile(&snapshot); err != nil {
+		poolStoreErrorsCounter.Inc()
+		return err
+	}
+	poolStoreSnapshotBundlesGauge.Set(float64(len(snapshot.Bundles)))
+
+	segments, err := listWALSegments(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, covered := range segments {
+		if covered >= segment {
+			break
+		}
+		if err := os.Remove(s.segmentPath(covered)); err != nil {
+			log.Warn().Err(err).Uint64("segment", covered).Msg("Failed to delete write-ahead log segment")
+		}
+	}
+	return nil
+}
+
+func (s *PoolStore) writeSnapshotFile(snapshot *poolSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode pool snapshot: %v", err)
+	}
+
+	// Write to a temporary file first, so a crash never leaves a partial snapshot behind
+	tmp, err := os.CreateTemp(s.dir, poolSnapshotFile+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create pool snapshot: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write pool snapshot: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync pool snapshot: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close pool snapshot: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, poolSnapshotFile)); err != nil {
+		return fmt.Errorf("failed to replace pool snapshot: %v", err)
+	}
+	return nil
+}
+
+// close syncs and closes the current log segment
+func (s *PoolStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal == nil {
+		return nil
+	}
+	err := s.wal.Sync()
+	if closeErr := s.wal.Close(); err == nil {
+		err = closeErr
+	}
+	s.wal = nil
+	return err
+}
+
+// persistLocked appends a mutation of the bundle to the write-ahead log, if the pool is persisted
+func (p *TxBundlePool) persistLocked(op string, bundle *TxPoolBundle) error {
+	if p.store == nil {
+		return nil
+	}
+
+	record := poolRecord{Op: op, UUID: bundle.ReplacementUUID}
+	if op == poolOpAdd || op == poolOpReplace {
+		persisted, err := persistBundle(bundle)
+		if err != nil {
+			return err
+		}
+		record.Bundle = persisted
+	}
+	return p.store.append(record)
+}
+
+// setStore enables the persistence of the pool mutations
+func (p *TxBundlePool) setStore(store *PoolStore) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.store = store
+}
+
+// pendingBundles returns the bundles that are not marked for deletion, in no particular order
+func (p *TxBundlePool) pendingBundles() []*TxPoolBundle {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return append([]*TxPoolBundle(nil), p.queue.items...)
+}
+
+// restoreBundles adds the bundles loaded from the pool store to the pools of their chains.
+// Bundles that expired while the sequencer was down are skipped, by max timestamp right away
+// and by target block once the head followers see the first head.
+func (c *ChainPools) restoreBundles(bundles []*TxPoolBundle, now time.Time) (int, int) {
+	restored, skipped := 0, 0
+	for _, bundle := range bundles {
+		if reason := bundle.expiryReason(nil, now); reason != "" {
+			log.Info().Str("uuid", bundle.ReplacementUUID).Str("reason", reason).Msg("Skipping bundle that expired while down")
+			skipped++
+			continue
+		}
+		if _, err := c.addBundle(bundle, true); err != nil {
+			log.Warn().Err(err).Str("uuid", bundle.ReplacementUUID).Msg("Skipping bundle that can't be restored")
+			skipped++
+			continue
+		}
+		restored++
+	}
+	return restored, skipped
+}
+
+// setStore enables the persistence of the mutations of all pools
+func (c *ChainPools) setStore(store *PoolStore) {
+	for _, target := range c.targetList() {
+		target.Pool.setStore(store)
+	}
+}
+
+// snapshot writes the pending bundles of all pools to the pool store. The log is rotated before
+// the pools are read, so records written meanwhile are replayed on top of the snapshot.
+func (c *ChainPools) snapshot(store *PoolStore) error {
+	store.snapshotMu.Lock()
+	defer store.snapshotMu.Unlock()
+
+	startTime := time.Now()
+
+	segment, err := store.rotate()
+	if err != nil {
+		return err
+	}
+
+	var bundles []*TxPoolBundle
+	for _, target := range c.targetList() {
+		bundles = append(bundles, target.Pool.pendingBundles()...)
+	}
+	if err := store.writeSnapshot(segment, bundles); err != nil {
+		return err
+	}
+
+	log.Debug().Int("bundles", len(bundles)).Uint64("segment", segment).Dur("duration", time.Since(startTime)).Msg("Pool snapshot written")
+	return nil
+}
+
+// startSnapshotJob snapshots the pools periodically to compact the write-ahead log
+func (c *ChainPools) startSnapshotJob(store *PoolStore, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := c.snapshot(store); err != nil {
+				log.Error().Err(err).Msg("Failed to write pool snapshot")
+			}
+		}
+	}()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestChainPools(t *testing.T) *ChainPools {
+	t.Helper()
+
+	chains := ChainConfig{ChainIDs: []uint64{1}, AllowUnprotected: true}
+	pools, err := newChainPools(chains, false, "127.0.0.1:50051", nil, 12*time.Second, func() *TxBundlePool {
+		return newTestPool(orderingPolicies["block_number"])
+	})
+	if err != nil {
+		t.Fatalf("newChainPools() error = %v", err)
+	}
+	return pools
+}
+
+// reopenPoolStore loads the pool store in dir into new pools, as after a restart
+func reopenPoolStore(t *testing.T, dir string, now time.Time) (*ChainPools, *PoolStore) {
+	t.Helper()
+
+	store, err := openPoolStore(dir, false)
+	if err != nil {
+		t.Fatalf("openPoolStore() error = %v", err)
+	}
+	bundles, err := store.load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+
+	pools := newTestChainPools(t)
+	pools.restoreBundles(bundles, now)
+	pools.setStore(store)
+	return pools, store
+}
+
+func assertPooledUUIDs(t *testing.T, pools *ChainPools, uuids ...string) {
+	t.Helper()
+
+	bundles := queuedBundles(pools.pools[1], len(uuids)+1)
+	if len(bundles) != len(uuids) {
+		t.Fatalf("got %d pooled bundles, want %d", len(bundles), len(uuids))
+	}
+	for i, uuid := range uuids {
+		if bundles[i].ReplacementUUID != uuid {
+			t.Errorf("bundle %d has UUID %s, want %s", i, bundles[i].ReplacementUUID, uuid)
+		}
+	}
+}
+
+func TestPoolStoreRestore(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	pools, store := reopenPoolStore(t, dir, now)
+	for _, bundle := range []*TxPoolBundle{
+		newTestBundle(1, "cancelled", 10),
+		newTestBundle(2, "replaced", 10),
+		newTestBundle(3, "accepted", 11),
+		newTestBundle(4, "kept", 12),
+	} {
+		if _, err := pools.addBundle(bundle, false); err != nil {
+			t.Fatalf("addBundle() error = %v", err)
+		}
+	}
+	if _, err := pools.addBundle(newTestBundle(5, "replaced", 13), true); err != nil {
+		t.Fatalf("addBundle() replacement error = %v", err)
+	}
+	if err := pools.cancelBundleByUUID("cancelled", ""); err != nil {
+		t.Fatalf("cancelBundleByUUID() error = %v", err)
+	}
+	pool := pools.pools[1]
+	pool.leaseBundles(10, now)
+	settleBundle(t, pool, mustGetBundle(t, pool, "accepted"), deliveryAccepted, "included", now)
+	pools.pools[1].cleanupMarkedBundles()
+	if err := store.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+
+	// The write-ahead log alone restores the pool
+	pools, store = reopenPoolStore(t, dir, now)
+	assertPooledUUIDs(t, pools, "kept", "replaced")
+	if bundle, _ := pools.getBundleByUUID("replaced"); bundle.Txs[0].Nonce() != 5 {
+		t.Errorf("restored the replaced bundle instead of its replacement")
+	}
+
+	// A snapshot compacts the log, later records are replayed on top of it
+	if err := pools.snapshot(store); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	if _, err := pools.addBundle(newTestBundle(6, "added", 10), false); err != nil {
+		t.Fatalf("addBundle() error = %v", err)
+	}
+	if err := store.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		t.Fatalf("listWALSegments() error = %v", err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("got %d write-ahead log segments after the snapshot, want 1", len(segments))
+	}
+
+	// A record torn by a crash at the end of the log is skipped
+	file, err := os.OpenFile(store.segmentPath(segments[len(segments)-1]), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	if _, err := file.WriteString(`{"op":"add","uuid":"torn","bun`); err != nil {
+		t.Fatalf("failed to write torn record: %v", err)
+	}
+	file.Close()
+
+	pools, _ = reopenPoolStore(t, dir, now)
+	assertPooledUUIDs(t, pools, "added", "kept", "replaced")
+}
+
+func TestPoolStoreSkipsExpiredBundles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	pools, store := reopenPoolStore(t, dir, now)
+	expiring := newTestBundle(1, "expiring", 10)
+	expiring.MaxTimestamp = now.Unix() + 60
+	for _, bundle := range []*TxPoolBundle{expiring, newTestBundle(2, "kept", 10)} {
+		if _, err := pools.addBundle(bundle, false); err != nil {
+			t.Fatalf("addBundle() error = %v", err)
+		}
+	}
+	if err := store.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+
+	// The sequencer restarts after the max timestamp of the expiring bundle elapsed
+	pools, _ = reopenPoolStore(t, dir, now.Add(2*time.Minute))
+	assertPooledUUIDs(t, pools, "kept")
+}
@@ -2,96 +2,503 @@
 package main
 
 import (
+	"cmp"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"sort"
+	"math/big"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
 
 // TxPoolBundle represents a transaction pool bundle.
 type TxPoolBundle struct {
 	Txs               []*types.Transaction // Array of transactions
+	Senders           []common.Address     // Recovered senders, by index of Txs
+	FeeScore          *big.Int             // Effective priority fee per gas in wei, cached for the fee ordering
 	BlockNumber       string               // Hex-encoded block number
+	TargetBlock       uint64               // Parsed block number, cached for the block number ordering
+	LastBlock         uint64               // Parsed last block for inclusion, cached for the expiry
+	MaxBlockNumber    string               // Optional hex-encoded last block for inclusion (private transactions and MEV-Share bundles)
 	MinTimestamp      int64                // Optional minimum timestamp
 	MaxTimestamp      int64                // Optional maximum timestamp
 	RevertingTxHashes []string             // Optional list of tx hashes allowed to revert
 	ReplacementUUID   string               // Optional replacement UUID
-	Builders          []string             // Optional list of builder names
+	BundleHash        common.Hash          // Hash over the transactions and targeting fields
+	Builders          []string             // Optional list of canonical builder names
+	BuilderPriority   int                  // Highest priority of the builders, cached for the builder ordering
+	Size              uint64               // Encoded size of the transactions in bytes, cached for the capacity limits
+	ChainID           uint64               // Chain the bundle is sequenced for
+	Username          string               // Authenticated user that submitted the bundle
+	ReceivedAt        time.Time            // Time the bundle arrived at the sequencer
+	Conflicts         []BundleConflict     // Conflicts with pending bundles found when the bundle was added
 	MarkedForDeletion bool                 // Flag for deletion from the TxBundlePool
+
+	seq                uint64 // Insertion sequence in the pool, breaks the ties of the ordering policy
+	queueIndex         int    // Position in the priority queue of the pool
+	deadlineIndex      int    // Position in the max timestamp index of the pool
+	evictionIndex      int    // Position in the eviction order of the pool
+	userEvictionIndex  int    // Position in the eviction order of the bundles of the user
+	blockEvictionIndex int    // Position in the eviction order of the bundles targeting the same block
+	readyIndex         int    // Position in the ready bundles of the pool
+	arrivalIndex       int    // Position in the ready bundles of the pool by arrival
+	waitIndex          int    // Position in the waiting bundles of the pool, a bundle waits for one condition at a time
+
+	attempts      int             // Dispatches to the bundle merger
+	leasedUntil   time.Time       // End of the lease of the latest dispatch, zero if the bundle isn't leased
+	retryAt       time.Time       // Earliest time of the next dispatch after a nack
+	lastStatus    string          // Status of the latest answer of the bundle merger
+	acceptedBy    map[string]bool // Bundle mergers that accepted the bundle in an earlier dispatch
+	dispatchedAt  time.Time       // Time of the first dispatch, zero if the bundle wasn't dispatched yet
+	dispatchBlock uint64          // Upcoming block of the chain at the latest dispatch, zero without a chain head
+	acceptedFor   uint64          // Latest block the bundle mergers accepted the bundle for, later blocks of its range are dispatched again
+	retargeted    bool            // Whether the bundle was moved to the next block after missing the cutoff, it's moved once
+
+	references bundleSet // Pooled bundles the bundle references by hash (mev_sendBundle), they are no conflicts
+}
+
+// bundleSet is a set of bundles
+type bundleSet map[*TxPoolBundle]struct{}
+
+// blockKey identifies a block of a chain
+type blockKey struct {
+	chainID uint64
+	block   uint64
 }
 
-// TxBundlePool represents a pool of transaction bundles.
+// bundleHashKey identifies the bundles of a user by bundle hash, identical bundles of different
+// users are pooled side by side
+type bundleHashKey struct {
+	username string
+	hash     common.Hash
+}
+
+// hashKey returns the key of the bundle in the bundle hash index
+func (b *TxPoolBundle) hashKey() bundleHashKey {
+	return bundleHashKey{username: b.Username, hash: b.BundleHash}
+}
+
+// TxBundlePool represents a pool of transaction bundles. Pending bundles are kept in a priority
+// queue ordered by the ordering policy and in secondary indexes, so adding, replacing and removing
+// a bundle takes O(log n). Bundles marked for deletion leave the queue and the indexes right away
+// and stay reachable by UUID and bundle hash until the cleanup removes them.
 type TxBundlePool struct {
-	bundles    []*TxPoolBundle                 // Store bundles of individual transactions
-	bundleMap  map[string]*TxPoolBundle        // Use a map to track bundles by UUID
-	mu         sync.RWMutex                    // A mutex for concurrent access
-	customSort func(b1, b2 *TxPoolBundle) bool // The policy for bundle ordering
+	queue     *bundleHeap                     // Pending bundles in dispatch order
+	bundleMap map[string]*TxPoolBundle        // Use a map to track bundles by UUID
+	hashMap   map[bundleHashKey]*TxPoolBundle // Use a map to track bundles by user and bundle hash
+	txHashMap map[common.Hash]bundleSet       // Pending bundles by transaction hash
+	nonceMap  map[senderNonce]bundleSet       // Pending bundles by chain, sender and nonce
+	blockMap  map[blockKey]bundleSet          // Pending bundles by chain and last target block
+	deadlines map[uint64]*bundleHeap          // Pending bundles with a max timestamp by chain, earliest first
+	marked    bundleSet                       // Bundles marked for deletion, removed by the cleanup
+	leased    bundleSet                       // Pending bundles leased to the dispatch
+	ready     *bundleHeap                     // Pending bundles that can be leased now, in dispatch order
+	arrived   *bundleHeap                     // Pending bundles that can be leased now, oldest arrival first
+	retrying  *bundleHeap                     // Pending bundles waiting for their retry backoff, earliest first
+	waiting   map[uint64]*waitingBundles      // Pending bundles waiting for a later upcoming block by chain
+	counts    map[uint64]int                  // Number of pending bundles by chain
+	seq       uint64                          // Insertion sequence of the latest bundle
+	mu        sync.RWMutex                    // A mutex for concurrent access
+	ordering  OrderingPolicy                  // The policy for bundle ordering
+
+	limits       PoolLimits                  // Capacity limits of the pool
+	evictAll     *evictionScope              // Pending bundles in eviction order, if the pool is limited
+	evictByUser  map[string]*evictionScope   // Pending bundles by user in eviction order, if users are limited
+	evictByBlock map[blockKey]*evictionScope // Pending bundles by chain and target block in eviction order, if blocks are limited
+
+	conflictPolicy string // Handling of bundles conflicting with pending bundles
+
+	retry       RetryPolicy  // Retry budget of dispatched bundles
+	deadLetters []DeadLetter // Bundles that exhausted their retry budget, oldest first
+
+	statusTracker   *BundleStatusTracker           // Lifecycle tracking of the pooled bundles
+	nextBlock       func(chainID uint64) NextBlock // Optional upcoming block by chain, used to gate dispatch
+	baseFees        map[uint64]*big.Int            // Base fee by chain the fee scores are computed against
+	builderPriority func(builders []string) int    // Optional priority of the builders of a bundle
+	store           *PoolStore                     // Optional persistence of the pool mutations
+	arrivals        chan struct{}                  // Signalled when a bundle was queued, wakes the dispatcher
+}
+
+// NextBlock represents the upcoming block of a chain that bundles are dispatched for.
+type NextBlock struct {
+	Number    uint64 // Block number, zero if the chain head is unknown
+	Timestamp uint64 // Expected block timestamp in seconds
+}
+
+func newTxBundlePool(ordering OrderingPolicy, limits PoolLimits, conflictPolicy string, retry RetryPolicy, statusTracker *BundleStatusTracker, builderPriority func(builders []string) int) *TxBundlePool {
+	p := &TxBundlePool{
+		bundleMap: make(map[string]*TxPoolBundle),
+		hashMap:   make(map[bundleHashKey]*TxPoolBundle),
+		txHashMap: make(map[common.Hash]bundleSet),
+		nonceMap:  make(map[senderNonce]bundleSet),
+		blockMap:  make(map[blockKey]bundleSet),
+		deadlines: make(map[uint64]*bundleHeap),
+		marked:    make(bundleSet),
+		leased:    make(bundleSet),
+		waiting:   make(map[uint64]*waitingBundles),
+		counts:    make(map[uint64]int),
+		baseFees:  make(map[uint64]*big.Int),
+		ordering:  ordering,
+
+		limits:       limits,
+		evictByUser:  make(map[string]*evictionScope),
+		evictByBlock: make(map[blockKey]*evictionScope),
+
+		conflictPolicy: conflictPolicy,
+
+		retry: retry,
+
+		statusTracker:   statusTracker,
+		builderPriority: builderPriority,
+		arrivals:        make(chan struct{}, 1),
+	}
+	p.queue = newBundleHeap(p.dispatchedBefore, func(bundle *TxPoolBundle) *int { return &bundle.queueIndex })
+	p.ready = newBundleHeap(p.dispatchedBefore, func(bundle *TxPoolBundle) *int { return &bundle.readyIndex })
+	p.arrived = newBundleHeap(sortByArrival, func(bundle *TxPoolBundle) *int { return &bundle.arrivalIndex })
+	p.retrying = newBundleHeap(sortByRetryAt, func(bundle *TxPoolBundle) *int { return &bundle.waitIndex })
+	p.evictAll = p.newEvictionScope(func(bundle *TxPoolBundle) *int { return &bundle.evictionIndex })
+	return p
 }
 
-func (p *TxBundlePool) addBundle(bundle *TxPoolBundle, replace bool) error {
+// dispatchedBefore orders the queue by the ordering policy, bundles the policy doesn't order keep their insertion order
+func (p *TxBundlePool) dispatchedBefore(b1, b2 *TxPoolBundle) bool {
+	if result := p.ordering.Compare(b1, b2); result != 0 {
+		return result < 0
+	}
+	return b1.seq < b2.seq
+}
+
+// addBundle adds a bundle to the pool and returns the pooled bundle. If the bundle has no
+// replacement UUID, a new one is generated, unless an identical bundle of the same user is
+// already pooled, in which case the existing bundle is returned instead.
+func (p *TxBundlePool) addBundle(bundle *TxPoolBundle, replace bool) (*TxPoolBundle, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	// Parse the targeted blocks once, the pool works on the cached block numbers
+	first, last, err := parseBlockRange(bundle.BlockNumber, bundle.MaxBlockNumber)
+	if err != nil {
+		return nil, err
+	}
+	bundle.TargetBlock, bundle.LastBlock = first, last
+	bundle.BundleHash = computeBundleHash(bundle)
+
+	// Check if the user already pooled an identical bundle, the bundles of other users are not found
+	if duplicate, exists := p.hashMap[bundle.hashKey()]; exists && !duplicate.MarkedForDeletion {
+		if bundle.ReplacementUUID == "" || bundle.ReplacementUUID == duplicate.ReplacementUUID {
+			log.Info().Str("uuid", duplicate.ReplacementUUID).Str("bundle_hash", duplicate.BundleHash.Hex()).Msg("Identical bundle already in the pool")
+			return duplicate, nil
+		}
+		return nil, fmt.Errorf("bundle with hash %s already exists with UUID %s", bundle.BundleHash.Hex(), duplicate.ReplacementUUID)
+	}
+
+	// If no ReplacementUUID is provided, generate one
+	if bundle.ReplacementUUID == "" {
+		bundle.ReplacementUUID = uuid.New().String()
+		log.Info().Str("uuid", bundle.ReplacementUUID).Msg("Generated new UUID for bundle")
+	}
+
 	// Check if a bundle with the same replacementUUID already exists
+	op := poolOpAdd
 	existingBundle, exists := p.bundleMap[bundle.ReplacementUUID]
 	if exists {
+		// Bundles can only be replaced by the user that submitted them
+		if existingBundle.Username != bundle.Username {
+			return nil, fmt.Errorf("bundle with UUID %s belongs to another user", bundle.ReplacementUUID)
+		}
+
 		// Check if the existing bundle is marked for deletion
 		if existingBundle.MarkedForDeletion {
 			log.Info().Str("uuid", bundle.ReplacementUUID).Msg("Existing bundle marked for deletion, replacing with new bundle")
-
-			// Remove the existing bundle from the list
-			for i, b := range p.bundles {
-				if b.ReplacementUUID == existingBundle.ReplacementUUID {
-					p.bundles = append(p.bundles[:i], p.bundles[i+1:]...)
-					break
-				}
-			}
 		} else {
 			if !replace {
 				// If replace is false and the bundle exists (and isn't marked for deletion), return an error
-				return fmt.Errorf("bundle with UUID %s already exists", bundle.ReplacementUUID)
+				return nil, fmt.Errorf("bundle with UUID %s already exists", bundle.ReplacementUUID)
 			}
 
+			op = poolOpReplace
+		}
+	}
+
+	// Cache the fee score against the current base fee of the chain, the builder priority and the size
+	bundle.FeeScore = bundleFeeScore(bundle.Txs, p.baseFees[bundle.ChainID])
+	if p.builderPriority != nil {
+		bundle.BuilderPriority = p.builderPriority(bundle.Builders)
+	}
+	bundle.Size = 0
+	for _, tx := range bundle.Txs {
+		bundle.Size += tx.Size()
+	}
+
+	// Apply the conflict policy to the pending bundles sharing a transaction or a sender nonce
+	conflicting, conflicts := p.conflictsLocked(bundle, existingBundle)
+	bundle.Conflicts = conflicts
+	displaced, err := p.resolveConflictsLocked(bundle, conflicting)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the capacity limits, nothing is evicted unless the bundle is admitted
+	leaving := displaced
+	if exists {
+		leaving = append(leaving, existingBundle)
+	}
+	evictions, err := p.admitLocked(bundle, leaving)
+	if err != nil {
+		return nil, err
+	}
+
+	// Persist the bundle before it is pooled, so a pooled bundle survives a restart
+	if err := p.persistLocked(op, bundle); err != nil {
+		return nil, fmt.Errorf("failed to persist bundle: %v", err)
+	}
+
+	if exists {
+		if op == poolOpReplace {
 			// If replace is true and the existing bundle isn't marked for deletion, replace the existing bundle
 			log.Info().Str("uuid", bundle.ReplacementUUID).Msg("Replacing existing bundle")
+			p.statusTracker.record(bundle.ReplacementUUID, BundleStateReplaced, "")
+		}
+
+		// Remove the existing bundle from the queue and the indexes
+		p.removeLocked(existingBundle)
+	}
+	for _, pending := range displaced {
+		p.displaceLocked(pending, bundle)
+	}
+	for _, victim := range evictions {
+		p.evictLocked(victim, bundle)
+	}
+
+	// Add the new bundle to the maps and queue it by the ordering policy
+	p.bundleMap[bundle.ReplacementUUID] = bundle
+	p.hashMap[bundle.hashKey()] = bundle
+	p.enqueueLocked(bundle)
+	p.statusTracker.setOwner(bundle.ReplacementUUID, bundle.Username)
+	p.statusTracker.recordAt(bundle.ReplacementUUID, BundleStateReceived, "", bundle.ReceivedAt)
+	p.statusTracker.record(bundle.ReplacementUUID, BundleStateQueued, "")
+
+	// Wake the dispatcher, a pending signal already covers the bundle
+	select {
+	case p.arrivals <- struct{}{}:
+	default:
+	}
+
+	return bundle, nil
+}
+
+// enqueueLocked adds a pending bundle to the queue and the secondary indexes
+func (p *TxBundlePool) enqueueLocked(bundle *TxPoolBundle) {
+	p.seq++
+	bundle.seq = p.seq
+	p.queue.push(bundle)
+	p.counts[bundle.ChainID]++
+	p.trackLocked(bundle)
+	p.scheduleLocked(bundle, time.Now())
+
+	for _, tx := range bundle.Txs {
+		bundles, exists := p.txHashMap[tx.Hash()]
+		if !exists {
+			bundles = make(bundleSet)
+			p.txHashMap[tx.Hash()] = bundles
+		}
+		bundles[bundle] = struct{}{}
+	}
+
+	for i := range bundle.Txs {
+		if key, ok := bundle.senderNonceOf(i); ok {
+			bundles, exists := p.nonceMap[key]
+			if !exists {
+				bundles = make(bundleSet)
+				p.nonceMap[key] = bundles
+			}
+			bundles[bundle] = struct{}{}
+		}
+	}
+
+	if _, last := bundle.blockRange(); last > 0 {
+		key := blockKey{chainID: bundle.ChainID, block: last}
+		bundles, exists := p.blockMap[key]
+		if !exists {
+			bundles = make(bundleSet)
+			p.blockMap[key] = bundles
+		}
+		bundles[bundle] = struct{}{}
+	}
+
+	if bundle.MaxTimestamp > 0 {
+		deadlines, exists := p.deadlines[bundle.ChainID]
+		if !exists {
+			deadlines = newBundleHeap(sortByDeadline, func(bundle *TxPoolBundle) *int { return &bundle.deadlineIndex })
+			p.deadlines[bundle.ChainID] = deadlines
+		}
+		deadlines.push(bundle)
+	}
+}
+
+// dequeueLocked removes a pending bundle from the queue and the secondary indexes
+func (p *TxBundlePool) dequeueLocked(bundle *TxPoolBundle) {
+	if !p.queue.remove(bundle) {
+		return
+	}
+	p.counts[bundle.ChainID]--
+	p.untrackLocked(bundle)
+	p.unscheduleLocked(bundle)
+	delete(p.leased, bundle)
+
+	for _, tx := range bundle.Txs {
+		if bundles, exists := p.txHashMap[tx.Hash()]; exists {
+			delete(bundles, bundle)
+			if len(bundles) == 0 {
+				delete(p.txHashMap, tx.Hash())
+			}
+		}
+	}
 
-			// Remove the existing bundle from the list
-			for i, b := range p.bundles {
-				if b.ReplacementUUID == existingBundle.ReplacementUUID {
-					p.bundles = append(p.bundles[:i], p.bundles[i+1:]...)
-					break
+	for i := range bundle.Txs {
+		if key, ok := bundle.senderNonceOf(i); ok {
+			if bundles, exists := p.nonceMap[key]; exists {
+				delete(bundles, bundle)
+				if len(bundles) == 0 {
+					delete(p.nonceMap, key)
 				}
 			}
 		}
 	}
 
-	// Add the new bundle to the map and the list
-	p.bundleMap[bundle.ReplacementUUID] = bundle
-	p.bundles = append(p.bundles, bundle)
+	if _, last := bundle.blockRange(); last > 0 {
+		key := blockKey{chainID: bundle.ChainID, block: last}
+		if bundles, exists := p.blockMap[key]; exists {
+			delete(bundles, bundle)
+			if len(bundles) == 0 {
+				delete(p.blockMap, key)
+			}
+		}
+	}
 
-	// Sort the pool based on the custom sorting policy
-	p.sortPool()
+	if deadlines, exists := p.deadlines[bundle.ChainID]; exists {
+		deadlines.remove(bundle)
+	}
+}
 
-	return nil
+// markLocked marks a bundle for deletion by the given operation and takes it out of the queue,
+// it reports whether the bundle was pending
+func (p *TxBundlePool) markLocked(bundle *TxPoolBundle, op string) bool {
+	if bundle.MarkedForDeletion {
+		return false
+	}
+	bundle.MarkedForDeletion = true
+	p.dequeueLocked(bundle)
+	p.marked[bundle] = struct{}{}
+
+	if err := p.persistLocked(op, bundle); err != nil {
+		log.Error().Err(err).Str("uuid", bundle.ReplacementUUID).Str("op", op).Msg("Failed to persist pool mutation")
+	}
+	return true
+}
+
+// removeLocked removes a bundle from the pool
+func (p *TxBundlePool) removeLocked(bundle *TxPoolBundle) {
+	p.dequeueLocked(bundle)
+	delete(p.marked, bundle)
+	if p.bundleMap[bundle.ReplacementUUID] == bundle {
+		delete(p.bundleMap, bundle.ReplacementUUID)
+	}
+	if p.hashMap[bundle.hashKey()] == bundle {
+		delete(p.hashMap, bundle.hashKey())
+	}
+}
+
+// computeBundleHash computes a deterministic hash over the ordered transaction hashes, the targeting
+// fields and the builders, using the block numbers cached by addBundle
+func computeBundleHash(bundle *TxPoolBundle) common.Hash {
+	var data []byte
+	for _, tx := range bundle.Txs {
+		data = append(data, tx.Hash().Bytes()...)
+	}
+
+	data = binary.BigEndian.AppendUint64(data, bundle.TargetBlock)
+	data = binary.BigEndian.AppendUint64(data, bundle.LastBlock)
+	data = binary.BigEndian.AppendUint64(data, uint64(bundle.MinTimestamp))
+	data = binary.BigEndian.AppendUint64(data, uint64(bundle.MaxTimestamp))
+
+	for _, revertingTxHash := range bundle.RevertingTxHashes {
+		data = append(data, common.HexToHash(revertingTxHash).Bytes()...)
+	}
+
+	// Bundles for different builders are different bundles, regardless of the order of the builders
+	for _, builder := range slices.Sorted(slices.Values(bundle.Builders)) {
+		data = append(data, builder...)
+		data = append(data, 0)
+	}
+
+	return crypto.Keccak256Hash(data)
+}
+
+// setOrderingPolicy switches the ordering policy and re-orders the pool atomically
+func (p *TxBundlePool) setOrderingPolicy(policy OrderingPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ordering = policy
+	p.queue.reorder()
+	p.ready.reorder()
+}
+
+// setBaseFee updates the base fee of a chain, recomputes the fee scores of its bundles and re-orders the pool
+func (p *TxBundlePool) setBaseFee(chainID uint64, baseFee *big.Int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if current, exists := p.baseFees[chainID]; exists && current != nil && baseFee != nil && current.Cmp(baseFee) == 0 {
+		return
+	}
+	p.baseFees[chainID] = baseFee
+
+	for _, bundle := range p.queue.items {
+		if bundle.ChainID == chainID {
+			bundle.FeeScore = bundleFeeScore(bundle.Txs, baseFee)
+		}
+	}
+	p.queue.reorder()
+	p.ready.reorder()
+	p.reorderEvictionsLocked()
+}
+
+// refreshBuilderPriorities recomputes the builder priorities of the bundles and re-orders the pool
+func (p *TxBundlePool) refreshBuilderPriorities() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.builderPriority == nil {
+		return
+	}
+	for _, bundle := range p.queue.items {
+		bundle.BuilderPriority = p.builderPriority(bundle.Builders)
+	}
+	p.queue.reorder()
+	p.ready.reorder()
 }
 
-func (p *TxBundlePool) sortPool() {
-	sort.Slice(p.bundles, func(i, j int) bool {
-		return p.customSort(p.bundles[i], p.bundles[j])
-	})
+func (p *TxBundlePool) orderingPolicy() OrderingPolicy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.ordering
 }
 
 // // sorting policies
 // sort by block number
 func sortByBlockNumber(b1, b2 *TxPoolBundle) bool {
-	bn1, _ := strconv.ParseInt(b1.BlockNumber, 0, 64)
-	bn2, _ := strconv.ParseInt(b2.BlockNumber, 0, 64)
-
-	return bn1 < bn2 // Sort in ascending order
+	return b1.TargetBlock < b2.TargetBlock // Sort in ascending order
 }
 
 // sort by min timestamp, in ascending order
@@ -104,114 +511,324 @@ func sortByMaxTimestamp(b1, b2 *TxPoolBundle) bool {
 	return b1.MaxTimestamp > b2.MaxTimestamp
 }
 
-// ToDo: sort by gas price
-/*func sortByGasPrice(b1, b2 *TxPoolBundle) bool {
-	maxGasPriceB1 := extractMaxGasPrice(b1.Txs)
-	maxGasPriceB2 := extractMaxGasPrice(b2.Txs)
+// sort by arrival time, in ascending order
+func sortByArrivalTime(b1, b2 *TxPoolBundle) bool {
+	return b1.ReceivedAt.Before(b2.ReceivedAt)
+}
 
-	return maxGasPriceB1 > maxGasPriceB2 // Sort in descending order
+// sort by fee score, in descending order
+func sortByFeeScore(b1, b2 *TxPoolBundle) bool {
+	return feeScoreOf(b1).Cmp(feeScoreOf(b2)) > 0
 }
 
-// Helper function to extract max gas price (simplified)
-func extractMaxGasPrice(txs []*types.Transaction) big.Int {
-	maxGasPrice := big.NewInt(0)
-	for _, tx := range txs {
-		if tx.GasPrice() > maxGasPrice {
-			maxGasPrice = tx.GasPrice
-		}
+// sort by builder priority, in descending order
+func sortByBuilderPriority(b1, b2 *TxPoolBundle) bool {
+	return b1.BuilderPriority > b2.BuilderPriority // Higher priority number is more important
+}
+
+// sort by max timestamp, in ascending order, used by the max timestamp index
+func sortByDeadline(b1, b2 *TxPoolBundle) bool {
+	return b1.MaxTimestamp < b2.MaxTimestamp
+}
+
+// sort by arrival time and insertion order, in ascending order, used by the ready bundles by arrival
+func sortByArrival(b1, b2 *TxPoolBundle) bool {
+	if !b1.ReceivedAt.Equal(b2.ReceivedAt) {
+		return b1.ReceivedAt.Before(b2.ReceivedAt)
 	}
-	return maxGasPrice
-}*/
+	return b1.seq < b2.seq
+}
 
-// ToDo: sort by builder priority
-func sortByBuilderPriority(b1, b2 *TxPoolBundle) bool {
-	priorityB1 := getBuilderPriority(b1.Builders)
-	priorityB2 := getBuilderPriority(b2.Builders)
+// sort by retry time, in ascending order, used by the bundles waiting for their retry backoff
+func sortByRetryAt(b1, b2 *TxPoolBundle) bool {
+	return b1.retryAt.Before(b2.retryAt)
+}
 
-	return priorityB1 > priorityB2 // Higher priority number is more important
+// sort by the first eligible block, in ascending order, used by the bundles waiting for a later block
+func sortByEligibleFrom(b1, b2 *TxPoolBundle) bool {
+	return b1.eligibleFrom() < b2.eligibleFrom()
 }
 
-// Helper function to assign priority to builders
-func getBuilderPriority(builders []string) int {
-	priority := 0 // Default to low priority
-	for _, builder := range builders {
-		switch builder {
-		case "flashbots":
-			priority = max(priority, 10)
-		case "Titan":
-			priority = max(priority, 20)
-		default:
-			// do nothing
-		}
+func (p *TxBundlePool) getBundleByUUID(uuid string) (*TxPoolBundle, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	bundle, exists := p.bundleMap[uuid]
+	if !exists || bundle.MarkedForDeletion {
+		return nil, false
 	}
-	return priority
+	return bundle, true
 }
 
-func (p *TxBundlePool) markBundleForDeletion(bundle *TxPoolBundle) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+// pendingMaxBlockNumber returns the max block number of the pending bundle with the given UUID
+func (p *TxBundlePool) pendingMaxBlockNumber(uuid string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
-	bundle.MarkedForDeletion = true
+	bundle, exists := p.bundleMap[uuid]
+	if !exists || bundle.MarkedForDeletion {
+		return "", false
+	}
+	return bundle.MaxBlockNumber, true
 }
 
-func (p *TxBundlePool) markBundlesForDeletion(bundles []*TxPoolBundle) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+func (p *TxBundlePool) getBundleByHash(hash common.Hash, username string) (*TxPoolBundle, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
-	for _, bundle := range bundles {
-		bundle.MarkedForDeletion = true
+	bundle, exists := p.hashMap[bundleHashKey{username: username, hash: hash}]
+	if !exists || bundle.MarkedForDeletion {
+		return nil, false
 	}
+	return bundle, true
 }
 
-func (p *TxBundlePool) cancelBundleByUUID(uuid string) error {
+// countBundles returns the number of pending bundles by chain ID
+func (p *TxBundlePool) countBundles() map[uint64]int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	counts := make(map[uint64]int, len(p.counts))
+	for chainID, count := range p.counts {
+		counts[chainID] = count
+	}
+	return counts
+}
+
+// Reasons a bundle can't be canceled
+var (
+	errBundleNotFound = errors.New("bundle not found")
+	errBundleLeftPool = errors.New("bundle already left the pool")
+)
+
+// cancelBundleByUUID cancels a pending bundle of the given user. Canceling a canceled bundle succeeds.
+// The bundles of other users are not found, so their existence isn't revealed.
+func (p *TxBundlePool) cancelBundleByUUID(uuid string, username string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Check if the bundle exists in the map
+	// The retained status tells why a bundle that left the pool can't be canceled anymore
 	bundle, exists := p.bundleMap[uuid]
 	if !exists {
-		return fmt.Errorf("bundle with UUID %s not found", uuid)
+		status, retained := p.statusTracker.get(uuid)
+		switch {
+		case !retained || status.username != username:
+			return fmt.Errorf("%w: %s", errBundleNotFound, uuid)
+		case status.State == BundleStateCancelled:
+			return nil
+		}
+		return fmt.Errorf("%w: %s is %s", errBundleLeftPool, uuid, status.State)
+	}
+	if bundle.Username != username {
+		return fmt.Errorf("%w: %s", errBundleNotFound, uuid)
 	}
 
-	// Mark the bundle for deletion
-	bundle.MarkedForDeletion = true
-	log.Info().Str("uuid", uuid).Msg("Bundle marked for deletion")
+	// Bundles already marked for deletion have reached their final state
+	if bundle.MarkedForDeletion {
+		status, _ := p.statusTracker.get(uuid)
+		if status.State != BundleStateCancelled {
+			return fmt.Errorf("%w: %s is %s", errBundleLeftPool, uuid, status.State)
+		}
+		return nil
+	}
+
+	p.statusTracker.record(uuid, BundleStateCancelled, "")
+	p.markLocked(bundle, poolOpCancel)
+	log.Info().Str("uuid", uuid).Msg("Bundle canceled and marked for deletion")
 
 	return nil
 }
 
-func (p *TxBundlePool) cleanupMarkedBundles() {
+// parseBlockRange parses the first and last block a bundle targets, zero if it targets no block
+func parseBlockRange(blockNumber, maxBlockNumber string) (uint64, uint64, error) {
+	var first uint64
+	if blockNumber != "" {
+		var err error
+		if first, err = strconv.ParseUint(blockNumber, 0, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid block number %q: %v", blockNumber, err)
+		}
+	}
+	last := first
+	if maxBlockNumber != "" {
+		maxBlock, err := strconv.ParseUint(maxBlockNumber, 0, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid max block number %q: %v", maxBlockNumber, err)
+		}
+		if maxBlock < first {
+			return 0, 0, fmt.Errorf("max block number %d is lower than block number %d", maxBlock, first)
+		}
+		last = maxBlock
+	}
+	return first, last, nil
+}
+
+// blockRange returns the first and last block the bundle targets, zero if it targets no block
+func (b *TxPoolBundle) blockRange() (uint64, uint64) {
+	return b.TargetBlock, b.LastBlock
+}
+
+// expiryReason returns why the bundle can no longer be included, or an empty string if it still can.
+// Without a chain head only the MaxTimestamp is checked against the wall clock.
+func (b *TxPoolBundle) expiryReason(head *ChainHead, now time.Time) string {
+	if b.MaxTimestamp > 0 && now.Unix() > b.MaxTimestamp {
+		return fmt.Sprintf("max timestamp %d elapsed", b.MaxTimestamp)
+	}
+	if head == nil {
+		return ""
+	}
+
+	// The block after the head is the earliest block the bundle can still be included in
+	if _, last := b.blockRange(); last > 0 && last <= head.Number {
+		return fmt.Sprintf("target block %d passed, head is %d", last, head.Number)
+	}
+	if b.MaxTimestamp > 0 && uint64(b.MaxTimestamp) <= head.Timestamp {
+		return fmt.Sprintf("max timestamp %d elapsed at block %d", b.MaxTimestamp, head.Number)
+	}
+	return ""
+}
+
+// expireBundles marks the bundles of the chain for deletion that can't be included after the given
+// head, or at the given time if the head is unknown, and records their expiry. The candidates are
+// looked up in the target block and max timestamp indexes instead of scanning the pool.
+func (p *TxBundlePool) expireBundles(chainID uint64, head *ChainHead, now time.Time) int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	newBundles := []*TxPoolBundle{}
-	for _, bundle := range p.bundles {
-		if !bundle.MarkedForDeletion {
-			newBundles = append(newBundles, bundle)
-		} else {
-			delete(p.bundleMap, bundle.ReplacementUUID) // Remove from map
+	var candidates []*TxPoolBundle
+	if head != nil {
+		for key, bundles := range p.blockMap {
+			if key.chainID == chainID && key.block <= head.Number {
+				for bundle := range bundles {
+					candidates = append(candidates, bundle)
+				}
+			}
 		}
 	}
-	p.bundles = newBundles
+
+	// The max timestamp elapsed by the wall clock or by the timestamp of the head
+	elapsed := now.Unix() - 1
+	if head != nil {
+		elapsed = max(elapsed, int64(head.Timestamp))
+	}
+	if deadlines, exists := p.deadlines[chainID]; exists {
+		deadlines.walk(func(bundle *TxPoolBundle) bool {
+			if bundle.MaxTimestamp > elapsed {
+				return false
+			}
+			candidates = append(candidates, bundle)
+			return true
+		})
+	}
+
+	expired := 0
+	for _, bundle := range candidates {
+		reason := bundle.expiryReason(head, now)
+		if reason == "" || !p.markLocked(bundle, poolOpExpire) {
+			continue
+		}
+
+		p.statusTracker.record(bundle.ReplacementUUID, BundleStateExpired, reason)
+		expiredBundlesCounter.WithLabelValues(chainLabel(bundle.ChainID)).Inc()
+		log.Info().Str("uuid", bundle.ReplacementUUID).Str("reason", reason).Msg("Bundle expired")
+		expired++
+	}
+	return expired
 }
 
-func (p *TxBundlePool) getBundlesForProcessing(limit int, markForDeletion bool) []*TxPoolBundle {
+// markIncludedBundles marks the pending bundles of the chain for deletion that contain a transaction
+// included in the given head. Bundles included as a whole record their inclusion, the others can't be
+// included anymore and expire. The candidates are looked up in the transaction hash index.
+func (p *TxBundlePool) markIncludedBundles(chainID uint64, head *ChainHead) int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	var selectedBundles []*TxPoolBundle
-	for _, bundle := range p.bundles {
-		if !bundle.MarkedForDeletion {
-			selectedBundles = append(selectedBundles, bundle)
-			if markForDeletion {
-				bundle.MarkedForDeletion = true // Mark the bundle for deletion
+	included := make(map[common.Hash]bool, len(head.TxHashes))
+	var candidates []*TxPoolBundle
+	for _, hash := range head.TxHashes {
+		included[hash] = true
+		for bundle := range p.txHashMap[hash] {
+			if bundle.ChainID == chainID && !slices.Contains(candidates, bundle) {
+				candidates = append(candidates, bundle)
 			}
-			if len(selectedBundles) >= limit {
+		}
+	}
+	// Map iteration is random, handle the bundles in insertion order
+	slices.SortFunc(candidates, func(b1, b2 *TxPoolBundle) int { return cmp.Compare(b1.seq, b2.seq) })
+
+	for _, bundle := range candidates {
+		var missing *types.Transaction
+		for _, tx := range bundle.Txs {
+			if !included[tx.Hash()] {
+				missing = tx
 				break
 			}
 		}
+
+		if missing == nil {
+			p.markLocked(bundle, poolOpMark)
+			p.statusTracker.record(bundle.ReplacementUUID, BundleStateIncluded, fmt.Sprintf("included in block %d", head.Number))
+			log.Info().Str("uuid", bundle.ReplacementUUID).Uint64("block", head.Number).Msg("Bundle included")
+			continue
+		}
+
+		reason := fmt.Sprintf("transactions included in block %d without transaction %s", head.Number, missing.Hash().Hex())
+		p.markLocked(bundle, poolOpExpire)
+		p.statusTracker.record(bundle.ReplacementUUID, BundleStateExpired, reason)
+		expiredBundlesCounter.WithLabelValues(chainLabel(bundle.ChainID)).Inc()
+		log.Info().Str("uuid", bundle.ReplacementUUID).Str("reason", reason).Msg("Bundle expired")
 	}
-	return selectedBundles
+	return len(candidates)
+}
+
+// cleanupMarkedBundles removes the bundles marked for deletion, in O(marked bundles)
+func (p *TxBundlePool) cleanupMarkedBundles() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	records := make([]poolRecord, 0, len(p.marked))
+	for bundle := range p.marked {
+		p.removeLocked(bundle)
+		p.statusTracker.markRemoved(bundle.ReplacementUUID)
+		records = append(records, poolRecord{Op: poolOpCleanup, UUID: bundle.ReplacementUUID})
+	}
+
+	if p.store != nil && len(records) > 0 {
+		if err := p.store.append(records...); err != nil {
+			log.Error().Err(err).Int("bundles", len(records)).Msg("Failed to persist pool cleanup")
+		}
+	}
+}
+
+// isEligible reports whether the bundle may be included in the given upcoming block.
+// Bundles targeting a later block or with a later MinTimestamp have to wait, as do bundles the
+// bundle mergers already accepted for the upcoming block.
+func (b *TxPoolBundle) isEligible(next NextBlock) bool {
+	if next.Number > 0 && b.eligibleFrom() > next.Number {
+		return false
+	}
+	if b.MinTimestamp > 0 && uint64(b.MinTimestamp) > next.Timestamp {
+		return false
+	}
+	return true
+}
+
+// eligibleFrom returns the first upcoming block the bundle may be included in, the block after
+// the one the bundle mergers accepted it for if they did
+func (b *TxPoolBundle) eligibleFrom() uint64 {
+	first, _ := b.blockRange()
+	return max(first, b.acceptedFor+1)
+}
+
+// chainIDs returns the chains the pool holds bundles with a max timestamp for
+func (p *TxBundlePool) chainIDs() []uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	chainIDs := make([]uint64, 0, len(p.deadlines))
+	for chainID := range p.deadlines {
+		chainIDs = append(chainIDs, chainID)
+	}
+	return chainIDs
 }
 
 func (p *TxBundlePool) startCleanupJob(interval time.Duration) {
@@ -223,6 +840,9 @@ func (p *TxBundlePool) startCleanupJob(interval time.Duration) {
 			select {
 			case <-ticker.C:
 				startTime := time.Now() // Timestamp before cleanup
+				for _, chainID := range p.chainIDs() {
+					p.expireBundles(chainID, nil, startTime)
+				}
 				p.cleanupMarkedBundles()
 				endTime := time.Now() // Timestamp after cleanup
 
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/rs/zerolog"
+)
+
+// benchmarkPoolSize is the number of bundles the pool holds during the benchmarks
+const benchmarkPoolSize = 100_000
+
+func newTestPool(ordering OrderingPolicy) *TxBundlePool {
+	return newTxBundlePool(ordering, PoolLimits{}, conflictKeepHigher, defaultRetryPolicy, newBundleStatusTracker(0, nil), nil)
+}
+
+// newTestBundle returns a bundle with a single transaction that is unique for the given nonce
+func newTestBundle(nonce uint64, uuid string, block uint64) *TxPoolBundle {
+	tx := types.NewTx(&types.LegacyTx{Nonce: nonce, Gas: 21000, GasPrice: big.NewInt(int64(nonce%100) + 1), To: &feeTestRecipient})
+	return &TxPoolBundle{
+		Txs:             []*types.Transaction{tx},
+		BlockNumber:     hexutil.EncodeUint64(block),
+		ReplacementUUID: uuid,
+		ChainID:         1,
+		ReceivedAt:      time.Now(),
+	}
+}
+
+func mustAddBundle(t testing.TB, pool *TxBundlePool, bundle *TxPoolBundle, replace bool) {
+	t.Helper()
+
+	if _, err := pool.addBundle(bundle, replace); err != nil {
+		t.Fatalf("addBundle() error = %v", err)
+	}
+}
+
+// queuedBundles returns up to limit pending bundles in dispatch order, without leasing them
+func queuedBundles(pool *TxBundlePool, limit int) []*TxPoolBundle {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	var bundles []*TxPoolBundle
+	pool.queue.walk(func(bundle *TxPoolBundle) bool {
+		bundles = append(bundles, bundle)
+		return len(bundles) < limit
+	})
+	return bundles
+}
+
+func TestPoolDispatchOrder(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+
+	late := newTestBundle(1, "late", 12)
+	first := newTestBundle(2, "first", 10)
+	second := newTestBundle(3, "second", 10)
+	middle := newTestBundle(4, "middle", 11)
+	for _, bundle := range []*TxPoolBundle{late, first, second, middle} {
+		mustAddBundle(t, pool, bundle, false)
+	}
+
+	// Bundles the policy doesn't order keep their insertion order
+	assertBundleOrder(t, queuedBundles(pool, 10), first, second, middle, late)
+	assertBundleOrder(t, queuedBundles(pool, 2), first, second)
+
+	// A replacement is queued by its own target block
+	replacement := newTestBundle(5, "first", 13)
+	mustAddBundle(t, pool, replacement, true)
+	assertBundleOrder(t, queuedBundles(pool, 10), second, middle, late, replacement)
+
+	// Switching the policy re-orders the pool
+	pool.setOrderingPolicy(orderingPolicies["arrival_time"])
+	assertBundleOrder(t, queuedBundles(pool, 10), late, second, middle, replacement)
+
+	// Leases follow the dispatch order
+	assertBundleOrder(t, pool.leaseBundles(2, time.Now()), late, second)
+}
+
+func TestPoolDeduplicatesPerUser(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+	alice := newTestBundle(1, "alice", 10)
+	alice.Username = "alice"
+	mustAddBundle(t, pool, alice, false)
+
+	// An identical bundle of another user is pooled on its own, without revealing the first one
+	bob := newTestBundle(1, "bob", 10)
+	bob.Username = "bob"
+	if pooled, err := pool.addBundle(bob, false); err != nil || pooled != bob {
+		t.Fatalf("addBundle() = %v, %v, want the bundle of the other user pooled", pooled, err)
+	}
+	assertPending(t, pool, map[string]bool{"alice": true, "bob": true})
+
+	// Resubmissions are deduplicated for their user
+	resubmitted := newTestBundle(1, "", 10)
+	resubmitted.Username = "alice"
+	if pooled, err := pool.addBundle(resubmitted, false); err != nil || pooled != alice {
+		t.Errorf("addBundle() = %v, %v, want the pooled bundle of the user", pooled, err)
+	}
+	if found, exists := pool.getBundleByHash(alice.BundleHash, "bob"); !exists || found != bob {
+		t.Errorf("getBundleByHash() found %v, want the bundle of the user", found)
+	}
+}
+
+func TestPoolIndexes(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+
+	bundle := newTestBundle(1, "bundle", 10)
+	shared := &TxPoolBundle{Txs: append([]*types.Transaction{newLegacyTx(21000, 1)}, bundle.Txs...), BlockNumber: "0xa", ReplacementUUID: "shared", ChainID: 1, Username: "bob"}
+	mustAddBundle(t, pool, bundle, false)
+	mustAddBundle(t, pool, shared, false)
+
+	if got := len(pool.txHashMap[bundle.Txs[0].Hash()]); got != 2 {
+		t.Errorf("transaction hash index holds %d bundles, want 2", got)
+	}
+	if got := pool.countBundles()[1]; got != 2 {
+		t.Errorf("countBundles() = %d, want 2", got)
+	}
+
+	// Cancelled bundles leave the queue and the indexes, but can be looked up until the cleanup
+	if err := pool.cancelBundleByUUID("bundle", ""); err != nil {
+		t.Fatalf("cancelBundleByUUID() error = %v", err)
+	}
+	if got := len(pool.txHashMap[bundle.Txs[0].Hash()]); got != 1 {
+		t.Errorf("transaction hash index holds %d bundles after cancel, want 1", got)
+	}
+	if got := pool.countBundles()[1]; got != 1 {
+		t.Errorf("countBundles() = %d after cancel, want 1", got)
+	}
+	if _, exists := pool.bundleMap["bundle"]; !exists {
+		t.Errorf("cancelled bundle removed before the cleanup")
+	}
+	assertBundleOrder(t, queuedBundles(pool, 10), shared)
+
+	pool.cleanupMarkedBundles()
+	if _, exists := pool.bundleMap["bundle"]; exists {
+		t.Errorf("cancelled bundle still indexed by UUID after the cleanup")
+	}
+	if _, exists := pool.hashMap[bundle.hashKey()]; exists {
+		t.Errorf("cancelled bundle still indexed by bundle hash after the cleanup")
+	}
+	if len(pool.marked) != 0 {
+		t.Errorf("%d bundles still marked after the cleanup", len(pool.marked))
+	}
+}
+
+func TestAddBundleChecksBlockNumbers(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+
+	for name, blocks := range map[string][2]string{
+		"malformed block number":     {"0xzz", ""},
+		"malformed max block number": {"0xa", "twelve"},
+		"range ending before start":  {"0xc", "0xa"},
+	} {
+		bundle := newTestBundle(1, "bundle", 0)
+		bundle.BlockNumber, bundle.MaxBlockNumber = blocks[0], blocks[1]
+		if _, err := pool.addBundle(bundle, false); err == nil {
+			t.Errorf("addBundle() with %s succeeded, want an error", name)
+		}
+	}
+	if got := pool.countBundles()[1]; got != 0 {
+		t.Errorf("countBundles() = %d, want 0", got)
+	}
+}
+
+func TestExpireBundles(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+	now := time.Unix(1_700_000_100, 0)
+
+	passed := newTestBundle(1, "passed", 10)
+	ranged := newTestBundle(2, "ranged", 10)
+	ranged.MaxBlockNumber = "0xc"
+	elapsed := newTestBundle(3, "elapsed", 12)
+	elapsed.MaxTimestamp = 1_700_000_050
+	pending := newTestBundle(4, "pending", 12)
+	pending.MaxTimestamp = 1_700_000_200
+	other := newTestBundle(5, "other", 10)
+	other.ChainID = 2
+	for _, bundle := range []*TxPoolBundle{passed, ranged, elapsed, pending, other} {
+		mustAddBundle(t, pool, bundle, false)
+	}
+
+	// Without a head, only the max timestamp is checked against the wall clock
+	if got := pool.expireBundles(1, nil, now); got != 1 || !elapsed.MarkedForDeletion {
+		t.Errorf("expireBundles() without head expired %d bundles, want the elapsed bundle", got)
+	}
+
+	head := &ChainHead{Number: 10, Timestamp: 1_700_000_090}
+	if got := pool.expireBundles(1, head, now); got != 1 || !passed.MarkedForDeletion {
+		t.Errorf("expireBundles() at head 10 expired %d bundles, want the passed bundle", got)
+	}
+	if ranged.MarkedForDeletion || pending.MarkedForDeletion || other.MarkedForDeletion {
+		t.Errorf("expireBundles() expired a bundle that can still be included")
+	}
+
+	head = &ChainHead{Number: 12, Timestamp: 1_700_000_200}
+	if got := pool.expireBundles(1, head, now); got != 2 || !ranged.MarkedForDeletion || !pending.MarkedForDeletion {
+		t.Errorf("expireBundles() at head 12 expired %d bundles, want the ranged and pending bundles", got)
+	}
+	if other.MarkedForDeletion {
+		t.Errorf("expireBundles() expired a bundle of another chain")
+	}
+}
+
+func TestBundleIsEligible(t *testing.T) {
+	next := NextBlock{Number: 11, Timestamp: 1_700_000_000}
+	bundle := func(block uint64, maxBlock string, minTimestamp int64, acceptedFor uint64) *TxPoolBundle {
+		bundle := newTestBundle(1, "bundle", block)
+		bundle.MaxBlockNumber = maxBlock
+		bundle.MinTimestamp = minTimestamp
+		bundle.acceptedFor = acceptedFor
+		bundle.TargetBlock, bundle.LastBlock, _ = parseBlockRange(bundle.BlockNumber, bundle.MaxBlockNumber) // Cached by addBundle
+		return bundle
+	}
+
+	tests := []struct {
+		name   string
+		bundle *TxPoolBundle
+		next   NextBlock
+		want   bool
+	}{
+		{"upcoming block", bundle(11, "", 0, 0), next, true},
+		{"passed block", bundle(10, "", 0, 0), next, true},
+		{"later block", bundle(16, "", 0, 0), next, false},
+		{"range including the upcoming block", bundle(10, "0xc", 0, 0), next, true},
+		{"range accepted for the upcoming block", bundle(10, "0xc", 0, 11), next, false},
+		{"range accepted for an earlier block", bundle(10, "0xc", 0, 10), next, true},
+		{"min timestamp reached", bundle(11, "", 1_700_000_000, 0), next, true},
+		{"min timestamp ahead", bundle(11, "", 1_700_000_001, 0), next, false},
+		{"later block without chain head", bundle(16, "", 0, 0), NextBlock{Timestamp: 1_700_000_000}, true},
+		{"min timestamp ahead without chain head", bundle(16, "", 1_700_000_001, 0), NextBlock{Timestamp: 1_700_000_000}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.bundle.isEligible(tt.next); got != tt.want {
+				t.Errorf("isEligible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newBenchmarkPool returns a pool filled with benchmarkPoolSize bundles spread over ten target blocks
+func newBenchmarkPool(b *testing.B) *TxBundlePool {
+	b.Helper()
+
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	b.Cleanup(func() { zerolog.SetGlobalLevel(level) })
+
+	pool := newTestPool(orderingPolicies["block_number"])
+	for i := uint64(0); i < benchmarkPoolSize; i++ {
+		mustAddBundle(b, pool, newTestBundle(i, fmt.Sprintf("bundle-%d", i), 100+i%10), false)
+	}
+	return pool
+}
+
+// runBundleBenchmark runs op on b.N bundles, which are generated in batches outside of the timer.
+// After each batch, done is called outside of the timer as well, e.g. to restore the pool size.
+func runBundleBenchmark(b *testing.B, next func(i int) *TxPoolBundle, op func(bundle *TxPoolBundle), done func(batch []*TxPoolBundle)) {
+	const batchSize = 10_000
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for start := 0; start < b.N; {
+		b.StopTimer()
+		batch := make([]*TxPoolBundle, min(batchSize, b.N-start))
+		for i := range batch {
+			batch[i] = next(start + i)
+		}
+		b.StartTimer()
+
+		for _, bundle := range batch {
+			op(bundle)
+		}
+
+		b.StopTimer()
+		if done != nil {
+			done(batch)
+		}
+		b.StartTimer()
+		start += len(batch)
+	}
+}
+
+func BenchmarkAddBundle(b *testing.B) {
+	pool := newBenchmarkPool(b)
+
+	runBundleBenchmark(b,
+		func(i int) *TxPoolBundle {
+			return newTestBundle(uint64(benchmarkPoolSize+i), fmt.Sprintf("added-%d", i), 100+uint64(i%10))
+		},
+		func(bundle *TxPoolBundle) {
+			mustAddBundle(b, pool, bundle, false)
+		},
+		func(batch []*TxPoolBundle) {
+			// Remove the added bundles to keep the pool at its size
+			for _, bundle := range batch {
+				if err := pool.cancelBundleByUUID(bundle.ReplacementUUID, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+			pool.cleanupMarkedBundles()
+			pool.statusTracker.cleanupExpiredStatuses()
+		},
+	)
+}
+
+func BenchmarkReplaceBundle(b *testing.B) {
+	pool := newBenchmarkPool(b)
+
+	runBundleBenchmark(b,
+		func(i int) *TxPoolBundle {
+			return newTestBundle(uint64(benchmarkPoolSize+i), fmt.Sprintf("bundle-%d", i%benchmarkPoolSize), 100+uint64(i%10))
+		},
+		func(bundle *TxPoolBundle) {
+			mustAddBundle(b, pool, bundle, true)
+		},
+		nil,
+	)
+}
+
+func BenchmarkCancelAndCleanup(b *testing.B) {
+	pool := newBenchmarkPool(b)
+
+	cancelled := 0
+	runBundleBenchmark(b,
+		func(i int) *TxPoolBundle {
+			// Cancel the bundles in the order they were added, queued again by the done function
+			return pool.bundleMap[fmt.Sprintf("bundle-%d", i%benchmarkPoolSize)]
+		},
+		func(bundle *TxPoolBundle) {
+			if err := pool.cancelBundleByUUID(bundle.ReplacementUUID, ""); err != nil {
+				b.Fatal(err)
+			}
+			if cancelled++; cancelled%1000 == 0 {
+				pool.cleanupMarkedBundles()
+			}
+		},
+		func(batch []*TxPoolBundle) {
+			pool.cleanupMarkedBundles()
+			for _, bundle := range batch {
+				mustAddBundle(b, pool, newTestBundle(bundle.Txs[0].Nonce(), bundle.ReplacementUUID, 100+bundle.Txs[0].Nonce()%10), false)
+			}
+			pool.statusTracker.cleanupExpiredStatuses()
+		},
+	)
+}
+
+func BenchmarkLeaseBundles(b *testing.B) {
+	pool := newBenchmarkPool(b)
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bundles := pool.leaseBundles(100, now)
+		if len(bundles) != 100 {
+			b.Fatalf("leaseBundles() returned %d bundles, want 100", len(bundles))
+		}
+
+		// Release the leases without counting the attempt, as after a failed send
+		b.StopTimer()
+		deliveries := make([]delivery, len(bundles))
+		for i, bundle := range bundles {
+			deliveries[i] = delivery{bundle: bundle, merger: "merger", outcome: deliveryFailed}
+		}
+		pool.settleDeliveries(deliveries, nil, now)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkLeaseBundlesWithBlockGating(b *testing.B) {
+	pool := newBenchmarkPool(b)
+	now := time.Now()
+
+	// The pooled bundles target blocks 5 to 14 after the upcoming block and wait, only the bundles
+	// added for the upcoming block are ready
+	pool.nextBlock = func(uint64) NextBlock { return NextBlock{Number: 95, Timestamp: uint64(now.Unix())} }
+	for i := uint64(0); i < 100; i++ {
+		mustAddBundle(b, pool, newTestBundle(benchmarkPoolSize+i, fmt.Sprintf("ready-%d", i), 95), false)
+	}
+	// The bundles were added before the chain head was known, they are scheduled once
+	pool.mu.Lock()
+	pool.refreshReadyLocked(now)
+	pool.mu.Unlock()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bundles := pool.leaseBundles(100, now)
+		if len(bundles) != 100 {
+			b.Fatalf("leaseBundles() returned %d bundles, want 100", len(bundles))
+		}
+
+		// Release the leases without counting the attempt, as after a failed send
+		b.StopTimer()
+		deliveries := make([]delivery, len(bundles))
+		for i, bundle := range bundles {
+			deliveries[i] = delivery{bundle: bundle, merger: "merger", outcome: deliveryFailed}
+		}
+		pool.settleDeliveries(deliveries, nil, now)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkExpireBundles(b *testing.B) {
+	pool := newBenchmarkPool(b)
+	now := time.Now()
+
+	// Heads before the target blocks expire nothing, but the pool is checked on every head
+	head := &ChainHead{Number: 99, Timestamp: uint64(now.Unix())}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if expired := pool.expireBundles(1, head, now); expired != 0 {
+			b.Fatalf("expireBundles() expired %d bundles, want 0", expired)
+		}
+	}
+}
+
+func TestCancelBundleChecksTheOwner(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+	mustAddBundle(t, pool, newUserTestBundle(1, "bundle", "alice", 10), false)
+
+	// Bundles of other users can't be canceled, nor are they revealed
+	if err := pool.cancelBundleByUUID("bundle", "bob"); !errors.Is(err, errBundleNotFound) {
+		t.Fatalf("cancelBundleByUUID() error = %v for the bundle of another user, want %v", err, errBundleNotFound)
+	}
+	assertPending(t, pool, map[string]bool{"bundle": true})
+
+	if err := pool.cancelBundleByUUID("bundle", "alice"); err != nil {
+		t.Fatalf("cancelBundleByUUID() error = %v", err)
+	}
+	assertPending(t, pool, map[string]bool{"bundle": false})
+}
@@ -0,0 +1,207 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+)
+
+// privateTxBlockRange is the number of blocks a private transaction without a maxBlockNumber
+// targets, the default of Flashbots
+const privateTxBlockRange = 25
+
+// SendPrivateTransactionParams represents parameters for sending a single private transaction.
+type SendPrivateTransactionParams struct {
+	Tx             string                `json:"tx"`                       // Signed transaction (hex string)
+	MaxBlockNumber string                `json:"maxBlockNumber,omitempty"` // Optional hex-encoded last block for inclusion
+	Preferences    *PrivateTxPreferences `json:"preferences,omitempty"`    // Optional inclusion preferences
+}
+
+// PrivateTxPreferences represents the inclusion preferences of a private transaction.
+type PrivateTxPreferences struct {
+	Builders []string `json:"builders,omitempty"` // Optional list of builder names
+}
+
+// CancelPrivateTransactionParams represents parameters for canceling a private transaction.
+type CancelPrivateTransactionParams struct {
+	TxHash string `json:"txHash"` // Hash of the private transaction to cancel
+}
+
+// registerPrivateTransactionMethods registers the single transaction JSON-RPC methods of the sequencer
+func registerPrivateTransactionMethods(registry *RPCRegistry, pools *ChainPools, validator Validator, builders *BuilderRegistry) {
+	registry.register("eth_sendRawTransaction", handleEthSendRawTransaction(pools, validator, builders))
+	registry.register("eth_sendPrivateTransaction", handleEthSendPrivateTransaction(pools, validator, builders))
+	registry.register("eth_cancelPrivateTransaction", handleEthCancelPrivateTransaction(pools))
+}
+
+// Handle eth_sendRawTransaction requests
+func handleEthSendRawTransaction(pools *ChainPools, validator Validator, builders *BuilderRegistry) RPCMethod {
+	return func(ctx context.Context, rawParams json.RawMessage) (interface{}, error) {
+		tracer := otel.Tracer("prof-sequencer")
+		ctx, span := tracer.Start(ctx, "handleSendRawTransactionRequest")
+		defer span.End()
+
+		var params []string
+		if err := decodeParams(rawParams, &params); err != nil {
+			return nil, err
+		}
+		if len(params) != 1 {
+			return nil, newRPCError(rpcErrInvalidParams, "Expected exactly one transaction", nil)
+		}
+
+		return processPrivateTransaction(ctx, pools, validator, builders, SendPrivateTransactionParams{Tx: params[0]})
+	}
+}
+
+// Handle eth_sendPrivateTransaction requests
+func handleEthSendPrivateTransaction(pools *ChainPools, validator Validator, builders *BuilderRegistry) RPCMethod {
+	return func(ctx context.Context, rawParams json.RawMessage) (interface{}, error) {
+		tracer := otel.Tracer("prof-sequencer")
+		ctx, span := tracer.Start(ctx, "handleSendPrivateTransactionRequest")
+		defer span.End()
+
+		var params []SendPrivateTransactionParams
+		if err := decodeParams(rawParams, &params); err != nil {
+			return nil, err
+		}
+		if len(params) != 1 {
+			return nil, newRPCError(rpcErrInvalidParams, "Expected exactly one transaction", nil)
+		}
+
+		return processPrivateTransaction(ctx, pools, validator, builders, params[0])
+	}
+}
+
+// processPrivateTransaction wraps a single transaction into a bundle keyed by its hash and adds it to the pool
+func processPrivateTransaction(ctx context.Context, pools *ChainPools, validator Validator, builders *BuilderRegistry, params SendPrivateTransactionParams) (interface{}, error) {
+	tracer := otel.Tracer("prof-sequencer")
+	_, span := tracer.Start(ctx, "processPrivateTransaction")
+	defer span.End()
+
+	receivedAt := time.Now()
+
+	// The last block for inclusion is normalized, so the pool and the bundle hash see a single representation
+	if params.MaxBlockNumber != "" {
+		maxBlock, err := hexutil.DecodeUint64(params.MaxBlockNumber)
+		if err != nil {
+			processedTransactionsCounter.WithLabelValues("failed").Inc()
+			return nil, newRPCError(rpcErrInvalidParams, "Invalid maxBlockNumber", err.Error())
+		}
+		params.MaxBlockNumber = hexutil.EncodeUint64(maxBlock)
+	}
+
+	tx, err := decodeTransaction(params.Tx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to decode private transaction")
+		processedTransactionsCounter.WithLabelValues("failed").Inc()
+		return nil, newRPCError(rpcErrInvalidParams, "Invalid transaction", newTxRejection(0, nil, err))
+	}
+
+	from, err := validator.Validate(tx)
+	if err != nil {
+		processedTransactionsCounter.WithLabelValues("failed").Inc()
+		log.Warn().Err(err).Interface("transaction", tx).Msg("Rejecting invalid private transaction")
+		return nil, newRPCError(rpcErrInvalidParams, "Invalid transaction", newTxRejection(0, tx, err))
+	}
+	processedTransactionsCounter.WithLabelValues("success").Inc()
+
+	// Without a last block the transaction targets the next blocks of its chain
+	if params.MaxBlockNumber == "" {
+		params.MaxBlockNumber = defaultMaxBlockNumber(pools, tx)
+	}
+
+	// The transaction hash doubles as the replacement UUID, so the transaction can be canceled by its hash
+	bundle := TxPoolBundle{
+		Txs:             []*types.Transaction{tx},
+		Senders:         []common.Address{from},
+		MaxBlockNumber:  params.MaxBlockNumber,
+		ReplacementUUID: tx.Hash().Hex(),
+		Username:        usernameFromContext(ctx),
+		ReceivedAt:      receivedAt,
+	}
+	if params.Preferences != nil {
+		bundle.Builders, err = builders.resolve(params.Preferences.Builders)
+		if err != nil {
+			processedBundlesCounter.WithLabelValues("failed").Inc()
+			return nil, newRPCError(rpcErrInvalidParams, "Invalid preferences", err.Error())
+		}
+	}
+
+	// Resubmissions of a pooled transaction are idempotent
+	if _, err := pools.addBundle(&bundle, false); err != nil {
+		log.Error().Str("tx_hash", bundle.ReplacementUUID).Err(err).Msg("Failed to add private transaction to pool")
+		processedBundlesCounter.WithLabelValues("failed").Inc()
+		if errors.Is(err, errPoolFull) {
+			return nil, newPoolFullError(err, nil)
+		}
+		return nil, newRPCError(rpcErrServer, "Failed to add transaction to pool", err.Error())
+	}
+
+	processedBundlesCounter.WithLabelValues("success").Inc()
+	log.Info().Str("tx_hash", bundle.ReplacementUUID).Msg("Private transaction received and added to the pool")
+
+	return bundle.ReplacementUUID, nil
+}
+
+// defaultMaxBlockNumber returns the last of the next privateTxBlockRange blocks of the chain of a
+// transaction, or empty if the chain head is unknown. A pooled transaction keeps its last block,
+// so resubmitting it stays idempotent.
+func defaultMaxBlockNumber(pools *ChainPools, tx *types.Transaction) string {
+	chainID, err := pools.bundleChainID([]*types.Transaction{tx})
+	if err != nil {
+		return "" // Adding the transaction to the pool reports the error
+	}
+	if maxBlockNumber, exists := pools.pools[chainID].pendingMaxBlockNumber(tx.Hash().Hex()); exists {
+		return maxBlockNumber
+	}
+
+	next := pools.nextBlock(chainID)
+	if next.Number == 0 {
+		return ""
+	}
+	return hexutil.EncodeUint64(next.Number + privateTxBlockRange - 1)
+}
+
+// Handle eth_cancelPrivateTransaction requests
+func handleEthCancelPrivateTransaction(pools *ChainPools) RPCMethod {
+	return func(ctx context.Context, rawParams json.RawMessage) (interface{}, error) {
+		tracer := otel.Tracer("prof-sequencer")
+		_, span := tracer.Start(ctx, "handleCancelPrivateTransactionRequest")
+		defer span.End()
+
+		var params []CancelPrivateTransactionParams
+		if err := decodeParams(rawParams, &params); err != nil {
+			return nil, err
+		}
+		if len(params) != 1 {
+			return nil, newRPCError(rpcErrInvalidParams, "Expected exactly one transaction hash", nil)
+		}
+
+		// Normalize the hash to the representation used as pool key
+		var hash common.Hash
+		if err := hash.UnmarshalText([]byte(params[0].TxHash)); err != nil {
+			return nil, newRPCError(rpcErrInvalidParams, "Invalid transaction hash", err.Error())
+		}
+		txHash := hash.Hex()
+
+		// Only the user that sent the transaction can cancel it
+		if err := pools.cancelBundleByUUID(txHash, usernameFromContext(ctx)); err != nil {
+			log.Warn().Str("tx_hash", txHash).Err(err).Msg("Failed to cancel private transaction")
+			// The transactions of other users are not found, like in the status endpoint
+			if errors.Is(err, errBundleLeftPool) {
+				return nil, newRPCError(rpcErrServer, "Transaction already left the pool", err.Error())
+			}
+			return nil, newRPCError(rpcErrServer, "Transaction not found", txHash)
+		}
+
+		return true, nil
+	}
+}
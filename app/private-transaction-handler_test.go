@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// newSignedTestTx returns a hex-encoded transaction of chain 1 signed by a new key
+func newSignedTestTx(t *testing.T, tx types.TxData) string {
+	t.Helper()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	signed, err := types.SignNewTx(key, types.LatestSignerForChainID(big.NewInt(1)), tx)
+	if err != nil {
+		t.Fatalf("SignNewTx() error = %v", err)
+	}
+	encoded, err := signed.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error = %v", err)
+	}
+	return hexutil.Encode(encoded)
+}
+
+// newHandlerTestRegistry returns a registry with the bundle, private transaction and MEV-Share methods over a pool of chain 1
+func newHandlerTestRegistry(t *testing.T) (*RPCRegistry, *ChainPools) {
+	t.Helper()
+
+	pools := newTestChainPools(t)
+	return newHandlerTestRegistryFor(t, pools), pools
+}
+
+// newHandlerTestRegistryFor returns a registry with all JSON-RPC methods serving the given pools
+func newHandlerTestRegistryFor(t *testing.T, pools *ChainPools) *RPCRegistry {
+	t.Helper()
+
+	validator, err := loadValidationPipeline("", pools.chains)
+	if err != nil {
+		t.Fatalf("loadValidationPipeline() error = %v", err)
+	}
+	builders, err := loadBuilderRegistry("")
+	if err != nil {
+		t.Fatalf("loadBuilderRegistry() error = %v", err)
+	}
+
+	registry := newRPCRegistry()
+	registerSequencerMethods(registry, pools, validator, builders)
+	registerPrivateTransactionMethods(registry, pools, validator, builders)
+	registerMevShareMethods(registry, pools, validator, builders)
+	return registry
+}
+
+// callRPC calls a method of the registry as the given user and returns the encoded response
+func callRPC(t *testing.T, registry *RPCRegistry, username string, method string, params string) string {
+	t.Helper()
+
+	ctx := context.WithValue(context.Background(), usernameContextKey, username)
+	body := `{"jsonrpc":"2.0","id":1,"method":"` + method + `","params":` + params + `}`
+	return marshalRPC(t, processRPCPayload(ctx, registry, []byte(body)))
+}
+
+func TestSendPrivateTransaction(t *testing.T) {
+	registry, pools := newHandlerTestRegistry(t)
+
+	txHex := newSignedTestTx(t, &types.DynamicFeeTx{ChainID: big.NewInt(1), Gas: 21000, GasFeeCap: big.NewInt(2), GasTipCap: big.NewInt(1), To: &feeTestRecipient})
+	tx, _ := decodeTransaction(txHex)
+	txHash := tx.Hash().Hex()
+	ranged := newSignedTestTx(t, &types.LegacyTx{Nonce: 1, Gas: 21000, GasPrice: big.NewInt(1), To: &feeTestRecipient})
+	tx, _ = decodeTransaction(ranged)
+	rangedHash := tx.Hash().Hex()
+
+	tests := []struct {
+		name   string
+		method string
+		params string
+		want   string
+	}{
+		{"raw transaction", "eth_sendRawTransaction", `["` + txHex + `"]`, `{"jsonrpc":"2.0","id":1,"result":"` + txHash + `"}`},
+		{"idempotent resubmission", "eth_sendPrivateTransaction", `[{"tx":"` + txHex + `"}]`, `{"jsonrpc":"2.0","id":1,"result":"` + txHash + `"}`},
+		{"max block number", "eth_sendPrivateTransaction", `[{"tx":"` + ranged + `","maxBlockNumber":"0xC"}]`, `{"jsonrpc":"2.0","id":1,"result":"` + rangedHash + `"}`},
+		{"invalid max block number", "eth_sendPrivateTransaction", `[{"tx":"` + txHex + `","maxBlockNumber":"12"}]`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Invalid maxBlockNumber","data":"hex string without 0x prefix"}}`},
+		{"invalid transaction", "eth_sendPrivateTransaction", `[{"tx":"0x01"}]`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Invalid transaction","data":{"index":0,"rule":"decode","reason":"invalid_encoding","message":"failed to unmarshal transaction: typed transaction too short"}}}`},
+		{"two transactions", "eth_sendRawTransaction", `["` + txHex + `","` + ranged + `"]`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Expected exactly one transaction"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := callRPC(t, registry, "alice", tt.method, tt.params); got != tt.want {
+				t.Errorf("%s = %s, want %s", tt.method, got, tt.want)
+			}
+		})
+	}
+
+	bundle, exists := pools.pools[1].bundleMap[rangedHash]
+	if !exists || bundle.MaxBlockNumber != "0xc" || bundle.Username != "alice" {
+		t.Errorf("pooled transaction = %+v, want the normalized max block number of alice", bundle)
+	}
+	if bundle := pools.pools[1].bundleMap[txHash]; bundle.MaxBlockNumber != "" {
+		t.Errorf("MaxBlockNumber = %q without a chain head, want none", bundle.MaxBlockNumber)
+	}
+}
+
+func TestSendPrivateTransactionDefaultsMaxBlockNumber(t *testing.T) {
+	pools := newTestChainPools(t)
+	follower := &HeadFollower{chainID: 1, head: &ChainHead{Number: 100}}
+	pools.followers[1] = follower
+	registry := newHandlerTestRegistryFor(t, pools)
+
+	txHex := newSignedTestTx(t, &types.LegacyTx{Gas: 21000, GasPrice: big.NewInt(1), To: &feeTestRecipient})
+	tx, _ := decodeTransaction(txHex)
+	txHash := tx.Hash().Hex()
+	want := `{"jsonrpc":"2.0","id":1,"result":"` + txHash + `"}`
+
+	if got := callRPC(t, registry, "alice", "eth_sendRawTransaction", `["`+txHex+`"]`); got != want {
+		t.Fatalf("eth_sendRawTransaction = %s, want %s", got, want)
+	}
+	// The transaction targets blocks 101 to 125
+	if bundle := pools.pools[1].bundleMap[txHash]; bundle.MaxBlockNumber != "0x7d" {
+		t.Errorf("MaxBlockNumber = %q, want 0x7d", bundle.MaxBlockNumber)
+	}
+
+	// A resubmission after a new head keeps the range of the pooled transaction
+	follower.head = &ChainHead{Number: 110}
+	if got := callRPC(t, registry, "alice", "eth_sendRawTransaction", `["`+txHex+`"]`); got != want {
+		t.Errorf("eth_sendRawTransaction = %s after a new head, want %s", got, want)
+	}
+	if bundle := pools.pools[1].bundleMap[txHash]; bundle.MaxBlockNumber != "0x7d" {
+		t.Errorf("MaxBlockNumber = %q after a new head, want 0x7d", bundle.MaxBlockNumber)
+	}
+}
+
+func TestCancelPrivateTransaction(t *testing.T) {
+	registry, pools := newHandlerTestRegistry(t)
+
+	txHex := newSignedTestTx(t, &types.LegacyTx{Gas: 21000, GasPrice: big.NewInt(1), To: &feeTestRecipient})
+	var txHash string
+	if err := json.Unmarshal([]byte(callRPC(t, registry, "alice", "eth_sendRawTransaction", `["`+txHex+`"]`)), &struct {
+		Result *string `json:"result"`
+	}{&txHash}); err != nil || txHash == "" {
+		t.Fatalf("eth_sendRawTransaction failed: %v", err)
+	}
+
+	// A second transaction expires before it is canceled
+	expiredHex := newSignedTestTx(t, &types.LegacyTx{Nonce: 1, Gas: 21000, GasPrice: big.NewInt(1), To: &feeTestRecipient})
+	expiredTx, _ := decodeTransaction(expiredHex)
+	expiredHash := expiredTx.Hash().Hex()
+	callRPC(t, registry, "alice", "eth_sendRawTransaction", `["`+expiredHex+`"]`)
+	pool := pools.pools[1]
+	pool.mu.Lock()
+	pool.markLocked(pool.bundleMap[expiredHash], poolOpExpire)
+	pool.statusTracker.record(expiredHash, BundleStateExpired, "")
+	pool.mu.Unlock()
+
+	unknownHash := common.Hash{1}.Hex()
+	tests := []struct {
+		name     string
+		username string
+		params   string
+		want     string
+	}{
+		{"invalid hash", "alice", `[{"txHash":"0x01"}]`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Invalid transaction hash","data":"hex string has length 2, want 64 for Hash"}}`},
+		{"unknown transaction", "alice", `[{"txHash":"` + unknownHash + `"}]`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"Transaction not found","data":"` + unknownHash + `"}}`},
+		{"other user", "bob", `[{"txHash":"` + txHash + `"}]`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"Transaction not found","data":"` + txHash + `"}}`},
+		{"expired transaction of another user", "bob", `[{"txHash":"` + expiredHash + `"}]`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"Transaction not found","data":"` + expiredHash + `"}}`},
+		{"expired transaction", "alice", `[{"txHash":"` + expiredHash + `"}]`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"Transaction already left the pool","data":"bundle already left the pool: ` + expiredHash + ` is expired"}}`},
+		{"owner", "alice", `[{"txHash":"` + txHash + `"}]`, `{"jsonrpc":"2.0","id":1,"result":true}`},
+		{"canceled transaction", "alice", `[{"txHash":"` + txHash + `"}]`, `{"jsonrpc":"2.0","id":1,"result":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := callRPC(t, registry, tt.username, "eth_cancelPrivateTransaction", tt.params); got != tt.want {
+				t.Errorf("eth_cancelPrivateTransaction = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if counts := pools.countBundles(); counts[1] != 0 {
+		t.Errorf("countBundles() = %d after cancel, want 0", counts[1])
+	}
+}
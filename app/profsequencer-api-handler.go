@@ -4,25 +4,18 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"io"
-	"net/http"
+	"errors"
+	"fmt"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel"
 )
 
-// SendBundleRequest represents a request to send a bundle.
-type SendBundleRequest struct {
-	JSONRPC string             `json:"jsonrpc"` // JSON-RPC version,
-	ID      int                `json:"id"`      // ID of the request
-	Method  string             `json:"method"`  // Method name, should be "eth_sendBundle"
-	Params  []SendBundleParams `json:"params"`  // Array containing bundle params objects
-}
-
 // SendBundleParams represents parameters for sending a bundle.
 type SendBundleParams struct {
 	Txs               []string `json:"txs"`                         // Array of signed transactions (hex strings)
@@ -32,6 +25,18 @@ type SendBundleParams struct {
 	RevertingTxHashes []string `json:"revertingTxHashes,omitempty"` // Optional list of tx hashes allowed to revert
 	ReplacementUUID   string   `json:"replacementUuid,omitempty"`   // Optional replacement UUID
 	Builders          []string `json:"builders,omitempty"`          // Optional list of builder names
+	AllowPartial      bool     `json:"allowPartial,omitempty"`      // Optional opt-in to pool the valid transactions of a partially invalid bundle
+}
+
+// SendBundleResult represents the outcome of a single bundle of an eth_sendBundle request.
+type SendBundleResult struct {
+	Index           int              `json:"index"`                     // Index of the bundle in the params
+	ReplacementUUID string           `json:"replacementUuid,omitempty"` // UUID the bundle is pooled under
+	BundleHash      string           `json:"bundleHash,omitempty"`      // Hash of the pooled bundle
+	Duplicate       bool             `json:"duplicate,omitempty"`       // Whether an identical bundle was already pooled
+	Error           string           `json:"error,omitempty"`           // Reason the bundle was rejected
+	RejectedTxs     []TxRejection    `json:"rejectedTxs,omitempty"`     // Transactions that failed validation
+	Conflicts       []BundleConflict `json:"conflicts,omitempty"`       // Conflicts with pending bundles
 }
 
 // Define Prometheus metrics
@@ -59,124 +64,126 @@ func init() {
 	profSequencerRegisterer.MustRegister(processedTransactionsCounter)
 }
 
-func handleEthSendBundle(txPool *TxBundlePool) gin.HandlerFunc {
-	return func(c *gin.Context) {
+// registerSequencerMethods registers the bundle related JSON-RPC methods of the sequencer
+func registerSequencerMethods(registry *RPCRegistry, pools *ChainPools, validator Validator, builders *BuilderRegistry) {
+	registry.register("eth_sendBundle", handleEthSendBundle(pools, validator, builders))
+	registry.register("eth_cancelBundle", handleEthCancelBundle(pools))
+}
+
+// Handle eth_sendBundle requests
+func handleEthSendBundle(pools *ChainPools, validator Validator, builders *BuilderRegistry) RPCMethod {
+	return func(ctx context.Context, rawParams json.RawMessage) (interface{}, error) {
 		// Start a new span for the handleBundleRequest function
 		tracer := otel.Tracer("prof-sequencer")
-		ctx, span := tracer.Start(c.Request.Context(), "handleBundleRequest")
+		ctx, span := tracer.Start(ctx, "handleBundleRequest")
 		defer span.End()
 
-		var req SendBundleRequest
-
-		// Read the raw request body
-		rawBody, err := io.ReadAll(c.Request.Body)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body: " + err.Error()})
-			return
-		}
-
-		// Decode the incoming request body into the SendBundleRequest struct
-		if err := json.Unmarshal(rawBody, &req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
-			return
+		// Decode the params into the SendBundleParams structs
+		var params []SendBundleParams
+		if err := decodeParams(rawParams, &params); err != nil {
+			return nil, err
 		}
 
-		// Ensure the method is eth_sendBundle
-		if req.Method != "eth_sendBundle" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid method: " + req.Method})
-			return
+		// Ensure there are bundles in the params
+		if len(params) == 0 {
+			return nil, newRPCError(rpcErrInvalidParams, "Missing params", nil)
 		}
 
-		// Ensure there are bundles in the params
-		if len(req.Params) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing params"})
-			return
+		// Block numbers are normalized, so the pool and the bundle hash see a single representation
+		for i := range params {
+			block, err := hexutil.DecodeUint64(params[i].BlockNumber)
+			if err == nil && block == 0 {
+				err = errors.New("block number must be greater than 0")
+			}
+			if err != nil {
+				processedBundlesCounter.WithLabelValues("failed").Inc()
+				return nil, newRPCError(rpcErrInvalidParams, "Invalid blockNumber", fmt.Sprintf("bundle %d: %v", i, err))
+			}
+			params[i].BlockNumber = hexutil.EncodeUint64(block)
 		}
 
 		// Process the bundles and return the response
-		response := processBundlesEthSendBundle(ctx, txPool, req)
-
-		c.JSON(http.StatusAccepted, response)
+		return processBundlesEthSendBundle(ctx, pools, validator, builders, params)
 	}
 }
 
-func processBundlesEthSendBundle(ctx context.Context, txPool *TxBundlePool, req SendBundleRequest) map[string]interface{} {
+// processBundlesEthSendBundle pools the bundles and reports the outcome per bundle. If no bundle
+// was pooled because the pool is full, a pool full error carrying the outcomes is returned instead.
+func processBundlesEthSendBundle(ctx context.Context, pools *ChainPools, validator Validator, builders *BuilderRegistry, bundleParams []SendBundleParams) (map[string]interface{}, error) {
 	tracer := otel.Tracer("prof-sequencer")
 	_, span := tracer.Start(ctx, "processBundlesEthSendBundle")
 	defer span.End()
 
 	var processedBundles []string
 	var failedBundles []string
+	var poolFullErr error
+	results := make([]SendBundleResult, 0, len(bundleParams))
 
-	// Process each bundle in the Params array
-	for _, params := range req.Params {
-		// If no ReplacementUUID is provided, generate one
-		if params.ReplacementUUID == "" {
-			newUUID := uuid.New().String()
-			log.Info().Str("uuid", newUUID).Msg("Generated new UUID for bundle")
-			params.ReplacementUUID = newUUID
+	// Process each bundle in the params array
+	for i, params := range bundleParams {
+		receivedAt := time.Now()
+		result := SendBundleResult{Index: i, ReplacementUUID: params.ReplacementUUID}
+
+		// Resolve the requested builders against the builder registry
+		bundleBuilders, err := builders.resolve(params.Builders)
+		if err != nil {
+			log.Warn().Str("uuid", params.ReplacementUUID).Err(err).Msg("Rejecting bundle with invalid builders")
+			if params.ReplacementUUID != "" {
+				failedBundles = append(failedBundles, params.ReplacementUUID)
+			}
+			result.Error = err.Error()
+			results = append(results, result)
+			processedBundlesCounter.WithLabelValues("failed").Inc()
+			continue
 		}
 
 		// Decode the hex-encoded transactions
 		var validTxs []*types.Transaction
-		for _, txHex := range params.Txs {
-			txData, err := decodeHex(txHex)
+		var senders []common.Address
+		var rejectedTxs []TxRejection
+		for j, txHex := range params.Txs {
+			tx, err := decodeTransaction(txHex)
 			if err != nil {
-				log.Error().Err(err).Msg("Failed to decode transaction hex")
+				log.Error().Err(err).Msg("Failed to decode transaction")
 				processedTransactionsCounter.WithLabelValues("failed").Inc()
+				rejectedTxs = append(rejectedTxs, newTxRejection(j, nil, err))
 				continue
 			}
-
-			tx := new(types.Transaction)
-			err = tx.UnmarshalBinary(txData)
+			// Validation recovers the sender, transactions with unrecoverable signatures are rejected
+			from, err := validator.Validate(tx)
 			if err != nil {
-				log.Error().Err(err).Msg("Failed to unmarshal transaction")
 				processedTransactionsCounter.WithLabelValues("failed").Inc()
-				continue
-			}
-			// Optional logging
-			if false {
-				// Derive the sender address based on the transaction type
-				var signer types.Signer
-				switch tx.Type() {
-				case types.LegacyTxType:
-					signer = types.HomesteadSigner{}
-				case types.AccessListTxType:
-					signer = types.NewEIP2930Signer(tx.ChainId())
-				case types.DynamicFeeTxType:
-					signer = types.NewLondonSigner(tx.ChainId())
-				default:
-					log.Error().Int("type", int(tx.Type())).Msg("Unsupported transaction type")
-					continue
-				}
-
-				from, err := types.Sender(signer, tx)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to derive sender address")
-					continue
-				}
-
-				// Get the signature values
-				v, r, s := tx.RawSignatureValues()
-
-				log.Info().Interface("transaction", tx).Str("sender", from.Hex()).Msg("Transaction details")
-				log.Info().Int64("v", v.Int64()).Str("r", r.String()).Str("s", s.String()).Msg("Signature values")
-			}
-
-			if isValidTransaction(tx) {
+				log.Warn().Err(err).Interface("transaction", tx).Msg("Skipping invalid transaction")
+				rejectedTxs = append(rejectedTxs, newTxRejection(j, tx, err))
+			} else {
 				validTxs = append(validTxs, tx)
+				senders = append(senders, from)
 				processedTransactionsCounter.WithLabelValues("success").Inc()
-				log.Info().Interface("transaction", tx).Uint64("nonce", tx.Nonce()).Msg("Valid transaction")
-			} else {
-				processedTransactionsCounter.WithLabelValues("failed").Inc()
-				log.Warn().Interface("transaction", tx).Msg("Skipping invalid transaction")
+				log.Info().Interface("transaction", tx).Str("sender", from.Hex()).Uint64("nonce", tx.Nonce()).Msg("Valid transaction")
 			}
 		}
+		result.RejectedTxs = rejectedTxs
+
+		// Bundles are accepted atomically, unless the caller opted into partial acceptance
+		if len(rejectedTxs) > 0 && !params.AllowPartial {
+			log.Warn().Str("uuid", params.ReplacementUUID).Int("rejected_txs", len(rejectedTxs)).Msg("Rejecting bundle with invalid transactions")
+			if params.ReplacementUUID != "" {
+				failedBundles = append(failedBundles, params.ReplacementUUID)
+			}
+			result.Error = "bundle contains invalid transactions"
+			results = append(results, result)
+			processedBundlesCounter.WithLabelValues("failed").Inc()
+			continue
+		}
 
 		// Ensure at least one valid transaction exists in the bundle
 		if len(validTxs) == 0 {
 			log.Warn().Str("uuid", params.ReplacementUUID).Msg("No valid transactions in the bundle")
-			failedBundles = append(failedBundles, params.ReplacementUUID)
+			if params.ReplacementUUID != "" {
+				failedBundles = append(failedBundles, params.ReplacementUUID)
+			}
+			result.Error = "no valid transactions in the bundle"
+			results = append(results, result)
 			processedBundlesCounter.WithLabelValues("failed").Inc()
 			continue
 		}
@@ -184,18 +191,22 @@ func processBundlesEthSendBundle(ctx context.Context, txPool *TxBundlePool, req
 		// Create the TxPoolBundle using the validated transactions
 		bundle := TxPoolBundle{
 			Txs:               validTxs,
+			Senders:           senders,
 			BlockNumber:       params.BlockNumber,
 			MinTimestamp:      params.MinTimestamp,
 			MaxTimestamp:      params.MaxTimestamp,
 			RevertingTxHashes: params.RevertingTxHashes,
 			ReplacementUUID:   params.ReplacementUUID,
-			Builders:          params.Builders,
+			Builders:          bundleBuilders,
+			Username:          usernameFromContext(ctx),
+			ReceivedAt:        receivedAt,
 		}
 
 		// Log details of each transaction in the bundle
 		for j, tx := range bundle.Txs {
 			log.Info().
 				Int("index", j+1).
+				Str("from", bundle.Senders[j].Hex()).
 				Interface("to", tx.To()).
 				Uint64("nonce", tx.Nonce()).
 				Uint64("gas", tx.Gas()).
@@ -204,34 +215,55 @@ func processBundlesEthSendBundle(ctx context.Context, txPool *TxBundlePool, req
 		}
 
 		// Add the bundle to the transaction pool
-		err := txPool.addBundle(&bundle, false)
+		pooledBundle, err := pools.addBundle(&bundle, false)
 		if err != nil {
 			log.Error().Str("uuid", bundle.ReplacementUUID).Err(err).Msg("Failed to add bundle to pool")
-			failedBundles = append(failedBundles, bundle.ReplacementUUID)
+			if errors.Is(err, errPoolFull) {
+				poolFullErr = err
+			}
+			var conflictErr *ConflictError
+			if errors.As(err, &conflictErr) {
+				result.Conflicts = conflictErr.Conflicts
+			}
+			if params.ReplacementUUID != "" {
+				failedBundles = append(failedBundles, params.ReplacementUUID)
+			}
+			result.Error = err.Error()
+			results = append(results, result)
 			processedBundlesCounter.WithLabelValues("failed").Inc()
 			continue
 		}
 
-		processedBundles = append(processedBundles, bundle.ReplacementUUID)
+		// Identical resubmissions are answered with the already pooled bundle
+		result.ReplacementUUID = pooledBundle.ReplacementUUID
+		result.BundleHash = pooledBundle.BundleHash.Hex()
+		result.Duplicate = pooledBundle != &bundle
+		if !result.Duplicate {
+			result.Conflicts = bundle.Conflicts
+		}
+		results = append(results, result)
+
+		processedBundles = append(processedBundles, pooledBundle.ReplacementUUID)
 		processedBundlesCounter.WithLabelValues("success").Inc()
-		log.Info().Str("uuid", bundle.ReplacementUUID).Msg("Bundle received and added to the pool")
+		log.Info().Str("uuid", pooledBundle.ReplacementUUID).Bool("duplicate", result.Duplicate).Msg("Bundle received and added to the pool")
 	}
 
 	// Respond with the result
 	response := map[string]interface{}{
 		"processedBundles": processedBundles,
 		"failedBundles":    failedBundles,
+		"bundles":          results,
 	}
 
-	return response
-}
+	// Single bundle requests are also answered in the Flashbots format
+	if len(results) == 1 && results[0].BundleHash != "" {
+		response["bundleHash"] = results[0].BundleHash
+	}
 
-// CancelBundleRequest represents a request to cancel a bundle.
-type CancelBundleRequest struct {
-	JSONRPC string               `json:"jsonrpc"` // JSON-RPC version
-	ID      int                  `json:"id"`      // ID of the request
-	Method  string               `json:"method"`  // Method name, should be "eth_cancelBundle"
-	Params  []CancelBundleParams `json:"params"`  // Array containing CancelBundleParams objects
+	if len(processedBundles) == 0 && poolFullErr != nil {
+		return nil, newPoolFullError(poolFullErr, response)
+	}
+	return response, nil
 }
 
 // CancelBundleParams represents parameters for canceling a bundle.
@@ -240,78 +272,61 @@ type CancelBundleParams struct {
 }
 
 // Handle eth_cancelBundle requests
-func handleEthCancelBundle(txPool *TxBundlePool) gin.HandlerFunc {
-	return func(c *gin.Context) {
+func handleEthCancelBundle(pools *ChainPools) RPCMethod {
+	return func(ctx context.Context, rawParams json.RawMessage) (interface{}, error) {
 		// Start a new span for the handleCancelBundleRequest function
 		tracer := otel.Tracer("prof-sequencer")
-		ctx, span := tracer.Start(c.Request.Context(), "handleCancelBundleRequest")
+		ctx, span := tracer.Start(ctx, "handleCancelBundleRequest")
 		defer span.End()
 
-		var req CancelBundleRequest
-
-		// Parse the JSON body into the CancelBundleRequest struct
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
-			return
-		}
-
-		// Ensure the method is eth_cancelBundle
-		if req.Method != "eth_cancelBundle" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid method: " + req.Method})
-			return
+		// Decode the params into the CancelBundleParams structs
+		var params []CancelBundleParams
+		if err := decodeParams(rawParams, &params); err != nil {
+			return nil, err
 		}
 
 		// Ensure there are bundles in the params
-		if len(req.Params) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing params"})
-			return
+		if len(params) == 0 {
+			return nil, newRPCError(rpcErrInvalidParams, "Missing params", nil)
 		}
 
 		// Process the bundles and return the response
-		var failedBundles []string
-		response := processBundlesEthCancelBundle(ctx, txPool, req, &failedBundles)
+		failedBundles := processBundlesEthCancelBundle(ctx, pools, params)
 
 		// Handle partial success or failure
 		if len(failedBundles) > 0 {
-			response["error"] = map[string]interface{}{
-				"message":       "Failed to cancel some bundles",
+			return nil, newRPCError(rpcErrServer, "Failed to cancel some bundles", map[string]interface{}{
 				"failedBundles": failedBundles,
-			}
-			c.JSON(http.StatusMultiStatus, response) // 207 Multi-Status (to indicate partial success)
-		} else {
-			response["result"] = "All bundles canceled successfully"
-			c.JSON(http.StatusOK, response)
+			})
 		}
+
+		return "All bundles canceled successfully", nil
 	}
 }
 
-func processBundlesEthCancelBundle(ctx context.Context, txPool *TxBundlePool, req CancelBundleRequest, failedBundles *[]string) map[string]interface{} {
+func processBundlesEthCancelBundle(ctx context.Context, pools *ChainPools, cancelParams []CancelBundleParams) []string {
 	tracer := otel.Tracer("prof-sequencer")
 	_, span := tracer.Start(ctx, "processBundlesEthCancelBundle")
 	defer span.End()
 
-	// Process each bundle in the Params array
-	for _, param := range req.Params {
+	var failedBundles []string
+
+	// Process each bundle in the params array
+	for _, param := range cancelParams {
 		// Check if ReplacementUUID is provided
 		if param.ReplacementUUID == "" {
-			*failedBundles = append(*failedBundles, "missing UUID")
+			failedBundles = append(failedBundles, "missing UUID")
 			continue
 		}
 
-		// Attempt to cancel the bundle by replacementUUID
-		err := txPool.cancelBundleByUUID(param.ReplacementUUID)
+		// Attempt to cancel the bundle of the user by replacementUUID
+		err := pools.cancelBundleByUUID(param.ReplacementUUID, usernameFromContext(ctx))
 		if err != nil {
 			log.Error().Str("uuid", param.ReplacementUUID).Err(err).Msg("Failed to cancel bundle")
-			*failedBundles = append(*failedBundles, param.ReplacementUUID)
+			failedBundles = append(failedBundles, param.ReplacementUUID)
 			continue
 		}
 	}
 
-	// Create the response
-	response := map[string]interface{}{
-		"jsonrpc": "2.0",
-		"id":      req.ID,
-	}
-
-	return response
+	return failedBundles
 }
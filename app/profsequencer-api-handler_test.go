@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// sendBundleResponse represents the result of an eth_sendBundle request
+type sendBundleResponse struct {
+	Result struct {
+		BundleHash       string             `json:"bundleHash"`
+		ProcessedBundles []string           `json:"processedBundles"`
+		FailedBundles    []string           `json:"failedBundles"`
+		Bundles          []SendBundleResult `json:"bundles"`
+	} `json:"result"`
+	Error json.RawMessage `json:"error"`
+}
+
+// sendTestBundles sends the bundles as alice and decodes the response
+func sendTestBundles(t *testing.T, registry *RPCRegistry, params string) sendBundleResponse {
+	t.Helper()
+
+	var response sendBundleResponse
+	if err := json.Unmarshal([]byte(callRPC(t, registry, "alice", "eth_sendBundle", params)), &response); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	return response
+}
+
+func TestComputeBundleHash(t *testing.T) {
+	// hashOf caches the block numbers like addBundle before hashing
+	hashOf := func(bundle *TxPoolBundle) common.Hash {
+		first, last, err := parseBlockRange(bundle.BlockNumber, bundle.MaxBlockNumber)
+		if err != nil {
+			t.Fatalf("parseBlockRange() error = %v", err)
+		}
+		bundle.TargetBlock, bundle.LastBlock = first, last
+		return computeBundleHash(bundle)
+	}
+
+	first, second := newLegacyTx(21000, 1), newLegacyTx(21000, 2)
+	hash := hashOf(&TxPoolBundle{Txs: []*types.Transaction{first, second}, BlockNumber: "0xa"})
+
+	tests := []struct {
+		name   string
+		bundle *TxPoolBundle
+		same   bool
+	}{
+		{"identical bundle", &TxPoolBundle{Txs: []*types.Transaction{first, second}, BlockNumber: "0xa"}, true},
+		{"other block number representation", &TxPoolBundle{Txs: []*types.Transaction{first, second}, BlockNumber: "0x0a"}, true},
+		{"other UUID", &TxPoolBundle{Txs: []*types.Transaction{first, second}, BlockNumber: "0xa", ReplacementUUID: "other"}, true},
+		{"other order", &TxPoolBundle{Txs: []*types.Transaction{second, first}, BlockNumber: "0xa"}, false},
+		{"other block", &TxPoolBundle{Txs: []*types.Transaction{first, second}, BlockNumber: "0xb"}, false},
+		{"block range", &TxPoolBundle{Txs: []*types.Transaction{first, second}, BlockNumber: "0xa", MaxBlockNumber: "0xb"}, false},
+		{"timestamps", &TxPoolBundle{Txs: []*types.Transaction{first, second}, BlockNumber: "0xa", MaxTimestamp: 1}, false},
+		{"reverting transactions", &TxPoolBundle{Txs: []*types.Transaction{first, second}, BlockNumber: "0xa", RevertingTxHashes: []string{first.Hash().Hex()}}, false},
+		{"builders", &TxPoolBundle{Txs: []*types.Transaction{first, second}, BlockNumber: "0xa", Builders: []string{"flashbots"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hashOf(tt.bundle); (got == hash) != tt.same {
+				t.Errorf("computeBundleHash() = %s, base bundle %s, want same hash %v", got.Hex(), hash.Hex(), tt.same)
+			}
+		})
+	}
+
+	// The order of the builders doesn't matter
+	ordered := hashOf(&TxPoolBundle{Txs: []*types.Transaction{first}, BlockNumber: "0xa", Builders: []string{"beaverbuild", "flashbots"}})
+	if reversed := hashOf(&TxPoolBundle{Txs: []*types.Transaction{first}, BlockNumber: "0xa", Builders: []string{"flashbots", "beaverbuild"}}); reversed != ordered {
+		t.Errorf("computeBundleHash() = %s for the reversed builders, want %s", reversed.Hex(), ordered.Hex())
+	}
+}
+
+func TestSendBundleDeduplicatesByHash(t *testing.T) {
+	registry, pools := newHandlerTestRegistry(t)
+	tx, _ := newTestTxHex(t, 1)
+
+	first := sendTestBundles(t, registry, `[{"txs":["`+tx+`"],"blockNumber":"0xa"}]`)
+	if len(first.Error) > 0 || first.Result.BundleHash == "" || len(first.Result.ProcessedBundles) != 1 {
+		t.Fatalf("eth_sendBundle = %+v, want a pooled bundle and its hash", first)
+	}
+	uuid := first.Result.ProcessedBundles[0]
+
+	tests := []struct {
+		name          string
+		params        string
+		wantDuplicate bool
+		wantError     bool
+	}{
+		{"identical resubmission", `[{"txs":["` + tx + `"],"blockNumber":"0xa"}]`, true, false},
+		{"identical resubmission under another UUID", `[{"txs":["` + tx + `"],"blockNumber":"0xa","replacementUuid":"other"}]`, false, true},
+		{"other block", `[{"txs":["` + tx + `"],"blockNumber":"0xb"}]`, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := sendTestBundles(t, registry, tt.params)
+			if len(response.Result.Bundles) != 1 {
+				t.Fatalf("eth_sendBundle = %+v, want a single bundle result", response)
+			}
+			result := response.Result.Bundles[0]
+			if tt.wantError {
+				if result.Error == "" || result.BundleHash != "" {
+					t.Errorf("bundle result = %+v, want an error", result)
+				}
+				return
+			}
+			if result.Duplicate != tt.wantDuplicate || (result.ReplacementUUID == uuid) != tt.wantDuplicate || (result.BundleHash == first.Result.BundleHash) != tt.wantDuplicate {
+				t.Errorf("bundle result = %+v, want duplicate %v of %s", result, tt.wantDuplicate, uuid)
+			}
+			if response.Result.BundleHash != result.BundleHash {
+				t.Errorf("eth_sendBundle bundleHash = %s, want %s", response.Result.BundleHash, result.BundleHash)
+			}
+		})
+	}
+
+	if counts := pools.countBundles(); counts[1] != 2 {
+		t.Errorf("countBundles() = %d, want 2", counts[1])
+	}
+}
+
+func TestSendBundleValidatesBlockNumber(t *testing.T) {
+	registry, pools := newHandlerTestRegistry(t)
+	tx, _ := newTestTxHex(t, 1)
+
+	invalidBlock := func(data string) string {
+		return `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Invalid blockNumber","data":"` + data + `"}}`
+	}
+	tests := []struct {
+		name   string
+		params string
+		want   string
+	}{
+		{"missing block number", `[{"txs":["` + tx + `"]}]`, invalidBlock("bundle 0: empty hex string")},
+		{"decimal block number", `[{"txs":["` + tx + `"],"blockNumber":"10"}]`, invalidBlock("bundle 0: hex string without 0x prefix")},
+		{"malformed block number", `[{"txs":["` + tx + `"],"blockNumber":"0xzz"}]`, invalidBlock("bundle 0: invalid hex string")},
+		{"zero block number", `[{"txs":["` + tx + `"],"blockNumber":"0x0"}]`, invalidBlock("bundle 0: block number must be greater than 0")},
+		{"second bundle", `[{"txs":["` + tx + `"],"blockNumber":"0xa"},{"txs":["` + tx + `"],"blockNumber":""}]`, invalidBlock("bundle 1: empty hex string")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := callRPC(t, registry, "alice", "eth_sendBundle", tt.params); got != tt.want {
+				t.Errorf("eth_sendBundle = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if counts := pools.countBundles(); counts[1] != 0 {
+		t.Errorf("countBundles() = %d, want no bundle pooled", counts[1])
+	}
+}
+
+func TestSendBundleValidatesAtomically(t *testing.T) {
+	registry, pools := newHandlerTestRegistry(t)
+	valid, _ := newTestTxHex(t, 1)
+	lowGas := newSignedTestTx(t, &types.LegacyTx{Nonce: 2, Gas: 1000, GasPrice: big.NewInt(1), To: &feeTestRecipient})
+	lowGasTx, _ := decodeTransaction(lowGas)
+
+	tests := []struct {
+		name         string
+		params       string
+		wantPooled   int
+		wantError    string
+		wantRejected []TxRejection
+	}{
+		{
+			"invalid transactions reject the bundle",
+			`[{"txs":["` + valid + `","0xzz","` + lowGas + `"],"blockNumber":"0xa","replacementUuid":"atomic"}]`,
+			0,
+			"bundle contains invalid transactions",
+			[]TxRejection{
+				{Index: 1, Rule: ruleDecode, Reason: rejectReasonInvalidHex},
+				{Index: 2, Hash: lowGasTx.Hash().Hex(), Rule: ruleIntrinsicGas, Reason: rejectReasonIntrinsicGas},
+			},
+		},
+		{
+			"partial bundle pools the valid transactions",
+			`[{"txs":["` + valid + `","` + lowGas + `"],"blockNumber":"0xa","replacementUuid":"partial","allowPartial":true}]`,
+			1,
+			"",
+			[]TxRejection{{Index: 1, Hash: lowGasTx.Hash().Hex(), Rule: ruleIntrinsicGas, Reason: rejectReasonIntrinsicGas}},
+		},
+		{
+			"partial bundle without valid transactions",
+			`[{"txs":["` + lowGas + `"],"blockNumber":"0xa","replacementUuid":"empty","allowPartial":true}]`,
+			0,
+			"no valid transactions in the bundle",
+			[]TxRejection{{Index: 0, Hash: lowGasTx.Hash().Hex(), Rule: ruleIntrinsicGas, Reason: rejectReasonIntrinsicGas}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := sendTestBundles(t, registry, tt.params)
+			if len(response.Result.Bundles) != 1 {
+				t.Fatalf("eth_sendBundle = %+v, want a single bundle result", response)
+			}
+			result := response.Result.Bundles[0]
+			if result.Error != tt.wantError {
+				t.Errorf("bundle error = %q, want %q", result.Error, tt.wantError)
+			}
+			if len(result.RejectedTxs) != len(tt.wantRejected) {
+				t.Fatalf("bundle rejected %d transactions, want %d", len(result.RejectedTxs), len(tt.wantRejected))
+			}
+			for i, want := range tt.wantRejected {
+				got := result.RejectedTxs[i]
+				if got.Index != want.Index || got.Hash != want.Hash || got.Rule != want.Rule || got.Reason != want.Reason || got.Message == "" {
+					t.Errorf("rejected transaction %d = %+v, want %+v", i, got, want)
+				}
+			}
+
+			pooled := 0
+			if bundle, exists := pools.getBundleByUUID(result.ReplacementUUID); exists {
+				pooled = len(bundle.Txs)
+			}
+			if pooled != tt.wantPooled {
+				t.Errorf("pool holds %d transactions of the bundle, want %d", pooled, tt.wantPooled)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// beaconRequestTimeout bounds a single request to the beacon node API
+const beaconRequestTimeout = 5 * time.Second
+
+// Phases of a slot, the block of the slot is due at its end
+const (
+	slotPhaseOpen     = "open"     // Bundles are dispatched by the dispatch triggers
+	slotPhaseDispatch = "dispatch" // Dispatch window before the cutoff, eligible bundles are dispatched right away
+	slotPhaseClosed   = "closed"   // After the cutoff, the bundle set of the upcoming block is final
+)
+
+// slotPhases lists the phases of a slot in their order
+var slotPhases = []string{slotPhaseOpen, slotPhaseDispatch, slotPhaseClosed}
+
+// Late bundle policies, how bundles still targeting the upcoming block after the cutoff are handled
+const (
+	lateBundleRetarget = "retarget" // The bundle targets the block after the upcoming block instead
+	lateBundleDrop     = "drop"     // The bundle expires
+)
+
+// Define Prometheus metrics
+var (
+	beaconSlotGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "beacon_slot",
+			Help: "Current beacon slot of the slot clock",
+		},
+	)
+	slotPhaseGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "slot_phase",
+			Help: "Current phase of the beacon slot, 1 for the active phase",
+		},
+		[]string{"phase"},
+	)
+	lateBundlesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "late_bundles_total",
+			Help: "Total number of bundles that missed the cutoff of their target block by chain ID and outcome",
+		},
+		[]string{"chain_id", "outcome"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(beaconSlotGauge)
+	profSequencerRegisterer.MustRegister(slotPhaseGauge)
+	profSequencerRegisterer.MustRegister(lateBundlesCounter)
+}
+
+func validateLateBundlePolicy(policy string) error {
+	switch policy {
+	case lateBundleRetarget, lateBundleDrop:
+		return nil
+	default:
+		return fmt.Errorf("invalid late bundle policy %q, expected %s", policy, strings.Join([]string{lateBundleRetarget, lateBundleDrop}, ", "))
+	}
+}
+
+// SlotClock represents the beacon slots of a chain. The block of a slot is due at the end of the
+// slot, the bundle mergers need the final bundle set a cutoff before.
+type SlotClock struct {
+	Genesis      time.Time     // Start of slot 0
+	SlotDuration time.Duration // Duration of a slot
+	Cutoff       time.Duration // Time before the end of a slot from which the bundle set of the upcoming block is final
+	Window       time.Duration // Time before the cutoff from which eligible bundles are dispatched right away, 0 disables
+}
+
+// SlotPosition represents a point in time within a slot.
+type SlotPosition struct {
+	Slot        uint64    // Current slot
+	Phase       string    // Current phase of the slot
+	WindowStart time.Time // Start of the dispatch window
+	Cutoff      time.Time // Cutoff of the bundle set of the upcoming block
+	End         time.Time // End of the slot, when the upcoming block is due
+}
+
+func (c *SlotClock) validate() error {
+	if c.Genesis.IsZero() {
+		return fmt.Errorf("genesis time is required")
+	}
+	if c.SlotDuration <= 0 {
+		return fmt.Errorf("slot duration must be positive")
+	}
+	if c.Cutoff < 0 || c.Window < 0 {
+		return fmt.Errorf("cutoff and dispatch window must not be negative")
+	}
+	if c.Cutoff+c.Window >= c.SlotDuration {
+		return fmt.Errorf("cutoff %v and dispatch window %v don't fit into a slot of %v", c.Cutoff, c.Window, c.SlotDuration)
+	}
+	return nil
+}
+
+// slot returns the slot at the given time, slot 0 before genesis
+func (c *SlotClock) slot(t time.Time) uint64 {
+	if t.Before(c.Genesis) {
+		return 0
+	}
+	return uint64(t.Sub(c.Genesis) / c.SlotDuration)
+}
+
+// slotStart returns the start of the slot
+func (c *SlotClock) slotStart(slot uint64) time.Time {
+	return c.Genesis.Add(time.Duration(slot) * c.SlotDuration)
+}
+
+// position returns the slot and its phase at the given time
+func (c *SlotClock) position(t time.Time) SlotPosition {
+	slot := c.slot(t)
+	end := c.slotStart(slot + 1)
+	cutoff := end.Add(-c.Cutoff)
+	windowStart := cutoff.Add(-c.Window)
+
+	phase := slotPhaseOpen
+	switch {
+	case !t.Before(cutoff):
+		phase = slotPhaseClosed
+	case !t.Before(windowStart):
+		phase = slotPhaseDispatch
+	}
+	return SlotPosition{Slot: slot, Phase: phase, WindowStart: windowStart, Cutoff: cutoff, End: end}
+}
+
+// next returns the start of the next phase after the given time
+func (p SlotPosition) next(t time.Time) time.Time {
+	for _, boundary := range []time.Time{p.WindowStart, p.Cutoff} {
+		if boundary.After(t) {
+			return boundary
+		}
+	}
+	return p.End
+}
+
+// fetchBeaconSlotClock reads the genesis time and the seconds per slot from the beacon node API
+func fetchBeaconSlotClock(ctx context.Context, beaconURL string) (time.Time, time.Duration, error) {
+	client := &http.Client{Timeout: beaconRequestTimeout}
+	beaconURL = strings.TrimSuffix(beaconURL, "/")
+
+	var genesis struct {
+		Data struct {
+			GenesisTime string `json:"genesis_time"`
+		} `json:"data"`
+	}
+	if err := getBeaconJSON(ctx, client, beaconURL+"/eth/v1/beacon/genesis", &genesis); err != nil {
+		return time.Time{}, 0, err
+	}
+	genesisTime, err := strconv.ParseInt(genesis.Data.GenesisTime, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid genesis time %q: %v", genesis.Data.GenesisTime, err)
+	}
+
+	var spec struct {
+		Data struct {
+			SecondsPerSlot string `json:"SECONDS_PER_SLOT"`
+		} `json:"data"`
+	}
+	if err := getBeaconJSON(ctx, client, beaconURL+"/eth/v1/config/spec", &spec); err != nil {
+		return time.Time{}, 0, err
+	}
+	secondsPerSlot, err := strconv.ParseUint(spec.Data.SecondsPerSlot, 10, 64)
+	if err != nil || secondsPerSlot == 0 {
+		return time.Time{}, 0, fmt.Errorf("invalid seconds per slot %q", spec.Data.SecondsPerSlot)
+	}
+
+	return time.Unix(genesisTime, 0), time.Duration(secondsPerSlot) * time.Second, nil
+}
+
+// getBeaconJSON performs a GET request to the beacon node API and decodes the JSON response into result
+func getBeaconJSON(ctx context.Context, client *http.Client, url string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected HTTP status %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("GET %s: invalid response: %v", url, err)
+	}
+	return nil
+}
+
+// startSlotClockJob reports the current slot and phase at every phase change
+func startSlotClockJob(clock *SlotClock) {
+	go func() {
+		for {
+			now := time.Now()
+			pos := clock.position(now)
+			beaconSlotGauge.Set(float64(pos.Slot))
+			for _, phase := range slotPhases {
+				active := 0.0
+				if phase == pos.Phase {
+					active = 1
+				}
+				slotPhaseGauge.WithLabelValues(phase).Set(active)
+			}
+			log.Debug().Uint64("slot", pos.Slot).Str("phase", pos.Phase).Msg("Slot phase changed")
+
+			time.Sleep(pos.next(now).Sub(now))
+		}
+	}()
+}
+
+// cutOffLateBundles applies the late bundle policy to the pending bundles of the chain whose last
+// target block is the given block, once the bundle set of the block is final. Leased bundles are
+// left to the answer of the bundle merger.
+func (p *TxBundlePool) cutOffLateBundles(chainID uint64, block uint64, policy string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var late []*TxPoolBundle
+	for bundle := range p.blockMap[blockKey{chainID: chainID, block: block}] {
+		if bundle.leasedUntil.IsZero() {
+			late = append(late, bundle)
+		}
+	}
+	// Map iteration is random, handle the bundles in insertion order
+	slices.SortFunc(late, func(b1, b2 *TxPoolBundle) int { return cmp.Compare(b1.seq, b2.seq) })
+
+	for _, bundle := range late {
+		reason := fmt.Sprintf("missed the cutoff of block %d", block)
+		if policy == lateBundleRetarget {
+			refused := p.retargetLocked(bundle, block+1)
+			if refused == "" {
+				p.statusTracker.record(bundle.ReplacementUUID, BundleStateRetargeted, fmt.Sprintf("%s, retargeted to block %d", reason, block+1))
+				lateBundlesCounter.WithLabelValues(chainLabel(chainID), "retargeted").Inc()
+				log.Info().Str("uuid", bundle.ReplacementUUID).Uint64("block", block+1).Msg("Late bundle retargeted to the next block")
+				continue
+			}
+			reason += ", " + refused
+		}
+
+		p.markLocked(bundle, poolOpExpire)
+		p.statusTracker.record(bundle.ReplacementUUID, BundleStateExpired, reason)
+		lateBundlesCounter.WithLabelValues(chainLabel(chainID), "dropped").Inc()
+		log.Info().Str("uuid", bundle.ReplacementUUID).Str("reason", reason).Msg("Late bundle dropped")
+	}
+	return len(late)
+}
+
+// retargetLocked moves a pending bundle to the given block, keeping its UUID, and returns why it
+// can't be moved, or an empty string if it was. A bundle is moved at most once, so it outlives its
+// last target block by a single block, and keeps its MaxTimestamp. The conflict policy is applied
+// to the pending bundles of the block as if the bundle was added for it.
+func (p *TxBundlePool) retargetLocked(bundle *TxPoolBundle, block uint64) string {
+	if bundle.retargeted {
+		return "already retargeted once"
+	}
+	retargeted := *bundle
+	retargeted.BlockNumber = hexutil.EncodeUint64(block)
+	if retargeted.MaxBlockNumber != "" {
+		retargeted.MaxBlockNumber = retargeted.BlockNumber
+	}
+	retargeted.TargetBlock, retargeted.LastBlock = block, block
+	retargeted.BundleHash = computeBundleHash(&retargeted)
+	if duplicate, exists := p.hashMap[retargeted.hashKey()]; exists && duplicate != bundle && !duplicate.MarkedForDeletion {
+		return "an identical bundle targets the next block"
+	}
+
+	conflicting, conflicts := p.conflictsLocked(&retargeted, bundle)
+	retargeted.Conflicts = conflicts
+	displaced, err := p.resolveConflictsLocked(&retargeted, conflicting)
+	if err != nil {
+		return err.Error()
+	}
+
+	// Re-index the bundle under its new target block and hash
+	p.dequeueLocked(bundle)
+	if p.hashMap[bundle.hashKey()] == bundle {
+		delete(p.hashMap, bundle.hashKey())
+	}
+	bundle.BlockNumber = retargeted.BlockNumber
+	bundle.MaxBlockNumber = retargeted.MaxBlockNumber
+	bundle.BundleHash = retargeted.BundleHash
+	bundle.TargetBlock, bundle.LastBlock = block, block
+	bundle.acceptedBy = nil // The bundle mergers accepted the bundle for the previous block
+	bundle.retargeted = true
+	p.hashMap[bundle.hashKey()] = bundle
+
+	for _, pending := range displaced {
+		p.displaceLocked(pending, bundle)
+	}
+	p.enqueueLocked(bundle)
+
+	if err := p.persistLocked(poolOpReplace, bundle); err != nil {
+		log.Error().Err(err).Str("uuid", bundle.ReplacementUUID).Str("op", poolOpReplace).Msg("Failed to persist pool mutation")
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestSlotClockPosition(t *testing.T) {
+	genesis := time.Unix(1606824023, 0)
+	clock := &SlotClock{Genesis: genesis, SlotDuration: 12 * time.Second, Cutoff: 4 * time.Second, Window: 2 * time.Second}
+	if err := clock.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		at        time.Time
+		wantSlot  uint64
+		wantPhase string
+		wantNext  time.Time
+	}{
+		{"before genesis", genesis.Add(-time.Minute), 0, slotPhaseOpen, genesis.Add(6 * time.Second)},
+		{"slot start", genesis.Add(24 * time.Second), 2, slotPhaseOpen, genesis.Add(30 * time.Second)},
+		{"dispatch window", genesis.Add(30 * time.Second), 2, slotPhaseDispatch, genesis.Add(32 * time.Second)},
+		{"after the cutoff", genesis.Add(35 * time.Second), 2, slotPhaseClosed, genesis.Add(36 * time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pos := clock.position(tt.at)
+			if pos.Slot != tt.wantSlot || pos.Phase != tt.wantPhase || !pos.next(tt.at).Equal(tt.wantNext) {
+				t.Errorf("position() = slot %d, phase %s, next %v, want slot %d, phase %s, next %v", pos.Slot, pos.Phase, pos.next(tt.at), tt.wantSlot, tt.wantPhase, tt.wantNext)
+			}
+		})
+	}
+
+	clock.Window = 8 * time.Second
+	if err := clock.validate(); err == nil {
+		t.Errorf("validate() accepted a cutoff and dispatch window longer than the slot")
+	}
+}
+
+func TestFetchBeaconSlotClock(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/eth/v1/beacon/genesis":
+			w.Write([]byte(`{"data":{"genesis_time":"1695902400","genesis_validators_root":"0x9143aa7c615a7f7115e2b6aac319c03529df8242ae705fba9df39b79c59fa8b1","genesis_fork_version":"0x01017000"}}`))
+		case "/eth/v1/config/spec":
+			w.Write([]byte(`{"data":{"CONFIG_NAME":"holesky","SECONDS_PER_SLOT":"12","SLOTS_PER_EPOCH":"32"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	genesis, slotDuration, err := fetchBeaconSlotClock(context.Background(), server.URL+"/")
+	if err != nil {
+		t.Fatalf("fetchBeaconSlotClock() error = %v", err)
+	}
+	if !genesis.Equal(time.Unix(1695902400, 0)) || slotDuration != 12*time.Second {
+		t.Errorf("fetchBeaconSlotClock() = %v, %v, want the genesis and slot duration of the beacon node", genesis, slotDuration)
+	}
+
+	if _, _, err := fetchBeaconSlotClock(context.Background(), server.URL+"/missing"); err == nil {
+		t.Errorf("fetchBeaconSlotClock() accepted a missing beacon node API")
+	}
+}
+
+func TestCutOffLateBundlesRetargets(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+	ranged := newTestBundle(2, "ranged", 9)
+	ranged.MaxBlockNumber = "0xa"
+	bundles := []*TxPoolBundle{newTestBundle(1, "late", 10), ranged, newTestBundle(3, "collides", 10), newTestBundle(3, "identical", 11), newTestBundle(4, "leased", 10)}
+	for _, bundle := range bundles {
+		mustAddBundle(t, pool, bundle, false)
+	}
+	late := mustGetBundle(t, pool, "late")
+	oldHash := late.BundleHash
+	mustGetBundle(t, pool, "leased").leasedUntil = time.Now().Add(time.Minute)
+
+	// Leased bundles are left to the answer of the bundle merger
+	if cut := pool.cutOffLateBundles(1, 10, lateBundleRetarget); cut != 3 {
+		t.Fatalf("cutOffLateBundles() = %d, want 3", cut)
+	}
+	assertPending(t, pool, map[string]bool{"late": true, "ranged": true, "collides": false, "identical": true, "leased": true})
+
+	for _, uuid := range []string{"late", "ranged"} {
+		bundle := mustGetBundle(t, pool, uuid)
+		if first, last := bundle.blockRange(); first != 11 || last != 11 || bundle.TargetBlock != 11 {
+			t.Errorf("bundle %s targets blocks %d to %d, want 11", uuid, first, last)
+		}
+		if status, _ := pool.statusTracker.get(uuid); status.State != BundleStateRetargeted {
+			t.Errorf("bundle %s has state %s, want %s", uuid, status.State, BundleStateRetargeted)
+		}
+	}
+	if _, exists := pool.getBundleByHash(oldHash, late.Username); exists {
+		t.Errorf("retargeted bundle is still found by its previous hash")
+	}
+	if bundle, exists := pool.getBundleByHash(late.BundleHash, late.Username); !exists || bundle != late {
+		t.Errorf("retargeted bundle isn't found by its new hash")
+	}
+
+	// A bundle identical to a bundle of the next block can't be retargeted
+	if status, _ := pool.statusTracker.get("collides"); status.State != BundleStateExpired {
+		t.Errorf("bundle has state %s, want %s", status.State, BundleStateExpired)
+	}
+	if cut := pool.cutOffLateBundles(1, 10, lateBundleRetarget); cut != 0 {
+		t.Errorf("cutOffLateBundles() = %d after the cutoff, want 0", cut)
+	}
+
+	// A bundle is retargeted once, it's dropped when it misses the cutoff of the next block as well
+	mustGetBundle(t, pool, "leased").leasedUntil = time.Time{}
+	if cut := pool.cutOffLateBundles(1, 11, lateBundleRetarget); cut != 3 {
+		t.Fatalf("cutOffLateBundles() = %d, want 3", cut)
+	}
+	assertPending(t, pool, map[string]bool{"late": false, "ranged": false, "identical": true, "leased": true})
+	if status, _ := pool.statusTracker.get("late"); status.State != BundleStateExpired || status.Status != "missed the cutoff of block 11, already retargeted once" {
+		t.Errorf("bundle has state %s and status %q, want expired after its second cutoff", status.State, status.Status)
+	}
+}
+
+func TestCutOffLateBundlesAppliesTheConflictPolicy(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+	cheap := newTestBundle(1, "cheap", 10)
+	pricey := newTestBundle(50, "pricey", 10)
+	higher := &TxPoolBundle{Txs: []*types.Transaction{cheap.Txs[0], newTestBundle(90, "", 0).Txs[0]}, BlockNumber: "0xb", ReplacementUUID: "higher", ChainID: 1}
+	lower := &TxPoolBundle{Txs: []*types.Transaction{pricey.Txs[0], newTestBundle(10, "", 0).Txs[0]}, BlockNumber: "0xb", ReplacementUUID: "lower", ChainID: 1}
+	for _, bundle := range []*TxPoolBundle{cheap, pricey, higher, lower} {
+		mustAddBundle(t, pool, bundle, false)
+	}
+
+	// Bundles sharing transactions with bundles of the next block are kept by their fee scores
+	if cut := pool.cutOffLateBundles(1, 10, lateBundleRetarget); cut != 2 {
+		t.Fatalf("cutOffLateBundles() = %d, want 2", cut)
+	}
+	assertPending(t, pool, map[string]bool{"cheap": false, "pricey": true, "higher": true, "lower": false})
+	for uuid, want := range map[string]BundleState{"cheap": BundleStateExpired, "pricey": BundleStateRetargeted, "lower": BundleStateDisplaced} {
+		if status, _ := pool.statusTracker.get(uuid); status.State != want {
+			t.Errorf("bundle %s has state %s, want %s", uuid, status.State, want)
+		}
+	}
+}
+
+func TestCutOffLateBundlesDrops(t *testing.T) {
+	pool := newTestPool(orderingPolicies["block_number"])
+	mustAddBundle(t, pool, newTestBundle(1, "late", 10), false)
+	mustAddBundle(t, pool, newTestBundle(2, "next", 11), false)
+
+	if cut := pool.cutOffLateBundles(1, 10, lateBundleDrop); cut != 1 {
+		t.Fatalf("cutOffLateBundles() = %d, want 1", cut)
+	}
+	assertPending(t, pool, map[string]bool{"late": false, "next": true})
+
+	if status, _ := pool.statusTracker.get("late"); status.State != BundleStateExpired || status.Status != "missed the cutoff of block 10" {
+		t.Errorf("bundle has state %s and status %q, want expired after the cutoff", status.State, status.Status)
+	}
+}
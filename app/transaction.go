@@ -2,19 +2,89 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math/big"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/rs/zerolog/log"
 )
 
-func isValidTransaction(tx *types.Transaction) bool {
-	// Check if the gas limit is reasonable (min 21000)
-	if tx.Gas() < 21000 {
-		log.Error().Uint64("gas", tx.Gas()).Msg("Transaction has insufficient gas")
-		return false
+// Reason codes for rejected transactions
+const (
+	rejectReasonInvalidHex         = "invalid_hex"         // Transaction is not valid hex
+	rejectReasonInvalidEncoding    = "invalid_encoding"    // Transaction could not be unmarshaled
+	rejectReasonInvalidTransaction = "invalid_transaction" // Transaction failed validation
+)
+
+// TxValidationError describes why a transaction was rejected.
+type TxValidationError struct {
+	Rule    string // Validation rule that rejected the transaction
+	Reason  string // Machine-readable reason code
+	Message string // Human-readable description
+}
+
+func (e *TxValidationError) Error() string {
+	return e.Message
+}
+
+// TxRejection reports a rejected transaction of a bundle to the caller.
+type TxRejection struct {
+	Index   int    `json:"index"`          // Index of the transaction in the bundle
+	Hash    string `json:"hash,omitempty"` // Hash of the transaction, if it could be decoded
+	Rule    string `json:"rule,omitempty"` // Validation rule that rejected the transaction
+	Reason  string `json:"reason"`         // Machine-readable reason code
+	Message string `json:"message"`        // Human-readable description
+}
+
+// decodeTransaction decodes a hex-encoded, signed transaction
+func decodeTransaction(txHex string) (*types.Transaction, error) {
+	txData, err := decodeHex(txHex)
+	if err != nil {
+		validationRejectionsCounter.WithLabelValues(ruleDecode).Inc()
+		return nil, &TxValidationError{Rule: ruleDecode, Reason: rejectReasonInvalidHex, Message: fmt.Sprintf("failed to decode transaction hex: %v", err)}
+	}
+
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(txData); err != nil {
+		validationRejectionsCounter.WithLabelValues(ruleDecode).Inc()
+		return nil, &TxValidationError{Rule: ruleDecode, Reason: rejectReasonInvalidEncoding, Message: fmt.Sprintf("failed to unmarshal transaction: %v", err)}
 	}
 
-	// ToDo: Add validation logic here
+	return tx, nil
+}
+
+// newTxSigner returns the Prague signer, which accepts every transaction type for the given chain
+// ID: legacy (with and without replay protection), access list, dynamic fee, blob and set-code
+// (EIP-7702) transactions.
+func newTxSigner(chainID *big.Int) types.Signer {
+	return types.NewPragueSigner(chainID)
+}
+
+// recoverSender recovers the sender of a transaction from its signature
+func recoverSender(signer types.Signer, tx *types.Transaction) (common.Address, error) {
+	from, err := types.Sender(signer, tx)
+	if err != nil {
+		if errors.Is(err, types.ErrInvalidChainId) {
+			return common.Address{}, &TxValidationError{Rule: ruleSender, Reason: rejectReasonWrongChainID, Message: fmt.Sprintf("failed to recover sender: %v", err)}
+		}
+		return common.Address{}, &TxValidationError{Rule: ruleSender, Reason: rejectReasonInvalidSignature, Message: fmt.Sprintf("failed to recover sender: %v", err)}
+	}
+	return from, nil
+}
+
+// newTxRejection creates the rejection report of the transaction at the given index
+func newTxRejection(index int, tx *types.Transaction, err error) TxRejection {
+	rejection := TxRejection{Index: index, Reason: rejectReasonInvalidTransaction, Message: err.Error()}
+
+	var validationErr *TxValidationError
+	if errors.As(err, &validationErr) {
+		rejection.Rule = validationErr.Rule
+		rejection.Reason = validationErr.Reason
+	}
+	if tx != nil {
+		rejection.Hash = tx.Hash().Hex()
+	}
 
-	return tx != nil && tx.Hash() != (common.Hash{})
+	return rejection
 }
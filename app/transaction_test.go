@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+)
+
+// newSetCodeTx returns a set-code transaction of chain 1 delegating the account of key to feeTestRecipient
+func newSetCodeTx(t *testing.T, gas uint64) *types.SetCodeTx {
+	t.Helper()
+
+	key, _ := crypto.GenerateKey()
+	auth, err := types.SignSetCode(key, types.SetCodeAuthorization{ChainID: *uint256.NewInt(1), Address: feeTestRecipient})
+	if err != nil {
+		t.Fatalf("SignSetCode() error = %v", err)
+	}
+	return &types.SetCodeTx{
+		ChainID:   uint256.NewInt(1),
+		Gas:       gas,
+		GasFeeCap: uint256.NewInt(2),
+		GasTipCap: uint256.NewInt(1),
+		To:        feeTestRecipient,
+		Value:     uint256.NewInt(0),
+		AuthList:  []types.SetCodeAuthorization{auth},
+	}
+}
+
+func TestDecodeTransactionAndRecoverSender(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	signer := newTxSigner(big.NewInt(1))
+
+	unprotected, err := types.SignNewTx(key, types.HomesteadSigner{}, &types.LegacyTx{Gas: 21000, GasPrice: big.NewInt(1), To: &feeTestRecipient})
+	if err != nil {
+		t.Fatalf("SignNewTx() error = %v", err)
+	}
+	blobTx := &types.BlobTx{
+		ChainID:    uint256.NewInt(1),
+		Gas:        21000,
+		GasFeeCap:  uint256.NewInt(2),
+		GasTipCap:  uint256.NewInt(1),
+		To:         feeTestRecipient,
+		Value:      uint256.NewInt(0),
+		BlobFeeCap: uint256.NewInt(1),
+		BlobHashes: []common.Hash{{0x01}},
+	}
+
+	tests := []struct {
+		name string
+		tx   *types.Transaction
+	}{
+		{"unprotected legacy", unprotected},
+		{"legacy", signTestTx(t, key, 1, &types.LegacyTx{Gas: 21000, GasPrice: big.NewInt(1), To: &feeTestRecipient})},
+		{"access list", signTestTx(t, key, 1, &types.AccessListTx{ChainID: big.NewInt(1), Gas: 21000, GasPrice: big.NewInt(1), To: &feeTestRecipient})},
+		{"dynamic fee", signTestTx(t, key, 1, &types.DynamicFeeTx{ChainID: big.NewInt(1), Gas: 21000, GasFeeCap: big.NewInt(2), GasTipCap: big.NewInt(1), To: &feeTestRecipient})},
+		{"blob", signTestTx(t, key, 1, blobTx)},
+		{"set-code", signTestTx(t, key, 1, newSetCodeTx(t, 50000))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.tx.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() error = %v", err)
+			}
+			tx, err := decodeTransaction(hexutil.Encode(encoded))
+			if err != nil {
+				t.Fatalf("decodeTransaction() error = %v", err)
+			}
+			if from, err := recoverSender(signer, tx); err != nil || from != sender {
+				t.Errorf("recoverSender() = %s, %v, want %s", from.Hex(), err, sender.Hex())
+			}
+		})
+	}
+
+	// Transactions of other chains are reported as such
+	var validationErr *TxValidationError
+	if _, err := recoverSender(newTxSigner(big.NewInt(2)), tests[1].tx); !errors.As(err, &validationErr) || validationErr.Reason != rejectReasonWrongChainID {
+		t.Errorf("recoverSender() error = %v, want %s", err, rejectReasonWrongChainID)
+	}
+}
+
+func TestDecodeTransactionRejections(t *testing.T) {
+	tests := []struct {
+		name       string
+		txHex      string
+		wantReason string
+	}{
+		{"invalid hex", "0xzz", rejectReasonInvalidHex},
+		{"empty", "0x", rejectReasonInvalidEncoding},
+		{"unknown type", "0x7f01", rejectReasonInvalidEncoding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeTransaction(tt.txHex)
+			var validationErr *TxValidationError
+			if !errors.As(err, &validationErr) || validationErr.Rule != ruleDecode || validationErr.Reason != tt.wantReason {
+				t.Errorf("decodeTransaction() error = %v, want %s", err, tt.wantReason)
+			}
+			if rejection := newTxRejection(3, nil, err); rejection.Index != 3 || rejection.Rule != ruleDecode || rejection.Reason != tt.wantReason || rejection.Hash != "" {
+				t.Errorf("newTxRejection() = %+v, want the decode rejection at index 3", rejection)
+			}
+		})
+	}
+}
+
+func TestIntrinsicGasOfSetCodeTransactions(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	pipeline, err := newValidationPipeline(defaultValidationConfig, ChainConfig{ChainIDs: []uint64{1}})
+	if err != nil {
+		t.Fatalf("newValidationPipeline() error = %v", err)
+	}
+
+	// Every authorization costs gas on top of the base cost of the transaction
+	if _, err := pipeline.Validate(signTestTx(t, key, 1, newSetCodeTx(t, 21000))); err == nil {
+		t.Errorf("Validate() accepted a set-code transaction without gas for its authorization")
+	}
+	if _, err := pipeline.Validate(signTestTx(t, key, 1, newSetCodeTx(t, 50000))); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
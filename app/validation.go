@@ -0,0 +1,293 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Names of the validation rules
+const (
+	ruleDecode       = "decode"        // Decoding of the raw transaction, always applied first
+	ruleChainID      = "chain_id"      // Chain ID of the transaction, always applied after decoding
+	ruleSender       = "sender"        // Signature and sender recovery, always applied after the chain ID
+	ruleIntrinsicGas = "intrinsic_gas" // Gas limit covers the intrinsic gas
+	ruleSize         = "size"          // Size limits of the transaction
+	ruleFeeCap       = "fee_cap"       // Fee caps and tips
+	ruleDenylist     = "denylist"      // Denylisted sender and recipient addresses
+)
+
+// Reason codes reported by the validation rules
+const (
+	rejectReasonInvalidSignature  = "invalid_signature"
+	rejectReasonWrongChainID      = "wrong_chain_id"
+	rejectReasonIntrinsicGas      = "intrinsic_gas_too_low"
+	rejectReasonOversized         = "oversized"
+	rejectReasonFeeCapExceeded    = "fee_cap_exceeded"
+	rejectReasonTipTooLow         = "tip_too_low"
+	rejectReasonTxFeeExceeded     = "tx_fee_exceeded"
+	rejectReasonDenylistedAddress = "denylisted_address"
+)
+
+// defaultMaxTxSize is the max size of a transaction, matching the geth txpool limit
+const defaultMaxTxSize = 4 * 32 * 1024
+
+// Define Prometheus metrics
+var (
+	validationRejectionsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "validation_rejections_total",
+			Help: "Total number of transactions rejected by validation rule",
+		},
+		[]string{"rule"},
+	)
+)
+
+func init() {
+	// Register metrics
+	profSequencerRegisterer := prometheus.WrapRegistererWithPrefix("prof_sequencer_", prometheus.DefaultRegisterer)
+	profSequencerRegisterer.MustRegister(validationRejectionsCounter)
+}
+
+// Validator validates a decoded transaction and returns its recovered sender.
+type Validator interface {
+	Validate(tx *types.Transaction) (common.Address, error)
+}
+
+// ValidationRule is a single named rule of the validation pipeline. Rejections are
+// reported as *TxValidationError carrying the reason code of the rule.
+type ValidationRule interface {
+	Name() string
+	Validate(tx *types.Transaction, from common.Address) error
+}
+
+// ValidationPipeline checks the chain ID of a transaction, recovers its sender and applies an
+// ordered chain of rules, stopping at the first rejection.
+type ValidationPipeline struct {
+	chains  ChainConfig             // Chains served by the sequencer
+	signers map[uint64]types.Signer // Signer by chain ID
+	rules   []ValidationRule        // Rules in the order they are applied
+}
+
+// Validate checks the chain ID, recovers the sender and applies the rules of the pipeline in order
+func (v *ValidationPipeline) Validate(tx *types.Transaction) (common.Address, error) {
+	chainID, err := v.chains.txChainID(tx)
+	if err != nil {
+		validationRejectionsCounter.WithLabelValues(ruleChainID).Inc()
+		return common.Address{}, err
+	}
+
+	from, err := recoverSender(v.signers[chainID], tx)
+	if err != nil {
+		validationRejectionsCounter.WithLabelValues(ruleSender).Inc()
+		return common.Address{}, err
+	}
+
+	for _, rule := range v.rules {
+		if err := rule.Validate(tx, from); err != nil {
+			validationRejectionsCounter.WithLabelValues(rule.Name()).Inc()
+
+			var validationErr *TxValidationError
+			if !errors.As(err, &validationErr) {
+				return common.Address{}, &TxValidationError{Rule: rule.Name(), Reason: rejectReasonInvalidTransaction, Message: err.Error()}
+			}
+			return common.Address{}, &TxValidationError{Rule: rule.Name(), Reason: validationErr.Reason, Message: err.Error()}
+		}
+	}
+	return from, nil
+}
+
+// ValidationConfig represents the validation pipeline configuration file.
+type ValidationConfig struct {
+	Rules []ValidationRuleConfig `json:"rules"` // Rules in the order they are applied
+}
+
+// ValidationRuleConfig represents the configuration of a single rule.
+type ValidationRuleConfig struct {
+	Name    string          `json:"name"`              // Name of the rule
+	Options json.RawMessage `json:"options,omitempty"` // Rule specific options
+}
+
+// validationRuleFactories creates the rules by name from their options
+var validationRuleFactories = map[string]func(options json.RawMessage) (ValidationRule, error){
+	ruleIntrinsicGas: func(_ json.RawMessage) (ValidationRule, error) {
+		return &intrinsicGasRule{}, nil
+	},
+	ruleSize: func(options json.RawMessage) (ValidationRule, error) {
+		rule := &sizeRule{MaxTxSize: defaultMaxTxSize}
+		if err := decodeRuleOptions(options, rule); err != nil {
+			return nil, err
+		}
+		return rule, nil
+	},
+	ruleFeeCap: func(options json.RawMessage) (ValidationRule, error) {
+		rule := &feeCapRule{}
+		if err := decodeRuleOptions(options, rule); err != nil {
+			return nil, err
+		}
+		return rule, nil
+	},
+	ruleDenylist: func(options json.RawMessage) (ValidationRule, error) {
+		rule := &denylistRule{}
+		if err := decodeRuleOptions(options, rule); err != nil {
+			return nil, err
+		}
+		rule.denied = make(map[common.Address]struct{}, len(rule.Addresses))
+		for _, address := range rule.Addresses {
+			rule.denied[address] = struct{}{}
+		}
+		return rule, nil
+	},
+}
+
+// defaultValidationConfig is used if no configuration file is given
+var defaultValidationConfig = ValidationConfig{
+	Rules: []ValidationRuleConfig{
+		{Name: ruleIntrinsicGas},
+		{Name: ruleSize},
+	},
+}
+
+func decodeRuleOptions(options json.RawMessage, target interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	return json.Unmarshal(options, target)
+}
+
+// loadValidationPipeline builds the validation pipeline for the given chains from a JSON
+// configuration file, or from the default configuration if no file is given
+func loadValidationPipeline(configPath string, chains ChainConfig) (*ValidationPipeline, error) {
+	config := defaultValidationConfig
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read validation config: %v", err)
+		}
+		config = ValidationConfig{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse validation config: %v", err)
+		}
+	}
+
+	return newValidationPipeline(config, chains)
+}
+
+func newValidationPipeline(config ValidationConfig, chains ChainConfig) (*ValidationPipeline, error) {
+	pipeline := &ValidationPipeline{chains: chains, signers: make(map[uint64]types.Signer)}
+	for _, chainID := range chains.ChainIDs {
+		pipeline.signers[chainID] = newTxSigner(new(big.Int).SetUint64(chainID))
+	}
+
+	for i, ruleConfig := range config.Rules {
+		factory, exists := validationRuleFactories[ruleConfig.Name]
+		if !exists {
+			return nil, fmt.Errorf("rules[%d]: unknown validation rule %q", i, ruleConfig.Name)
+		}
+		rule, err := factory(ruleConfig.Options)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: invalid options for rule %q: %v", i, ruleConfig.Name, err)
+		}
+		pipeline.rules = append(pipeline.rules, rule)
+
+		// Make sure the rejection counter is exported for every configured rule
+		validationRejectionsCounter.WithLabelValues(rule.Name())
+	}
+	validationRejectionsCounter.WithLabelValues(ruleDecode)
+	validationRejectionsCounter.WithLabelValues(ruleChainID)
+	validationRejectionsCounter.WithLabelValues(ruleSender)
+
+	for _, rule := range pipeline.rules {
+		log.Info().Str("rule", rule.Name()).Msg("Validation rule enabled")
+	}
+
+	return pipeline, nil
+}
+
+// intrinsicGasRule rejects transactions whose gas limit doesn't cover the intrinsic gas
+type intrinsicGasRule struct{}
+
+func (r *intrinsicGasRule) Name() string { return ruleIntrinsicGas }
+
+func (r *intrinsicGasRule) Validate(tx *types.Transaction, _ common.Address) error {
+	gas, err := core.IntrinsicGas(tx.Data(), tx.AccessList(), tx.SetCodeAuthorizations(), tx.To() == nil, true, true, true)
+	if err != nil {
+		return &TxValidationError{Reason: rejectReasonIntrinsicGas, Message: err.Error()}
+	}
+	if tx.Gas() < gas {
+		return &TxValidationError{Reason: rejectReasonIntrinsicGas, Message: fmt.Sprintf("gas limit %d below intrinsic gas %d", tx.Gas(), gas)}
+	}
+	return nil
+}
+
+// sizeRule rejects oversized transactions
+type sizeRule struct {
+	MaxTxSize   uint64 `json:"maxTxSize"`   // Max encoded size of the transaction in bytes
+	MaxDataSize uint64 `json:"maxDataSize"` // Optional max size of the calldata in bytes
+}
+
+func (r *sizeRule) Name() string { return ruleSize }
+
+func (r *sizeRule) Validate(tx *types.Transaction, _ common.Address) error {
+	if r.MaxTxSize > 0 && tx.Size() > r.MaxTxSize {
+		return &TxValidationError{Reason: rejectReasonOversized, Message: fmt.Sprintf("transaction size %d exceeds %d bytes", tx.Size(), r.MaxTxSize)}
+	}
+	if r.MaxDataSize > 0 && uint64(len(tx.Data())) > r.MaxDataSize {
+		return &TxValidationError{Reason: rejectReasonOversized, Message: fmt.Sprintf("calldata size %d exceeds %d bytes", len(tx.Data()), r.MaxDataSize)}
+	}
+	return nil
+}
+
+// feeCapRule rejects transactions with unreasonable fees
+type feeCapRule struct {
+	MaxFeePerGas *big.Int `json:"maxFeePerGas"` // Optional max fee cap per gas in wei
+	MinTipCap    *big.Int `json:"minTipCap"`    // Optional min priority fee per gas in wei
+	MaxTxFee     *big.Int `json:"maxTxFee"`     // Optional max total fee (gas limit * fee cap) in wei
+}
+
+func (r *feeCapRule) Name() string { return ruleFeeCap }
+
+func (r *feeCapRule) Validate(tx *types.Transaction, _ common.Address) error {
+	if r.MaxFeePerGas != nil && tx.GasFeeCapIntCmp(r.MaxFeePerGas) > 0 {
+		return &TxValidationError{Reason: rejectReasonFeeCapExceeded, Message: fmt.Sprintf("fee cap %s exceeds %s", tx.GasFeeCap(), r.MaxFeePerGas)}
+	}
+	if r.MinTipCap != nil && tx.GasTipCapIntCmp(r.MinTipCap) < 0 {
+		return &TxValidationError{Reason: rejectReasonTipTooLow, Message: fmt.Sprintf("tip cap %s below %s", tx.GasTipCap(), r.MinTipCap)}
+	}
+	if r.MaxTxFee != nil {
+		txFee := new(big.Int).Mul(tx.GasFeeCap(), new(big.Int).SetUint64(tx.Gas()))
+		if txFee.Cmp(r.MaxTxFee) > 0 {
+			return &TxValidationError{Reason: rejectReasonTxFeeExceeded, Message: fmt.Sprintf("transaction fee %s exceeds %s", txFee, r.MaxTxFee)}
+		}
+	}
+	return nil
+}
+
+// denylistRule rejects transactions from or to denylisted addresses
+type denylistRule struct {
+	Addresses []common.Address `json:"addresses"` // Denylisted addresses
+	denied    map[common.Address]struct{}
+}
+
+func (r *denylistRule) Name() string { return ruleDenylist }
+
+func (r *denylistRule) Validate(tx *types.Transaction, from common.Address) error {
+	if to := tx.To(); to != nil {
+		if _, denied := r.denied[*to]; denied {
+			return &TxValidationError{Reason: rejectReasonDenylistedAddress, Message: fmt.Sprintf("recipient %s is denylisted", to.Hex())}
+		}
+	}
+	if _, denied := r.denied[from]; denied {
+		return &TxValidationError{Reason: rejectReasonDenylistedAddress, Message: fmt.Sprintf("sender %s is denylisted", from.Hex())}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// funcRule is a validation rule backed by a function
+type funcRule struct {
+	name     string
+	validate func(tx *types.Transaction) error
+}
+
+func (r *funcRule) Name() string { return r.name }
+
+func (r *funcRule) Validate(tx *types.Transaction, _ common.Address) error { return r.validate(tx) }
+
+// signTestTx signs the transaction with the key for the given chain
+func signTestTx(t *testing.T, key *ecdsa.PrivateKey, chainID int64, tx types.TxData) *types.Transaction {
+	t.Helper()
+
+	signed, err := types.SignNewTx(key, types.LatestSignerForChainID(big.NewInt(chainID)), tx)
+	if err != nil {
+		t.Fatalf("SignNewTx() error = %v", err)
+	}
+	return signed
+}
+
+func TestValidationPipeline(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	denied := common.HexToAddress("0xbad")
+
+	config := ValidationConfig{Rules: []ValidationRuleConfig{
+		{Name: ruleIntrinsicGas},
+		{Name: ruleSize, Options: json.RawMessage(`{"maxTxSize":1024,"maxDataSize":64}`)},
+		{Name: ruleFeeCap, Options: json.RawMessage(`{"maxFeePerGas":1000,"minTipCap":2,"maxTxFee":100000000}`)},
+		{Name: ruleDenylist, Options: json.RawMessage(`{"addresses":["` + denied.Hex() + `"]}`)},
+	}}
+	pipeline, err := newValidationPipeline(config, ChainConfig{ChainIDs: []uint64{1}})
+	if err != nil {
+		t.Fatalf("newValidationPipeline() error = %v", err)
+	}
+
+	dynamicFeeTx := func(gas uint64, feeCap, tipCap int64, to common.Address, data []byte) *types.DynamicFeeTx {
+		return &types.DynamicFeeTx{ChainID: big.NewInt(1), Gas: gas, GasFeeCap: big.NewInt(feeCap), GasTipCap: big.NewInt(tipCap), To: &to, Data: data}
+	}
+	unprotected, err := types.SignNewTx(key, types.HomesteadSigner{}, &types.LegacyTx{Gas: 21000, GasPrice: big.NewInt(10), To: &feeTestRecipient})
+	if err != nil {
+		t.Fatalf("SignNewTx() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		tx         *types.Transaction
+		wantRule   string
+		wantReason string
+	}{
+		{"valid", signTestTx(t, key, 1, dynamicFeeTx(21000, 10, 2, feeTestRecipient, nil)), "", ""},
+		{"other chain", signTestTx(t, key, 2, &types.DynamicFeeTx{ChainID: big.NewInt(2), Gas: 21000, GasFeeCap: big.NewInt(10), GasTipCap: big.NewInt(2), To: &feeTestRecipient}), ruleChainID, rejectReasonWrongChainID},
+		{"unprotected", unprotected, ruleChainID, rejectReasonWrongChainID},
+		{"intrinsic gas", signTestTx(t, key, 1, dynamicFeeTx(20000, 10, 2, feeTestRecipient, nil)), ruleIntrinsicGas, rejectReasonIntrinsicGas},
+		{"calldata too large", signTestTx(t, key, 1, dynamicFeeTx(30000, 10, 2, feeTestRecipient, make([]byte, 65))), ruleSize, rejectReasonOversized},
+		{"fee cap", signTestTx(t, key, 1, dynamicFeeTx(21000, 1001, 2, feeTestRecipient, nil)), ruleFeeCap, rejectReasonFeeCapExceeded},
+		{"tip", signTestTx(t, key, 1, dynamicFeeTx(21000, 10, 1, feeTestRecipient, nil)), ruleFeeCap, rejectReasonTipTooLow},
+		{"transaction fee", signTestTx(t, key, 1, dynamicFeeTx(200000, 1000, 2, feeTestRecipient, nil)), ruleFeeCap, rejectReasonTxFeeExceeded},
+		{"denylisted recipient", signTestTx(t, key, 1, dynamicFeeTx(21000, 10, 2, denied, nil)), ruleDenylist, rejectReasonDenylistedAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, err := pipeline.Validate(tt.tx)
+			if tt.wantRule == "" {
+				if err != nil || from != sender {
+					t.Errorf("Validate() = %s, %v, want sender %s", from.Hex(), err, sender.Hex())
+				}
+				return
+			}
+
+			var validationErr *TxValidationError
+			if !errors.As(err, &validationErr) || validationErr.Rule != tt.wantRule || validationErr.Reason != tt.wantReason {
+				t.Errorf("Validate() error = %#v, want rule %s and reason %s", err, tt.wantRule, tt.wantReason)
+			}
+		})
+	}
+
+	// Senders are denylisted as well
+	config.Rules = []ValidationRuleConfig{{Name: ruleDenylist, Options: json.RawMessage(`{"addresses":["` + sender.Hex() + `"]}`)}}
+	pipeline, _ = newValidationPipeline(config, ChainConfig{ChainIDs: []uint64{1}})
+	var validationErr *TxValidationError
+	if _, err := pipeline.Validate(signTestTx(t, key, 1, dynamicFeeTx(21000, 10, 2, feeTestRecipient, nil))); !errors.As(err, &validationErr) || validationErr.Reason != rejectReasonDenylistedAddress {
+		t.Errorf("Validate() error = %v, want a denylisted sender", err)
+	}
+}
+
+func TestValidationPipelineReportsTheRule(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	tx := signTestTx(t, key, 1, &types.LegacyTx{Gas: 21000, GasPrice: big.NewInt(1), To: &feeTestRecipient})
+
+	tests := []struct {
+		name       string
+		err        error
+		wantReason string
+	}{
+		{"validation error", &TxValidationError{Reason: rejectReasonOversized, Message: "too large"}, rejectReasonOversized},
+		{"wrapped validation error", fmt.Errorf("custom check: %w", &TxValidationError{Reason: rejectReasonTipTooLow, Message: "tip"}), rejectReasonTipTooLow},
+		{"plain error", errors.New("boom"), rejectReasonInvalidTransaction},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, _ := newValidationPipeline(ValidationConfig{}, ChainConfig{ChainIDs: []uint64{1}})
+			pipeline.rules = []ValidationRule{&funcRule{name: "custom", validate: func(*types.Transaction) error { return tt.err }}}
+
+			_, err := pipeline.Validate(tx)
+			var validationErr *TxValidationError
+			if !errors.As(err, &validationErr) || validationErr.Rule != "custom" || validationErr.Reason != tt.wantReason || validationErr.Message != tt.err.Error() {
+				t.Errorf("Validate() error = %#v, want rule custom, reason %s and message %q", err, tt.wantReason, tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestNewValidationPipelineRejectsInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ValidationConfig
+	}{
+		{"unknown rule", ValidationConfig{Rules: []ValidationRuleConfig{{Name: "unknown"}}}},
+		{"invalid options", ValidationConfig{Rules: []ValidationRuleConfig{{Name: ruleSize, Options: json.RawMessage(`{"maxTxSize":"large"}`)}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newValidationPipeline(tt.config, ChainConfig{ChainIDs: []uint64{1}}); err == nil {
+				t.Errorf("newValidationPipeline() accepted an invalid config")
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Package main implements the sequencer
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	wsWriteTimeout   = 10 * time.Second       // Max time to write a single message
+	wsPongTimeout    = 60 * time.Second       // Max time between pongs from the client
+	wsPingInterval   = wsPongTimeout * 9 / 10 // Interval of pings to the client
+	wsMaxMessageSize = 1 << 20                // Max size of a message from the client
+)
+
+// Subscription topics supported by eth_subscribe
+const subscriptionBundleEvents = "bundleEvents"
+
+// Clients authenticate with a JWT in the Authorization header, so cross-origin requests are not a concern
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(_ *http.Request) bool { return true },
+}
+
+// wsSession is a single WebSocket connection serving JSON-RPC and bundle event subscriptions.
+type wsSession struct {
+	conn          *websocket.Conn                   // Underlying WebSocket connection
+	registry      *RPCRegistry                      // Methods available on the connection
+	hub           *BundleEventHub                   // Source of the bundle events
+	username      string                            // Authenticated user of the connection
+	subscriptions map[string]*bundleEventSubscriber // Active subscriptions by subscription ID
+	subMu         sync.Mutex                        // A mutex for the subscriptions
+	writeMu       sync.Mutex                        // A mutex for writes to the connection
+	done          chan struct{}                     // Closed when the connection terminates
+}
+
+// handleWebSocket upgrades the connection and serves JSON-RPC requests, including eth_subscribe, over it
+func handleWebSocket(registry *RPCRegistry, hub *BundleEventHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to upgrade WebSocket connection")
+			return
+		}
+
+		session := &wsSession{
+			conn:          conn,
+			registry:      registry,
+			hub:           hub,
+			username:      c.GetString("username"),
+			subscriptions: make(map[string]*bundleEventSubscriber),
+			done:          make(chan struct{}),
+		}
+
+		log.Info().Str("username", session.username).Msg("WebSocket connection opened")
+		session.serve()
+		log.Info().Str("username", session.username).Msg("WebSocket connection closed")
+	}
+}
+
+func (s *wsSession) serve() {
+	defer func() {
+		close(s.done)
+		s.unsubscribeAll()
+		_ = s.conn.Close()
+	}()
+
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	_ = s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	go s.keepAlive()
+
+	ctx := context.WithValue(context.Background(), usernameContextKey, s.username)
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Warn().Err(err).Msg("WebSocket connection closed unexpectedly")
+			}
+			return
+		}
+
+		if response := processRPCPayload(ctx, s, message); response != nil {
+			if err := s.writeJSON(response); err != nil {
+				log.Error().Err(err).Msg("Failed to write WebSocket response")
+				return
+			}
+		}
+	}
+}
+
+// lookup resolves the subscription methods of the session and falls back to the registry
+func (s *wsSession) lookup(method string) (RPCMethod, bool) {
+	switch method {
+	case "eth_subscribe":
+		return s.handleSubscribe, true
+	case "eth_unsubscribe":
+		return s.handleUnsubscribe, true
+	default:
+		return s.registry.lookup(method)
+	}
+}
+
+// Handle eth_subscribe requests
+func (s *wsSession) handleSubscribe(_ context.Context, rawParams json.RawMessage) (interface{}, error) {
+	var params []string
+	if err := decodeParams(rawParams, &params); err != nil {
+		return nil, err
+	}
+	if len(params) != 1 || params[0] != subscriptionBundleEvents {
+		return nil, newRPCError(rpcErrInvalidParams, "Unsupported subscription", fmt.Sprintf("supported: %s", subscriptionBundleEvents))
+	}
+
+	id := "0x" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	sub := s.hub.subscribe(s.username)
+
+	s.subMu.Lock()
+	s.subscriptions[id] = sub
+	s.subMu.Unlock()
+
+	go s.forwardEvents(id, sub)
+
+	return id, nil
+}
+
+// Handle eth_unsubscribe requests
+func (s *wsSession) handleUnsubscribe(_ context.Context, rawParams json.RawMessage) (interface{}, error) {
+	var params []string
+	if err := decodeParams(rawParams, &params); err != nil {
+		return nil, err
+	}
+	if len(params) != 1 {
+		return nil, newRPCError(rpcErrInvalidParams, "Expected exactly one subscription ID", nil)
+	}
+
+	s.subMu.Lock()
+	sub, exists := s.subscriptions[params[0]]
+	delete(s.subscriptions, params[0])
+	s.subMu.Unlock()
+
+	if !exists {
+		return false, nil
+	}
+
+	s.hub.unsubscribe(sub)
+	close(sub.events)
+	return true, nil
+}
+
+func (s *wsSession) unsubscribeAll() {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	for id, sub := range s.subscriptions {
+		s.hub.unsubscribe(sub)
+		close(sub.events)
+		delete(s.subscriptions, id)
+	}
+}
+
+// forwardEvents pushes the events of a subscription as eth_subscription notifications
+func (s *wsSession) forwardEvents(id string, sub *bundleEventSubscriber) {
+	for event := range sub.events {
+		notification := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "eth_subscription",
+			"params": map[string]interface{}{
+				"subscription": id,
+				"result":       event,
+			},
+		}
+		if err := s.writeJSON(notification); err != nil {
+			log.Error().Err(err).Str("subscription", id).Msg("Failed to write bundle event")
+			return
+		}
+	}
+}
+
+// keepAlive pings the client periodically until the connection terminates
+func (s *wsSession) keepAlive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.writeMu.Lock()
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			s.writeMu.Unlock()
+			if err != nil {
+				log.Debug().Err(err).Msg("Failed to ping WebSocket client")
+				return
+			}
+		}
+	}
+}
+
+func (s *wsSession) writeJSON(v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return s.conn.WriteJSON(v)
+}
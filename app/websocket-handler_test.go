@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestWebSocket connects to the WebSocket endpoint of the test server
+func dialTestWebSocket(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// callWebSocket sends a JSON-RPC request and returns the response
+func callWebSocket(t *testing.T, conn *websocket.Conn, request string) string {
+	t.Helper()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	_, response, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	return string(response)
+}
+
+func TestWebSocketBundleEvents(t *testing.T) {
+	hub := newBundleEventHub()
+	server := newBundleEventsTestServer(t, "alice", handleWebSocket(newTestRPCRegistry(), hub))
+	conn := dialTestWebSocket(t, server.URL)
+
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{"registry method", `{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["a"]}`, `{"jsonrpc":"2.0","id":1,"result":["a"]}`},
+		{"unsupported subscription", `{"jsonrpc":"2.0","id":2,"method":"eth_subscribe","params":["newHeads"]}`, `{"jsonrpc":"2.0","id":2,"error":{"code":-32602,"message":"Unsupported subscription","data":"supported: bundleEvents"}}`},
+		{"unknown subscription", `{"jsonrpc":"2.0","id":3,"method":"eth_unsubscribe","params":["0x1"]}`, `{"jsonrpc":"2.0","id":3,"result":false}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := callWebSocket(t, conn, tt.request); got != tt.want+"\n" {
+				t.Errorf("response = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	var subscribed struct {
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(callWebSocket(t, conn, `{"jsonrpc":"2.0","id":4,"method":"eth_subscribe","params":["bundleEvents"]}`)), &subscribed); err != nil || subscribed.Result == "" {
+		t.Fatalf("eth_subscribe failed: %v", err)
+	}
+
+	// Only the events of the bundles of the connected user are pushed
+	hub.publish("bob", BundleEvent{ReplacementUUID: "other", State: BundleStateQueued})
+	hub.publish("alice", BundleEvent{ReplacementUUID: "bundle", State: BundleStateQueued})
+	var notification struct {
+		Method string `json:"method"`
+		Params struct {
+			Subscription string      `json:"subscription"`
+			Result       BundleEvent `json:"result"`
+		} `json:"params"`
+	}
+	if err := conn.ReadJSON(&notification); err != nil {
+		t.Fatalf("ReadJSON() error = %v", err)
+	}
+	if notification.Method != "eth_subscription" || notification.Params.Subscription != subscribed.Result || notification.Params.Result.ReplacementUUID != "bundle" {
+		t.Errorf("notification = %+v, want the event of the bundle of alice", notification)
+	}
+
+	want := `{"jsonrpc":"2.0","id":5,"result":true}` + "\n"
+	if got := callWebSocket(t, conn, `{"jsonrpc":"2.0","id":5,"method":"eth_unsubscribe","params":["`+subscribed.Result+`"]}`); got != want {
+		t.Errorf("eth_unsubscribe = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+// Package main provides a stub of the beacon node API serving the genesis time and slot duration
+// the slot clock of the sequencer is read from.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", ":5052", "Address the beacon node API listens on")
+	genesisTime := flag.Int64("genesis-time", time.Now().Unix(), "Unix time in seconds of the genesis (defaults to the start of the stub)")
+	secondsPerSlot := flag.Uint64("seconds-per-slot", 12, "Duration of a slot in seconds")
+	flag.Parse()
+
+	http.HandleFunc("/eth/v1/beacon/genesis", func(w http.ResponseWriter, r *http.Request) {
+		writeData(w, map[string]string{
+			"genesis_time":            strconv.FormatInt(*genesisTime, 10),
+			"genesis_validators_root": "0x0000000000000000000000000000000000000000000000000000000000000000",
+			"genesis_fork_version":    "0x00000000",
+		})
+	})
+	http.HandleFunc("/eth/v1/config/spec", func(w http.ResponseWriter, r *http.Request) {
+		writeData(w, map[string]string{
+			"SECONDS_PER_SLOT": strconv.FormatUint(*secondsPerSlot, 10),
+		})
+	})
+
+	log.Printf("Beacon node API stub running on %s, genesis at %d, %d seconds per slot...", *addr, *genesisTime, *secondsPerSlot)
+	server := &http.Server{Addr: *addr, ReadHeaderTimeout: 5 * time.Second}
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+}
+
+// writeData writes the data in the response envelope of the beacon node API
+func writeData(w http.ResponseWriter, data map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"data": data}); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}